@@ -0,0 +1,403 @@
+package marco
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/google/uuid"
+)
+
+// The archival tier moves cold documents out of the collection into immutable
+// compressed segments, keeping the hot keyspace (and Badger's LSM tree) small
+// for latency-sensitive collections.
+//
+// A segment holds up to ArchivePolicy.SegmentSize documents, gzip-compressed,
+// under a collection-scoped system key:
+//
+//	systemKeyPrefix + "archive:" + collection + "\x00" + segment ID
+//
+// Archived documents are no longer returned by Get, GetID, Collection or
+// Query; Query includes them only with QueryOptions.IncludeArchived, which
+// decompresses every segment of the queried collection.
+
+func init() {
+	registerCollectionKeyKind("archive")
+}
+
+// ArchivePolicy configures the archival of a collection.
+type ArchivePolicy struct {
+	// TimeField is the document field holding the date the age of a
+	// document is measured from: a time.Time, an RFC3339 string or epoch
+	// milliseconds. Documents without a valid date are never archived.
+	TimeField string `json:"timeField"`
+
+	// OlderThan is the age after which documents are archived.
+	OlderThan time.Duration `json:"olderThan"`
+
+	// SegmentSize is the maximum number of documents per segment, each
+	// segment being written in one transaction. Zero means DefaultBatchSize.
+	SegmentSize int `json:"segmentSize,omitempty"`
+}
+
+// ArchiveResult describes one archival pass over a collection.
+type ArchiveResult struct {
+	Archived int // documents moved to the archive
+	Segments int // segments written
+}
+
+// archiveSegment is the decoded content of a segment.
+type archiveSegment struct {
+	Created time.Time      `json:"created"`
+	Entries []archiveEntry `json:"entries"`
+}
+
+// archiveEntry is an archived document with its ID.
+type archiveEntry struct {
+	ID  string                 `json:"id"`
+	Doc map[string]interface{} `json:"doc"`
+}
+
+// SetArchivePolicy stores the archive policy of a collection in its metadata.
+// RunArchiver applies it periodically; ArchiveCollection applies it once.
+func (db *DB) SetArchivePolicy(collection string, policy ArchivePolicy) error {
+	if policy.TimeField == "" {
+		return fmt.Errorf("archive policy of collection %s requires a TimeField", collection)
+	}
+	if policy.OlderThan <= 0 {
+		return fmt.Errorf("archive policy of collection %s requires a positive OlderThan", collection)
+	}
+	return db.setCollectionMetaField(collection, "archive", policy)
+}
+
+// RemoveArchivePolicy stops the archival of a collection. Documents already
+// archived stay in the archive.
+func (db *DB) RemoveArchivePolicy(collection string) error {
+	return db.setCollectionMetaField(collection, "archive", nil)
+}
+
+// ArchivePolicy returns the archive policy of a collection; the second result
+// is false if the collection has none.
+func (db *DB) ArchivePolicy(collection string) (ArchivePolicy, bool, error) {
+	var policy ArchivePolicy
+	var found bool
+	err := db.db.View(func(txn *badger.Txn) error {
+		var err error
+		found, err = collectionMetaField(txn, collection, "archive", &policy)
+		return err
+	})
+	return policy, found, err
+}
+
+// ArchiveCollection moves the documents of a collection that are older than
+// its archive policy allows into new archive segments. Each segment is written
+// in the transaction deleting its documents, so a document is never both live
+// and archived.
+func (db *DB) ArchiveCollection(collection string) (ArchiveResult, error) {
+	var result ArchiveResult
+
+	policy, found, err := db.ArchivePolicy(collection)
+	if err != nil {
+		return result, err
+	}
+	if !found {
+		return result, fmt.Errorf("collection %s has no archive policy", collection)
+	}
+	segmentSize := policy.SegmentSize
+	if segmentSize <= 0 {
+		segmentSize = DefaultBatchSize
+	}
+	cutoff := time.Now().Add(-policy.OlderThan)
+
+	// Find the cold documents first, then move them segment by segment
+	var coldKeys [][]byte
+	prefix := db.keys.collectionPrefix(collection)
+	err = db.db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			item := it.Item()
+			if !isCollectionKey(db.keys, collection, item.Key()) {
+				continue
+			}
+			var cold bool
+			if err := item.Value(func(val []byte) error {
+				val, err := db.documentValue(txn, item.Key(), val)
+				if err != nil {
+					return err
+				}
+				doc, err := db.decodeDocument(val)
+				if err != nil {
+					return err
+				}
+				cold = isColdDocument(doc, policy.TimeField, cutoff)
+				return nil
+			}); err != nil {
+				return err
+			}
+			if cold {
+				coldKeys = append(coldKeys, item.KeyCopy(nil))
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return result, err
+	}
+
+	for start := 0; start < len(coldKeys); start += segmentSize {
+		end := start + segmentSize
+		if end > len(coldKeys) {
+			end = len(coldKeys)
+		}
+		archived, err := db.writeArchiveSegment(collection, coldKeys[start:end], policy.TimeField, cutoff)
+		if err != nil {
+			return result, fmt.Errorf("failed to archive documents of collection %s: %w", collection, err)
+		}
+		result.Archived += archived
+		if archived > 0 {
+			result.Segments++
+		}
+	}
+	return result, nil
+}
+
+// writeArchiveSegment moves the documents at primaryKeys into a new segment.
+// Documents are read again in the transaction, so one modified since the scan
+// is archived as it is now, or skipped if it is no longer cold or was deleted.
+func (db *DB) writeArchiveSegment(collection string, primaryKeys [][]byte, timeField string, cutoff time.Time) (int, error) {
+	var archived int
+	var chunks pendingChunks
+	err := db.update(func(txn *badger.Txn) error {
+		chunks.begin()
+		segment := archiveSegment{Created: time.Now().UTC()}
+
+		for _, primaryKey := range primaryKeys {
+			doc, err := db.getDocument(txn, primaryKey)
+			if err == ErrNotFound {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			if !isColdDocument(doc, timeField, cutoff) {
+				continue
+			}
+
+			if err := chargeQuota(txn, collection, primaryKey, -1); err != nil {
+				return err
+			}
+			_, uBytes := db.keys.splitPrimaryKey(primaryKey)
+			if err := db.deleteDocumentKeys(txn, primaryKey, uBytes, &chunks); err != nil {
+				return err
+			}
+			segment.Entries = append(segment.Entries, archiveEntry{ID: uuidString(uBytes), Doc: doc})
+		}
+
+		archived = len(segment.Entries)
+		if archived == 0 {
+			return nil
+		}
+		val, err := encodeArchiveSegment(segment)
+		if err != nil {
+			return err
+		}
+		return txn.Set(archiveSegmentKey(collection, segment.Created), val)
+	})
+	chunks.settle(db, err == nil)
+	if archived > 0 {
+		db.documentCache().clear()
+	}
+	return archived, err
+}
+
+// deleteDocumentKeys deletes a primary key, its index entries and its
+// secondary key, if the secondary key still points at it.
+func (db *DB) deleteDocumentKeys(txn *badger.Txn, primaryKey, uBytes []byte, pending *pendingChunks) error {
+	secondaryKey := db.keys.secondaryKey(uBytes)
+	item, err := txn.Get(secondaryKey)
+	if err == nil {
+		var pointsHere bool
+		if err := item.Value(func(val []byte) error {
+			pointsHere = bytes.Equal(val, primaryKey)
+			return nil
+		}); err != nil {
+			return err
+		}
+		if pointsHere {
+			if err := txn.Delete(secondaryKey); err != nil {
+				return err
+			}
+		}
+	} else if err != badger.ErrKeyNotFound {
+		return err
+	}
+	if err := db.indexDocument(txn, primaryKey, nil); err != nil {
+		return err
+	}
+	if err := db.deleteDocumentChunks(txn, primaryKey, pending); err != nil {
+		return err
+	}
+	return txn.Delete(primaryKey)
+}
+
+// isColdDocument reports whether the date in timeField is before cutoff.
+func isColdDocument(doc map[string]interface{}, timeField string, cutoff time.Time) bool {
+	value := getNestedField(doc, timeField)
+	if value == nil {
+		return false
+	}
+	t, ok := toTime(value)
+	return ok && t.Before(cutoff)
+}
+
+// archiveSegmentKey returns the key of a segment created at 'created'. Keys
+// sort by creation time; the random suffix keeps segments created in the same
+// nanosecond from overwriting each other.
+func archiveSegmentKey(collection string, created time.Time) []byte {
+	key := collectionSystemPrefix("archive", collection)
+	id := uuid.New()
+	return append(key, fmt.Sprintf("%016x%x", created.UnixNano(), id[:])...)
+}
+
+func encodeArchiveSegment(segment archiveSegment) ([]byte, error) {
+	encoded, err := json.Marshal(segment)
+	if err != nil {
+		return nil, err
+	}
+	return gzipCompression{}.Compress(encoded)
+}
+
+func decodeArchiveSegment(val []byte) (archiveSegment, error) {
+	var segment archiveSegment
+	decoded, err := gzipCompression{}.Decompress(val)
+	if err != nil {
+		return segment, err
+	}
+	err = json.Unmarshal(decoded, &segment)
+	return segment, err
+}
+
+// ArchivedDocuments returns the archived documents of a collection, oldest
+// segment first. This reads and decompresses every segment.
+func (db *DB) ArchivedDocuments(collection string) ([]map[string]interface{}, error) {
+	var docs []map[string]interface{}
+	err := db.db.View(func(txn *badger.Txn) error {
+		var err error
+		docs, err = archivedDocuments(txn, collection)
+		return err
+	})
+	return docs, err
+}
+
+// snapshotArchivedDocuments returns the archived documents of a collection as
+// seen by the query running in ctx, in the transaction its collections were
+// read in: a document being archived is either live or archived, never both.
+func (db *DB) snapshotArchivedDocuments(ctx context.Context, collection string) ([]map[string]interface{}, error) {
+	snapshot, ok := ctx.Value(querySnapshotKey{}).(*querySnapshot)
+	if !ok {
+		return db.ArchivedDocuments(collection)
+	}
+	var docs []map[string]interface{}
+	err := snapshot.view(db, func(txn *badger.Txn) error {
+		var err error
+		docs, err = archivedDocuments(txn, collection)
+		return err
+	})
+	return docs, err
+}
+
+// archivedDocuments reads the archived documents of a collection in txn.
+func archivedDocuments(txn *badger.Txn, collection string) ([]map[string]interface{}, error) {
+	var docs []map[string]interface{}
+	prefix := collectionSystemPrefix("archive", collection)
+
+	it := txn.NewIterator(badger.DefaultIteratorOptions)
+	defer it.Close()
+
+	for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+		if err := it.Item().Value(func(val []byte) error {
+			segment, err := decodeArchiveSegment(val)
+			if err != nil {
+				return fmt.Errorf("corrupt archive segment %q: %w", it.Item().Key(), err)
+			}
+			for _, entry := range segment.Entries {
+				docs = append(docs, entry.Doc)
+			}
+			return nil
+		}); err != nil {
+			return nil, err
+		}
+	}
+	return docs, nil
+}
+
+// archivedCollections returns the collections that have an archive policy.
+func (db *DB) archivedCollections() ([]string, error) {
+	var collections []string
+	prefix := []byte(systemKeyPrefix + "meta:")
+
+	err := db.db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			rest := string(it.Item().Key()[len(prefix):])
+			collection := strings.TrimSuffix(rest, "\x00")
+			if collection == rest {
+				continue
+			}
+			var policy ArchivePolicy
+			found, err := collectionMetaField(txn, collection, "archive", &policy)
+			if err != nil {
+				return err
+			}
+			if found {
+				collections = append(collections, collection)
+			}
+		}
+		return nil
+	})
+	return collections, err
+}
+
+// RunArchiver archives the collections that have an archive policy every
+// interval, until ctx is done. It is meant to run in its own goroutine:
+//
+//	go db.RunArchiver(ctx, time.Hour, nil)
+//
+// Errors of a pass are reported to onError, if set, and do not stop the
+// archiver. RunArchiver returns ctx.Err().
+func (db *DB) RunArchiver(ctx context.Context, interval time.Duration, onError func(collection string, err error)) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+
+		collections, err := db.archivedCollections()
+		if err != nil {
+			if onError != nil {
+				onError("", err)
+			}
+			continue
+		}
+		for _, collection := range collections {
+			if ctx.Err() != nil {
+				break
+			}
+			if _, err := db.ArchiveCollection(collection); err != nil && onError != nil {
+				onError(collection, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,227 @@
+package marco
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+
+	"github.com/dgraph-io/badger/v3"
+)
+
+// DefaultBatchSize is the number of documents processed per transaction by
+// bulk operations such as DropCollection when no batch size is configured.
+// It keeps each transaction well below Badger's ErrTxnTooBig limit.
+const DefaultBatchSize = 1000
+
+// DropOptions configures DropCollectionWithOptions.
+type DropOptions struct {
+	// BatchSize is the maximum number of documents deleted per transaction.
+	// Zero means DefaultBatchSize.
+	BatchSize int
+
+	// Progress, if set, is called after every committed batch with the total
+	// number of keys deleted so far.
+	Progress func(deleted int)
+}
+
+// batchVisitor is called for every key found under the scanned prefix inside
+// the current batch transaction. It performs the actual work (deleting the key
+// and anything attached to it) and reports whether the key counted towards the
+// batch. Returning badger.ErrTxnTooBig ends the batch early; the key is visited
+// again in the next transaction.
+type batchVisitor func(txn *badger.Txn, key []byte) (bool, error)
+
+// processPrefixInBatches walks every key under 'prefix' and hands it to
+// 'visit', committing a transaction every 'batchSize' counted keys so that
+// arbitrarily large key ranges never exceed Badger's transaction limits.
+//
+// This is the building block for DropCollection and for bulk operations
+// (delete-many, update-many) that must touch an unbounded number of documents.
+// It returns the total number of counted keys.
+func (db *DB) processPrefixInBatches(
+	prefix []byte,
+	batchSize int,
+	visit batchVisitor,
+	progress func(processed int),
+) (int, error) {
+	if batchSize <= 0 {
+		batchSize = DefaultBatchSize
+	}
+
+	total := 0
+	seekKey := prefix
+	for {
+		var lastKey []byte
+		var counted int
+		var exhausted bool
+
+		err := db.update(func(txn *badger.Txn) error {
+			// Reset the batch state, the transaction may be retried on conflict
+			lastKey, counted, exhausted = nil, 0, true
+
+			opts := badger.DefaultIteratorOptions
+			opts.PrefetchValues = false
+
+			it := txn.NewIterator(opts)
+			defer it.Close()
+
+			for it.Seek(seekKey); it.ValidForPrefix(prefix); it.Next() {
+				key := it.Item().KeyCopy(nil)
+				if lastKey == nil && bytes.Equal(key, seekKey) && !bytes.Equal(seekKey, prefix) {
+					// The resume key was already handled by the previous batch
+					continue
+				}
+				if counted >= batchSize {
+					exhausted = false
+					return nil
+				}
+
+				ok, err := visit(txn, key)
+				if err == badger.ErrTxnTooBig {
+					exhausted = false
+					return nil
+				}
+				if err != nil {
+					return err
+				}
+				if ok {
+					counted++
+				}
+				lastKey = key
+			}
+			return nil
+		})
+		if err != nil {
+			return total, err
+		}
+
+		total += counted
+		if progress != nil && counted > 0 {
+			progress(total)
+		}
+		if exhausted {
+			return total, nil
+		}
+		if lastKey == nil {
+			return total, fmt.Errorf("batch made no progress under prefix %x", prefix)
+		}
+		seekKey = lastKey
+	}
+}
+
+// DropCollectionWithOptions removes every document of 'collection', the secondary
+// keys pointing at them, and all auxiliary system keys of the collection, in
+// bounded transactions so that collections of any size can be dropped.
+//
+// A drop marker is written before the first batch and removed after the last one.
+// If the process stops half-way, PendingDrops reports the collection and
+// ResumeDrops (or simply calling DropCollection again) finishes the job.
+func (db *DB) DropCollectionWithOptions(collection string, opts DropOptions) error {
+	defer db.documentCache().clear()
+
+	marker := systemKey("drop", collection)
+	if err := db.update(func(txn *badger.Txn) error {
+		return txn.Set(marker, nil)
+	}); err != nil {
+		return fmt.Errorf("failed to record drop of collection %s: %w", collection, err)
+	}
+
+	deleted := 0
+	progress := func(n int) {
+		if opts.Progress != nil {
+			opts.Progress(deleted + n)
+		}
+	}
+
+	// Documents and their secondary keys
+	collectionPrefix := db.keys.collectionPrefix(collection)
+	n, err := db.processPrefixInBatches(collectionPrefix, opts.BatchSize, func(txn *badger.Txn, primaryKey []byte) (bool, error) {
+		// Skip keys of another collection whose name starts with "collection:"
+		keyCollection, uBytes := db.keys.splitPrimaryKey(primaryKey)
+		if uBytes == nil || keyCollection != collection {
+			return false, nil
+		}
+		secondaryKey := db.keys.secondaryKey(uBytes)
+
+		// Only remove the secondary key if it still points at this document;
+		// the same UUID may have been reused in another collection.
+		item, err := txn.Get(secondaryKey)
+		if err == nil {
+			var pointsHere bool
+			if err := item.Value(func(val []byte) error {
+				pointsHere = bytes.Equal(val, primaryKey)
+				return nil
+			}); err != nil {
+				return false, err
+			}
+			if pointsHere {
+				if err := txn.Delete(secondaryKey); err != nil {
+					return false, err
+				}
+			}
+		} else if err != badger.ErrKeyNotFound {
+			return false, fmt.Errorf("failed to read secondary key %x: %w", secondaryKey, err)
+		}
+
+		if err := txn.Delete(primaryKey); err != nil {
+			return false, err
+		}
+		return true, nil
+	}, progress)
+	deleted += n
+	if err != nil {
+		return fmt.Errorf("failed to drop documents of collection %s: %w", collection, err)
+	}
+
+	// Auxiliary keys maintained by other subsystems
+	for _, prefix := range collectionAuxPrefixes(collection) {
+		n, err := db.processPrefixInBatches(prefix, opts.BatchSize, func(txn *badger.Txn, key []byte) (bool, error) {
+			return true, txn.Delete(key)
+		}, progress)
+		deleted += n
+		if err != nil {
+			return fmt.Errorf("failed to drop auxiliary keys of collection %s: %w", collection, err)
+		}
+	}
+
+	return db.update(func(txn *badger.Txn) error {
+		return txn.Delete(marker)
+	})
+}
+
+// PendingDrops returns the collections whose drop was started but never finished.
+func (db *DB) PendingDrops() ([]string, error) {
+	prefix := systemKey("drop")
+	var collections []string
+
+	err := db.db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+
+		it := txn.NewIterator(opts)
+		defer it.Close()
+
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			collections = append(collections, strings.TrimPrefix(string(it.Item().Key()), string(prefix)))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return collections, nil
+}
+
+// ResumeDrops finishes every interrupted DropCollection.
+func (db *DB) ResumeDrops(opts DropOptions) error {
+	collections, err := db.PendingDrops()
+	if err != nil {
+		return err
+	}
+	for _, collection := range collections {
+		if err := db.DropCollectionWithOptions(collection, opts); err != nil {
+			return err
+		}
+	}
+	return nil
+}
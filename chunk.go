@@ -0,0 +1,266 @@
+package marco
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/google/uuid"
+)
+
+// Badger handles multi-megabyte values poorly and rejects values past its
+// size limits, so documents whose encoded value is larger than the chunk size
+// are stored in parts:
+//
+//   - Primary key = collection + ":" + 16-byte binary UUID           -> chunk manifest
+//   - Chunk key   = "chunk" system prefix of the collection + UUID + generation + part -> part of the value
+//
+// The manifest is chunkMarker + uvarint(size of the value) + uvarint(parts) +
+// generation, which is neither plain JSON ('{') nor a codec header
+// (codecHeaderMarker).
+//
+// A document too large for one transaction must not fail with
+// badger.ErrTxnTooBig, so its parts are written and deleted outside of the
+// transaction storing or deleting its manifest (see pendingChunks): new parts
+// by a WriteBatch before it, old parts once it commits. Every value is given a
+// new random generation, so that its parts never overwrite those of the
+// manifest still stored. Readers check that every part of a manifest exists.
+// The parts are collection-scoped system keys rather than keys under the
+// collection prefix, so that collection scans only see documents and
+// DropCollection deletes them with the other auxiliary keys. Chunking happens
+// below the codec: the reassembled value is decoded as any other.
+
+// DefaultChunkSize is the size of the parts of large documents unless changed
+// with SetChunkSize.
+const DefaultChunkSize = 1 << 20
+
+// chunkMarker starts the manifest stored at the primary key of a chunked
+// document.
+const chunkMarker = 0x01
+
+func init() {
+	registerCollectionKeyKind("chunk")
+}
+
+// SetChunkSize sets the size in bytes above which documents written from now
+// on are split into parts of that size, stored under keys of their own and
+// reassembled when read. Zero restores DefaultChunkSize and a negative size
+// disables chunking. Documents already stored are read whatever the setting.
+func (db *DB) SetChunkSize(size int) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.chunkSize = size
+}
+
+// chunkThreshold returns the chunk size, or a negative number if documents are
+// not chunked.
+func (db *DB) chunkThreshold() int {
+	db.mu.RLock()
+	size := db.chunkSize
+	db.mu.RUnlock()
+	if size == 0 {
+		return DefaultChunkSize
+	}
+	return size
+}
+
+// chunkGenerationSize is the size of the generation of a chunked value.
+const chunkGenerationSize = 16
+
+// chunkKey returns the key of part 'part' of generation 'generation' of
+// document 'id' of 'collection'.
+func chunkKey(collection string, id, generation []byte, part int) []byte {
+	prefix := collectionSystemPrefix("chunk", collection)
+	key := make([]byte, 0, len(prefix)+len(id)+len(generation)+4)
+	key = append(append(append(key, prefix...), id...), generation...)
+	var n [4]byte
+	binary.BigEndian.PutUint32(n[:], uint32(part))
+	return append(key, n[:]...)
+}
+
+// chunkManifest parses the manifest of a chunked document. ok is false if val
+// is a document value. generation aliases val.
+func chunkManifest(val []byte) (size, parts int, generation []byte, ok bool) {
+	if len(val) == 0 || val[0] != chunkMarker {
+		return 0, 0, nil, false
+	}
+	s, n := binary.Uvarint(val[1:])
+	if n <= 0 {
+		return 0, 0, nil, false
+	}
+	p, m := binary.Uvarint(val[1+n:])
+	if m <= 0 || len(val) != 1+n+m+chunkGenerationSize {
+		return 0, 0, nil, false
+	}
+	return int(s), int(p), val[1+n+m:], true
+}
+
+// storedSize returns the size of the document value stored as val, the
+// reassembled size for a chunked document.
+func storedSize(val []byte) int {
+	if size, _, _, ok := chunkManifest(val); ok {
+		return size
+	}
+	return len(val)
+}
+
+// documentValue returns the value of the document stored at primaryKey as
+// val, reassembling it from its parts if it is chunked.
+func (db *DB) documentValue(txn *badger.Txn, primaryKey, val []byte) ([]byte, error) {
+	size, parts, generation, ok := chunkManifest(val)
+	if !ok {
+		return val, nil
+	}
+	collection, id := db.keys.splitPrimaryKey(primaryKey)
+	if id == nil {
+		return nil, fmt.Errorf("chunked value at invalid primary key %x", primaryKey)
+	}
+
+	value := make([]byte, 0, size)
+	for part := 0; part < parts; part++ {
+		item, err := txn.Get(chunkKey(collection, id, generation, part))
+		if err == badger.ErrKeyNotFound {
+			return nil, fmt.Errorf("part %d of %d of document %s is missing", part, parts, uuidString(id))
+		}
+		if err != nil {
+			return nil, err
+		}
+		if err := item.Value(func(data []byte) error {
+			value = append(value, data...)
+			return nil
+		}); err != nil {
+			return nil, err
+		}
+	}
+	if len(value) != size {
+		return nil, fmt.Errorf("document %s has %d bytes in its parts, %d expected", uuidString(id), len(value), size)
+	}
+	return value, nil
+}
+
+// chunkParts identifies the parts of a chunked value.
+type chunkParts struct {
+	collection string
+	id         []byte
+	generation []byte
+	parts      int
+}
+
+// pendingChunks collects the parts written and released by a write
+// transaction, to delete those no manifest refers to once it is done. The
+// transaction may run several times (see DB.update) and must call begin at
+// the start of every run; only the last run can commit.
+type pendingChunks struct {
+	orphans  []chunkParts // written by earlier runs
+	written  []chunkParts // written by the current run
+	released []chunkParts // of the manifests replaced or deleted by the current run
+}
+
+// begin starts a run of the transaction.
+func (p *pendingChunks) begin() {
+	p.orphans = append(p.orphans, p.written...)
+	p.written, p.released = nil, nil
+}
+
+// settle deletes the parts no manifest refers to once the transaction is
+// done: those it released if it committed, those it wrote otherwise. The
+// document operation is already decided, so errors are only logged; the
+// parts left behind take space until the collection is dropped.
+func (p *pendingChunks) settle(db *DB, committed bool) {
+	unreferenced := p.orphans
+	if committed {
+		unreferenced = append(unreferenced, p.released...)
+	} else {
+		unreferenced = append(unreferenced, p.written...)
+	}
+	if len(unreferenced) == 0 {
+		return
+	}
+	wb := db.db.NewWriteBatch()
+	defer wb.Cancel()
+	for _, c := range unreferenced {
+		for part := 0; part < c.parts; part++ {
+			if err := wb.Delete(chunkKey(c.collection, c.id, c.generation, part)); err != nil {
+				db.logf(LogError, "failed to delete the parts of document %s: %v", uuidString(c.id), err)
+				return
+			}
+		}
+	}
+	if err := wb.Flush(); err != nil {
+		db.logf(LogError, "failed to delete the parts of unreferenced document values: %v", err)
+	}
+}
+
+// setDocumentValue stores val at primaryKey in txn and releases the parts of
+// the value it replaces. A value larger than the chunk size is split into
+// parts, written right away by a WriteBatch; only its manifest is set in txn.
+func (db *DB) setDocumentValue(txn *badger.Txn, primaryKey, val []byte, pending *pendingChunks) error {
+	if err := db.deleteDocumentChunks(txn, primaryKey, pending); err != nil {
+		return err
+	}
+	threshold := db.chunkThreshold()
+	if threshold < 0 || len(val) <= threshold {
+		return txn.Set(primaryKey, val)
+	}
+
+	collection, id := db.keys.splitPrimaryKey(primaryKey)
+	generation := uuid.New()
+	chunks := chunkParts{
+		collection: collection,
+		id:         id,
+		generation: generation[:],
+		parts:      (len(val) + threshold - 1) / threshold,
+	}
+	// Recorded before writing, so that the parts of a failed batch are deleted
+	pending.written = append(pending.written, chunks)
+
+	wb := db.db.NewWriteBatch()
+	defer wb.Cancel()
+	for part := 0; part < chunks.parts; part++ {
+		start := part * threshold
+		end := start + threshold
+		if end > len(val) {
+			end = len(val)
+		}
+		// The batch keeps the slices it is given until it is flushed
+		if err := wb.Set(chunkKey(collection, id, chunks.generation, part), val[start:end]); err != nil {
+			return err
+		}
+	}
+	if err := wb.Flush(); err != nil {
+		return err
+	}
+
+	manifest := make([]byte, 1+2*binary.MaxVarintLen64, 1+2*binary.MaxVarintLen64+chunkGenerationSize)
+	manifest[0] = chunkMarker
+	n := 1 + binary.PutUvarint(manifest[1:], uint64(len(val)))
+	n += binary.PutUvarint(manifest[n:], uint64(chunks.parts))
+	return txn.Set(primaryKey, append(manifest[:n], chunks.generation...))
+}
+
+// deleteDocumentChunks releases the parts of the document stored at
+// primaryKey in txn, if it is chunked: they are deleted outside of txn once
+// it commits, so that a document of any size is deleted in one transaction.
+func (db *DB) deleteDocumentChunks(txn *badger.Txn, primaryKey []byte, pending *pendingChunks) error {
+	item, err := txn.Get(primaryKey)
+	if err == badger.ErrKeyNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return item.Value(func(val []byte) error {
+		_, parts, generation, chunked := chunkManifest(val)
+		if chunked {
+			collection, id := db.keys.splitPrimaryKey(primaryKey)
+			pending.released = append(pending.released, chunkParts{
+				collection: collection,
+				id:         id,
+				// The value is only valid in this function
+				generation: append([]byte(nil), generation...),
+				parts:      parts,
+			})
+		}
+		return nil
+	})
+}
@@ -0,0 +1,323 @@
+package marco
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/dgraph-io/badger/v3"
+)
+
+// Documents are stored as plain JSON unless their collection is configured
+// with another codec. A codec is an encoding (how a document becomes bytes)
+// followed by an optional compression, e.g. MessagePack+zstd for a large
+// events collection while configuration stays readable JSON.
+//
+// Values written with a codec other than plain JSON start with a header
+// naming the codec:
+//
+//	0x00 + len(name) + name + payload, where name is "encoding+compression"
+//
+// so every value can be decoded on its own: changing the codec of a
+// collection applies to new writes and existing documents remain readable.
+// Plain JSON values always start with '{' and carry no header.
+
+// Encoding converts documents to bytes and back.
+type Encoding interface {
+	Marshal(doc map[string]interface{}) ([]byte, error)
+	Unmarshal(data []byte) (map[string]interface{}, error)
+}
+
+// Compression compresses encoded documents.
+type Compression interface {
+	Compress(data []byte) ([]byte, error)
+	Decompress(data []byte) ([]byte, error)
+}
+
+// CollectionCodec selects how the documents of a collection are stored.
+type CollectionCodec struct {
+	Encoding    string `json:"encoding,omitempty"`    // registered encoding, "json" by default
+	Compression string `json:"compression,omitempty"` // registered compression, "none" by default
+}
+
+// normalized fills in the defaults.
+func (c CollectionCodec) normalized() CollectionCodec {
+	if c.Encoding == "" {
+		c.Encoding = "json"
+	}
+	if c.Compression == "" {
+		c.Compression = "none"
+	}
+	return c
+}
+
+// name identifies the codec in value headers.
+func (c CollectionCodec) name() string {
+	c = c.normalized()
+	return c.Encoding + "+" + c.Compression
+}
+
+// plain reports whether the codec stores headerless JSON.
+func (c CollectionCodec) plain() bool {
+	c = c.normalized()
+	return c.Encoding == "json" && c.Compression == "none"
+}
+
+// codecHeaderMarker starts the values written with a codec other than plain JSON.
+const codecHeaderMarker = 0x00
+
+// jsonEncoding is the default encoding.
+type jsonEncoding struct{}
+
+func (jsonEncoding) Marshal(doc map[string]interface{}) ([]byte, error) {
+	return json.Marshal(doc)
+}
+
+func (jsonEncoding) Unmarshal(data []byte) (map[string]interface{}, error) {
+	var doc map[string]interface{}
+	err := json.Unmarshal(data, &doc)
+	return doc, err
+}
+
+// gzipCompression is the built-in "gzip" compression.
+type gzipCompression struct{}
+
+func (c gzipCompression) Compress(data []byte) ([]byte, error) {
+	buf := getBuffer()
+	defer putBuffer(buf)
+	if err := c.compressTo(buf, data); err != nil {
+		return nil, err
+	}
+	return bufferBytes(buf), nil
+}
+
+func (c gzipCompression) Decompress(data []byte) ([]byte, error) {
+	buf := getBuffer()
+	defer putBuffer(buf)
+	if err := c.decompressTo(buf, data); err != nil {
+		return nil, err
+	}
+	return bufferBytes(buf), nil
+}
+
+// compressTo appends the compressed data to buf. encodeDocument uses it to
+// write the codec header and the payload to the same buffer.
+func (gzipCompression) compressTo(buf *bytes.Buffer, data []byte) error {
+	w := gzipWriterPool.Get().(*gzip.Writer)
+	defer gzipWriterPool.Put(w)
+	w.Reset(buf)
+	if _, err := w.Write(data); err != nil {
+		return err
+	}
+	return w.Close()
+}
+
+// decompressTo appends the decompressed data to buf. decodeDocument uses it
+// to decode JSON from a pooled buffer rather than from a copy.
+func (gzipCompression) decompressTo(buf *bytes.Buffer, data []byte) error {
+	r, err := getGzipReader(bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	defer gzipReaderPool.Put(r)
+	defer r.Close()
+	_, err = buf.ReadFrom(r)
+	return err
+}
+
+// RegisterEncoding makes an encoding available to SetCollectionCodec under
+// name. Encodings must be registered before documents using them are read,
+// typically right after Open. "json" is built in.
+func (db *DB) RegisterEncoding(name string, encoding Encoding) error {
+	if err := validateCodecPartName(name); err != nil {
+		return err
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.encodings == nil {
+		db.encodings = make(map[string]Encoding)
+	}
+	db.encodings[name] = encoding
+	return nil
+}
+
+// RegisterCompression makes a compression available to SetCollectionCodec
+// under name. "none" and "gzip" are built in.
+func (db *DB) RegisterCompression(name string, compression Compression) error {
+	if err := validateCodecPartName(name); err != nil {
+		return err
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.compressions == nil {
+		db.compressions = make(map[string]Compression)
+	}
+	db.compressions[name] = compression
+	return nil
+}
+
+func validateCodecPartName(name string) error {
+	if name == "" || strings.Contains(name, "+") || len(name) > 100 {
+		return fmt.Errorf("invalid codec name %q", name)
+	}
+	return nil
+}
+
+// codecParts returns the encoding and compression of codec; a nil
+// compression stands for "none".
+func (db *DB) codecParts(codec CollectionCodec) (Encoding, Compression, error) {
+	codec = codec.normalized()
+
+	db.mu.RLock()
+	encoding, encodingOK := db.encodings[codec.Encoding]
+	compression, compressionOK := db.compressions[codec.Compression]
+	db.mu.RUnlock()
+
+	if !encodingOK {
+		if codec.Encoding != "json" {
+			return nil, nil, fmt.Errorf("unknown encoding %q", codec.Encoding)
+		}
+		encoding = jsonEncoding{}
+	}
+	if !compressionOK {
+		switch codec.Compression {
+		case "none":
+			compression = nil
+		case "gzip":
+			compression = gzipCompression{}
+		default:
+			return nil, nil, fmt.Errorf("unknown compression %q", codec.Compression)
+		}
+	}
+	return encoding, compression, nil
+}
+
+// SetCollectionCodec sets the codec used to write the documents of a
+// collection; it is stored in the collection metadata. Existing documents are
+// not rewritten and remain readable.
+//
+//	db.RegisterEncoding("msgpack", myMsgpackEncoding)
+//	db.RegisterCompression("zstd", myZstdCompression)
+//	db.SetCollectionCodec("events", marco.CollectionCodec{Encoding: "msgpack", Compression: "zstd"})
+func (db *DB) SetCollectionCodec(collection string, codec CollectionCodec) error {
+	if _, _, err := db.codecParts(codec); err != nil {
+		return err
+	}
+	if codec.plain() {
+		return db.setCollectionMetaField(collection, "codec", nil)
+	}
+	return db.setCollectionMetaField(collection, "codec", codec.normalized())
+}
+
+// CollectionCodec returns the codec used to write the documents of a collection.
+func (db *DB) CollectionCodec(collection string) (CollectionCodec, error) {
+	var codec CollectionCodec
+	err := db.db.View(func(txn *badger.Txn) error {
+		var err error
+		codec, err = collectionCodec(txn, collection)
+		return err
+	})
+	return codec.normalized(), err
+}
+
+// collectionCodec reads the codec of a collection from its metadata.
+func collectionCodec(txn *badger.Txn, collection string) (CollectionCodec, error) {
+	var codec CollectionCodec
+	_, err := collectionMetaField(txn, collection, "codec", &codec)
+	return codec, err
+}
+
+// encodeDocument encodes a document with the codec of its collection.
+func (db *DB) encodeDocument(txn *badger.Txn, collection string, doc map[string]interface{}) ([]byte, error) {
+	codec, err := collectionCodec(txn, collection)
+	if err != nil {
+		return nil, err
+	}
+	if codec.plain() {
+		return json.Marshal(doc)
+	}
+
+	encoding, compression, err := db.codecParts(codec)
+	if err != nil {
+		return nil, fmt.Errorf("collection %s: %w", collection, err)
+	}
+	payload, err := encoding.Marshal(doc)
+	if err != nil {
+		return nil, err
+	}
+	name := codec.name()
+	if gz, ok := compression.(gzipCompression); ok {
+		// The header and the compressed payload are copied once, together
+		buf := getBuffer()
+		defer putBuffer(buf)
+		buf.WriteByte(codecHeaderMarker)
+		buf.WriteByte(byte(len(name)))
+		buf.WriteString(name)
+		if err := gz.compressTo(buf, payload); err != nil {
+			return nil, err
+		}
+		return bufferBytes(buf), nil
+	}
+	if compression != nil {
+		if payload, err = compression.Compress(payload); err != nil {
+			return nil, err
+		}
+	}
+
+	val := make([]byte, 0, 2+len(name)+len(payload))
+	val = append(val, codecHeaderMarker, byte(len(name)))
+	val = append(val, name...)
+	return append(val, payload...), nil
+}
+
+// decodeDocument decodes a stored document, whatever codec it was written with.
+func (db *DB) decodeDocument(val []byte) (map[string]interface{}, error) {
+	if len(val) == 0 || val[0] != codecHeaderMarker {
+		return jsonEncoding{}.Unmarshal(val)
+	}
+
+	codec, payload, err := splitCodecHeader(val)
+	if err != nil {
+		return nil, err
+	}
+	encoding, compression, err := db.codecParts(codec)
+	if err != nil {
+		return nil, err
+	}
+	if gz, ok := compression.(gzipCompression); ok {
+		if _, ok := encoding.(jsonEncoding); ok {
+			// JSON decoding copies what it keeps, so the payload is
+			// decompressed into a pooled buffer
+			buf := getBuffer()
+			defer putBuffer(buf)
+			if err := gz.decompressTo(buf, payload); err != nil {
+				return nil, err
+			}
+			return encoding.Unmarshal(buf.Bytes())
+		}
+	}
+	if compression != nil {
+		if payload, err = compression.Decompress(payload); err != nil {
+			return nil, err
+		}
+	}
+	return encoding.Unmarshal(payload)
+}
+
+// splitCodecHeader returns the codec named by the header of a value written
+// with a codec other than plain JSON, and the payload following it.
+func splitCodecHeader(val []byte) (CollectionCodec, []byte, error) {
+	if len(val) < 2 || len(val) < 2+int(val[1]) {
+		return CollectionCodec{}, nil, fmt.Errorf("truncated codec header")
+	}
+	name := string(val[2 : 2+int(val[1])])
+	payload := val[2+int(val[1]):]
+
+	parts := strings.SplitN(name, "+", 2)
+	if len(parts) != 2 {
+		return CollectionCodec{}, nil, fmt.Errorf("invalid codec %q", name)
+	}
+	return CollectionCodec{Encoding: parts[0], Compression: parts[1]}, payload, nil
+}
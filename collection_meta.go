@@ -0,0 +1,79 @@
+package marco
+
+import (
+	"encoding/json"
+
+	"github.com/dgraph-io/badger/v3"
+)
+
+// The metadata document of a collection, stored under collectionMetaKey, holds
+// the per-collection settings of the subsystems (codec, archive policy, ...),
+// each under its own field. It is removed with the collection.
+
+// readCollectionMeta returns the metadata document of a collection, empty if
+// there is none.
+func readCollectionMeta(txn *badger.Txn, collection string) (map[string]interface{}, error) {
+	meta := make(map[string]interface{})
+	item, err := txn.Get(collectionMetaKey(collection))
+	if err == badger.ErrKeyNotFound {
+		return meta, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = item.Value(func(val []byte) error {
+		return json.Unmarshal(val, &meta)
+	})
+	return meta, err
+}
+
+// writeCollectionMeta stores the metadata document of a collection, deleting
+// the key when it is empty.
+func writeCollectionMeta(txn *badger.Txn, collection string, meta map[string]interface{}) error {
+	if len(meta) == 0 {
+		return txn.Delete(collectionMetaKey(collection))
+	}
+	val, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	return txn.Set(collectionMetaKey(collection), val)
+}
+
+// collectionMetaField decodes one field of the metadata of a collection into
+// out. It reports whether the field is set.
+func collectionMetaField(txn *badger.Txn, collection, field string, out interface{}) (bool, error) {
+	meta, err := readCollectionMeta(txn, collection)
+	if err != nil {
+		return false, err
+	}
+	raw, ok := meta[field]
+	if !ok {
+		return false, nil
+	}
+	encoded, err := json.Marshal(raw)
+	if err != nil {
+		return false, err
+	}
+	return true, json.Unmarshal(encoded, out)
+}
+
+// setCollectionMetaField sets one field of the metadata of a collection, or
+// removes it when value is nil.
+func (db *DB) setCollectionMetaField(collection, field string, value interface{}) error {
+	if err := validateCollectionName(collection); err != nil {
+		return err
+	}
+	return db.update(func(txn *badger.Txn) error {
+		meta, err := readCollectionMeta(txn, collection)
+		if err != nil {
+			return err
+		}
+		if value == nil {
+			delete(meta, field)
+		} else {
+			meta[field] = value
+		}
+		return writeCollectionMeta(txn, collection, meta)
+	})
+}
@@ -0,0 +1,156 @@
+package marco
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+)
+
+// CompareOptions configures ComparePipelines.
+type CompareOptions struct {
+	// Key is the dotted path of the field matching the results of the two
+	// pipelines; results without it are matched by position. If empty,
+	// results are matched by their whole content, and none are changed.
+	Key string
+
+	// Isolation selects how the collections are read, as in QueryOptions.
+	Isolation QueryIsolation
+}
+
+// DocumentChange is a result of both pipelines that differs between them.
+type DocumentChange struct {
+	Key    interface{}
+	Before map[string]interface{} // result of the first pipeline
+	After  map[string]interface{} // result of the second pipeline
+}
+
+// PipelineDiff lists how the results of a pipeline differ from those of
+// another one run over the same data.
+type PipelineDiff struct {
+	Added     []map[string]interface{} // only returned by the second pipeline
+	Removed   []map[string]interface{} // only returned by the first pipeline
+	Changed   []DocumentChange
+	Unchanged int
+}
+
+// Equal reports whether both pipelines returned the same results.
+func (d *PipelineDiff) Equal() bool {
+	return len(d.Added) == 0 && len(d.Removed) == 0 && len(d.Changed) == 0
+}
+
+// ComparePipelines runs two pipelines on a collection, over the same snapshot
+// of the data, and reports the results added, removed or changed by the
+// second one. It helps checking that a rewritten pipeline still returns what
+// the original did:
+//
+//	diff, err := db.ComparePipelines(ctx, "orders", oldPipeline, newPipeline, marco.CompareOptions{Key: "orderId"})
+//
+// Results are matched by their key, so the order they are returned in is not
+// compared; documents are compared field by field, numbers by value.
+func (db *DB) ComparePipelines(ctx context.Context, collectionName string, before, after string, opts CompareOptions) (*PipelineDiff, error) {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	ctx = withQueryNow(ctx) // both pipelines see the same $$NOW
+
+	beforeStages, err := db.parseAggregationStagesJSON(ctx, before)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing first pipeline: %w", err)
+	}
+	afterStages, err := db.parseAggregationStagesJSON(ctx, after)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing second pipeline: %w", err)
+	}
+
+	// Load the collections joined by either pipeline in one snapshot
+	allStages := append(append([]AggregationStage{}, beforeStages...), afterStages...)
+	ctx, input, err := db.loadPipelineInput(ctx, collectionName, allStages, opts.Isolation)
+	if err != nil {
+		return nil, err
+	}
+	defer releaseQuerySnapshot(ctx)
+
+	// Stages may modify their input documents: each pipeline gets a copy
+	beforeResults, err := db.runStages(ctx, beforeStages, cloneDocuments(input), QueryOptions{}, &QueryStats{})
+	if err != nil {
+		return nil, fmt.Errorf("first pipeline failed: %w", err)
+	}
+	afterResults, err := db.runStages(ctx, afterStages, cloneDocuments(input), QueryOptions{}, &QueryStats{})
+	if err != nil {
+		return nil, fmt.Errorf("second pipeline failed: %w", err)
+	}
+	return diffResults(beforeResults, afterResults, opts.Key), nil
+}
+
+// diffResults matches the documents of before and after by the field key, or
+// by content if key is empty, and lists their differences.
+func diffResults(before, after []map[string]interface{}, key string) *PipelineDiff {
+	diff := &PipelineDiff{}
+	keyOf := func(doc map[string]interface{}) (interface{}, bool) {
+		if key == "" {
+			return doc, true
+		}
+		return getNestedFieldExists(doc, key)
+	}
+
+	// Documents sharing a key are matched in order
+	keyed := make(map[interface{}][]map[string]interface{})
+	var unkeyed []map[string]interface{}
+	for _, doc := range before {
+		if value, ok := keyOf(doc); ok {
+			k := groupKey(value)
+			keyed[k] = append(keyed[k], doc)
+		} else {
+			unkeyed = append(unkeyed, doc)
+		}
+	}
+
+	compare := func(k interface{}, old, doc map[string]interface{}) {
+		if reflect.DeepEqual(groupKey(old), groupKey(doc)) {
+			diff.Unchanged++
+		} else {
+			diff.Changed = append(diff.Changed, DocumentChange{Key: k, Before: old, After: doc})
+		}
+	}
+
+	position := 0
+	for _, doc := range after {
+		value, ok := keyOf(doc)
+		if !ok {
+			if position < len(unkeyed) {
+				compare(nil, unkeyed[position], doc)
+				position++
+			} else {
+				diff.Added = append(diff.Added, doc)
+			}
+			continue
+		}
+
+		k := groupKey(value)
+		if matches := keyed[k]; len(matches) > 0 {
+			compare(value, matches[0], doc)
+			keyed[k] = matches[1:]
+		} else {
+			diff.Added = append(diff.Added, doc)
+		}
+	}
+
+	// What is left of before was not returned by after, reported in the
+	// order of before
+	for _, doc := range before {
+		if value, ok := keyOf(doc); ok {
+			k := groupKey(value)
+			if matches := keyed[k]; len(matches) > 0 && sameDocument(matches[0], doc) {
+				diff.Removed = append(diff.Removed, doc)
+				keyed[k] = matches[1:]
+			}
+		}
+	}
+	diff.Removed = append(diff.Removed, unkeyed[position:]...)
+	return diff
+}
+
+// sameDocument reports whether a and b are the same map, not equal copies.
+func sameDocument(a, b map[string]interface{}) bool {
+	return reflect.ValueOf(a).Pointer() == reflect.ValueOf(b).Pointer()
+}
@@ -0,0 +1,160 @@
+package marco
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+)
+
+// defaultCursorBatchSize is the batch size of QueryCursor when none is given.
+const defaultCursorBatchSize = 100
+
+// Cursor reads the results of a pipeline a batch at a time, see QueryCursor.
+// A Cursor is not safe for concurrent use.
+type Cursor struct {
+	source    docIterator       // results of the pipeline
+	stream    *collectionStream // nil for pipelines run at once, and once closed
+	batchSize int
+	batch     []map[string]interface{}
+	pos       int
+	doc       map[string]interface{}
+	err       error
+	closed    bool
+	stats     QueryStats
+}
+
+// QueryCursor runs an aggregation pipeline on a collection and returns a
+// Cursor over its results, so that large result sets can be consumed
+// incrementally instead of as one slice:
+//
+//	cur, err := db.QueryCursor("orders", `[{"$match": {"status": "paid"}}]`, 500)
+//	if err != nil {
+//		return err
+//	}
+//	defer cur.Close()
+//	for cur.Next() {
+//		var order Order
+//		if err := cur.Decode(&order); err != nil {
+//			return err
+//		}
+//		process(order)
+//	}
+//	if err := cur.Err(); err != nil {
+//		return err
+//	}
+//
+// With the optimized engine, the collection is read as the results are: the
+// stages up to the last blocking stage ($sort, $group, ...) run when the
+// cursor is opened, and the others on each batch of batchSize documents
+// (100 if zero or less). The cursor then holds the read transaction of the
+// query until it is exhausted or closed, so close cursors you don't read to
+// the end. Pipelines that need the whole collection in memory, with the
+// legacy engine, pipeline middleware or a $lookup from the queried
+// collection itself, run when the cursor is opened, like Query.
+func (db *DB) QueryCursor(collection string, pipeline string, batchSize int) (*Cursor, error) {
+	if batchSize <= 0 {
+		batchSize = defaultCursorBatchSize
+	}
+	cur := &Cursor{batchSize: batchSize}
+
+	ctx := withQueryNow(context.Background())
+	ctx = withMemoryBudget(ctx, db.queryMemoryLimit(QueryOptions{}))
+	stages, err := db.parseAggregationStagesJSON(ctx, pipeline)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing aggregation stages: %w", err)
+	}
+
+	if db.queryEngine(QueryOptions{}) != EngineOptimized || db.hasPipelineMiddleware() || pipelineLooksUp(stages, collection) {
+		results, err := db.Query(collection, pipeline)
+		if err != nil {
+			return nil, err
+		}
+		cur.source = &sliceIterator{docs: results}
+		return cur, nil
+	}
+
+	cur.stream, err = db.openCollectionStream(ctx, collection, stages, SnapshotIsolation, &cur.stats)
+	if err != nil {
+		return nil, err
+	}
+	cur.source = cur.stream.out
+	return cur, nil
+}
+
+// Next advances to the next result and reports whether there is one. It
+// reads a new batch when the current one is consumed, and returns false at
+// the end of the results, after an error (see Err) and once the cursor is
+// closed.
+func (c *Cursor) Next() bool {
+	c.doc = nil
+	if c.err != nil || c.closed {
+		return false
+	}
+	if c.pos == len(c.batch) {
+		if err := c.readBatch(); err != nil {
+			c.err = err
+			c.Close()
+			return false
+		}
+		if len(c.batch) == 0 {
+			// Exhausted: release the snapshot without waiting for Close
+			c.Close()
+			return false
+		}
+	}
+	c.doc = c.batch[c.pos]
+	c.batch[c.pos] = nil
+	c.pos++
+	return true
+}
+
+// readBatch reads up to batchSize results.
+func (c *Cursor) readBatch() error {
+	c.batch, c.pos = c.batch[:0], 0
+	for len(c.batch) < c.batchSize {
+		doc, err := c.source.next()
+		if err != nil {
+			return err
+		}
+		if doc == nil {
+			break
+		}
+		c.batch = append(c.batch, doc)
+	}
+	return nil
+}
+
+// Decode stores the current result in the value pointed to by v: a
+// *map[string]interface{} receives the document itself, other types are
+// decoded from its JSON encoding, as with json.Unmarshal.
+func (c *Cursor) Decode(v interface{}) error {
+	if c.doc == nil {
+		return fmt.Errorf("cursor has no current document, call Next first")
+	}
+	if m, ok := v.(*map[string]interface{}); ok {
+		*m = c.doc
+		return nil
+	}
+	data, err := json.Marshal(c.doc)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// Err returns the error that stopped the cursor, if any.
+func (c *Cursor) Err() error {
+	return c.err
+}
+
+// Close releases the read transaction held by the cursor. It is safe to call
+// several times.
+func (c *Cursor) Close() error {
+	c.closed = true
+	c.batch = nil
+	if c.stream != nil {
+		c.stream.close(&c.stats)
+		c.stream = nil
+	}
+	return nil
+}
@@ -0,0 +1,143 @@
+package marco
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Badger can be left in an unrecoverable state when it runs out of disk space
+// in the middle of a compaction or a value log write. The disk monitor checks
+// the free space of the database directory and switches the database to
+// read-only mode before that happens: writes then fail with ErrReadOnly while
+// reads keep working, a clean failure mode operators can alert on.
+
+// ErrReadOnly is returned by writes while the database is in read-only mode.
+var ErrReadOnly = errors.New("database is in read-only mode")
+
+// DiskMonitorOptions configures MonitorDisk.
+type DiskMonitorOptions struct {
+	// Path is the directory whose file system is watched. Empty means the
+	// Badger directory; it is required for in-memory databases.
+	Path string
+
+	// MinFreeBytes is the free space under which the database switches to
+	// read-only mode.
+	MinFreeBytes uint64
+
+	// ResumeFreeBytes is the free space above which the monitor leaves the
+	// read-only mode it entered, so that a disk hovering around the
+	// threshold does not flap. Zero means MinFreeBytes; it cannot be lower.
+	ResumeFreeBytes uint64
+
+	// Interval between checks. Zero means one minute.
+	Interval time.Duration
+
+	// OnChange, if set, is called each time the monitor switches the mode.
+	OnChange func(DiskEvent)
+
+	// OnError, if set, receives the errors met reading the free space.
+	OnError func(error)
+}
+
+// DiskEvent describes a switch of the read-only mode by the disk monitor.
+type DiskEvent struct {
+	ReadOnly  bool   // the new mode
+	Path      string // the watched directory
+	FreeBytes uint64 // the free space that triggered the switch
+}
+
+// SetReadOnly switches the database to or from read-only mode. In read-only
+// mode writes fail with ErrReadOnly; reads and queries are unaffected.
+func (db *DB) SetReadOnly(readOnly bool) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.readOnly = readOnly
+}
+
+// ReadOnly reports whether the database is in read-only mode.
+func (db *DB) ReadOnly() bool {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return db.readOnly
+}
+
+// MonitorDisk checks the free disk space every interval until ctx is done,
+// switching the database to read-only mode when it falls below
+// opts.MinFreeBytes. It is meant to run in its own goroutine:
+//
+//	go db.MonitorDisk(ctx, marco.DiskMonitorOptions{
+//		MinFreeBytes: 2 << 30,
+//		OnChange:     func(e marco.DiskEvent) { log.Printf("read-only=%v, %d bytes free", e.ReadOnly, e.FreeBytes) },
+//	})
+//
+// The monitor only leaves the read-only mode it entered itself, once the free
+// space is back above opts.ResumeFreeBytes; a mode set with SetReadOnly is
+// left alone. MonitorDisk checks once before returning an error for invalid
+// options or an unreadable path, then returns ctx.Err(). Free space is read on
+// Windows, Linux, macOS, FreeBSD, DragonFly BSD and AIX; elsewhere MonitorDisk
+// returns an error.
+func (db *DB) MonitorDisk(ctx context.Context, opts DiskMonitorOptions) error {
+	path := opts.Path
+	if path == "" {
+		path = db.db.Opts().Dir
+	}
+	if path == "" {
+		return fmt.Errorf("disk monitor needs a Path for an in-memory database")
+	}
+	if opts.MinFreeBytes == 0 {
+		return fmt.Errorf("disk monitor needs a positive MinFreeBytes")
+	}
+	resume := opts.ResumeFreeBytes
+	if resume < opts.MinFreeBytes {
+		resume = opts.MinFreeBytes
+	}
+	interval := opts.Interval
+	if interval <= 0 {
+		interval = time.Minute
+	}
+	if _, err := freeDiskSpace(path); err != nil {
+		return fmt.Errorf("disk monitor can't read the free space of %s: %w", path, err)
+	}
+
+	entered := false // whether the monitor switched to read-only mode
+	check := func() {
+		free, err := freeDiskSpace(path)
+		if err != nil {
+			if opts.OnError != nil {
+				opts.OnError(err)
+			}
+			return
+		}
+
+		switch {
+		case !entered && free < opts.MinFreeBytes:
+			if db.ReadOnly() {
+				return // already read-only by the operator's choice
+			}
+			db.SetReadOnly(true)
+			entered = true
+		case entered && free > resume:
+			db.SetReadOnly(false)
+			entered = false
+		default:
+			return
+		}
+		if opts.OnChange != nil {
+			opts.OnChange(DiskEvent{ReadOnly: entered, Path: path, FreeBytes: free})
+		}
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		check()
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,14 @@
+//go:build !aix && !darwin && !dragonfly && !freebsd && !linux && !windows
+
+package marco
+
+import (
+	"fmt"
+	"runtime"
+)
+
+// freeDiskSpace fails: this platform has no free space call wired up, so a
+// disk monitor can't be started on it.
+func freeDiskSpace(path string) (uint64, error) {
+	return 0, fmt.Errorf("reading free disk space is not supported on %s", runtime.GOOS)
+}
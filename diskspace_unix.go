@@ -0,0 +1,15 @@
+//go:build aix || darwin || dragonfly || freebsd || linux
+
+package marco
+
+import "syscall"
+
+// freeDiskSpace returns the bytes available to the process on the file
+// system holding path.
+func freeDiskSpace(path string) (uint64, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(path, &stat); err != nil {
+		return 0, err
+	}
+	return uint64(stat.Bavail) * uint64(stat.Bsize), nil
+}
@@ -0,0 +1,162 @@
+package marco
+
+import (
+	"container/list"
+	"sync"
+	"sync/atomic"
+
+	"github.com/google/uuid"
+)
+
+// DocumentCacheStats counts the lookups served by the document cache.
+type DocumentCacheStats struct {
+	Hits    uint64 // documents found in the cache
+	Misses  uint64 // documents read from Badger
+	Entries int    // documents in the cache
+}
+
+// SetDocumentCache caches up to 'size' documents read by GetID and
+// RecursiveGraphTraversal, so that graphs where many documents refer to the
+// same ones read each of them once. Documents are evicted least recently used
+// first, and dropped from the cache when they are written or deleted. The
+// cache starts empty; a size of zero or less disables it, which is the
+// default.
+func (db *DB) SetDocumentCache(size int) {
+	var cache *documentCache
+	if size > 0 {
+		cache = newDocumentCache(size)
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.docCache = cache
+}
+
+// DocumentCacheStats returns the counters of the document cache, zero when
+// it is disabled.
+func (db *DB) DocumentCacheStats() DocumentCacheStats {
+	return db.documentCache().stats()
+}
+
+// documentCache returns the document cache, or nil when it is disabled.
+func (db *DB) documentCache() *documentCache {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return db.docCache
+}
+
+// documentCache is a least-recently-used cache of decoded documents, keyed by
+// UUID. A nil *documentCache is a disabled cache.
+type documentCache struct {
+	mu         sync.Mutex
+	capacity   int
+	order      *list.List // front = most recently used
+	entries    map[uuid.UUID]*list.Element
+	generation uint64 // incremented by every invalidation
+	hits       uint64 // updated atomically
+	misses     uint64 // updated atomically
+}
+
+// documentCacheEntry is the value of a documentCache list element.
+type documentCacheEntry struct {
+	id  uuid.UUID
+	doc map[string]interface{}
+}
+
+func newDocumentCache(capacity int) *documentCache {
+	return &documentCache{
+		capacity: capacity,
+		order:    list.New(),
+		entries:  make(map[uuid.UUID]*list.Element),
+	}
+}
+
+// get returns a copy of the cached document 'id'. On a miss, it also returns
+// the generation to pass to add once the document is read.
+func (c *documentCache) get(id uuid.UUID) (map[string]interface{}, uint64, bool) {
+	if c == nil {
+		return nil, 0, false
+	}
+	c.mu.Lock()
+	elem, ok := c.entries[id]
+	if !ok {
+		generation := c.generation
+		c.mu.Unlock()
+		atomic.AddUint64(&c.misses, 1)
+		return nil, generation, false
+	}
+	c.order.MoveToFront(elem)
+	doc := elem.Value.(*documentCacheEntry).doc
+	c.mu.Unlock()
+
+	atomic.AddUint64(&c.hits, 1)
+	// Callers own the documents they get, and RecursiveGraphTraversal
+	// replaces references in place
+	return deepCopyDocument(doc), 0, true
+}
+
+// add caches a copy of the document 'id' read after get returned
+// 'generation'. The document is not cached if it may have been written or
+// deleted since it was read.
+func (c *documentCache) add(id uuid.UUID, doc map[string]interface{}, generation uint64) {
+	if c == nil || doc == nil {
+		return
+	}
+	doc = deepCopyDocument(doc)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.generation != generation {
+		return
+	}
+	if elem, ok := c.entries[id]; ok {
+		// Read concurrently by another caller
+		c.order.MoveToFront(elem)
+		return
+	}
+	c.entries[id] = c.order.PushFront(&documentCacheEntry{id: id, doc: doc})
+	if c.order.Len() > c.capacity {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*documentCacheEntry).id)
+	}
+}
+
+// invalidate drops the document 'id' from the cache.
+func (c *documentCache) invalidate(id uuid.UUID) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.generation++
+	if elem, ok := c.entries[id]; ok {
+		c.order.Remove(elem)
+		delete(c.entries, id)
+	}
+}
+
+// clear empties the cache, after writes that touch many documents.
+func (c *documentCache) clear() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.generation++
+	c.order.Init()
+	c.entries = make(map[uuid.UUID]*list.Element)
+}
+
+func (c *documentCache) stats() DocumentCacheStats {
+	if c == nil {
+		return DocumentCacheStats{}
+	}
+	c.mu.Lock()
+	entries := c.order.Len()
+	c.mu.Unlock()
+	return DocumentCacheStats{
+		Hits:    atomic.LoadUint64(&c.hits),
+		Misses:  atomic.LoadUint64(&c.misses),
+		Entries: entries,
+	}
+}
@@ -0,0 +1,172 @@
+package marco
+
+import (
+	"context"
+	"math/rand"
+)
+
+// ExecutionEngine selects how pipelines are executed.
+type ExecutionEngine int
+
+const (
+	// EngineDefault uses the engine of the database (see SetExecutionEngine)
+	// for a query, and EngineOptimized for the database.
+	EngineDefault ExecutionEngine = iota
+
+	// EngineOptimized takes the execution shortcuts: the streamed
+	// $match/$sort/$limit scan, the $lookup+$unwind join, and documents
+	// passed one at a time through the stages that don't need their whole
+	// input, such as $match, $project or $limit.
+	EngineOptimized
+
+	// EngineLegacy runs every stage as written on the whole collection, as
+	// marco always did. It is the fallback if the optimized engine returns
+	// wrong results.
+	EngineLegacy
+)
+
+// String returns "default", "optimized" or "legacy".
+func (e ExecutionEngine) String() string {
+	switch e {
+	case EngineOptimized:
+		return "optimized"
+	case EngineLegacy:
+		return "legacy"
+	}
+	return "default"
+}
+
+// SetExecutionEngine selects the engine of the queries that don't set
+// QueryOptions.Engine. EngineDefault restores the optimized engine.
+func (db *DB) SetExecutionEngine(engine ExecutionEngine) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.engine = engine
+}
+
+// ExecutionEngine returns the engine of the queries that don't set
+// QueryOptions.Engine.
+func (db *DB) ExecutionEngine() ExecutionEngine {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if db.engine == EngineDefault {
+		return EngineOptimized
+	}
+	return db.engine
+}
+
+// queryEngine returns the engine running a query with opts.
+func (db *DB) queryEngine(opts QueryOptions) ExecutionEngine {
+	if opts.Engine != EngineDefault {
+		return opts.Engine
+	}
+	return db.ExecutionEngine()
+}
+
+// ShadowDivergence describes a query whose results differ between the
+// optimized and the legacy engine.
+type ShadowDivergence struct {
+	Collection string
+	Pipeline   string
+
+	// Diff lists the results added, removed or changed by the optimized
+	// engine compared to the legacy one. It is nil if LegacyErr is set.
+	Diff *PipelineDiff
+
+	// LegacyErr is the error of the legacy engine, which failed where the
+	// optimized engine succeeded.
+	LegacyErr error
+}
+
+// DivergenceLogger receives the divergences found by shadow execution. It is
+// called synchronously at the end of Query and should hand them off quickly.
+type DivergenceLogger func(divergence ShadowDivergence)
+
+// ShadowOptions configures shadow execution.
+type ShadowOptions struct {
+	// SampleRate is the fraction of queries shadowed, between 0 and 1.
+	// Zero shadows every query.
+	SampleRate float64
+
+	// Key is the field matching the results of both engines, as in
+	// CompareOptions. Empty matches them by content.
+	Key string
+}
+
+// shadowExecution holds the logger installed with SetShadowExecution.
+type shadowExecution struct {
+	logger DivergenceLogger
+	opts   ShadowOptions
+}
+
+// SetShadowExecution enables shadow execution: the queries run by the
+// optimized engine are run again by the legacy engine, and the divergences of
+// their results are passed to logger. This checks the optimized engine on
+// production traffic before relying on it; shadowed queries take about twice
+// as long. A nil logger disables it.
+//
+//	db.SetShadowExecution(func(d marco.ShadowDivergence) {
+//		log.Printf("engines diverge on %s %s: %+v", d.Collection, d.Pipeline, d.Diff)
+//	}, marco.ShadowOptions{SampleRate: 0.01})
+//
+// Both engines read the same snapshot, except after the streamed scan, which
+// reads the collection on its own: writes committed in between may then show
+// up as divergences. Pipelines using $rand or $sampleRate diverge by nature.
+func (db *DB) SetShadowExecution(logger DivergenceLogger, opts ShadowOptions) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if logger == nil {
+		db.shadow = nil
+		return
+	}
+	db.shadow = &shadowExecution{logger: logger, opts: opts}
+}
+
+// sampledShadow returns the shadow execution settings if the current query
+// must be shadowed.
+func (db *DB) sampledShadow() *shadowExecution {
+	db.mu.RLock()
+	shadow := db.shadow
+	db.mu.RUnlock()
+
+	if shadow == nil {
+		return nil
+	}
+	if rate := shadow.opts.SampleRate; rate > 0 && rate < 1 && rand.Float64() >= rate {
+		return nil
+	}
+	return shadow
+}
+
+// run runs stages with the legacy engine and logs how its results differ
+// from those of the optimized engine. input is a copy of the documents the
+// optimized engine read; if nil, the collections are read again.
+func (s *shadowExecution) run(ctx context.Context, db *DB, collectionName, pipeline string, stages []AggregationStage, input []map[string]interface{}, isolation QueryIsolation, results []map[string]interface{}) {
+	// The optimized run charged the budget of the query: the legacy run
+	// gets its own, with the same limit
+	limit := int64(-1)
+	if budget := queryMemory(ctx); budget != nil {
+		limit = budget.limit
+	}
+	ctx = withMemoryBudget(ctx, limit)
+
+	if input == nil {
+		var err error
+		ctx, input, err = db.loadPipelineInput(ctx, collectionName, stages, isolation)
+		if err != nil {
+			s.logger(ShadowDivergence{Collection: collectionName, Pipeline: pipeline, LegacyErr: err})
+			return
+		}
+		defer releaseQuerySnapshot(ctx)
+	}
+
+	legacy, err := db.runStages(ctx, stages, input, QueryOptions{Engine: EngineLegacy}, &QueryStats{})
+	if err != nil {
+		s.logger(ShadowDivergence{Collection: collectionName, Pipeline: pipeline, LegacyErr: err})
+		return
+	}
+	if diff := diffResults(legacy, results, s.opts.Key); !diff.Equal() {
+		s.logger(ShadowDivergence{Collection: collectionName, Pipeline: pipeline, Diff: diff})
+	}
+}
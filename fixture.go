@@ -0,0 +1,96 @@
+package marco
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"path"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// fixtureIDNamespace is the UUID namespace of the IDs of fixture documents
+// whose _id is not a UUID.
+var fixtureIDNamespace = uuid.MustParse("0f6c2d4e-8b1a-4f3e-9c7d-5a2b1e0d4c39")
+
+// maxFixtureLine is the longest line, in bytes, of a fixture file.
+const maxFixtureLine = 16 << 20
+
+// LoadFixture loads the fixture files of directory dir of fsys into db, for
+// seed or reference data shipped inside a binary:
+//
+//	//go:embed fixtures
+//	var fixtures embed.FS
+//
+//	err := marco.LoadFixture(db, fixtures, "fixtures")
+//
+// Each file named <collection>.ndjson or <collection>.jsonl holds one JSON
+// document per line; blank lines are skipped and other files ignored.
+// Documents get a stable ID, so loading a fixture again overwrites them
+// instead of adding copies: their _id when it is a UUID, otherwise a UUID
+// derived from the collection and the _id, or from the line number for
+// documents without one.
+func LoadFixture(db *DB, fsys fs.FS, dir string) error {
+	entries, err := fs.ReadDir(fsys, dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		ext := path.Ext(name)
+		if entry.IsDir() || (ext != ".ndjson" && ext != ".jsonl") {
+			continue
+		}
+		if err := loadFixtureFile(db, fsys, path.Join(dir, name), strings.TrimSuffix(name, ext)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loadFixtureFile loads one fixture file into collection.
+func loadFixtureFile(db *DB, fsys fs.FS, file, collection string) error {
+	f, err := fsys.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxFixtureLine)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+		var doc map[string]interface{}
+		if err := json.Unmarshal([]byte(text), &doc); err != nil {
+			return fmt.Errorf("fixture %s:%d: %w", file, line, err)
+		}
+		if _, err := db.Put(collection, fixtureDocumentID(collection, doc, line), doc); err != nil {
+			return fmt.Errorf("fixture %s:%d: %w", file, line, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("fixture %s: %w", file, err)
+	}
+	return nil
+}
+
+// fixtureDocumentID returns the stable ID of the fixture document found at
+// line of the file of collection.
+func fixtureDocumentID(collection string, doc map[string]interface{}, line int) string {
+	id, ok := doc["_id"]
+	if !ok {
+		return uuid.NewSHA1(fixtureIDNamespace, []byte(fmt.Sprintf("%s\x00line %d", collection, line))).String()
+	}
+	if s, ok := id.(string); ok {
+		if u, err := uuid.Parse(s); err == nil {
+			return u.String()
+		}
+	}
+	encoded, _ := json.Marshal(id)
+	return uuid.NewSHA1(fixtureIDNamespace, append([]byte(collection+"\x00"), encoded...)).String()
+}
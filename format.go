@@ -0,0 +1,121 @@
+package marco
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/dgraph-io/badger/v3"
+)
+
+// currentFormatVersion is the storage format written by this version of marco.
+const currentFormatVersion = 1
+
+// formatVersionKey holds the storage format version of the database as a
+// decimal string.
+var formatVersionKey = systemKey("format")
+
+// keyEncodings maps every supported storage format version to its key layout.
+var keyEncodings = map[int]keyEncoding{
+	1: keyEncodingV1{},
+}
+
+// formatMigration upgrades a database from one storage format version to the
+// next. It runs after the previous version's encoding has been installed and
+// must be resumable: if it is interrupted, Open runs it again.
+type formatMigration func(db *DB) error
+
+// formatMigrations maps version N to the migration producing version N+1.
+var formatMigrations = map[int]formatMigration{}
+
+// initStorageFormat reads the storage format version, upgrades the database
+// to currentFormatVersion when needed, and installs the matching key encoding.
+//
+// Databases created before the format key existed are version 1. A database
+// written by a newer marco (unknown version) is rejected instead of being
+// misread.
+func (db *DB) initStorageFormat(readOnly bool) error {
+	version, found, err := db.readFormatVersion()
+	if err != nil {
+		return err
+	}
+	if !found {
+		version = 1
+	}
+	if version > currentFormatVersion {
+		return fmt.Errorf("storage format version %d is newer than the supported version %d", version, currentFormatVersion)
+	}
+
+	encoding, ok := keyEncodings[version]
+	if !ok {
+		return fmt.Errorf("unsupported storage format version %d", version)
+	}
+	db.keys = encoding
+
+	if readOnly {
+		if version != currentFormatVersion {
+			return fmt.Errorf("storage format version %d needs migrating to %d, which is not possible in read-only mode", version, currentFormatVersion)
+		}
+		return nil
+	}
+
+	for version < currentFormatVersion {
+		migrate, ok := formatMigrations[version]
+		if !ok {
+			return fmt.Errorf("no migration from storage format version %d", version)
+		}
+		if err := migrate(db); err != nil {
+			return fmt.Errorf("storage format migration from version %d failed: %w", version, err)
+		}
+		version++
+		db.keys = keyEncodings[version]
+		if err := db.writeFormatVersion(version); err != nil {
+			return err
+		}
+	}
+
+	if !found {
+		return db.writeFormatVersion(version)
+	}
+	return nil
+}
+
+// FormatVersion returns the storage format version of the database.
+func (db *DB) FormatVersion() (int, error) {
+	version, found, err := db.readFormatVersion()
+	if err != nil || !found {
+		return 1, err
+	}
+	return version, nil
+}
+
+// readFormatVersion returns the recorded storage format version.
+func (db *DB) readFormatVersion() (int, bool, error) {
+	var version int
+	found := false
+
+	err := db.db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(formatVersionKey)
+		if err == badger.ErrKeyNotFound {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		return item.Value(func(val []byte) error {
+			version, err = strconv.Atoi(string(val))
+			if err != nil {
+				return fmt.Errorf("invalid storage format version %q: %w", val, err)
+			}
+			found = true
+			return nil
+		})
+	})
+	return version, found, err
+}
+
+// writeFormatVersion records the storage format version.
+func (db *DB) writeFormatVersion(version int) error {
+	return db.update(func(txn *badger.Txn) error {
+		return txn.Set(formatVersionKey, []byte(strconv.Itoa(version)))
+	})
+}
@@ -0,0 +1,340 @@
+package marco
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+
+	"github.com/dgraph-io/badger/v3"
+)
+
+// A field index keeps the documents of a collection ordered by the value of
+// one of their fields, so that a $sort on that field followed by a $limit
+// reads the documents of the page only, instead of sorting the collection.
+//
+// Every document has an entry in each index of its collection, under a
+// collection-scoped system key:
+//
+//	systemKeyPrefix + "index:" + collection + "\x00" + field + "\x00" + value + 16-byte UUID
+//
+// Values are encoded so that entries sort in the order of $sort: numbers by
+// value, then strings byte by byte, then every other value (missing fields,
+// booleans, dates, arrays, ...) unordered. Equal values sort by UUID, the
+// order documents are scanned in. $sort compares a number with a string, or
+// any other value, as formatted strings, which no key order matches, so an
+// index is only used while all its values are numbers or all are strings.
+//
+// The indexed fields are listed in the metadata of the collection, each
+// with whether its index is complete: an index is maintained by every write
+// from the moment CreateIndex records it, but only used once the documents
+// stored before have been indexed as well.
+
+func init() {
+	registerCollectionKeyKind("index")
+}
+
+// Kinds of indexed values, the first byte of their encoding.
+const (
+	indexKindNumber byte = 1 + iota
+	indexKindString
+	indexKindOther
+)
+
+// CreateIndex indexes the documents of a collection by 'field', a dotted
+// path, so that pipelines sorting on that field and limiting the result,
+// such as [{"$sort": {"age": -1}}, {"$limit": 10}], read the first documents
+// in order instead of the whole collection. Documents are indexed in batches
+// of DefaultBatchSize; if CreateIndex fails half-way, calling it again
+// finishes the index. Creating an existing index does nothing.
+func (db *DB) CreateIndex(collection, field string) error {
+	if err := validateCollectionName(collection); err != nil {
+		return err
+	}
+	if err := validateIndexField(field); err != nil {
+		return err
+	}
+
+	// Record the index first, so that writes from then on maintain it
+	var ready bool
+	if err := db.update(func(txn *badger.Txn) error {
+		indexes, err := readIndexes(txn, collection)
+		if err != nil {
+			return err
+		}
+		if built, ok := indexes[field]; ok {
+			ready = built
+			return nil
+		}
+		indexes[field] = false
+		return writeIndexes(txn, collection, indexes)
+	}); err != nil {
+		return fmt.Errorf("failed to record index %s of collection %s: %w", field, collection, err)
+	}
+	if ready {
+		return nil
+	}
+
+	// Index the documents stored before, each read again in the batch
+	// transaction so that a concurrent write is not indexed stale
+	_, err := db.processPrefixInBatches(db.keys.collectionPrefix(collection), DefaultBatchSize, func(txn *badger.Txn, primaryKey []byte) (bool, error) {
+		keyCollection, uBytes := db.keys.splitPrimaryKey(primaryKey)
+		if uBytes == nil || keyCollection != collection {
+			return false, nil // a collection whose name starts with "collection:"
+		}
+		doc, err := db.getDocument(txn, primaryKey)
+		if err == ErrNotFound {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+		return true, txn.Set(indexEntryKey(collection, field, doc, uBytes), nil)
+	}, nil)
+	if err != nil {
+		return fmt.Errorf("failed to index collection %s by %s: %w", collection, field, err)
+	}
+
+	return db.update(func(txn *badger.Txn) error {
+		indexes, err := readIndexes(txn, collection)
+		if err != nil {
+			return err
+		}
+		if _, ok := indexes[field]; !ok {
+			return fmt.Errorf("index %s of collection %s was dropped while it was built", field, collection)
+		}
+		indexes[field] = true
+		return writeIndexes(txn, collection, indexes)
+	})
+}
+
+// DropIndex removes the index of a collection on 'field' and its entries.
+// Dropping an index that does not exist does nothing.
+func (db *DB) DropIndex(collection, field string) error {
+	if err := validateCollectionName(collection); err != nil {
+		return err
+	}
+	if err := validateIndexField(field); err != nil {
+		return err
+	}
+
+	// Unlist the index first, so that no query reads it while its entries
+	// are deleted
+	if err := db.update(func(txn *badger.Txn) error {
+		indexes, err := readIndexes(txn, collection)
+		if err != nil {
+			return err
+		}
+		if _, ok := indexes[field]; !ok {
+			return nil
+		}
+		delete(indexes, field)
+		return writeIndexes(txn, collection, indexes)
+	}); err != nil {
+		return fmt.Errorf("failed to drop index %s of collection %s: %w", field, collection, err)
+	}
+
+	_, err := db.processPrefixInBatches(indexPrefix(collection, field), DefaultBatchSize, func(txn *badger.Txn, key []byte) (bool, error) {
+		return true, txn.Delete(key)
+	}, nil)
+	if err != nil {
+		return fmt.Errorf("failed to delete the entries of index %s of collection %s: %w", field, collection, err)
+	}
+	return nil
+}
+
+// Indexes returns the indexed fields of a collection, sorted, including
+// those whose index is still being built.
+func (db *DB) Indexes(collection string) ([]string, error) {
+	var fields []string
+	err := db.db.View(func(txn *badger.Txn) error {
+		indexes, err := readIndexes(txn, collection)
+		for field := range indexes {
+			fields = append(fields, field)
+		}
+		return err
+	})
+	sort.Strings(fields)
+	return fields, err
+}
+
+// validateIndexField rejects fields that can't be part of an index key.
+func validateIndexField(field string) error {
+	if field == "" || strings.ContainsRune(field, 0) {
+		return fmt.Errorf("index field %q must be non-empty and must not contain a zero byte", field)
+	}
+	return nil
+}
+
+// readIndexes returns the indexes of a collection: whether the index of each
+// indexed field is complete.
+func readIndexes(txn *badger.Txn, collection string) (map[string]bool, error) {
+	indexes := make(map[string]bool)
+	_, err := collectionMetaField(txn, collection, "indexes", &indexes)
+	return indexes, err
+}
+
+func writeIndexes(txn *badger.Txn, collection string, indexes map[string]bool) error {
+	meta, err := readCollectionMeta(txn, collection)
+	if err != nil {
+		return err
+	}
+	if len(indexes) == 0 {
+		delete(meta, "indexes")
+	} else {
+		meta["indexes"] = indexes
+	}
+	return writeCollectionMeta(txn, collection, meta)
+}
+
+// indexDocument updates the index entries of the document at primaryKey,
+// about to be replaced with the encoded document val, or deleted when val is
+// nil. It must run in the transaction of the write, before it. Collections
+// without indexes cost a read of their metadata.
+func (db *DB) indexDocument(txn *badger.Txn, primaryKey, val []byte) error {
+	collection, uBytes := db.keys.splitPrimaryKey(primaryKey)
+	indexes, err := readIndexes(txn, collection)
+	if err != nil || len(indexes) == 0 {
+		return err
+	}
+
+	old, err := db.getDocument(txn, primaryKey)
+	if err != nil && err != ErrNotFound {
+		return err
+	}
+	var doc map[string]interface{}
+	if val != nil {
+		if doc, err = db.decodeDocument(val); err != nil {
+			return err
+		}
+	}
+
+	for field := range indexes {
+		var oldKey, newKey []byte
+		if old != nil {
+			oldKey = indexEntryKey(collection, field, old, uBytes)
+		}
+		if doc != nil {
+			newKey = indexEntryKey(collection, field, doc, uBytes)
+		}
+		if bytes.Equal(oldKey, newKey) {
+			continue
+		}
+		if oldKey != nil {
+			if err := txn.Delete(oldKey); err != nil {
+				return err
+			}
+		}
+		if newKey != nil {
+			if err := txn.Set(newKey, nil); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// indexPrefix returns the prefix shared by the entries of an index.
+func indexPrefix(collection, field string) []byte {
+	return append(collectionSystemPrefix("index", collection), field+"\x00"...)
+}
+
+// indexEntryKey returns the key of the entry of document 'uBytes' in the
+// index of a collection on 'field'.
+func indexEntryKey(collection, field string, doc map[string]interface{}, uBytes []byte) []byte {
+	key := appendIndexValue(indexPrefix(collection, field), getNestedField(doc, field))
+	return append(key, uBytes...)
+}
+
+// appendIndexValue appends the encoding of an indexed value to key. Numbers
+// and strings are told apart as sortLess does, with toFloat64.
+func appendIndexValue(key []byte, value interface{}) []byte {
+	if n, ok := toFloat64(value); ok && !math.IsNaN(n) {
+		if n == 0 {
+			n = 0 // -0 sorts with 0
+		}
+		// Flip the sign bit of positive numbers, and every bit of negative
+		// ones, so that the big-endian bits sort as the numbers do
+		bits := math.Float64bits(n)
+		if bits>>63 == 0 {
+			bits |= 1 << 63
+		} else {
+			bits = ^bits
+		}
+		key = append(key, indexKindNumber)
+		for shift := 56; shift >= 0; shift -= 8 {
+			key = append(key, byte(bits>>uint(shift)))
+		}
+		return key
+	}
+	if s, ok := value.(string); ok {
+		// Zero bytes are escaped so that the terminator sorts a string
+		// before the longer strings it starts
+		key = append(key, indexKindString)
+		for i := 0; i < len(s); i++ {
+			key = append(key, s[i])
+			if s[i] == 0 {
+				key = append(key, 0xff)
+			}
+		}
+		return append(key, 0, 0)
+	}
+	return append(key, indexKindOther)
+}
+
+// indexEntryValue returns the encoded value of an index entry.
+func indexEntryValue(prefix, key []byte) []byte {
+	return key[len(prefix) : len(key)-16]
+}
+
+// sortIndex reports whether the documents of a collection can be read in
+// the order of the $sort spec 'spec' from a complete index, and if so
+// returns the field of the index and whether the order is descending. It
+// must run in the transaction the index is read in.
+func sortIndex(txn *badger.Txn, collection string, spec map[string]interface{}) (string, bool, bool, error) {
+	if len(spec) != 1 {
+		return "", false, false, nil
+	}
+	var field string
+	var descending bool
+	for f, direction := range spec {
+		field, descending = f, direction == float64(-1)
+	}
+	indexes, err := readIndexes(txn, collection)
+	if err != nil || !indexes[field] {
+		return "", false, false, err
+	}
+
+	// The first and last entries tell whether all values are of one kind
+	prefix := indexPrefix(collection, field)
+	first, err := firstIndexKind(txn, prefix, false)
+	if err != nil {
+		return "", false, false, err
+	}
+	last, err := firstIndexKind(txn, prefix, true)
+	if err != nil {
+		return "", false, false, err
+	}
+	return field, descending, first == last && first != indexKindOther, nil
+}
+
+// firstIndexKind returns the kind of the first entry of the index at prefix,
+// or of the last one if reverse is set; 0 if the index is empty.
+func firstIndexKind(txn *badger.Txn, prefix []byte, reverse bool) (byte, error) {
+	opts := badger.DefaultIteratorOptions
+	opts.PrefetchValues = false
+	opts.Reverse = reverse
+	it := txn.NewIterator(opts)
+	defer it.Close()
+
+	seek := prefix
+	if reverse {
+		seek = append(append([]byte{}, prefix...), 0xff)
+	}
+	it.Seek(seek)
+	if !it.ValidForPrefix(prefix) {
+		return 0, nil
+	}
+	return it.Item().Key()[len(prefix)], nil
+}
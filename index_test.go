@@ -0,0 +1,99 @@
+package marco
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+// indexedQuery runs a pipeline with both engines, checks that they return
+// the same documents and returns them with the shortcut of the optimized
+// engine.
+func indexedQuery(t *testing.T, db *DB, pipeline string) ([]map[string]interface{}, string) {
+	t.Helper()
+	want, _, err := db.QueryWithOptions(context.Background(), "c", pipeline, QueryOptions{Engine: EngineLegacy})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, stats, err := db.QueryWithOptions(context.Background(), "c", pipeline, QueryOptions{Engine: EngineOptimized})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("%s: got %v, want %v", pipeline, got, want)
+	}
+	return got, stats.Shortcut
+}
+
+func TestIndexedSort(t *testing.T) {
+	db := openTestDB(t, nil)
+	ids := make([]string, 20)
+	for i := range ids {
+		// Values repeat, so ties are broken by UUID in both directions
+		id, err := db.Put("c", "", testDocument(t, fmt.Sprintf(`{"n": %d, "s": "v%d", "i": %d}`, i%7-3, i%5, i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids[i] = id
+	}
+	if err := db.CreateIndex("c", "n"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.CreateIndex("c", "s"); err != nil {
+		t.Fatal(err)
+	}
+	if fields, err := db.Indexes("c"); err != nil || !reflect.DeepEqual(fields, []string{"n", "s"}) {
+		t.Fatalf("indexes %v, %v", fields, err)
+	}
+
+	pipelines := []string{
+		`[{"$sort": {"n": 1}}, {"$limit": 5}]`,
+		`[{"$sort": {"n": -1}}, {"$skip": 3}, {"$limit": 8}]`,
+		`[{"$match": {"i": {"$gte": 4}}}, {"$sort": {"s": -1}}, {"$limit": 6}]`,
+		`[{"$sort": {"s": 1}}, {"$limit": 100}]`,
+	}
+	check := func(shortcut string) {
+		t.Helper()
+		for _, pipeline := range pipelines {
+			if _, got := indexedQuery(t, db, pipeline); got != shortcut {
+				t.Errorf("%s: shortcut %q, want %q", pipeline, got, shortcut)
+			}
+		}
+	}
+	check("indexScan")
+
+	// Writes keep the indexes up to date
+	if _, err := db.Put("c", ids[0], testDocument(t, `{"n": 100, "s": "a", "i": 0}`)); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Delete("c", ids[1]); err != nil {
+		t.Fatal(err)
+	}
+	check("indexScan")
+
+	// The window is read from the start of the index
+	_, stats, err := db.QueryWithOptions(context.Background(), "c", `[{"$sort": {"n": -1}}, {"$limit": 2}]`, QueryOptions{Engine: EngineOptimized})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.DocsLoaded != 2 {
+		t.Errorf("loaded %d documents for a window of 2", stats.DocsLoaded)
+	}
+
+	// $sort compares a string with a number as strings, which the index
+	// doesn't order
+	if _, err := db.Put("c", "", testDocument(t, `{"n": "x", "s": "z", "i": 99}`)); err != nil {
+		t.Fatal(err)
+	}
+	if _, got := indexedQuery(t, db, pipelines[0]); got != "windowedScan" {
+		t.Errorf("index of mixed values used, shortcut %q", got)
+	}
+
+	if err := db.DropIndex("c", "s"); err != nil {
+		t.Fatal(err)
+	}
+	if _, got := indexedQuery(t, db, pipelines[3]); got != "windowedScan" {
+		t.Errorf("dropped index used, shortcut %q", got)
+	}
+}
@@ -0,0 +1,263 @@
+package marco
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"sort"
+	"strings"
+
+	"github.com/dgraph-io/badger/v3"
+)
+
+// IntegrityOptions configures CheckIntegrity.
+type IntegrityOptions struct {
+	// SampleRate is the fraction of documents decoded, between 0 (none)
+	// and 1 (all of them). Values above 1 are treated as 1.
+	SampleRate float64
+
+	// RebuildIndexes repairs the secondary keys (see Scrub) and finishes
+	// the drops interrupted by the shutdown (see ResumeDrops).
+	RebuildIndexes bool
+}
+
+// IntegrityProblem describes a damaged piece of data.
+type IntegrityProblem struct {
+	Collection string // collection the data belongs to, empty if unknown
+	ID         string // document UUID, empty for collection metadata
+	Message    string
+}
+
+// IntegrityReport summarizes a CheckIntegrity run.
+type IntegrityReport struct {
+	// Collections is the number of collection metadata documents checked,
+	// and Metadata the ones that could not be decoded or hold invalid
+	// settings (codec, archive policy, schema, quota).
+	Collections int
+	Metadata    []IntegrityProblem
+
+	// DocumentsSampled is the number of documents decoded, and Undecodable
+	// the ones that failed. UnknownCodec counts the sampled documents
+	// written with an encoding or compression not registered yet; they are
+	// not decoded.
+	DocumentsSampled int
+	Undecodable      []IntegrityProblem
+	UnknownCodec     int
+
+	// Index is the secondary key check, repaired with RebuildIndexes.
+	Index *ScrubReport
+
+	// PendingDrops lists the collections whose drop was interrupted; they
+	// are finished with RebuildIndexes, and ResumedDrops is then true.
+	PendingDrops []string
+	ResumedDrops bool
+}
+
+// Healthy reports whether no problem was found, or all were repaired.
+// Conflicting secondary keys are never repaired and always count.
+func (r *IntegrityReport) Healthy() bool {
+	if len(r.Metadata) > 0 || len(r.Undecodable) > 0 {
+		return false
+	}
+	if len(r.PendingDrops) > 0 && !r.ResumedDrops {
+		return false
+	}
+	if r.Index != nil {
+		broken := len(r.Index.Dangling) + len(r.Index.Missing)
+		if len(r.Index.Conflicting) > 0 || (broken > 0 && r.Index.Repaired < broken) {
+			return false
+		}
+	}
+	return true
+}
+
+// OpenWithIntegrityCheck opens a database like Open, then checks it with
+// CheckIntegrity, typically after an unclean shutdown. The database is
+// returned open whatever the report says; it is only closed if the check
+// itself fails.
+//
+// Documents written with custom encodings or compressions can't be decoded
+// before these are registered: they are counted in UnknownCodec. Run
+// CheckIntegrity after registering them to check those documents too.
+func OpenWithIntegrityCheck(opts badger.Options, check IntegrityOptions) (*DB, *IntegrityReport, error) {
+	db, err := Open(opts)
+	if err != nil {
+		return nil, nil, err
+	}
+	report, err := db.CheckIntegrity(check)
+	if err != nil {
+		db.Close()
+		return nil, nil, fmt.Errorf("integrity check failed: %w", err)
+	}
+	return db, report, nil
+}
+
+// CheckIntegrity verifies that the collection metadata and a sample of the
+// documents decode correctly, and that every document can be found through
+// its secondary key. With IntegrityOptions.RebuildIndexes, secondary keys are
+// repaired and interrupted drops are finished.
+func (db *DB) CheckIntegrity(opts IntegrityOptions) (*IntegrityReport, error) {
+	report := &IntegrityReport{}
+
+	if err := db.db.View(func(txn *badger.Txn) error {
+		if err := db.checkCollectionMeta(txn, report); err != nil {
+			return err
+		}
+		return db.sampleDocuments(txn, opts.SampleRate, report)
+	}); err != nil {
+		return nil, err
+	}
+
+	var err error
+	if report.PendingDrops, err = db.PendingDrops(); err != nil {
+		return nil, err
+	}
+	if opts.RebuildIndexes && len(report.PendingDrops) > 0 {
+		if err := db.ResumeDrops(DropOptions{}); err != nil {
+			return report, fmt.Errorf("failed to resume interrupted drops: %w", err)
+		}
+		report.ResumedDrops = true
+	}
+
+	// Check the secondary keys last: resumed drops remove some of them
+	if report.Index, err = db.Scrub(ScrubOptions{Repair: opts.RebuildIndexes}); err != nil {
+		return report, err
+	}
+	return report, nil
+}
+
+// checkCollectionMeta decodes the metadata of every collection and validates
+// the settings it holds.
+func (db *DB) checkCollectionMeta(txn *badger.Txn, report *IntegrityReport) error {
+	prefix := []byte(systemKeyPrefix + "meta:")
+
+	it := txn.NewIterator(badger.DefaultIteratorOptions)
+	defer it.Close()
+
+	for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+		rest := string(it.Item().Key()[len(prefix):])
+		collection := strings.TrimSuffix(rest, "\x00")
+		if collection == rest {
+			continue
+		}
+		report.Collections++
+
+		var meta map[string]json.RawMessage
+		if err := it.Item().Value(func(val []byte) error {
+			return json.Unmarshal(val, &meta)
+		}); err != nil {
+			report.Metadata = append(report.Metadata, IntegrityProblem{
+				Collection: collection,
+				Message:    fmt.Sprintf("metadata can't be decoded: %v", err),
+			})
+			continue
+		}
+		fields := make([]string, 0, len(meta))
+		for field := range meta {
+			fields = append(fields, field)
+		}
+		sort.Strings(fields) // report problems in a stable order
+		for _, field := range fields {
+			if err := checkMetaField(field, meta[field]); err != nil {
+				report.Metadata = append(report.Metadata, IntegrityProblem{
+					Collection: collection,
+					Message:    fmt.Sprintf("metadata field %q: %v", field, err),
+				})
+			}
+		}
+	}
+	return nil
+}
+
+// checkMetaField validates one field of the metadata of a collection.
+// Unknown fields, of subsystems added later, are accepted.
+func checkMetaField(field string, raw json.RawMessage) error {
+	switch field {
+	case "codec":
+		var codec CollectionCodec
+		return json.Unmarshal(raw, &codec)
+	case "archive":
+		var policy ArchivePolicy
+		if err := json.Unmarshal(raw, &policy); err != nil {
+			return err
+		}
+		if policy.TimeField == "" || policy.OlderThan <= 0 {
+			return fmt.Errorf("archive policy needs a TimeField and a positive OlderThan")
+		}
+	case "schema":
+		var schema map[string]interface{}
+		if err := json.Unmarshal(raw, &schema); err != nil {
+			return err
+		}
+		return validateSchemaDefinition(schema, "")
+	case "quota":
+		var quota CollectionQuota
+		if err := json.Unmarshal(raw, &quota); err != nil {
+			return err
+		}
+		if quota.MaxDocuments < 0 || quota.MaxBytes < 0 {
+			return fmt.Errorf("quota must not be negative")
+		}
+	}
+	return nil
+}
+
+// sampleDocuments decodes a random sample of the documents of every
+// collection, a fraction rate of them.
+func (db *DB) sampleDocuments(txn *badger.Txn, rate float64, report *IntegrityReport) error {
+	if rate <= 0 {
+		return nil
+	}
+
+	iterOpts := badger.DefaultIteratorOptions
+	iterOpts.PrefetchValues = false
+
+	it := txn.NewIterator(iterOpts)
+	defer it.Close()
+
+	for it.Rewind(); it.Valid(); it.Next() {
+		item := it.Item()
+		key := item.Key()
+		if bytes.HasPrefix(key, []byte(systemKeyPrefix)) || db.keys.isSecondaryKey(key) {
+			continue
+		}
+		collection, uBytes := db.keys.splitPrimaryKey(key)
+		if uBytes == nil || (rate < 1 && rand.Float64() >= rate) {
+			continue
+		}
+
+		if err := item.Value(func(val []byte) error {
+			val, err := db.documentValue(txn, key, val)
+			if err != nil {
+				report.DocumentsSampled++
+				report.Undecodable = append(report.Undecodable, IntegrityProblem{
+					Collection: collection,
+					ID:         uuidString(uBytes),
+					Message:    err.Error(),
+				})
+				return nil
+			}
+			if len(val) > 0 && val[0] == codecHeaderMarker {
+				if codec, _, err := splitCodecHeader(val); err == nil {
+					if _, _, err := db.codecParts(codec); err != nil {
+						report.UnknownCodec++
+						return nil
+					}
+				}
+			}
+			report.DocumentsSampled++
+			if _, err := db.decodeDocument(val); err != nil {
+				report.Undecodable = append(report.Undecodable, IntegrityProblem{
+					Collection: collection,
+					ID:         uuidString(uBytes),
+					Message:    err.Error(),
+				})
+			}
+			return nil
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
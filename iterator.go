@@ -0,0 +1,172 @@
+package marco
+
+import "github.com/dgraph-io/badger/v3"
+
+// Iterator reads the documents of a collection one at a time, in key order.
+// Only the current document is decoded, so collections of any size can be
+// processed without loading them in memory:
+//
+//	it, err := db.CollectionIter("orders")
+//	if err != nil {
+//		return err
+//	}
+//	defer it.Close()
+//	for it.Next() {
+//		process(it.ID(), it.Doc())
+//	}
+//	if err := it.Err(); err != nil {
+//		return err
+//	}
+//
+// The documents are read in a single read transaction, so they reflect one
+// point in time whatever is written meanwhile. The transaction is held until
+// Close: an open read transaction keeps Badger from discarding the versions
+// it can see, so close iterators as soon as they are no longer needed. An
+// Iterator is not safe for concurrent use.
+type Iterator struct {
+	db         *DB
+	collection string
+	prefix     []byte
+	txn        *badger.Txn // discarded by Close if ownTxn
+	ownTxn     bool
+	it         *badger.Iterator
+	started    bool
+	screen     rawScreen       // documents it doesn't admit are skipped undecoded
+	screened   int             // documents skipped by screen
+	fields     map[string]bool // fields decoded, all if nil
+
+	id   string
+	doc  map[string]interface{}
+	size int // size in bytes of the encoded document
+	err  error
+}
+
+// CollectionIter returns an Iterator over the documents of a collection.
+func (db *DB) CollectionIter(collection string) (*Iterator, error) {
+	if db.db.IsClosed() {
+		return nil, badger.ErrDBClosed
+	}
+	return db.newIterator(db.db.NewTransaction(false), true, collection), nil
+}
+
+// newIterator returns an Iterator reading a collection in txn, which it
+// discards on Close if ownTxn is set.
+func (db *DB) newIterator(txn *badger.Txn, ownTxn bool, collection string) *Iterator {
+	return &Iterator{
+		db:         db,
+		collection: collection,
+		prefix:     db.keys.collectionPrefix(collection),
+		txn:        txn,
+		ownTxn:     ownTxn,
+		it:         txn.NewIterator(db.scanOptions()),
+	}
+}
+
+// Next advances to the next document and reports whether there is one. It
+// returns false at the end of the collection, after an error (see Err) and
+// once the iterator is closed.
+func (it *Iterator) Next() bool {
+	it.id, it.doc, it.size = "", nil, 0
+	if it.err != nil || it.it == nil {
+		return false
+	}
+	if it.started {
+		it.it.Next()
+	} else {
+		it.it.Seek(it.prefix)
+		it.started = true
+	}
+
+	for ; it.it.ValidForPrefix(it.prefix); it.it.Next() {
+		item := it.it.Item()
+
+		// Keys of a collection whose name starts with "collection:" share the prefix
+		collection, id := it.db.keys.splitPrimaryKey(item.Key())
+		if id == nil || collection != it.collection {
+			continue
+		}
+
+		var doc map[string]interface{}
+		skipped := false
+		if err := item.Value(func(val []byte) error {
+			val, err := it.db.documentValue(it.txn, item.Key(), val)
+			if err != nil {
+				return err
+			}
+			if it.screen != nil && !it.screen.admits(val) {
+				skipped = true
+				return nil
+			}
+			it.size = len(val)
+			if it.fields != nil {
+				doc, err = it.db.decodeFields(val, it.fields)
+			} else {
+				doc, err = it.db.decodeDocument(val)
+			}
+			return err
+		}); err != nil {
+			it.err = err
+			return false
+		}
+		if skipped {
+			it.screened++
+			continue
+		}
+		it.id, it.doc = uuidString(id), doc
+		return true
+	}
+	return false
+}
+
+// ID returns the ID of the current document.
+func (it *Iterator) ID() string {
+	return it.id
+}
+
+// Doc returns the current document. It belongs to the caller, who may modify
+// it.
+func (it *Iterator) Doc() map[string]interface{} {
+	return it.doc
+}
+
+// Err returns the error that stopped the iteration, if any.
+func (it *Iterator) Err() error {
+	return it.err
+}
+
+// Close releases the read transaction of the iterator. It is safe to call
+// several times.
+func (it *Iterator) Close() error {
+	if it.it == nil {
+		return nil
+	}
+	it.it.Close()
+	it.it = nil
+	if it.ownTxn {
+		it.txn.Discard()
+	}
+	return nil
+}
+
+// ForEach calls fn for every document of a collection, in key order, reading
+// them one at a time as CollectionIter does. An error returned by fn stops
+// the scan and is returned by ForEach.
+//
+//	err := db.ForEach("orders", func(id string, doc map[string]interface{}) error {
+//		total += doc["amount"].(float64)
+//		return nil
+//	})
+func (db *DB) ForEach(collection string, fn func(id string, doc map[string]interface{}) error) error {
+	it, err := db.CollectionIter(collection)
+	if err != nil {
+		return err
+	}
+	defer it.Close()
+
+	for it.Next() {
+		if err := fn(it.ID(), it.Doc()); err != nil {
+			return err
+		}
+	}
+	return it.Err()
+}
@@ -0,0 +1,135 @@
+package marco
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// Layout of the Badger keyspace (storage format version 1):
+//
+//   - Primary key   = collection + ":" + 16-byte binary UUID -> JSON document
+//   - Secondary key = 16-byte binary UUID                  -> primary key
+//   - System key    = systemKeyPrefix + kind + ":" + ...   -> subsystem data
+//
+// System keys start with a zero byte, which is not allowed in collection
+// names, so they can never be confused with documents of a collection. The
+// parts of large documents are system keys too, see chunk.go.
+//
+// Document keys are built through a keyEncoding selected from the storage
+// format version recorded in the database (see format.go), so that a future
+// layout can be introduced without breaking existing databases.
+const systemKeyPrefix = "\x00marco:"
+
+// keyEncoding builds and parses the keys of documents and their secondary keys.
+type keyEncoding interface {
+	// primaryKey returns the key of document 'id' (16-byte UUID) in 'collection'.
+	primaryKey(collection string, id []byte) []byte
+
+	// secondaryKey returns the key resolving 'id' to its primary key.
+	secondaryKey(id []byte) []byte
+
+	// collectionPrefix returns the prefix shared by every primary key of 'collection'.
+	collectionPrefix(collection string) []byte
+
+	// splitPrimaryKey returns the collection and UUID of a primary key,
+	// or a nil UUID if key is not a primary key.
+	splitPrimaryKey(key []byte) (string, []byte)
+
+	// isSecondaryKey reports whether key is a secondary key.
+	isSecondaryKey(key []byte) bool
+}
+
+// keyEncodingV1 is the original layout: "collection:" + UUID, and the bare UUID
+// as secondary key.
+type keyEncodingV1 struct{}
+
+func (keyEncodingV1) primaryKey(collection string, id []byte) []byte {
+	return append([]byte(collection+":"), id...)
+}
+
+func (keyEncodingV1) secondaryKey(id []byte) []byte {
+	return id
+}
+
+func (keyEncodingV1) collectionPrefix(collection string) []byte {
+	return []byte(collection + ":")
+}
+
+func (keyEncodingV1) splitPrimaryKey(key []byte) (string, []byte) {
+	if len(key) < 18 || key[len(key)-17] != ':' || bytes.HasPrefix(key, []byte(systemKeyPrefix)) {
+		return "", nil
+	}
+	return string(key[:len(key)-17]), key[len(key)-16:]
+}
+
+func (keyEncodingV1) isSecondaryKey(key []byte) bool {
+	return len(key) == 16
+}
+
+// isCollectionKey reports whether a key found under the collection prefix
+// really belongs to 'collection'. Keys of a collection whose name starts with
+// "collection:" share the prefix.
+func isCollectionKey(keys keyEncoding, collection string, key []byte) bool {
+	keyCollection, id := keys.splitPrimaryKey(key)
+	return id != nil && keyCollection == collection
+}
+
+// collectionScopedKinds lists the system key kinds whose keys belong to a
+// single collection. Every such key is laid out as
+//
+//	systemKeyPrefix + kind + ":" + collection + "\x00" + ...
+//
+// so that DropCollection can discover and delete all auxiliary data of a
+// collection (indexes, views, schemas, retention rules, ...) by prefix.
+// Subsystems add their kind with registerCollectionKeyKind from an init function.
+var collectionScopedKinds = []string{"meta"}
+
+// registerCollectionKeyKind declares a new collection-scoped system key kind.
+func registerCollectionKeyKind(kind string) {
+	for _, existing := range collectionScopedKinds {
+		if existing == kind {
+			return
+		}
+	}
+	collectionScopedKinds = append(collectionScopedKinds, kind)
+}
+
+// systemKey builds a system key for the given kind and parts.
+func systemKey(kind string, parts ...string) []byte {
+	return []byte(systemKeyPrefix + kind + ":" + strings.Join(parts, ":"))
+}
+
+// collectionSystemPrefix returns the prefix shared by all system keys of 'kind'
+// that belong to 'collection'. The trailing zero byte terminates the collection
+// name so that "users" does not match keys of "users:archive".
+func collectionSystemPrefix(kind, collection string) []byte {
+	return []byte(systemKeyPrefix + kind + ":" + collection + "\x00")
+}
+
+// collectionMetaKey is the key holding the metadata document of a collection.
+func collectionMetaKey(collection string) []byte {
+	return collectionSystemPrefix("meta", collection)
+}
+
+// collectionAuxPrefixes returns the prefixes of every auxiliary key that belongs
+// to 'collection', across all registered subsystems.
+func collectionAuxPrefixes(collection string) [][]byte {
+	prefixes := make([][]byte, 0, len(collectionScopedKinds))
+	for _, kind := range collectionScopedKinds {
+		prefixes = append(prefixes, collectionSystemPrefix(kind, collection))
+	}
+	return prefixes
+}
+
+// validateCollectionName rejects collection names that would collide with the
+// system keyspace.
+func validateCollectionName(collection string) error {
+	if collection == "" {
+		return ErrCollectionEmpty
+	}
+	if strings.ContainsRune(collection, 0) {
+		return fmt.Errorf("collection name %q must not contain a zero byte", collection)
+	}
+	return nil
+}
@@ -0,0 +1,92 @@
+package marco
+
+import (
+	"fmt"
+	"log"
+)
+
+// LogLevel is the severity of a message logged by marco.
+type LogLevel int
+
+const (
+	LogDebug LogLevel = iota // details of the execution of a stage
+	LogInfo                  // notable but expected events
+	LogWarn                  // ignored input, e.g. unsupported stages or operators
+	LogError                 // failures that do not fail the operation
+)
+
+func (l LogLevel) String() string {
+	switch l {
+	case LogDebug:
+		return "DEBUG"
+	case LogInfo:
+		return "INFO"
+	case LogWarn:
+		return "WARN"
+	case LogError:
+		return "ERROR"
+	}
+	return fmt.Sprintf("LogLevel(%d)", int(l))
+}
+
+// Logger receives the messages logged by marco, mostly the warnings of stages
+// that ignore invalid input rather than failing the query. It must be safe
+// for concurrent use.
+type Logger interface {
+	Logf(level LogLevel, format string, args ...interface{})
+}
+
+// StdLogger returns a Logger writing the messages of level min and above to l,
+// or to the standard logger if l is nil:
+//
+//	db.SetLogger(marco.StdLogger(log.New(os.Stderr, "marco: ", log.LstdFlags), marco.LogDebug))
+func StdLogger(l *log.Logger, min LogLevel) Logger {
+	return &stdLogger{logger: l, min: min}
+}
+
+// defaultLogger is used until SetLogger is called.
+var defaultLogger = StdLogger(nil, LogWarn)
+
+type stdLogger struct {
+	logger *log.Logger
+	min    LogLevel
+}
+
+func (l *stdLogger) Logf(level LogLevel, format string, args ...interface{}) {
+	if level < l.min {
+		return
+	}
+	msg := level.String() + " " + fmt.Sprintf(format, args...)
+	if l.logger == nil {
+		log.Print(msg)
+		return
+	}
+	l.logger.Print(msg)
+}
+
+// discardLogger is installed by SetLogger(nil).
+type discardLogger struct{}
+
+func (discardLogger) Logf(LogLevel, string, ...interface{}) {}
+
+// SetLogger sets the logger of the database. By default warnings and errors
+// are written to the standard logger; a nil logger discards every message.
+func (db *DB) SetLogger(logger Logger) {
+	if logger == nil {
+		logger = discardLogger{}
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.logger = logger
+}
+
+// logf logs a message with the logger of the database.
+func (db *DB) logf(level LogLevel, format string, args ...interface{}) {
+	db.mu.RLock()
+	logger := db.logger
+	db.mu.RUnlock()
+	if logger == nil {
+		logger = defaultLogger
+	}
+	logger.Logf(level, format, args...)
+}
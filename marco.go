@@ -1,9 +1,9 @@
 package marco
 
 import (
-	"encoding/json"
 	"errors"
 	"fmt"
+	"sync"
 
 	"github.com/dgraph-io/badger/v3"
 	"github.com/google/uuid"
@@ -12,12 +12,36 @@ import (
 // DB wraps a Badger database instance and offers convenience methods
 // for CRUD operations, secondary indexing, and recursive graph traversal.
 type DB struct {
-	db *badger.DB
+	db   *badger.DB
+	keys keyEncoding // key layout of the storage format in use
+
+	// mu guards the settings below, which may be changed at runtime.
+	mu                 sync.RWMutex
+	retryPolicy        RetryPolicy
+	wherePredicates    map[string]WherePredicateContext
+	functions          map[string]ExpressionFunctionContext
+	accumulators       map[string]Accumulator
+	pipelineMiddleware []PipelineMiddleware
+	queryLog           *queryLog
+	engine             ExecutionEngine
+	shadow             *shadowExecution
+	parallel           ParallelOptions
+	memoryLimit        int64          // see SetQueryMemoryLimit
+	chunkSize          int            // see SetChunkSize
+	docCache           *documentCache // nil unless SetDocumentCache
+	logger             Logger         // nil for defaultLogger, see SetLogger
+	strict             bool           // reject marco extensions to the MongoDB syntax
+	readOnly           bool           // writes fail with ErrReadOnly, see diskmonitor.go
+	loadOptions        LoadOptions
+	loadSlots          chan struct{} // worker slots shared by collection loads
+	encodings          map[string]Encoding
+	compressions       map[string]Compression
 }
 
 // Open initializes a new DB instance using the given badger.Options.
 func Open(opts badger.Options) (*DB, error) {
 	db := new(DB)
+	db.retryPolicy = DefaultRetryPolicy
 
 	var err error
 	db.db, err = badger.Open(opts)
@@ -25,6 +49,20 @@ func Open(opts badger.Options) (*DB, error) {
 		return nil, err
 	}
 
+	// Detect the storage format and upgrade it if this is an older database
+	if err := db.initStorageFormat(opts.ReadOnly); err != nil {
+		db.db.Close()
+		return nil, err
+	}
+
+	// Queries interrupted by a crash may have left documents spilled to disk
+	if !opts.ReadOnly {
+		if err := db.dropSpills(); err != nil {
+			db.db.Close()
+			return nil, err
+		}
+	}
+
 	return db, nil
 }
 
@@ -38,6 +76,64 @@ func (db *DB) Close() error {
 	return db.db.Close()
 }
 
+var (
+	// ErrNotFound is returned when a document does not exist.
+	ErrNotFound = errors.New("document not found")
+
+	// ErrDocumentExists is returned by PutWithOptions in InsertOnly mode when
+	// the ID is already in use.
+	ErrDocumentExists = errors.New("document already exists")
+
+	// ErrInvalidUUID is returned when a document ID is not a valid UUID.
+	ErrInvalidUUID = errors.New("invalid UUID")
+
+	// ErrCollectionEmpty is returned when a collection name is empty.
+	ErrCollectionEmpty = errors.New("collection name is empty")
+
+	// ErrUnsupportedStage is returned when a pipeline uses a stage marco does
+	// not implement.
+	ErrUnsupportedStage = errors.New("unsupported aggregation stage")
+
+	// ErrUnsupportedOperator is returned in strict mode when a pipeline uses
+	// an operator or accumulator marco does not implement.
+	ErrUnsupportedOperator = errors.New("unsupported operator")
+
+	// ErrInvalidPipeline is matched by errors.Is for every
+	// *InvalidPipelineError.
+	ErrInvalidPipeline = errors.New("invalid aggregation pipeline")
+)
+
+// PutMode selects how PutWithOptions behaves when the document already exists.
+type PutMode int
+
+const (
+	// Upsert inserts the document or overwrites an existing one (the behavior of Put).
+	Upsert PutMode = iota
+	// InsertOnly fails with ErrDocumentExists if the ID is already in use.
+	InsertOnly
+	// UpdateOnly fails with ErrNotFound if the document does not exist in the collection.
+	UpdateOnly
+)
+
+// PutOptions configures PutWithOptions.
+type PutOptions struct {
+	Mode PutMode
+
+	// ReturnPrevious requests the document being overwritten, read in the
+	// same transaction as the write.
+	ReturnPrevious bool
+}
+
+// PutResult describes the outcome of PutWithOptions.
+type PutResult struct {
+	ID       string // ID of the stored document
+	Inserted bool   // true if the document did not exist before
+
+	// Previous is the overwritten document when PutOptions.ReturnPrevious
+	// is set, or nil if the document was inserted.
+	Previous map[string]interface{}
+}
+
 // Put inserts or updates a document in the specified collection.
 //
 // If 'id' is empty, a new UUID is generated. If provided, 'id' must be a valid
@@ -47,8 +143,23 @@ func (db *DB) Close() error {
 //   - Primary key = collection prefix + ":" + [16-byte binary UUID]
 //   - Secondary key = [16-byte binary UUID], pointing to the primary key.
 func (db *DB) Put(collection, id string, value map[string]interface{}) (string, error) {
+	result, err := db.PutWithOptions(collection, id, value, PutOptions{})
+	if err != nil {
+		return "", err
+	}
+	return result.ID, nil
+}
+
+// PutWithOptions stores a document like Put, but lets the caller state whether
+// it expects to create a new document (InsertOnly) or to replace an existing
+// one (UpdateOnly). The existence check and the write happen in the same
+// transaction, so a concurrent writer cannot slip in between.
+func (db *DB) PutWithOptions(collection, id string, value map[string]interface{}, opts PutOptions) (PutResult, error) {
 	if collection == "" {
-		return "", fmt.Errorf("collection name is empty, cannot insert document ID: %s", id)
+		return PutResult{}, fmt.Errorf("%w, cannot insert document ID: %s", ErrCollectionEmpty, id)
+	}
+	if err := validateCollectionName(collection); err != nil {
+		return PutResult{}, err
 	}
 
 	// Generate or parse UUID
@@ -61,42 +172,89 @@ func (db *DB) Put(collection, id string, value map[string]interface{}) (string,
 		// Validate user-provided ID
 		u, err = uuid.Parse(id)
 		if err != nil {
-			return "", fmt.Errorf("invalid UUID provided: %s", id)
+			return PutResult{}, fmt.Errorf("%w provided: %s", ErrInvalidUUID, id)
 		}
 	}
 
 	// Convert UUID to its 16-byte binary form
 	uBytes, err := u.MarshalBinary()
 	if err != nil {
-		return "", fmt.Errorf("unable to marshal UUID to binary: %v", err)
+		return PutResult{}, fmt.Errorf("unable to marshal UUID to binary: %v", err)
 	}
 
 	// Construct the primary key
 	// Format: collection + ":" + 16-byte UUID
-	primaryKey := append([]byte(collection+":"), uBytes...)
+	primaryKey := db.keys.primaryKey(collection, uBytes)
+	secondaryKey := db.keys.secondaryKey(uBytes)
+
+	result := PutResult{ID: id}
+
+	// Transaction to store the data. The parts of a large document are
+	// written ahead of it and deleted if it does not commit.
+	var chunks pendingChunks
+	err = db.update(func(txn *badger.Txn) error {
+		chunks.begin()
+
+		// Check whether the document exists. InsertOnly looks at the secondary
+		// key because IDs are unique across collections.
+		existsKey := primaryKey
+		if opts.Mode == InsertOnly {
+			existsKey = secondaryKey
+		}
+		_, err := txn.Get(existsKey)
+		if err != nil && err != badger.ErrKeyNotFound {
+			return err
+		}
+		exists := err == nil
 
-	// Transaction to store the data
-	err = db.db.Update(func(txn *badger.Txn) error {
-		// Convert the document to JSON
-		val, err := json.Marshal(value)
+		switch {
+		case opts.Mode == InsertOnly && exists:
+			return fmt.Errorf("%w: ID %s", ErrDocumentExists, id)
+		case opts.Mode == UpdateOnly && !exists:
+			return fmt.Errorf("%w: ID %s in collection %s", ErrNotFound, id, collection)
+		}
+		result.Inserted = !exists
+
+		// Fetch the pre-image before overwriting it
+		result.Previous = nil
+		if opts.ReturnPrevious {
+			if result.Previous, err = db.getDocument(txn, primaryKey); err != nil && err != ErrNotFound {
+				return err
+			}
+		}
+
+		// Encode the document with the codec of the collection (JSON by default)
+		val, err := db.encodeDocument(txn, collection, value)
 		if err != nil {
 			return err
 		}
 
-		// Set the primary key in Badger with the JSON value
-		if err := txn.Set(primaryKey, val); err != nil {
+		// Enforce the quota of the collection, if any
+		if err := chargeQuota(txn, collection, primaryKey, len(val)); err != nil {
+			return err
+		}
+
+		// Update the field indexes of the collection, if any
+		if err := db.indexDocument(txn, primaryKey, val); err != nil {
+			return err
+		}
+
+		// Set the primary key in Badger with the encoded value, in parts if
+		// it is large (see chunk.go)
+		if err := db.setDocumentValue(txn, primaryKey, val, &chunks); err != nil {
 			return err
 		}
 
 		// Secondary key is the 16-byte UUID only
-		secondaryKey := uBytes
 		return txn.Set(secondaryKey, primaryKey)
 	})
+	chunks.settle(db, err == nil)
 
 	if err != nil {
-		return "", err
+		return PutResult{}, err
 	}
-	return id, nil
+	db.documentCache().invalidate(u)
+	return result, nil
 }
 
 // Get retrieves a document by (collection, id).
@@ -108,24 +266,16 @@ func (db *DB) Get(collection, id string) (map[string]interface{}, error) {
 	// Parse the string UUID to binary
 	u, err := uuid.Parse(id)
 	if err != nil {
-		return nil, fmt.Errorf("invalid UUID: %s", id)
+		return nil, fmt.Errorf("%w: %s", ErrInvalidUUID, id)
 	}
 	uBytes, _ := u.MarshalBinary()
 
 	// Construct the primary key
-	primaryKey := append([]byte(collection+":"), uBytes...)
+	primaryKey := db.keys.primaryKey(collection, uBytes)
 
 	err = db.db.View(func(txn *badger.Txn) error {
-		item, err := txn.Get(primaryKey)
-		if err != nil {
-			if err == badger.ErrKeyNotFound {
-				return errors.New("document not found")
-			}
-			return err
-		}
-		return item.Value(func(val []byte) error {
-			return json.Unmarshal(val, &doc)
-		})
+		doc, err = db.getDocument(txn, primaryKey)
+		return err
 	})
 	if err != nil {
 		return nil, err
@@ -136,22 +286,31 @@ func (db *DB) Get(collection, id string) (map[string]interface{}, error) {
 // GetID retrieves a document using only the secondary key (which is the 16-byte binary UUID).
 // 1. Looks up `uBytes` -> primaryKey (collection + ":" + uBytes).
 // 2. Uses that primaryKey to fetch the actual document.
+//
+// Documents are served from the document cache when it is enabled, see
+// SetDocumentCache.
 func (db *DB) GetID(id string) (map[string]interface{}, error) {
 	var doc map[string]interface{}
 
 	// Parse the string UUID to binary
 	u, err := uuid.Parse(id)
 	if err != nil {
-		return nil, fmt.Errorf("invalid UUID for GetID: %s", id)
+		return nil, fmt.Errorf("%w for GetID: %s", ErrInvalidUUID, id)
 	}
 	uBytes, _ := u.MarshalBinary()
 
+	cache := db.documentCache()
+	doc, generation, ok := cache.get(u)
+	if ok {
+		return doc, nil
+	}
+
 	err = db.db.View(func(txn *badger.Txn) error {
 		// Lookup the primary key via the secondary index
-		item, err := txn.Get(uBytes)
+		item, err := txn.Get(db.keys.secondaryKey(uBytes))
 		if err != nil {
 			if err == badger.ErrKeyNotFound {
-				return errors.New("secondary key not found")
+				return fmt.Errorf("%w: secondary key of ID %s", ErrNotFound, id)
 			}
 			return err
 		}
@@ -170,68 +329,193 @@ func (db *DB) GetID(id string) (map[string]interface{}, error) {
 		item, err = txn.Get(primaryKey)
 		if err != nil {
 			if err == badger.ErrKeyNotFound {
-				return errors.New("primary key not found")
+				return fmt.Errorf("%w: primary key of ID %s", ErrNotFound, id)
 			}
 			return err
 		}
 
 		return item.Value(func(val []byte) error {
-			return json.Unmarshal(val, &doc)
+			if val, err = db.documentValue(txn, primaryKey, val); err != nil {
+				return err
+			}
+			doc, err = db.decodeDocument(val)
+			return err
 		})
 	})
 	if err != nil {
 		return nil, err
 	}
 
+	cache.add(u, doc, generation)
 	return doc, nil
 }
 
 // Collection returns all documents of the specified collection by prefix scanning.
 // The prefix is simply `collection + ":"` in ASCII, followed by 16 bytes of UUID data.
 func (db *DB) Collection(collection string) ([]map[string]interface{}, error) {
-	prefix := []byte(collection + ":")
 	var docs []map[string]interface{}
 
-	err := db.db.View(func(txn *badger.Txn) error {
-		it := txn.NewIterator(badger.DefaultIteratorOptions)
-		defer it.Close()
+	err := db.forEachDocument(collection, func(doc map[string]interface{}) (bool, error) {
+		docs = append(docs, doc)
+		return true, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return docs, nil
+}
+
+// forEachDocument decodes the documents of a collection one at a time and hands
+// them to fn. Returning false from fn stops the scan, so callers that only need
+// the first few documents never read the rest of the collection.
+func (db *DB) forEachDocument(collection string, fn func(doc map[string]interface{}) (bool, error)) error {
+	return db.forEachDocumentSized(collection, func(doc map[string]interface{}, _ int) (bool, error) {
+		return fn(doc)
+	})
+}
+
+// forEachDocumentSized is forEachDocument that also passes the size in bytes
+// of each encoded document.
+func (db *DB) forEachDocumentSized(collection string, fn func(doc map[string]interface{}, size int) (bool, error)) error {
+	return db.db.View(func(txn *badger.Txn) error {
+		return db.forEachDocumentInTxn(txn, collection, fn)
+	})
+}
+
+// forEachDocumentInTxn is forEachDocumentSized within an existing transaction.
+// Read-only transactions can run several scans concurrently.
+func (db *DB) forEachDocumentInTxn(txn *badger.Txn, collection string, fn func(doc map[string]interface{}, size int) (bool, error)) error {
+	prefix := db.keys.collectionPrefix(collection)
 
-		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
-			item := it.Item()
+	it := txn.NewIterator(db.scanOptions())
+	defer it.Close()
 
-			var doc map[string]interface{}
-			if err := item.Value(func(val []byte) error {
-				return json.Unmarshal(val, &doc)
-			}); err != nil {
+	for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+		item := it.Item()
+
+		// Keys of a collection whose name starts with "collection:" share the prefix
+		if !isCollectionKey(db.keys, collection, item.Key()) {
+			continue
+		}
+
+		var doc map[string]interface{}
+		var size int
+		if err := item.Value(func(val []byte) error {
+			val, err := db.documentValue(txn, item.Key(), val)
+			if err != nil {
 				return err
 			}
+			size = len(val)
+			doc, err = db.decodeDocument(val)
+			return err
+		}); err != nil {
+			return err
+		}
 
-			docs = append(docs, doc)
+		more, err := fn(doc, size)
+		if err != nil {
+			return err
+		}
+		if !more {
+			return nil
 		}
-		return nil
-	})
-	if err != nil {
-		return nil, err
 	}
-	return docs, nil
+	return nil
+}
+
+// ErrDropAllNotConfirmed is returned by DropAll when the caller did not set
+// DropAllOptions.Confirm.
+var ErrDropAllNotConfirmed = errors.New("DropAll requires DropAllOptions{Confirm: true}")
+
+// DropAllOptions guards DropAll against accidental use.
+type DropAllOptions struct {
+	// Confirm must be true, otherwise DropAll refuses to run.
+	Confirm bool
+}
+
+// DropAll deletes all keys and data from the Badger database, including
+// every collection, secondary key and system key (indexes, views, metadata).
+//
+// Because this cannot be undone, the caller must explicitly confirm:
+//
+//	db.DropAll(marco.DropAllOptions{Confirm: true})
+func (db *DB) DropAll(opts DropAllOptions) error {
+	if !opts.Confirm {
+		return ErrDropAllNotConfirmed
+	}
+	if db.ReadOnly() {
+		return ErrReadOnly
+	}
+	defer db.documentCache().clear()
+	if err := db.db.DropAll(); err != nil {
+		return err
+	}
+
+	// The emptied database is in the current storage format
+	return db.writeFormatVersion(currentFormatVersion)
 }
 
-// DropAll deletes all keys and data from the Badger database.
-func (db *DB) DropAll() error {
-	return db.db.DropAll()
+// DeleteOptions configures DeleteWithOptions.
+type DeleteOptions struct {
+	// ReturnPrevious requests the deleted document, read in the same
+	// transaction as the delete.
+	ReturnPrevious bool
+}
+
+// DeleteResult describes the outcome of DeleteWithOptions.
+type DeleteResult struct {
+	// Previous is the deleted document when DeleteOptions.ReturnPrevious is
+	// set, or nil if there was no such document.
+	Previous map[string]interface{}
 }
 
 // Delete removes a single document by (collection, id), along with its associated
 // secondary key. We compute the same key format in binary form.
 func (db *DB) Delete(collection, id string) error {
+	_, err := db.DeleteWithOptions(collection, id, DeleteOptions{})
+	return err
+}
+
+// DeleteWithOptions removes a document like Delete and can return the deleted
+// document, so callers doing audit logging or cache invalidation do not need a
+// separate (racy) Get before the delete.
+func (db *DB) DeleteWithOptions(collection, id string, opts DeleteOptions) (DeleteResult, error) {
+	var result DeleteResult
+
 	u, err := uuid.Parse(id)
 	if err != nil {
-		return fmt.Errorf("invalid UUID for Delete: %s", id)
+		return result, fmt.Errorf("%w for Delete: %s", ErrInvalidUUID, id)
 	}
 	uBytes, _ := u.MarshalBinary()
-	primaryKey := append([]byte(collection+":"), uBytes...)
+	primaryKey := db.keys.primaryKey(collection, uBytes)
+	secondaryKey := db.keys.secondaryKey(uBytes)
+
+	// The parts of a large document are deleted once the transaction commits
+	var chunks pendingChunks
+	err = db.update(func(txn *badger.Txn) error {
+		chunks.begin()
+
+		// Fetch the pre-image before deleting it
+		result.Previous = nil
+		if opts.ReturnPrevious {
+			var err error
+			if result.Previous, err = db.getDocument(txn, primaryKey); err != nil && err != ErrNotFound {
+				return err
+			}
+		}
+
+		if err := chargeQuota(txn, collection, primaryKey, -1); err != nil {
+			return err
+		}
+		if err := db.indexDocument(txn, primaryKey, nil); err != nil {
+			return err
+		}
+
+		// Release the parts of a chunked document
+		if err := db.deleteDocumentChunks(txn, primaryKey, &chunks); err != nil {
+			return err
+		}
 
-	err = db.db.Update(func(txn *badger.Txn) error {
 		// Delete the primary key
 		if err := txn.Delete(primaryKey); err != nil {
 			if err == badger.ErrKeyNotFound {
@@ -241,7 +525,7 @@ func (db *DB) Delete(collection, id string) error {
 		}
 
 		// Delete the secondary key (the 16-byte UUID)
-		if err := txn.Delete(uBytes); err != nil {
+		if err := txn.Delete(secondaryKey); err != nil {
 			if err == badger.ErrKeyNotFound {
 				return fmt.Errorf("secondary key with ID %s not found", id)
 			}
@@ -249,55 +533,57 @@ func (db *DB) Delete(collection, id string) error {
 		}
 		return nil
 	})
+	chunks.settle(db, err == nil)
 	if err != nil {
-		return fmt.Errorf("failed to delete item and its secondary key: %w", err)
+		return DeleteResult{}, fmt.Errorf("failed to delete item and its secondary key: %w", err)
 	}
-	return nil
+	db.documentCache().invalidate(u)
+	return result, nil
 }
 
-// DropCollection removes all documents in a specified collection by prefix-scanning
-// and also removes their corresponding secondary keys (the trailing 16 bytes).
-func (db *DB) DropCollection(collection string) error {
-	return db.db.Update(func(txn *badger.Txn) error {
-		collectionPrefix := []byte(collection + ":")
-
-		it := txn.NewIterator(badger.DefaultIteratorOptions)
-		defer it.Close()
-
-		var deletionErr error
-
-		for it.Seek(collectionPrefix); it.ValidForPrefix(collectionPrefix); it.Next() {
-			item := it.Item()
-			primaryKey := item.KeyCopy(nil)
-
-			// The last 16 bytes should be the binary UUID part
-			if len(primaryKey) < len(collectionPrefix)+16 {
-				// Malformed or unexpected key format, skip
-				continue
-			}
-			uBytes := primaryKey[len(collectionPrefix):]
-
-			// Delete the secondary key first
-			if err := txn.Delete(uBytes); err != nil {
-				if err != badger.ErrKeyNotFound {
-					deletionErr = fmt.Errorf("failed to delete secondary key %x: %w", uBytes, err)
-					continue
-				}
-			}
+// getDocument reads and decodes the document stored at primaryKey within txn.
+// It returns ErrNotFound if the key does not exist.
+func (db *DB) getDocument(txn *badger.Txn, primaryKey []byte) (map[string]interface{}, error) {
+	doc, _, err := db.getDocumentSized(txn, primaryKey)
+	return doc, err
+}
 
-			// Delete the primary key
-			if err := txn.Delete(primaryKey); err != nil {
-				if err != badger.ErrKeyNotFound {
-					deletionErr = fmt.Errorf("failed to delete primary key %x: %w", primaryKey, err)
-				}
-			}
+// getDocumentSized is getDocument that also returns the size in bytes of the
+// encoded document.
+func (db *DB) getDocumentSized(txn *badger.Txn, primaryKey []byte) (map[string]interface{}, int, error) {
+	item, err := txn.Get(primaryKey)
+	if err != nil {
+		if err == badger.ErrKeyNotFound {
+			return nil, 0, ErrNotFound
 		}
+		return nil, 0, err
+	}
 
-		if deletionErr != nil {
-			return deletionErr
+	var doc map[string]interface{}
+	var size int
+	if err := item.Value(func(val []byte) error {
+		val, err := db.documentValue(txn, primaryKey, val)
+		if err != nil {
+			return err
 		}
-		return nil
-	})
+		size = len(val)
+		doc, err = db.decodeDocument(val)
+		return err
+	}); err != nil {
+		return nil, 0, err
+	}
+	return doc, size, nil
+}
+
+// DropCollection removes all documents in a specified collection by prefix-scanning
+// and also removes their corresponding secondary keys (the trailing 16 bytes) and
+// every auxiliary system key of the collection (metadata, indexes, views, ...).
+//
+// Deletion happens in batches of DefaultBatchSize documents so that large
+// collections never exceed Badger's transaction limits; use
+// DropCollectionWithOptions to tune the batch size or follow progress.
+func (db *DB) DropCollection(collection string) error {
+	return db.DropCollectionWithOptions(collection, DropOptions{})
 }
 
 // RecursiveGraphTraversal fetches a document by 'id', then recursively processes its fields
@@ -308,6 +594,9 @@ func (db *DB) DropCollection(collection string) error {
 //
 // Example scenario:
 //   - If a field is a UUID string, we fetch that doc and optionally repeat up to maxRecursive levels.
+//
+// Documents referenced many times are read once with the document cache, see
+// SetDocumentCache.
 func (db *DB) RecursiveGraphTraversal(id string, maxRecursive int) (map[string]interface{}, error) {
 	// Fetch the top-level document by secondary key
 	item, err := db.GetID(id)
@@ -315,7 +604,7 @@ func (db *DB) RecursiveGraphTraversal(id string, maxRecursive int) (map[string]i
 		return nil, err
 	}
 	if item == nil {
-		return nil, fmt.Errorf("no data found for ID %s", id)
+		return nil, fmt.Errorf("%w: no data found for ID %s", ErrNotFound, id)
 	}
 
 	// Recursively process the item with an initial depth of 0
@@ -0,0 +1,393 @@
+package marco
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// The MongoDB importer copies collections of a MongoDB deployment into marco
+// and can then follow its change stream to keep marco in sync until the
+// application is switched over. marco does not depend on a MongoDB driver:
+// the caller adapts its driver to MongoSource and MongoChangeStream, handing
+// documents over as Extended JSON (bson.MarshalExtJSON, canonical or relaxed).
+//
+// Documents are mapped to marco as follows:
+//
+//   - the document ID is a UUID derived from the collection and the MongoDB
+//     _id, so re-importing or applying a change overwrites the same document
+//   - _id is kept, an ObjectId becoming its hex string
+//   - dates become RFC3339 strings in UTC, which date operators accept
+//   - 32 and 64-bit integers, doubles and decimals become numbers; NaN and
+//     infinities, which JSON can't hold, become null
+//   - binary data becomes base64, except UUIDs (subtype 4) which become
+//     their string form
+//   - regular expressions become {"pattern": ..., "options": ...},
+//     timestamps a date, MinKey and MaxKey null
+
+// mongoIDNamespace is the UUID namespace of the IDs of imported documents.
+var mongoIDNamespace = uuid.MustParse("6b1e6f0c-5a7e-4a51-9a3c-2f4f0d3b8e21")
+
+// MongoSource reads the collections of a MongoDB database.
+type MongoSource interface {
+	// Documents calls fn with every document of a collection, as Extended
+	// JSON. An error returned by fn stops the scan and is returned.
+	Documents(ctx context.Context, collection string, fn func(doc []byte) error) error
+}
+
+// MongoChangeStream is a MongoDB change stream opened on the imported
+// collections, typically with fullDocument set to "updateLookup".
+type MongoChangeStream interface {
+	// Next blocks until the next change, or returns an error once ctx is
+	// done or the stream fails.
+	Next(ctx context.Context) (MongoChange, error)
+}
+
+// MongoChange is an event of a change stream.
+type MongoChange struct {
+	// Operation is the operationType: "insert", "update", "replace",
+	// "delete" or "drop". Other operations are ignored.
+	Operation string
+
+	// Collection is the collection changed (ns.coll).
+	Collection string
+
+	// DocumentKey is the _id of the changed document, as Extended JSON.
+	DocumentKey []byte
+
+	// FullDocument is the document after the change, as Extended JSON. It
+	// is required for inserts, updates and replaces.
+	FullDocument []byte
+
+	// ResumeToken is passed back through MongoImportOptions.OnChange, for
+	// the caller to store and resume the stream from after a restart.
+	ResumeToken []byte
+}
+
+// MongoImportOptions configures ImportMongo and TailMongo.
+type MongoImportOptions struct {
+	// Collections lists the MongoDB collections to import.
+	Collections []string
+
+	// Rename maps a MongoDB collection to a marco collection. Collections
+	// not in the map keep their name.
+	Rename map[string]string
+
+	// Progress, if set, is called every DefaultBatchSize documents imported
+	// in a collection, and once it is complete.
+	Progress func(collection string, imported int)
+
+	// OnChange, if set, is called after each change applied by TailMongo.
+	OnChange func(change MongoChange)
+}
+
+// MongoImportResult counts the documents imported in each marco collection.
+type MongoImportResult struct {
+	Documents map[string]int
+}
+
+// target returns the marco collection of a MongoDB collection.
+func (opts MongoImportOptions) target(collection string) string {
+	if renamed, ok := opts.Rename[collection]; ok {
+		return renamed
+	}
+	return collection
+}
+
+// imported reports whether a MongoDB collection is imported.
+func (opts MongoImportOptions) imported(collection string) bool {
+	for _, c := range opts.Collections {
+		if c == collection {
+			return true
+		}
+	}
+	return false
+}
+
+// ImportMongo copies the collections listed in opts from source, overwriting
+// documents imported before. Open the change stream given to TailMongo before
+// calling ImportMongo, so that no change made during the copy is missed.
+func (db *DB) ImportMongo(ctx context.Context, source MongoSource, opts MongoImportOptions) (MongoImportResult, error) {
+	result := MongoImportResult{Documents: make(map[string]int)}
+	if len(opts.Collections) == 0 {
+		return result, fmt.Errorf("no MongoDB collection to import")
+	}
+
+	for _, collection := range opts.Collections {
+		target := opts.target(collection)
+		if err := validateCollectionName(target); err != nil {
+			return result, err
+		}
+
+		count := 0
+		err := source.Documents(ctx, collection, func(raw []byte) error {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if err := db.putMongoDocument(target, raw); err != nil {
+				return err
+			}
+			count++
+			if opts.Progress != nil && count%DefaultBatchSize == 0 {
+				opts.Progress(collection, count)
+			}
+			return nil
+		})
+		result.Documents[target] = count
+		if err != nil {
+			return result, fmt.Errorf("failed to import MongoDB collection %s: %w", collection, err)
+		}
+		if opts.Progress != nil {
+			opts.Progress(collection, count)
+		}
+	}
+	return result, nil
+}
+
+// TailMongo applies the changes of a change stream to the collections listed
+// in opts until ctx is done or the stream fails, and returns the error that
+// stopped it. Changes are idempotent, so a stream opened before ImportMongo
+// may replay changes already copied.
+func (db *DB) TailMongo(ctx context.Context, changes MongoChangeStream, opts MongoImportOptions) error {
+	for {
+		change, err := changes.Next(ctx)
+		if err != nil {
+			return err
+		}
+		if !opts.imported(change.Collection) {
+			continue
+		}
+		if err := db.applyMongoChange(opts.target(change.Collection), change); err != nil {
+			return fmt.Errorf("failed to apply MongoDB %s on %s: %w", change.Operation, change.Collection, err)
+		}
+		if opts.OnChange != nil {
+			opts.OnChange(change)
+		}
+	}
+}
+
+// applyMongoChange applies one change to a marco collection.
+func (db *DB) applyMongoChange(collection string, change MongoChange) error {
+	switch change.Operation {
+	case "insert", "update", "replace":
+		if len(change.FullDocument) == 0 {
+			return fmt.Errorf("change has no full document; open the change stream with fullDocument: \"updateLookup\"")
+		}
+		return db.putMongoDocument(collection, change.FullDocument)
+	case "delete":
+		key, err := decodeExtendedJSON(change.DocumentKey)
+		if err != nil {
+			return err
+		}
+		id := key
+		if doc, ok := key.(map[string]interface{}); ok {
+			if _, hasID := doc["_id"]; hasID {
+				id = doc["_id"] // a documentKey holding the whole key document
+			}
+		}
+		return db.Delete(collection, mongoDocumentID(collection, id))
+	case "drop":
+		return db.DropCollection(collection)
+	}
+	return nil
+}
+
+// putMongoDocument stores a document given as Extended JSON.
+func (db *DB) putMongoDocument(collection string, raw []byte) error {
+	value, err := decodeExtendedJSON(raw)
+	if err != nil {
+		return err
+	}
+	doc, ok := value.(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("MongoDB document is not an object")
+	}
+	id, ok := doc["_id"]
+	if !ok {
+		return fmt.Errorf("MongoDB document has no _id")
+	}
+	_, err = db.Put(collection, mongoDocumentID(collection, id), doc)
+	return err
+}
+
+// mongoDocumentID derives the UUID of an imported document from its
+// collection and its converted MongoDB _id.
+func mongoDocumentID(collection string, id interface{}) string {
+	encoded, _ := json.Marshal(id) // keys of maps are sorted, so this is canonical
+	return uuid.NewSHA1(mongoIDNamespace, append([]byte(collection+"\x00"), encoded...)).String()
+}
+
+// decodeExtendedJSON decodes MongoDB Extended JSON and converts its type
+// wrappers ({"$oid": ...}, {"$date": ...}, ...) into marco values.
+func decodeExtendedJSON(raw []byte) (interface{}, error) {
+	var value interface{}
+	if err := json.Unmarshal(raw, &value); err != nil {
+		return nil, fmt.Errorf("invalid Extended JSON: %w", err)
+	}
+	return convertExtendedJSON(value)
+}
+
+// convertExtendedJSON converts the type wrappers found in a decoded Extended
+// JSON value.
+func convertExtendedJSON(value interface{}) (interface{}, error) {
+	switch v := value.(type) {
+	case []interface{}:
+		for i, elem := range v {
+			converted, err := convertExtendedJSON(elem)
+			if err != nil {
+				return nil, err
+			}
+			v[i] = converted
+		}
+		return v, nil
+	case map[string]interface{}:
+		if converted, ok, err := convertTypeWrapper(v); ok || err != nil {
+			return converted, err
+		}
+		for key, elem := range v {
+			converted, err := convertExtendedJSON(elem)
+			if err != nil {
+				return nil, err
+			}
+			v[key] = converted
+		}
+		return v, nil
+	}
+	return value, nil
+}
+
+// convertTypeWrapper converts an Extended JSON type wrapper. It reports false
+// for a regular document.
+func convertTypeWrapper(doc map[string]interface{}) (interface{}, bool, error) {
+	if len(doc) == 2 {
+		// Legacy forms: {"$binary": "<base64>", "$type": "<hex>"} and
+		// {"$regex": ..., "$options": ...}
+		if data, ok := doc["$binary"].(string); ok {
+			subType, _ := doc["$type"].(string)
+			value, err := convertBinary(data, subType)
+			return value, true, err
+		}
+		if pattern, ok := doc["$regex"].(string); ok {
+			options, _ := doc["$options"].(string)
+			return map[string]interface{}{"pattern": pattern, "options": options}, true, nil
+		}
+		return nil, false, nil
+	}
+	if len(doc) != 1 {
+		return nil, false, nil
+	}
+
+	for key, arg := range doc {
+		switch key {
+		case "$oid":
+			id, ok := arg.(string)
+			if !ok {
+				return nil, true, fmt.Errorf("invalid $oid %v", arg)
+			}
+			return id, true, nil
+		case "$date":
+			t, err := extendedJSONDate(arg)
+			if err != nil {
+				return nil, true, err
+			}
+			return t.UTC().Format(time.RFC3339Nano), true, nil
+		case "$numberInt", "$numberLong", "$numberDouble", "$numberDecimal":
+			s, ok := arg.(string)
+			if !ok {
+				return nil, true, fmt.Errorf("invalid %s %v", key, arg)
+			}
+			f, err := strconv.ParseFloat(s, 64)
+			if err != nil {
+				return nil, true, fmt.Errorf("invalid %s %q", key, s)
+			}
+			if math.IsNaN(f) || math.IsInf(f, 0) {
+				return nil, true, nil
+			}
+			return f, true, nil
+		case "$binary":
+			// Canonical form: {"$binary": {"base64": ..., "subType": ...}}
+			spec, ok := arg.(map[string]interface{})
+			if !ok {
+				return nil, true, fmt.Errorf("invalid $binary %v", arg)
+			}
+			data, _ := spec["base64"].(string)
+			subType, _ := spec["subType"].(string)
+			value, err := convertBinary(data, subType)
+			return value, true, err
+		case "$uuid":
+			id, ok := arg.(string)
+			if !ok {
+				return nil, true, fmt.Errorf("invalid $uuid %v", arg)
+			}
+			return id, true, nil
+		case "$regularExpression":
+			spec, ok := arg.(map[string]interface{})
+			if !ok {
+				return nil, true, fmt.Errorf("invalid $regularExpression %v", arg)
+			}
+			return map[string]interface{}{"pattern": spec["pattern"], "options": spec["options"]}, true, nil
+		case "$timestamp":
+			spec, ok := arg.(map[string]interface{})
+			seconds, isNumber := toFloat64(spec["t"])
+			if !ok || !isNumber {
+				return nil, true, fmt.Errorf("invalid $timestamp %v", arg)
+			}
+			return time.Unix(int64(seconds), 0).UTC().Format(time.RFC3339Nano), true, nil
+		case "$minKey", "$maxKey", "$undefined":
+			return nil, true, nil
+		case "$symbol", "$code":
+			return arg, true, nil
+		}
+	}
+	return nil, false, nil
+}
+
+// extendedJSONDate decodes the argument of $date: an ISO-8601 string
+// (relaxed form), epoch milliseconds, or {"$numberLong": "<millis>"}
+// (canonical form).
+func extendedJSONDate(arg interface{}) (time.Time, error) {
+	switch v := arg.(type) {
+	case string:
+		t, err := time.Parse(time.RFC3339Nano, v)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("invalid $date %q", v)
+		}
+		return t, nil
+	case float64:
+		return time.UnixMilli(int64(v)), nil
+	case map[string]interface{}:
+		if s, ok := v["$numberLong"].(string); ok {
+			millis, err := strconv.ParseInt(s, 10, 64)
+			if err == nil {
+				return time.UnixMilli(millis), nil
+			}
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid $date %v", arg)
+}
+
+// convertBinary converts binary data: UUIDs (subtype 4) become their string
+// form, anything else stays base64.
+func convertBinary(data, subType string) (interface{}, error) {
+	if subType == "04" || subType == "4" {
+		raw, err := base64.StdEncoding.DecodeString(data)
+		if err != nil {
+			return nil, fmt.Errorf("invalid $binary data: %w", err)
+		}
+		u, err := uuid.FromBytes(raw)
+		if err != nil {
+			return nil, fmt.Errorf("invalid UUID in $binary: %w", err)
+		}
+		return u.String(), nil
+	}
+	if _, err := base64.StdEncoding.DecodeString(data); err != nil {
+		return nil, fmt.Errorf("invalid $binary data: %w", err)
+	}
+	return data, nil
+}
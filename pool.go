@@ -0,0 +1,86 @@
+package marco
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"sync"
+)
+
+// Pools of the scratch objects of the read and write paths, which would
+// otherwise be allocated for every document.
+//
+// Decoding a document allocates mostly the decoded values themselves, which
+// the caller keeps, so only what is discarded once the document is decoded
+// is pooled: buffers, gzip state and the raw fields read by decodeFields.
+// json.Unmarshal does not allocate more than a reused json.Decoder, which
+// copies its input and is slower, so JSON decoders are not pooled.
+
+// maxPooledBufferSize is the capacity above which buffers are dropped rather
+// than pooled, so that one large document does not pin its memory.
+const maxPooledBufferSize = 1 << 20
+
+var bufferPool = sync.Pool{
+	New: func() interface{} { return new(bytes.Buffer) },
+}
+
+// getBuffer returns an empty buffer from the pool.
+func getBuffer() *bytes.Buffer {
+	buf := bufferPool.Get().(*bytes.Buffer)
+	buf.Reset()
+	return buf
+}
+
+// putBuffer returns buf to the pool. buf must no longer be used.
+func putBuffer(buf *bytes.Buffer) {
+	if buf.Cap() <= maxPooledBufferSize {
+		bufferPool.Put(buf)
+	}
+}
+
+// bufferBytes returns a copy of the content of buf, sized to fit. Only
+// values that outlive buf, such as values written to Badger, are copied.
+func bufferBytes(buf *bytes.Buffer) []byte {
+	return append(make([]byte, 0, buf.Len()), buf.Bytes()...)
+}
+
+// gzipWriterPool holds gzip writers, whose compression state takes hundreds
+// of kilobytes.
+var gzipWriterPool = sync.Pool{
+	New: func() interface{} { return gzip.NewWriter(io.Discard) },
+}
+
+// gzipReaderPool holds gzip readers. gzip.Reader has no constructor that
+// does not read a header, so the pool starts empty.
+var gzipReaderPool sync.Pool
+
+// getGzipReader returns a gzip reader of r, from the pool if possible.
+func getGzipReader(r io.Reader) (*gzip.Reader, error) {
+	if zr, ok := gzipReaderPool.Get().(*gzip.Reader); ok {
+		if err := zr.Reset(r); err != nil {
+			return nil, err
+		}
+		return zr, nil
+	}
+	return gzip.NewReader(r)
+}
+
+// rawFieldsPool holds the maps decodeFields reads the raw fields of a
+// document into.
+var rawFieldsPool = sync.Pool{
+	New: func() interface{} { return make(map[string]json.RawMessage) },
+}
+
+// getRawFields returns an empty map from the pool.
+func getRawFields() map[string]json.RawMessage {
+	return rawFieldsPool.Get().(map[string]json.RawMessage)
+}
+
+// putRawFields empties raw and returns it to the pool.
+func putRawFields(raw map[string]json.RawMessage) {
+	for field := range raw {
+		delete(raw, field)
+	}
+	rawFieldsPool.Put(raw)
+}
@@ -0,0 +1,127 @@
+package marco
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"testing"
+
+	"github.com/dgraph-io/badger/v3"
+)
+
+// The benchmarks of the read path scan a collection of -marco.docs documents,
+// e.g. go test -run - -bench Scan -benchmem -marco.docs 1000000.
+var benchmarkDocs = flag.Int("marco.docs", 10000, "documents in the collections of the benchmarks")
+
+// benchmarkDB opens an in-memory database holding the collection "bench", of
+// *benchmarkDocs documents written with codec, and returns their IDs.
+func benchmarkDB(b *testing.B, codec CollectionCodec) (*DB, []string) {
+	b.Helper()
+	db := openTestDB(b, nil)
+	if err := db.SetCollectionCodec("bench", codec); err != nil {
+		b.Fatal(err)
+	}
+	ids := make([]string, *benchmarkDocs)
+	for i := range ids {
+		id, err := db.Put("bench", "", benchmarkDocument(i))
+		if err != nil {
+			b.Fatal(err)
+		}
+		ids[i] = id
+	}
+	return db, ids
+}
+
+// benchmarkDocument returns document i of the benchmarks.
+func benchmarkDocument(i int) map[string]interface{} {
+	return map[string]interface{}{
+		"name":   fmt.Sprintf("user%d", i),
+		"age":    i % 90,
+		"active": i%3 == 0,
+		"tags":   []interface{}{"a", "b", "c"},
+		"address": map[string]interface{}{
+			"city": fmt.Sprintf("city%d", i%100),
+			"zip":  fmt.Sprintf("%05d", i),
+		},
+	}
+}
+
+var benchmarkCodecs = map[string]CollectionCodec{
+	"json":      {},
+	"json+gzip": {Compression: "gzip"},
+}
+
+func BenchmarkCollectionScan(b *testing.B) {
+	for name, codec := range benchmarkCodecs {
+		b.Run(name, func(b *testing.B) {
+			db, _ := benchmarkDB(b, codec)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				docs, err := db.Collection("bench")
+				if err != nil {
+					b.Fatal(err)
+				}
+				if len(docs) != *benchmarkDocs {
+					b.Fatalf("got %d documents, want %d", len(docs), *benchmarkDocs)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkQueryScan(b *testing.B) {
+	db, _ := benchmarkDB(b, CollectionCodec{})
+	const pipeline = `[{"$match": {"active": true}}, {"$project": {"name": 1, "address.city": 1}}]`
+	for _, engine := range []ExecutionEngine{EngineLegacy, EngineOptimized} {
+		b.Run(engine.String(), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, _, err := db.QueryWithOptions(context.Background(), "bench", pipeline, QueryOptions{Engine: engine}); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkGet(b *testing.B) {
+	for name, codec := range benchmarkCodecs {
+		b.Run(name, func(b *testing.B) {
+			db, ids := benchmarkDB(b, codec)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := db.Get("bench", ids[i%len(ids)]); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkDecodeDocument(b *testing.B) {
+	db := openTestDB(b, nil)
+	for name, codec := range benchmarkCodecs {
+		b.Run(name, func(b *testing.B) {
+			if err := db.SetCollectionCodec(name, codec); err != nil {
+				b.Fatal(err)
+			}
+			var val []byte
+			if err := db.db.View(func(txn *badger.Txn) error {
+				var err error
+				val, err = db.encodeDocument(txn, name, benchmarkDocument(1))
+				return err
+			}); err != nil {
+				b.Fatal(err)
+			}
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := db.decodeDocument(val); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
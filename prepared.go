@@ -0,0 +1,183 @@
+package marco
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// PreparedPipeline is an aggregation pipeline parsed and validated once by
+// Prepare, to be run many times. It is safe for concurrent use.
+type PreparedPipeline struct {
+	db       *DB
+	pipeline string
+	stages   []AggregationStage
+	bound    []bool // stages with parameters, validated once bound
+}
+
+// Prepare parses and validates an aggregation pipeline, which can then be run
+// against any collection without parsing it again:
+//
+//	byStatus, err := db.Prepare(`[{"$match": {"status": {"$param": "status"}}}, {"$limit": {"$param": "n"}}]`)
+//	if err != nil {
+//		return err
+//	}
+//	paid, err := byStatus.Query("orders", map[string]interface{}{"status": "paid", "n": 10})
+//
+// {"$param": "name"} anywhere in the pipeline is a parameter, replaced by the
+// value bound to name when the pipeline runs. The stages with parameters are
+// validated once their values are bound.
+func (db *DB) Prepare(pipeline string) (*PreparedPipeline, error) {
+	stages, err := decodeAggregationStages(pipeline)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing aggregation stages: %w", err)
+	}
+	p := &PreparedPipeline{db: db, pipeline: pipeline, stages: stages, bound: make([]bool, len(stages))}
+	for i, stage := range stages {
+		if hasParams(stage.Params) {
+			p.bound[i] = true
+			continue
+		}
+		if err := db.validatePipelineStage(context.Background(), i, stage); err != nil {
+			return nil, fmt.Errorf("error parsing aggregation stages: %w", err)
+		}
+	}
+	return p, nil
+}
+
+// Query runs the pipeline on a collection with the parameter values
+// 'params', which may be nil for a pipeline without parameters.
+func (p *PreparedPipeline) Query(collection string, params map[string]interface{}) ([]map[string]interface{}, error) {
+	results, _, err := p.QueryWithOptions(context.Background(), collection, params, QueryOptions{})
+	return results, err
+}
+
+// QueryWithOptions is Query with a context and per-query options, as with
+// DB.QueryWithOptions.
+func (p *PreparedPipeline) QueryWithOptions(ctx context.Context, collection string, params map[string]interface{}, opts QueryOptions) ([]map[string]interface{}, *QueryStats, error) {
+	start := time.Now()
+	stats := &QueryStats{Collection: collection}
+
+	var results []map[string]interface{}
+	stages, err := p.bind(ctx, params)
+	if err == nil {
+		results, err = p.db.queryStages(ctx, collection, p.pipeline, stages, opts, stats)
+	}
+	stats.Duration = time.Since(start)
+
+	if ql := p.db.sampledQueryLog(); ql != nil {
+		ql.log(collection, p.pipeline, start, len(results), err)
+	}
+	return results, stats, err
+}
+
+// bind returns the stages of the pipeline with the parameters replaced by
+// their values, validating the stages that had parameters.
+func (p *PreparedPipeline) bind(ctx context.Context, params map[string]interface{}) ([]AggregationStage, error) {
+	stages := p.stages
+	copied := false
+	for i, stage := range p.stages {
+		if !p.bound[i] {
+			continue
+		}
+		if !copied {
+			// The prepared stages are shared by concurrent queries
+			stages = append([]AggregationStage(nil), p.stages...)
+			copied = true
+		}
+		bound, err := bindParams(stage.Params, params)
+		if err != nil {
+			return nil, fmt.Errorf("error in %s stage: %w", stage.Stage, err)
+		}
+		// {"$limit": {"$param": "n"}} binds the scalar parameter of the stage
+		if _, whole := paramName(stage.Params); whole {
+			bound, err = stageParams(stage.Stage, bound)
+			if err != nil {
+				return nil, fmt.Errorf("error parsing aggregation stages: %w", invalidStage(i, stage.Stage, err))
+			}
+		}
+		stages[i].Params = bound.(map[string]interface{})
+		if err := p.db.validatePipelineStage(ctx, i, stages[i]); err != nil {
+			return nil, fmt.Errorf("error parsing aggregation stages: %w", err)
+		}
+	}
+	return stages, nil
+}
+
+// paramName returns the name of the parameter 'value' stands for, if it is
+// one: {"$param": "name"}.
+func paramName(value interface{}) (string, bool) {
+	m, ok := value.(map[string]interface{})
+	if !ok || len(m) != 1 {
+		return "", false
+	}
+	name, ok := m["$param"].(string)
+	return name, ok
+}
+
+// hasParams reports whether value contains a parameter.
+func hasParams(value interface{}) bool {
+	if _, ok := paramName(value); ok {
+		return true
+	}
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for _, item := range v {
+			if hasParams(item) {
+				return true
+			}
+		}
+	case []interface{}:
+		for _, item := range v {
+			if hasParams(item) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// bindParams returns a copy of value with the parameters replaced by their
+// values in params.
+func bindParams(value interface{}, params map[string]interface{}) (interface{}, error) {
+	if name, ok := paramName(value); ok {
+		bound, ok := params[name]
+		if !ok {
+			return nil, fmt.Errorf("no value bound to parameter %q", name)
+		}
+		// Values are given the types of decoded JSON, e.g. numbers are float64
+		encoded, err := json.Marshal(bound)
+		if err != nil {
+			return nil, fmt.Errorf("parameter %q: %w", name, err)
+		}
+		var decoded interface{}
+		if err := json.Unmarshal(encoded, &decoded); err != nil {
+			return nil, fmt.Errorf("parameter %q: %w", name, err)
+		}
+		return decoded, nil
+	}
+	switch v := value.(type) {
+	case map[string]interface{}:
+		copied := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			bound, err := bindParams(item, params)
+			if err != nil {
+				return nil, err
+			}
+			copied[key] = bound
+		}
+		return copied, nil
+	case []interface{}:
+		copied := make([]interface{}, len(v))
+		for i, item := range v {
+			bound, err := bindParams(item, params)
+			if err != nil {
+				return nil, err
+			}
+			copied[i] = bound
+		}
+		return copied, nil
+	}
+	return value, nil
+}
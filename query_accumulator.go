@@ -0,0 +1,199 @@
+package marco
+
+import (
+	"context"
+	"fmt"
+)
+
+// Accumulator is a custom $group accumulator written in Go. The state it
+// carries between calls may be any value. Arguments are evaluated like the
+// rest of the pipeline: numbers are float64, documents
+// map[string]interface{} and arrays []interface{}.
+type Accumulator interface {
+	// Init returns the initial state of a group, given the evaluated
+	// initArgs.
+	Init(args ...interface{}) (interface{}, error)
+
+	// Accumulate adds a document, given as its evaluated accumulateArgs, to
+	// the state and returns the new state.
+	Accumulate(state interface{}, args ...interface{}) (interface{}, error)
+
+	// Merge combines the states of two parts of a group accumulated
+	// separately and returns the combined state.
+	Merge(state, other interface{}) (interface{}, error)
+
+	// Finalize turns the state of a group into the value of the field. Its
+	// result may be any value encodable as JSON.
+	Finalize(state interface{}) (interface{}, error)
+}
+
+// RegisterAccumulator makes 'acc' available to $group under 'name':
+//
+//	db.RegisterAccumulator("median", medianAccumulator{})
+//
+//	db.Query("orders", `[{"$group": {"_id": "$city", "median": {"$accumulator": {"name": "median", "accumulateArgs": ["$price"], "lang": "go"}}}}]`)
+//
+// initArgs, if present, are evaluated against the first document of the
+// group, and accumulateArgs against each document. lang, if present, must be
+// "go". Registering a name again replaces the previous accumulator; a nil
+// accumulator removes it. JavaScript accumulators are not supported.
+func (db *DB) RegisterAccumulator(name string, acc Accumulator) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if acc == nil {
+		delete(db.accumulators, name)
+		return
+	}
+	if db.accumulators == nil {
+		db.accumulators = make(map[string]Accumulator)
+	}
+	db.accumulators[name] = acc
+}
+
+// registeredAccumulator returns the accumulator registered under 'name', or
+// nil.
+func (db *DB) registeredAccumulator(name string) Accumulator {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return db.accumulators[name]
+}
+
+// accumulatorSpec is the parsed argument of $accumulator.
+type accumulatorSpec struct {
+	name           string
+	initArgs       []interface{}
+	accumulateArgs []interface{}
+}
+
+// parseAccumulatorSpec checks the argument of $accumulator: { name: <string>,
+// initArgs: [ <expr>, ... ], accumulateArgs: [ <expr>, ... ], lang: "go" }.
+func parseAccumulatorSpec(arg interface{}) (*accumulatorSpec, error) {
+	params, ok := arg.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("$accumulator expects an object with name and accumulateArgs, got %T", arg)
+	}
+	spec := &accumulatorSpec{}
+	for field, value := range params {
+		switch field {
+		case "name":
+			name, ok := value.(string)
+			if !ok || name == "" {
+				return nil, fmt.Errorf("$accumulator name must be the name of a registered accumulator, got %v", value)
+			}
+			spec.name = name
+		case "initArgs", "accumulateArgs":
+			exprs, ok := value.([]interface{})
+			if !ok {
+				return nil, fmt.Errorf("$accumulator %s must be an array, got %T", field, value)
+			}
+			for _, expr := range exprs {
+				if err := validateExpression(expr); err != nil {
+					return nil, fmt.Errorf("$accumulator %s: %w", field, err)
+				}
+			}
+			if field == "initArgs" {
+				spec.initArgs = exprs
+			} else {
+				spec.accumulateArgs = exprs
+			}
+		case "lang":
+			if value != "go" {
+				return nil, fmt.Errorf("$accumulator only supports lang \"go\", got %v", value)
+			}
+		case "init", "accumulate", "merge", "finalize":
+			return nil, fmt.Errorf("$accumulator %s: JavaScript accumulators are not supported, use name with an accumulator registered by RegisterAccumulator", field)
+		default:
+			return nil, fmt.Errorf("$accumulator has unknown field %q", field)
+		}
+	}
+	if spec.name == "" {
+		return nil, fmt.Errorf("$accumulator is missing required field: name")
+	}
+	return spec, nil
+}
+
+// compileCustomAccumulator implements the $accumulator accumulator with the
+// accumulator registered under the name of its argument.
+func (db *DB) compileCustomAccumulator(ctx context.Context, arg interface{}) (func() groupAccumulator, error) {
+	spec, err := parseAccumulatorSpec(arg)
+	if err != nil {
+		return nil, err
+	}
+	acc := db.registeredAccumulator(spec.name)
+	if acc == nil {
+		return nil, fmt.Errorf("$accumulator %q is not registered", spec.name)
+	}
+	return func() groupAccumulator {
+		return &customAccumulator{db: db, ctx: ctx, spec: spec, acc: acc}
+	}, nil
+}
+
+// customAccumulator is the state of a group for a registered accumulator.
+// Init is called with the first document of the group.
+type customAccumulator struct {
+	db          *DB
+	ctx         context.Context
+	spec        *accumulatorSpec
+	acc         Accumulator
+	state       interface{}
+	initialized bool
+}
+
+func (a *customAccumulator) init(doc map[string]interface{}) error {
+	initArgs, err := a.db.evaluateArgs(a.ctx, doc, a.spec.initArgs)
+	if err != nil {
+		return fmt.Errorf("$accumulator initArgs: %w", err)
+	}
+	if a.state, err = a.acc.Init(initArgs...); err != nil {
+		return fmt.Errorf("$accumulator %q init: %w", a.spec.name, err)
+	}
+	a.initialized = true
+	return nil
+}
+
+func (a *customAccumulator) add(doc map[string]interface{}) error {
+	if !a.initialized {
+		if err := a.init(doc); err != nil {
+			return err
+		}
+	}
+	args, err := a.db.evaluateArgs(a.ctx, doc, a.spec.accumulateArgs)
+	if err != nil {
+		return fmt.Errorf("$accumulator accumulateArgs: %w", err)
+	}
+	if a.state, err = a.acc.Accumulate(a.state, args...); err != nil {
+		return fmt.Errorf("$accumulator %q accumulate: %w", a.spec.name, err)
+	}
+	return nil
+}
+
+func (a *customAccumulator) result() (interface{}, error) {
+	if !a.initialized {
+		if err := a.init(nil); err != nil {
+			return nil, err
+		}
+	}
+	result, err := a.acc.Finalize(a.state)
+	if err != nil {
+		return nil, fmt.Errorf("$accumulator %q finalize: %w", a.spec.name, err)
+	}
+	result, err = decodedValue(result)
+	if err != nil {
+		return nil, fmt.Errorf("$accumulator %q returned a value that can't be encoded: %v", a.spec.name, err)
+	}
+	return result, nil
+}
+
+// evaluateArgs evaluates the expressions 'exprs' against doc.
+func (db *DB) evaluateArgs(ctx context.Context, doc map[string]interface{}, exprs []interface{}) ([]interface{}, error) {
+	args := make([]interface{}, len(exprs))
+	for i, expr := range exprs {
+		value, err := db.evaluate(ctx, doc, expr)
+		if err != nil {
+			return nil, err
+		}
+		args[i] = value
+	}
+	return args, nil
+}
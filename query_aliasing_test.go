@@ -0,0 +1,179 @@
+package marco
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/dgraph-io/badger/v3"
+)
+
+// Stages share the documents they don't modify between their input and
+// their output (copy-on-write, see cloneDocument). These tests modify the
+// documents a stage outputs, or run a stage that sets fields, and check that
+// no other document changes.
+
+// openTestDB opens an in-memory database holding the documents of 'data',
+// by collection.
+func openTestDB(t testing.TB, data map[string][]string) *DB {
+	t.Helper()
+	db, err := Open(badger.DefaultOptions("").WithInMemory(true).WithLogger(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	for collection, docs := range data {
+		for _, doc := range docs {
+			if _, err := db.Put(collection, "", testDocument(t, doc)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	return db
+}
+
+// testDocument decodes a JSON document.
+func testDocument(t testing.TB, doc string) map[string]interface{} {
+	t.Helper()
+	var m map[string]interface{}
+	if err := json.Unmarshal([]byte(doc), &m); err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+// lookupMatches returns the documents $lookup stored in the field 'as' of doc.
+func lookupMatches(t *testing.T, doc map[string]interface{}, as string) []map[string]interface{} {
+	t.Helper()
+	switch matches := doc[as].(type) {
+	case []map[string]interface{}:
+		return matches
+	case []interface{}:
+		docs := make([]map[string]interface{}, len(matches))
+		for i, match := range matches {
+			docs[i] = match.(map[string]interface{})
+		}
+		return docs
+	}
+	t.Fatalf("%s holds %T, not the matches of $lookup", as, doc[as])
+	return nil
+}
+
+func TestLookupMatchesAreNotShared(t *testing.T) {
+	db := openTestDB(t, map[string][]string{
+		"orders": {`{"sku": "a", "qty": 1}`, `{"sku": "a", "qty": 2}`},
+		"items":  {`{"sku": "a", "details": {"color": "red"}}`},
+	})
+	lookup := `{"$lookup": {"from": "items", "localField": "sku", "foreignField": "sku", "as": "item"}}`
+
+	results, err := db.Query("orders", `[`+lookup+`]`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 2 {
+		t.Fatalf("got %d results, want 2", len(results))
+	}
+	first := lookupMatches(t, results[0], "item")[0]
+	first["details"].(map[string]interface{})["color"] = "blue"
+	first["sku"] = "b"
+	second := lookupMatches(t, results[1], "item")[0]
+	if want := testDocument(t, `{"color": "red"}`); !reflect.DeepEqual(second["details"], want) || second["sku"] != "a" {
+		t.Errorf("modifying the match of one order changed the match of the other: %v", second)
+	}
+
+	// $lookup followed by an $unwind of its matches
+	results, err = db.Query("orders", `[`+lookup+`, {"$unwind": "$item"}]`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 2 {
+		t.Fatalf("got %d results, want 2", len(results))
+	}
+	results[0]["item"].(map[string]interface{})["details"].(map[string]interface{})["color"] = "blue"
+	details := results[1]["item"].(map[string]interface{})["details"]
+	if want := testDocument(t, `{"color": "red"}`); !reflect.DeepEqual(details, want) {
+		t.Errorf("modifying the unwound match of one order changed the other: %v", details)
+	}
+}
+
+func TestAddFieldsLeavesItsInputUnchanged(t *testing.T) {
+	db := openTestDB(t, nil)
+	ctx := context.Background()
+
+	t.Run("after $replaceRoot", func(t *testing.T) {
+		input := []map[string]interface{}{testDocument(t, `{"_id": 1, "inner": {"a": 1}}`)}
+		roots, err := db.replaceRootStage(ctx, input, testDocument(t, `{"newRoot": "$inner"}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		output, err := db.addFieldsStage(ctx, roots, testDocument(t, `{"b": 2, "a": 3}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := testDocument(t, `{"a": 3, "b": 2}`); !reflect.DeepEqual(output[0], want) {
+			t.Errorf("got %v, want %v", output[0], want)
+		}
+		if want := testDocument(t, `{"_id": 1, "inner": {"a": 1}}`); !reflect.DeepEqual(input[0], want) {
+			t.Errorf("$addFields changed the document $replaceRoot read: %v", input[0])
+		}
+	})
+
+	t.Run("after $facet", func(t *testing.T) {
+		input := []map[string]interface{}{testDocument(t, `{"_id": 1, "a": 1}`)}
+		facets := db.facetStage(ctx, input, testDocument(t, `{"x": [{"$match": {"_id": 1}}], "y": [{"$match": {"_id": 1}}]}`))
+		xs := db.unwindStage(facets, testDocument(t, `{"path": "$x"}`))
+		docs, err := db.replaceRootStage(ctx, xs, testDocument(t, `{"newRoot": "$x"}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := db.addFieldsStage(ctx, docs, testDocument(t, `{"a": 2, "b": 2}`)); err != nil {
+			t.Fatal(err)
+		}
+		want := testDocument(t, `{"_id": 1, "a": 1}`)
+		if !reflect.DeepEqual(input[0], want) {
+			t.Errorf("$addFields changed the input of $facet: %v", input[0])
+		}
+		ys := lookupMatches(t, facets[0], "y")
+		if !reflect.DeepEqual(ys[0], want) {
+			t.Errorf("$addFields on facet x changed facet y: %v", ys[0])
+		}
+	})
+}
+
+func TestUnwindOutputsDoNotShareModifiedDocuments(t *testing.T) {
+	db := openTestDB(t, nil)
+	ctx := context.Background()
+	const doc = `{"_id": 1, "tags": [{"name": "a", "score": 1}, {"name": "b", "score": 2}], "meta": {"owner": "x", "rev": 1}}`
+	input := []map[string]interface{}{testDocument(t, doc)}
+
+	unwound := db.unwindStage(input, testDocument(t, `{"path": "$tags"}`))
+	if len(unwound) != 2 {
+		t.Fatalf("got %d documents, want 2", len(unwound))
+	}
+
+	// Exclude nested fields from the first output only
+	projected, err := db.projectStage(ctx, unwound[:1], testDocument(t, `{"meta.rev": 0, "tags.score": 0}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := testDocument(t, `{"_id": 1, "tags": {"name": "a"}, "meta": {"owner": "x"}}`); !reflect.DeepEqual(projected[0], want) {
+		t.Errorf("got %v, want %v", projected[0], want)
+	}
+	if want := testDocument(t, `{"owner": "x", "rev": 1}`); !reflect.DeepEqual(unwound[1]["meta"], want) {
+		t.Errorf("projecting one $unwind output changed another: %v", unwound[1]["meta"])
+	}
+
+	// Set fields on every output
+	if _, err := db.addFieldsStage(ctx, unwound, testDocument(t, `{"meta": "$tags.name", "tags": 0}`)); err != nil {
+		t.Fatal(err)
+	}
+	for i, name := range []string{"a", "b"} {
+		if tag := unwound[i]["tags"].(map[string]interface{}); tag["name"] != name || tag["score"] == nil {
+			t.Errorf("output %d of $unwind changed: %v", i, unwound[i])
+		}
+	}
+	if want := testDocument(t, doc); !reflect.DeepEqual(input[0], want) {
+		t.Errorf("the input of $unwind changed: %v", input[0])
+	}
+}
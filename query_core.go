@@ -1,10 +1,11 @@
 package marco
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
-	"log"
 	"strings"
+	"time"
 )
 
 // AggregationStage represents a single stage in the MongoDB aggregation pipeline
@@ -18,100 +19,202 @@ func (db *DB) Query(
 	collectionName string, // The target collection name
 	mongoAggregationPipeline string, // The aggregation pipeline in JSON format
 ) ([]map[string]interface{}, error) {
+	return db.QueryContext(context.Background(), collectionName, mongoAggregationPipeline)
+}
+
+// QueryContext is Query with a context. The context is passed to pipeline
+// middleware and $where predicates, so values such as tenant or trace IDs are
+// available where policies are enforced. The query stops between stages once
+// the context is done.
+//
+// A query reads all its collections, including those joined by $lookup, in
+// one read transaction: results are consistent with a single point in time,
+// whatever is written while the query runs. QueryWithOptions can read them
+// with ReadCommitted instead.
+func (db *DB) QueryContext(ctx context.Context, collectionName string, mongoAggregationPipeline string) ([]map[string]interface{}, error) {
+	results, _, err := db.QueryWithOptions(ctx, collectionName, mongoAggregationPipeline, QueryOptions{})
+	return results, err
+}
+
+// QueryWithOptions is QueryContext with per-query options. It also returns
+// statistics on the execution of each stage, including the documents traced
+// with QueryOptions.TraceDocs.
+func (db *DB) QueryWithOptions(ctx context.Context, collectionName string, mongoAggregationPipeline string, opts QueryOptions) ([]map[string]interface{}, *QueryStats, error) {
+	start := time.Now()
+	stats := &QueryStats{Collection: collectionName}
+
+	results, err := db.query(ctx, collectionName, mongoAggregationPipeline, opts, stats)
+	stats.Duration = time.Since(start)
 
+	// Report the query to the structured query log, if enabled and sampled
+	if ql := db.sampledQueryLog(); ql != nil {
+		ql.log(collectionName, mongoAggregationPipeline, start, len(results), err)
+	}
+	return results, stats, err
+}
+
+// query runs an aggregation pipeline on a collection, filling stats.
+func (db *DB) query(ctx context.Context, collectionName string, mongoAggregationPipeline string, opts QueryOptions, stats *QueryStats) ([]map[string]interface{}, error) {
 	// Parse the aggregation stages using JSON parsing
-	stages, err := db.parseAggregationStagesJSON(mongoAggregationPipeline)
+	stages, err := db.parseAggregationStagesJSON(ctx, mongoAggregationPipeline)
 	if err != nil {
-		return nil, fmt.Errorf("error parsing aggregation stages: %v", err)
+		return nil, fmt.Errorf("error parsing aggregation stages: %w", err)
+	}
+	return db.queryStages(ctx, collectionName, mongoAggregationPipeline, stages, opts, stats)
+}
+
+// queryStages runs the parsed stages of the pipeline mongoAggregationPipeline
+// on a collection, filling stats.
+func (db *DB) queryStages(ctx context.Context, collectionName string, mongoAggregationPipeline string, stages []AggregationStage, opts QueryOptions, stats *QueryStats) ([]map[string]interface{}, error) {
+
+	// Every stage sees the same $$NOW
+	ctx = withQueryNow(ctx)
+	ctx = withMemoryBudget(ctx, db.queryMemoryLimit(opts))
+
+	if opts.AllowDiskUse {
+		var spill *diskSpill
+		ctx, spill = db.withDiskSpill(ctx, opts.SpillThreshold)
+		defer func() {
+			stats.DocsSpilled = spill.spilled()
+			if err := spill.release(); err != nil {
+				db.logf(LogError, "Error deleting the documents spilled to disk: %v", err)
+			}
+		}()
+	}
+
+	// Pipelines that only filter, sort and page do not need the whole collection
+	// in memory; stream it and stop reading as soon as the page is complete.
+	// Middleware and tracing must see every stage, so the shortcut is only taken without them.
+	tracing := opts.TraceDocs > 0
+	stats.Isolation = opts.Isolation
+	stats.Engine = db.queryEngine(opts)
+	var shadow *shadowExecution
+	if stats.Engine == EngineOptimized {
+		shadow = db.sampledShadow()
+	}
+	if opts.ProfileExpressions > 0 {
+		var profile *exprProfile
+		ctx, profile = withExprProfile(ctx, opts.ProfileExpressions)
+		defer func() { stats.Expressions = profile.report() }()
+	}
+	// A sorted window too large for the memory limit is sorted on disk by the
+	// streaming engine when the query may use it
+	if plan, ok := planWindowedScan(stages); ok && stats.Engine == EngineOptimized && !db.hasPipelineMiddleware() && !tracing && !opts.IncludeArchived && !(plan.sort != nil && opts.AllowDiskUse) {
+		stats.Shortcut = "windowedScan"
+		results, err := db.executeWindowedScan(ctx, collectionName, stages, plan, opts.Isolation, stats)
+		if err == nil && shadow != nil {
+			shadow.run(ctx, db, collectionName, mongoAggregationPipeline, stages, nil, opts.Isolation, results)
+		}
+		return results, err
+	}
+
+	// Counting the documents of the collection only needs its keys
+	if field, ok := planKeyCount(stages); ok && stats.Engine == EngineOptimized && !db.hasPipelineMiddleware() && !tracing && !opts.IncludeArchived {
+		stats.Shortcut = "keyCount"
+		count, err := db.countKeys(ctx, collectionName, opts.Isolation, stats)
+		if err != nil {
+			return nil, err
+		}
+		// $count outputs no document when there is nothing to count
+		var results []map[string]interface{}
+		if count > 0 {
+			results = []map[string]interface{}{{field: count}}
+		}
+		if shadow != nil {
+			shadow.run(ctx, db, collectionName, mongoAggregationPipeline, stages, nil, opts.Isolation, results)
+		}
+		return results, nil
+	}
+
+	// The optimized engine reads the collection one document at a time when
+	// nothing needs all of it: shadow execution, the archive and a $lookup
+	// from the queried collection itself do
+	if stats.Engine == EngineOptimized && !db.hasPipelineMiddleware() && !tracing && !opts.IncludeArchived && shadow == nil && !pipelineLooksUp(stages, collectionName) {
+		return db.streamCollection(ctx, collectionName, stages, opts.Isolation, stats)
 	}
 
 	// Retrieve the specified collection
-	// Start with a copy of  documents from the specified collection
-	stageInput, _ := db.Collection(collectionName)
+	ctx, stageInput, err := db.loadPipelineInput(ctx, collectionName, stages, opts.Isolation)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { stats.SnapshotHeld = releaseQuerySnapshot(ctx) }()
+	if opts.IncludeArchived {
+		archived, err := db.snapshotArchivedDocuments(ctx, collectionName)
+		if err != nil {
+			return nil, err
+		}
+		stageInput = append(stageInput, archived...)
+	}
+	stats.DocsLoaded = len(stageInput)
+
+	// Stages may modify their input documents: the legacy engine gets a copy
+	var shadowInput []map[string]interface{}
+	if shadow != nil {
+		shadowInput = cloneDocuments(stageInput)
+	}
+	results, err := db.runStages(ctx, stages, stageInput, opts, stats)
+	if err == nil && shadow != nil {
+		shadow.run(ctx, db, collectionName, mongoAggregationPipeline, stages, shadowInput, opts.Isolation, results)
+	}
+	return results, err
+}
+
+// runStages runs the stages of a pipeline on its input documents, appending
+// the statistics of each stage to stats.
+func (db *DB) runStages(ctx context.Context, stages []AggregationStage, stageInput []map[string]interface{}, opts QueryOptions, stats *QueryStats) ([]map[string]interface{}, error) {
 	if len(stageInput) == 0 {
 		return nil, nil
 	}
 
+	// The optimized engine streams documents through the stages; middleware
+	// and tracing must see the whole input and output of every stage
+	tracing := opts.TraceDocs > 0
+	if db.queryEngine(opts) == EngineOptimized && !db.hasPipelineMiddleware() && !tracing {
+		return db.streamStages(ctx, stages, &sliceIterator{docs: stageInput}, stats)
+	}
+
 	// Process each stage of the aggregation pipeline
-	for _, stage := range stages {
-
-		switch stage.Stage {
-		case "$match":
-			stageInput = db.matchStage(stageInput, stage.Params)
-		case "$project":
-			stageInput = db.projectStage(stageInput, stage.Params)
-		case "$group":
-			stageInput = db.groupStage(stageInput, stage.Params)
-		case "$facet":
-			stageInput = db.facetStage(stageInput, stage.Params)
-		case "$sort":
-			stageInput = db.sortStage(stageInput, stage.Params)
-		case "$limit":
-			stageInput = db.limitStage(stageInput, stage.Params)
-			if stageInput == nil {
-				return nil, fmt.Errorf("error in $limit stage: invalid limit value")
-			}
-		case "$skip":
-			stageInput = db.skipStage(stageInput, stage.Params)
-		case "$lookup":
-			stageInput = db.lookupStage(stageInput, stage.Params) // Use docs for lookups
-		case "$unwind":
-			stageInput = db.unwindStage(stageInput, stage.Params)
-		case "$sample":
-			stageInput, err = db.sampleStage(stageInput, stage.Params)
-			if err != nil {
-				return nil, fmt.Errorf("error in $sample stage: %w", err)
-			}
-		case "$sortByCount":
-			stageInput, err = db.sortByCountStage(stageInput, stage.Params)
-			if err != nil {
-				return nil, fmt.Errorf("error in $sortByCount stage: %w", err)
-			}
-		case "$unionWith":
-			// future feature
-		case "$redact":
-			// future feature
-		case "$graphLookup":
-			// future feature
-		case "$geoNear":
-			// future feature
-		case "$fill":
-			//
-
-		case "$count":
-			stageInput, err = db.countStage(stageInput, stage.Params)
-			if err != nil {
-				return nil, fmt.Errorf("error in $count stage: %w", err)
-			}
-		case "$replaceRoot":
-			//
-		case "$replaceWith":
-			//
-		case "$set":
-			//
-		case "$unset":
-			stageInput, _ = db.unsetStage(stageInput, stage.Params)
-
-		case "$addFields":
-			stageInput, err = db.addFieldsStage(stageInput, stage.Params)
-			if err != nil {
-				return nil, fmt.Errorf("error in %s stage: %w", stage.Stage, err)
-			}
-		case "$bucket":
-			stageInput, err = db.bucketStage(stageInput, stage.Params)
-			if err != nil {
-				return nil, fmt.Errorf("error in $bucket stage: %w", err)
-			}
-		case "$bucketAuto":
-			stageInput, err = db.bucketAutoStage(stageInput, stage.Params)
-			if err != nil {
-				return nil, fmt.Errorf("error in $bucketAuto stage: %w", err)
+	execute := db.stageExecutor()
+	for i := 0; i < len(stages); i++ {
+		stage := stages[i]
+
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		stageStats := StageStats{
+			Index:  i,
+			Stage:  stage.Stage,
+			DocsIn: len(stageInput),
+			Input:  traceDocuments(stageInput, opts.TraceDocs),
+		}
+		stageStart := time.Now()
+
+		// A buffering stage holds its input until it has produced its
+		// output; $group accounts for its groups itself
+		var memory *memoryBudget
+		if !streamingStages[stage.Stage] && stage.Stage != "$group" {
+			memory = queryMemory(ctx).stageBudget()
+			for _, doc := range stageInput {
+				if err := memory.holdValue(doc); err != nil {
+					return nil, fmt.Errorf("error in %s stage: %w", stage.Stage, err)
+				}
 			}
+		}
 
-		default:
-			log.Printf("Unsupported aggregation stage: %s", stage.Stage)
+		var err error
+		stageInput, err = execute(ctx, stage, stageInput)
+		memory.releaseTo(0)
+		if err != nil {
+			return nil, err
 		}
 
+		stageStats.Duration = time.Since(stageStart)
+		stageStats.DocsOut = len(stageInput)
+		stageStats.Output = traceDocuments(stageInput, opts.TraceDocs)
+		stats.Stages = append(stats.Stages, stageStats)
+
 		// If no results, break the pipeline
 		if len(stageInput) == 0 {
 			break
@@ -121,7 +224,197 @@ func (db *DB) Query(
 	return stageInput, nil
 }
 
-func (db *DB) parseAggregationStagesJSON(query string) ([]AggregationStage, error) {
+// loadPipelineInput reads the queried collection and the collections joined
+// by the pipeline into a snapshot attached to the returned context. The
+// caller releases the snapshot with releaseQuerySnapshot once the pipeline
+// has run; on error it is already released.
+func (db *DB) loadPipelineInput(ctx context.Context, collectionName string, stages []AggregationStage, isolation QueryIsolation) (context.Context, []map[string]interface{}, error) {
+	// Start with a copy of  documents from the specified collection
+	// Collections joined by the pipeline are loaded at the same time
+	ctx, snapshot := db.withQuerySnapshot(ctx, isolation)
+	snapshot.collection = collectionName
+	collections := []string{collectionName}
+	for _, c := range pipelineCollections(stages) {
+		if c != collectionName {
+			collections = append(collections, c)
+		}
+	}
+	if err := db.preloadCollections(ctx, snapshot, collections); err != nil {
+		snapshot.release()
+		return nil, nil, err
+	}
+	stageInput, _ := snapshot.get(collectionName)
+
+	// A self-lookup must join against the collection as read here; keep an
+	// untouched copy since stages may modify their input documents.
+	if len(stageInput) > 0 && pipelineLooksUp(stages, collectionName) {
+		snapshot.record(collectionName, cloneDocuments(stageInput))
+	}
+	return ctx, stageInput, nil
+}
+
+// executeStage runs a single aggregation stage on its input documents.
+// It is the innermost StageExecutor, wrapped by any pipeline middleware.
+func (db *DB) executeStage(ctx context.Context, stage AggregationStage, stageInput []map[string]interface{}) ([]map[string]interface{}, error) {
+	var err error
+
+	switch stage.Stage {
+	case "$match":
+		stageInput = db.matchStage(ctx, stageInput, stage.Params)
+	case "$project":
+		stageInput, err = db.projectStage(ctx, stageInput, stage.Params)
+		if err != nil {
+			return nil, fmt.Errorf("error in $project stage: %w", err)
+		}
+	case "$group":
+		stageInput, err = db.groupStage(ctx, stageInput, stage.Params)
+		if err != nil {
+			return nil, fmt.Errorf("error in $group stage: %w", err)
+		}
+	case "$facet":
+		stageInput = db.facetStage(ctx, stageInput, stage.Params)
+	case "$sort":
+		stageInput = db.sortStage(ctx, stageInput, stage.Params)
+	case "$limit":
+		stageInput = db.limitStage(stageInput, stage.Params)
+		if stageInput == nil {
+			return nil, fmt.Errorf("error in $limit stage: invalid limit value")
+		}
+	case "$skip":
+		stageInput = db.skipStage(stageInput, stage.Params)
+	case "$lookup":
+		stageInput, err = db.lookupStage(ctx, stageInput, stage.Params) // Use docs for lookups
+		if err != nil {
+			return nil, fmt.Errorf("error in $lookup stage: %w", err)
+		}
+	case "$unwind":
+		stageInput = db.unwindStage(stageInput, stage.Params)
+	case "$sample":
+		stageInput, err = db.sampleStage(stageInput, stage.Params)
+		if err != nil {
+			return nil, fmt.Errorf("error in $sample stage: %w", err)
+		}
+	case "$sortByCount":
+		stageInput, err = db.sortByCountStage(ctx, stageInput, stage.Params)
+		if err != nil {
+			return nil, fmt.Errorf("error in $sortByCount stage: %w", err)
+		}
+	case "$count":
+		stageInput, err = db.countStage(stageInput, stage.Params)
+		if err != nil {
+			return nil, fmt.Errorf("error in $count stage: %w", err)
+		}
+	case "$replaceRoot":
+		stageInput, err = db.replaceRootStage(ctx, stageInput, stage.Params)
+		if err != nil {
+			return nil, fmt.Errorf("error in $replaceRoot stage: %w", err)
+		}
+	case "$set":
+		// Accepted by validateStage but not implemented, see checkStrictStage
+	case "$unset":
+		stageInput, _ = db.unsetStage(stageInput, stage.Params)
+
+	case "$addFields":
+		stageInput, err = db.addFieldsStage(ctx, stageInput, stage.Params)
+		if err != nil {
+			return nil, fmt.Errorf("error in %s stage: %w", stage.Stage, err)
+		}
+	case "$bucket":
+		stageInput, err = db.bucketStage(ctx, stageInput, stage.Params)
+		if err != nil {
+			return nil, fmt.Errorf("error in $bucket stage: %w", err)
+		}
+	case "$bucketAuto":
+		stageInput, err = db.bucketAutoStage(ctx, stageInput, stage.Params)
+		if err != nil {
+			return nil, fmt.Errorf("error in $bucketAuto stage: %w", err)
+		}
+	case "$validate":
+		stageInput, err = db.schemaValidationStage(ctx, stageInput, stage.Params)
+		if err != nil {
+			return nil, fmt.Errorf("error in $validate stage: %w", err)
+		}
+
+	default:
+		// Future features ($unionWith, $redact, $graphLookup, $geoNear,
+		// $fill, $replaceWith) are rejected by validateStage, but pipeline
+		// middleware may add stages
+		if db.strictMode(ctx) {
+			return nil, fmt.Errorf("%w: %s", ErrUnsupportedStage, stage.Stage)
+		}
+		db.logf(LogWarn, "Unsupported aggregation stage: %s", stage.Stage)
+	}
+
+	return stageInput, nil
+}
+
+func (db *DB) parseAggregationStagesJSON(ctx context.Context, query string) ([]AggregationStage, error) {
+	stages, err := decodeAggregationStages(query)
+	if err != nil {
+		return nil, err
+	}
+	for i, stage := range stages {
+		if err := db.validatePipelineStage(ctx, i, stage); err != nil {
+			return nil, err
+		}
+	}
+	return stages, nil
+}
+
+// validatePipelineStage validates the stage at 'index' of a pipeline. In
+// strict mode, it also rejects the stages and operators marco accepts but
+// does not implement, see checkStrictStage.
+func (db *DB) validatePipelineStage(ctx context.Context, index int, stage AggregationStage) error {
+	if err := db.validateStage(ctx, stage.Stage, stage.Params); err != nil {
+		return invalidStage(index, stage.Stage, err)
+	}
+	if db.strictMode(ctx) {
+		if op, err := db.checkStrictStage(ctx, stage); err != nil {
+			invalid := invalidStage(index, stage.Stage, err)
+			invalid.Operator = op
+			return invalid
+		}
+	}
+	return nil
+}
+
+// InvalidPipelineError is returned when a pipeline cannot be parsed or one of
+// its stages is invalid. Err is the cause, e.g. ErrUnsupportedStage, if any.
+type InvalidPipelineError struct {
+	Stage    string // the invalid stage, "" if the pipeline is not valid JSON
+	Index    int    // position of the stage in the pipeline
+	Operator string // the unsupported operator, if that is the problem
+	Reason   string
+	Err      error
+}
+
+func (e *InvalidPipelineError) Error() string {
+	if e.Stage == "" {
+		return "invalid aggregation pipeline: " + e.Reason
+	}
+	return fmt.Sprintf("invalid %s stage at index %d: %s", e.Stage, e.Index, e.Reason)
+}
+
+// Is makes errors.Is(err, ErrInvalidPipeline) true.
+func (e *InvalidPipelineError) Is(target error) bool {
+	return target == ErrInvalidPipeline
+}
+
+// Unwrap returns the cause of the error, so that errors.Is and errors.As see
+// through it.
+func (e *InvalidPipelineError) Unwrap() error {
+	return e.Err
+}
+
+// invalidStage returns the *InvalidPipelineError of the stage at 'index' for
+// the validation error err.
+func invalidStage(index int, stage string, err error) *InvalidPipelineError {
+	return &InvalidPipelineError{Stage: stage, Index: index, Reason: err.Error(), Err: err}
+}
+
+// decodeAggregationStages decodes the stages of a pipeline, without
+// validating them.
+func decodeAggregationStages(query string) ([]AggregationStage, error) {
 	// Remove potential whitespace and trim
 	query = strings.TrimSpace(query)
 
@@ -132,30 +425,16 @@ func (db *DB) parseAggregationStagesJSON(query string) ([]AggregationStage, erro
 
 	var stageData []map[string]interface{}
 	if err := json.Unmarshal([]byte(query), &stageData); err != nil {
-		return nil, fmt.Errorf("error parsing JSON query at input: %s, error: %v", query, err)
+		return nil, &InvalidPipelineError{Reason: fmt.Sprintf("error parsing JSON query at input: %s, error: %v", query, err), Err: err}
 	}
 
 	var stages []AggregationStage
 	for _, stageMap := range stageData {
 		// Each stage is a map with a single key representing the stage type
 		for stageName, params := range stageMap {
-			// Convert params to map[string]interface{}
-			paramsMap := make(map[string]interface{})
-			switch v := params.(type) {
-			case map[string]interface{}:
-				paramsMap = v
-			case string:
-				paramsMap["path"] = v // For stages like "$unwind"
-			case float64, int, bool:
-				paramsMap["value"] = v // For stages with scalar values
-
-			default:
-				return nil, fmt.Errorf("invalid parameters for stage %s: %v", stageName, params)
-			}
-
-			// Optional: Validate the stage structure
-			if err := db.validateStage(stageName, paramsMap); err != nil {
-				return nil, err
+			paramsMap, err := stageParams(stageName, params)
+			if err != nil {
+				return nil, invalidStage(len(stages), stageName, err)
 			}
 
 			stages = append(stages, AggregationStage{
@@ -168,14 +447,31 @@ func (db *DB) parseAggregationStagesJSON(query string) ([]AggregationStage, erro
 	return stages, nil
 }
 
+// stageParams converts the parameters of a stage to map[string]interface{}.
+func stageParams(stageName string, params interface{}) (map[string]interface{}, error) {
+	paramsMap := make(map[string]interface{})
+	switch v := params.(type) {
+	case map[string]interface{}:
+		paramsMap = v
+	case string:
+		paramsMap["path"] = v // For stages like "$unwind"
+	case float64, int, bool:
+		paramsMap["value"] = v // For stages with scalar values
+
+	default:
+		return nil, fmt.Errorf("invalid parameters for stage %s: %v", stageName, params)
+	}
+	return paramsMap, nil
+}
+
 // Example validation function
 // validateStage checks that stage params have the required fields and acceptable value types.
-func (db *DB) validateStage(stageName string, params map[string]interface{}) error {
+func (db *DB) validateStage(ctx context.Context, stageName string, params map[string]interface{}) error {
 
 	switch stageName {
 
 	case "$match":
-		return db.validateMatchStage(params)
+		return db.validateMatchStage(ctx, params)
 
 	case "$project":
 		return db.validateProjectStage(params)
@@ -184,7 +480,7 @@ func (db *DB) validateStage(stageName string, params map[string]interface{}) err
 		return db.validateGroupStage(params)
 
 	case "$facet":
-		return db.validateFacetStage(params)
+		return db.validateFacetStage(ctx, params)
 
 	case "$sample":
 		return db.validateSampleStage(params)
@@ -223,9 +519,15 @@ func (db *DB) validateStage(stageName string, params map[string]interface{}) err
 	case "$addFields", "$set":
 		return db.validateAddFieldsStage(params)
 
+	case "$replaceRoot":
+		return db.validateReplaceRootStage(params)
+
+	case "$validate":
+		return db.validateSchemaValidationStage(params)
+
 	default:
 		// Return an error (or just skip) for an unrecognized stage.
-		return fmt.Errorf("unsupported aggregation stage: %s", stageName)
+		return fmt.Errorf("%w: %s", ErrUnsupportedStage, stageName)
 	}
 }
 
@@ -387,6 +689,15 @@ func isValidGroupOperator(op string) bool {
 		"$stdDevSamp":   true,
 		"$count":        true, // Available as a separate stage but can be represented as { $sum: 1 }
 		"$mergeObjects": true, // Allows merging multiple documents into a single object
+		"$accumulator":  true, // Custom Go accumulators, see RegisterAccumulator
+		"$top":          true, // MongoDB 5.2+, with $topN, $bottom and $bottomN
+		"$topN":         true,
+		"$bottom":       true,
+		"$bottomN":      true,
+		"$maxN":         true, // MongoDB 5.2+, with $minN, $firstN and $lastN
+		"$minN":         true,
+		"$firstN":       true,
+		"$lastN":        true,
 
 		// Newer Operators (Ensure your MongoDB version supports these)
 		"$percentile":   true, // MongoDB 5.0+
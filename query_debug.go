@@ -0,0 +1,135 @@
+package marco
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrDebugQueryDone is returned by QueryDebugger.Step once every stage has run.
+var ErrDebugQueryDone = errors.New("all pipeline stages have run")
+
+// QueryDebugger executes a pipeline one stage at a time, exposing the
+// documents between stages. It backs interactive pipeline builders: a user
+// can step through a pipeline and see what each stage does to the documents.
+//
+// Every stage runs as written, through the pipeline middleware; the shortcuts
+// taken by Query are disabled. The collections are read once, when the
+// debugger is created and in a single read transaction, so stepping and
+// resetting work on the same, consistent data.
+// A QueryDebugger is not safe for concurrent use.
+type QueryDebugger struct {
+	db      *DB
+	ctx     context.Context
+	stages  []AggregationStage
+	initial []map[string]interface{} // untouched copy of the collection
+	docs    []map[string]interface{} // output of the last stage run
+	next    int                      // index of the next stage to run
+	history []StageStats
+}
+
+// DebugQuery parses a pipeline and reads the collections it uses, returning a
+// debugger positioned before the first stage. No stage is run until Step or
+// Run is called. The context is used by every stage.
+func (db *DB) DebugQuery(ctx context.Context, collectionName string, mongoAggregationPipeline string) (*QueryDebugger, error) {
+	stages, err := db.parseAggregationStagesJSON(ctx, mongoAggregationPipeline)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing aggregation stages: %w", err)
+	}
+
+	ctx, input, err := db.loadPipelineInput(ctx, collectionName, stages, SnapshotIsolation)
+	if err != nil {
+		return nil, err
+	}
+	// A debugger can live for long; do not hold a read transaction meanwhile
+	releaseQuerySnapshot(ctx)
+
+	return &QueryDebugger{
+		db:      db,
+		ctx:     ctx,
+		stages:  stages,
+		initial: cloneDocuments(input),
+		docs:    input,
+	}, nil
+}
+
+// Stages returns the parsed stages of the pipeline.
+func (d *QueryDebugger) Stages() []AggregationStage {
+	return d.stages
+}
+
+// Position returns the index of the next stage to run, which is also the
+// number of stages run so far.
+func (d *QueryDebugger) Position() int {
+	return d.next
+}
+
+// Done reports whether every stage has run.
+func (d *QueryDebugger) Done() bool {
+	return d.next >= len(d.stages)
+}
+
+// Documents returns copies of the current documents: the collection before
+// the first step, then the output of the last stage run.
+func (d *QueryDebugger) Documents() []map[string]interface{} {
+	return cloneDocuments(d.docs)
+}
+
+// History returns the statistics of the stages run so far, in order.
+func (d *QueryDebugger) History() []StageStats {
+	return append([]StageStats(nil), d.history...)
+}
+
+// Step runs the next stage on the current documents and returns its
+// statistics. The stage output is available from Documents. After the last
+// stage, Step returns ErrDebugQueryDone. A failed stage can be retried: the
+// position only advances when the stage succeeds.
+func (d *QueryDebugger) Step() (StageStats, error) {
+	if d.Done() {
+		return StageStats{}, ErrDebugQueryDone
+	}
+	if err := d.ctx.Err(); err != nil {
+		return StageStats{}, err
+	}
+
+	stage := d.stages[d.next]
+	stageStats := StageStats{
+		Index:  d.next,
+		Stage:  stage.Stage,
+		DocsIn: len(d.docs),
+	}
+
+	// Stages may modify their input documents; run on a copy so that a
+	// failed stage leaves the current documents untouched.
+	stageStart := time.Now()
+	output, err := d.db.stageExecutor()(d.ctx, stage, cloneDocuments(d.docs))
+	if err != nil {
+		return StageStats{}, err
+	}
+
+	stageStats.Duration = time.Since(stageStart)
+	stageStats.DocsOut = len(output)
+	d.docs = output
+	d.next++
+	d.history = append(d.history, stageStats)
+	return stageStats, nil
+}
+
+// Run runs the remaining stages and returns the final documents.
+func (d *QueryDebugger) Run() ([]map[string]interface{}, error) {
+	for !d.Done() {
+		if _, err := d.Step(); err != nil {
+			return nil, err
+		}
+	}
+	return d.Documents(), nil
+}
+
+// Reset positions the debugger before the first stage again, with the
+// collection as it was read when the debugger was created.
+func (d *QueryDebugger) Reset() {
+	d.docs = cloneDocuments(d.initial)
+	d.next = 0
+	d.history = nil
+}
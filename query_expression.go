@@ -0,0 +1,694 @@
+package marco
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// The expression engine evaluates aggregation expressions for every stage
+// that accepts them ($project, $addFields/$set, $match with $expr, $group
+// accumulators, $bucket, $bucketAuto, $sortByCount, $replaceRoot, ...), so
+// that operator support and fixes apply uniformly.
+//
+// An expression is one of:
+//
+//   - a literal: string, number, bool or null
+//   - a field path: "$field" or "$field.nested", traversing arrays
+//   - a variable: "$$name" or "$$name.path", including the system variables
+//     $$ROOT, $$CURRENT, $$NOW and $$REMOVE
+//   - an array, whose elements are evaluated
+//   - an operator expression: {"$op": <arguments>}
+//
+// {"$literal": <value>} returns value as is, so strings starting with "$"
+// and objects shaped like operator expressions can be output verbatim.
+//
+// Operators are dispatched in exprEnv.apply; their handlers live in the
+// query_expression_*.go files, grouped by theme.
+
+// exprEnv is the environment an expression is evaluated in.
+type exprEnv struct {
+	db      *DB
+	ctx     context.Context
+	root    map[string]interface{} // the document the evaluation started from
+	current map[string]interface{} // the document "$field" paths refer to
+	vars    map[string]interface{} // variables bound by operators, without "$$"
+	now     time.Time              // value of $$NOW, fixed for the whole query
+	err     *error                 // first error met during evaluation, shared with withVars copies
+	removed *bool                  // the last value evaluated is $$REMOVE, shared with withVars copies
+	sample  *exprSample            // set when the evaluation is profiled
+}
+
+// queryNowKey is the context key of the time the running query started.
+type queryNowKey struct{}
+
+// withQueryNow fixes the value of $$NOW for the query run with the returned
+// context, so that every stage and document sees the same time.
+func withQueryNow(ctx context.Context) context.Context {
+	if _, ok := ctx.Value(queryNowKey{}).(time.Time); ok {
+		return ctx
+	}
+	return context.WithValue(ctx, queryNowKey{}, time.Now())
+}
+
+// queryNow returns the value of $$NOW for the query running in ctx.
+func queryNow(ctx context.Context) time.Time {
+	if now, ok := ctx.Value(queryNowKey{}).(time.Time); ok {
+		return now
+	}
+	return time.Now()
+}
+
+// newExprEnv returns an environment evaluating expressions against doc.
+func (db *DB) newExprEnv(ctx context.Context, doc map[string]interface{}) *exprEnv {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	return &exprEnv{
+		db:      db,
+		ctx:     ctx,
+		root:    doc,
+		current: doc,
+		now:     queryNow(ctx),
+		err:     new(error),
+		removed: new(bool),
+		sample:  exprSampleFor(ctx),
+	}
+}
+
+// evaluate evaluates expr against doc and returns the first error met.
+// $$REMOVE evaluates to nil; see evaluateField.
+func (db *DB) evaluate(ctx context.Context, doc map[string]interface{}, expr interface{}) (interface{}, error) {
+	env := db.newExprEnv(ctx, doc)
+	value := env.eval(expr)
+	return value, *env.err
+}
+
+// evaluateField evaluates the expression of an output field, such as a
+// $project field. removed is true if it evaluates to $$REMOVE, in which case
+// the field must be left out.
+func (db *DB) evaluateField(ctx context.Context, doc map[string]interface{}, expr interface{}) (value interface{}, removed bool, err error) {
+	env := db.newExprEnv(ctx, doc)
+	value = env.eval(expr)
+	return value, *env.removed, *env.err
+}
+
+// evaluateEach evaluates expr against every document.
+func (db *DB) evaluateEach(ctx context.Context, docs []map[string]interface{}, expr interface{}) ([]interface{}, error) {
+	values := make([]interface{}, len(docs))
+	for i, doc := range docs {
+		value, err := db.evaluate(ctx, doc, expr)
+		if err != nil {
+			return nil, err
+		}
+		values[i] = value
+	}
+	return values, nil
+}
+
+// fail records an evaluation error, keeping the first one, and returns nil.
+func (env *exprEnv) fail(format string, args ...interface{}) interface{} {
+	if *env.err == nil {
+		*env.err = fmt.Errorf(format, args...)
+	}
+	return nil
+}
+
+// withVars returns a copy of env with additional variables bound.
+func (env *exprEnv) withVars(vars map[string]interface{}) *exprEnv {
+	merged := make(map[string]interface{}, len(env.vars)+len(vars))
+	for name, value := range env.vars {
+		merged[name] = value
+	}
+	for name, value := range vars {
+		merged[name] = value
+	}
+	child := *env
+	child.vars = merged
+	return &child
+}
+
+// checkVariableName checks the name of a variable bound by an operator: as in
+// MongoDB, it must start with a lowercase letter and contain only letters,
+// digits and underscores.
+func checkVariableName(name string) error {
+	if name == "" {
+		return fmt.Errorf("variable name must not be empty")
+	}
+	for i, r := range name {
+		switch {
+		case r >= 'a' && r <= 'z', r > unicode.MaxASCII:
+		case i > 0 && (r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_'):
+		default:
+			return fmt.Errorf("invalid variable name %q", name)
+		}
+	}
+	return nil
+}
+
+// passThroughOperators return the value of one of their arguments as is, so
+// that $$REMOVE can be the result of a conditional.
+var passThroughOperators = map[string]bool{
+	"$cond":   true,
+	"$switch": true,
+}
+
+// eval evaluates an expression. Errors are recorded in env.err; the result
+// of a failed evaluation is nil. $$REMOVE evaluates to nil with env.removed
+// set; the fields of object literals evaluating to it are left out.
+func (env *exprEnv) eval(expr interface{}) interface{} {
+	*env.removed = false
+	switch val := expr.(type) {
+	case string:
+		if val == "$$REMOVE" {
+			*env.removed = true
+			return nil
+		}
+		if strings.HasPrefix(val, "$$") {
+			return env.variable(val[2:])
+		}
+		if strings.HasPrefix(val, "$") {
+			return fieldPathValue(env.current, val[1:])
+		}
+		// Otherwise it's just a literal string
+		return val
+
+	case map[string]interface{}:
+		op, args, isOperator := operatorExpression(val)
+		if !isOperator {
+			// An object literal whose values are expressions
+			out := make(map[string]interface{}, len(val))
+			for key, elem := range val {
+				if value := env.eval(elem); !*env.removed {
+					out[key] = value
+				}
+			}
+			*env.removed = false
+			return out
+		}
+		var result interface{}
+		if env.sample != nil {
+			result = env.profiledApply(op, args)
+		} else {
+			result = env.apply(op, args)
+		}
+		if !passThroughOperators[op] {
+			*env.removed = false
+		}
+		return result
+
+	case []interface{}:
+		resultArr := make([]interface{}, 0, len(val))
+		for _, item := range val {
+			resultArr = append(resultArr, env.eval(item))
+		}
+		*env.removed = false
+		return resultArr
+
+	default:
+		// Numbers, booleans, null and other Go values are literals
+		return val
+	}
+}
+
+// operatorExpression recognizes {"$op": <args>}. An object with several keys
+// where one starts with "$" is invalid and reported by validateExpression.
+func operatorExpression(expr map[string]interface{}) (string, interface{}, bool) {
+	if len(expr) != 1 {
+		return "", nil, false
+	}
+	for op, args := range expr {
+		if strings.HasPrefix(op, "$") {
+			return op, args, true
+		}
+	}
+	return "", nil, false
+}
+
+// variable resolves "$$name" or "$$name.path".
+func (env *exprEnv) variable(ref string) interface{} {
+	name, path := ref, ""
+	if i := strings.IndexByte(ref, '.'); i >= 0 {
+		name, path = ref[:i], ref[i+1:]
+	}
+
+	var value interface{}
+	switch name {
+	case "ROOT":
+		value = env.root
+	case "CURRENT":
+		value = env.current
+	case "NOW":
+		value = env.now
+	case "REMOVE":
+		return nil // a path in a missing value is missing
+	default:
+		var ok bool
+		if value, ok = env.vars[name]; !ok {
+			return env.fail("undefined variable $$%s", name)
+		}
+	}
+	if path == "" {
+		return value
+	}
+	doc, ok := value.(map[string]interface{})
+	if !ok {
+		return fieldPathValue(map[string]interface{}{"": value}, "."+path)
+	}
+	return fieldPathValue(doc, path)
+}
+
+// fieldPathValue resolves a dotted path in doc. As in MongoDB, a path that
+// goes through an array yields the array of the values found in its elements,
+// e.g. "$items.price" on {"items": [{"price": 1}, {"price": 2}]} is [1, 2].
+// A missing field is nil.
+func fieldPathValue(doc map[string]interface{}, path string) interface{} {
+	return pathValue(doc, strings.Split(path, "."))
+}
+
+func pathValue(value interface{}, parts []string) interface{} {
+	if len(parts) == 0 {
+		return value
+	}
+	switch v := value.(type) {
+	case map[string]interface{}:
+		field, exists := v[parts[0]]
+		if !exists {
+			return nil
+		}
+		return pathValue(field, parts[1:])
+	case []interface{}:
+		var values []interface{}
+		for _, elem := range v {
+			if _, isDoc := elem.(map[string]interface{}); !isDoc {
+				if _, isArr := elem.([]interface{}); !isArr {
+					continue
+				}
+			}
+			if found := pathValue(elem, parts); found != nil {
+				values = append(values, found)
+			}
+		}
+		if values == nil {
+			values = []interface{}{}
+		}
+		return values
+	default:
+		return nil
+	}
+}
+
+// apply dispatches an operator expression to its handler.
+func (env *exprEnv) apply(op string, args interface{}) interface{} {
+	switch op {
+	// Arithmetic (query_expression_arithmetic.go)
+	case "$add":
+		return handleAdd(env, args)
+	case "$subtract":
+		return handleSubtract(env, args)
+	case "$multiply":
+		return handleMultiply(env, args)
+	case "$divide":
+		return handleDivide(env, args)
+	case "$mod":
+		return handleMod(env, args)
+	case "$abs", "$ceil", "$floor", "$sqrt", "$exp", "$ln", "$log10":
+		return handleUnaryMath(env, op, args)
+	case "$pow":
+		return handlePow(env, args)
+	case "$log":
+		return handleLog(env, args)
+	case "$round", "$trunc":
+		return handleRound(env, op, args)
+	case "$sin", "$cos", "$tan", "$asin", "$acos", "$atan", "$degreesToRadians", "$radiansToDegrees":
+		return handleTrig(env, op, args)
+	case "$atan2":
+		return handleAtan2(env, args)
+
+	// Strings (query_expression_string.go)
+	case "$concat":
+		return handleConcat(env, args)
+	case "$substr", "$substrBytes":
+		return handleSubstrBytes(env, op, args)
+	case "$substrCP":
+		return handleSubstrCP(env, args)
+	case "$strLenCP", "$strLenBytes":
+		return handleStrLen(env, op, args)
+	case "$indexOfCP", "$indexOfBytes":
+		return handleIndexOf(env, op, args)
+	case "$split":
+		return handleSplit(env, args)
+	case "$regexMatch", "$regexFind", "$regexFindAll":
+		return handleRegex(env, op, args)
+	case "$replaceOne", "$replaceAll":
+		return handleReplace(env, op, args)
+	case "$toString":
+		return handleToString(env, args)
+	case "$toUpper", "$toLower":
+		return handleCase(env, op, args)
+	case "$trim", "$ltrim", "$rtrim":
+		return handleTrim(env, op, args)
+
+	// Dates (query_expression_date.go)
+	case "$dateToString":
+		return handleDateToString(env, args)
+	case "$year", "$month", "$dayOfMonth", "$dayOfYear", "$hour", "$minute", "$second", "$millisecond",
+		"$dayOfWeek", "$week", "$isoWeek", "$isoWeekYear", "$isoDayOfWeek":
+		return handleDatePart(env, op, args)
+	case "$dateAdd", "$dateSubtract":
+		return handleDateAdd(env, op, args)
+	case "$dateDiff":
+		return handleDateDiff(env, args)
+	case "$dateTrunc":
+		return handleDateTrunc(env, args)
+	case "$dateFromParts":
+		return handleDateFromParts(env, args)
+	case "$dateToParts":
+		return handleDateToParts(env, args)
+	case "$dateFromString":
+		return handleDateFromString(env, args)
+
+	// Booleans, conditionals and comparisons (query_expression_logic.go)
+	case "$and":
+		return handleAnd(env, args)
+	case "$or":
+		return handleOr(env, args)
+	case "$not":
+		return handleNot(env, args)
+	case "$cond":
+		return handleCond(env, args)
+	case "$switch":
+		return handleSwitch(env, args)
+	case "$literal":
+		// A copy, since documents may be modified by the next stages
+		return cloneValue(args)
+	case "$cmp", "$eq", "$ne", "$gt", "$gte", "$lt", "$lte":
+		return handleComparison(env, op, args)
+
+	// Arrays (query_expression_array.go)
+	case "$slice":
+		return handleSlice(env, args)
+	case "$arrayElemAt":
+		return handleArrayElemAt(env, args)
+	case "$first":
+		return handleFirst(env, args)
+	case "$last":
+		return handleLast(env, args)
+	case "$filter":
+		return handleFilter(env, args)
+	case "$map":
+		return handleMap(env, args)
+	case "$reduce":
+		return handleReduce(env, args)
+	case "$zip":
+		return handleZip(env, args)
+	case "$range":
+		return handleRange(env, args)
+	case "$concatArrays":
+		return handleConcatArrays(env, args)
+	case "$reverseArray":
+		return handleReverseArray(env, args)
+	case "$objectToArray":
+		return handleObjectToArray(env, args)
+	case "$arrayToObject":
+		return handleArrayToObject(env, args)
+	case "$in":
+		return handleIn(env, args)
+	case "$indexOfArray":
+		return handleIndexOfArray(env, args)
+	case "$size":
+		return handleSize(env, args)
+	case "$isArray":
+		return handleIsArray(env, args)
+	case "$sortArray":
+		return handleSortArray(env, args)
+
+	// Types (query_expression_type.go)
+	case "$type":
+		return handleType(env, args)
+	case "$isNumber", "$isString", "$isBool", "$isObject", "$isDate":
+		return handleIsType(env, op, args)
+
+	// Go functions (query_function.go)
+	case "$function":
+		return handleFunction(env, args)
+
+	// Randomness
+	case "$rand":
+		if spec, ok := args.(map[string]interface{}); !ok || len(spec) != 0 {
+			return env.fail("$rand expects an empty object, got %v", args)
+		}
+		return rand.Float64()
+
+	// Objects (query_expression_object.go)
+	case "$getField":
+		return handleGetField(env, args)
+	case "$setField":
+		return handleSetField(env, args)
+	case "$unsetField":
+		return handleUnsetField(env, args)
+	case "$mergeObjects":
+		return handleMergeObjects(env, args)
+
+	// Sets (query_expression_set.go)
+	case "$setUnion":
+		return handleSetUnion(env, args)
+	case "$setIntersection":
+		return handleSetIntersection(env, args)
+	case "$setDifference":
+		return handleSetDifference(env, args)
+	case "$setEquals":
+		return handleSetEquals(env, args)
+	case "$setIsSubset":
+		return handleSetIsSubset(env, args)
+
+	default:
+		return env.fail("unsupported expression operator %s", op)
+	}
+}
+
+// expressionOperators lists the operators handled by exprEnv.apply.
+var expressionOperators = map[string]bool{
+	// Arithmetic
+	"$add":      true,
+	"$subtract": true,
+	"$multiply": true,
+	"$divide":   true,
+	"$mod":      true,
+	"$abs":      true,
+	"$ceil":     true,
+	"$floor":    true,
+	"$trunc":    true,
+	"$round":    true,
+	"$pow":      true,
+	"$sqrt":     true,
+	"$exp":      true,
+	"$ln":       true,
+	"$log":      true,
+	"$log10":    true,
+
+	// Trigonometry
+	"$sin":              true,
+	"$cos":              true,
+	"$tan":              true,
+	"$asin":             true,
+	"$acos":             true,
+	"$atan":             true,
+	"$atan2":            true,
+	"$degreesToRadians": true,
+	"$radiansToDegrees": true,
+
+	// Strings
+	"$concat":       true,
+	"$substr":       true,
+	"$toString":     true,
+	"$toUpper":      true,
+	"$toLower":      true,
+	"$trim":         true,
+	"$ltrim":        true,
+	"$rtrim":        true,
+	"$substrBytes":  true,
+	"$substrCP":     true,
+	"$strLenCP":     true,
+	"$strLenBytes":  true,
+	"$indexOfCP":    true,
+	"$indexOfBytes": true,
+	"$split":        true,
+	"$regexMatch":   true,
+	"$regexFind":    true,
+	"$regexFindAll": true,
+	"$replaceOne":   true,
+	"$replaceAll":   true,
+
+	// Dates
+	"$dateToString":   true,
+	"$year":           true,
+	"$month":          true,
+	"$dayOfMonth":     true,
+	"$dayOfYear":      true,
+	"$hour":           true,
+	"$minute":         true,
+	"$second":         true,
+	"$millisecond":    true,
+	"$dayOfWeek":      true,
+	"$week":           true,
+	"$isoWeek":        true,
+	"$isoWeekYear":    true,
+	"$isoDayOfWeek":   true,
+	"$dateAdd":        true,
+	"$dateSubtract":   true,
+	"$dateDiff":       true,
+	"$dateTrunc":      true,
+	"$dateFromParts":  true,
+	"$dateToParts":    true,
+	"$dateFromString": true,
+
+	// Booleans, conditionals and comparisons
+	"$and":     true,
+	"$or":      true,
+	"$not":     true,
+	"$cond":    true,
+	"$switch":  true,
+	"$literal": true,
+	"$cmp":     true,
+	"$eq":      true,
+	"$ne":      true,
+	"$gt":      true,
+	"$gte":     true,
+	"$lt":      true,
+	"$lte":     true,
+
+	// Arrays
+	"$slice":         true,
+	"$arrayElemAt":   true,
+	"$first":         true,
+	"$last":          true,
+	"$filter":        true,
+	"$map":           true,
+	"$reduce":        true,
+	"$zip":           true,
+	"$range":         true,
+	"$concatArrays":  true,
+	"$reverseArray":  true,
+	"$objectToArray": true,
+	"$arrayToObject": true,
+	"$in":            true,
+	"$indexOfArray":  true,
+	"$size":          true,
+	"$isArray":       true,
+	"$sortArray":     true,
+
+	// Types
+	"$type":     true,
+	"$isNumber": true,
+	"$isString": true,
+	"$isBool":   true,
+	"$isObject": true,
+	"$isDate":   true,
+
+	// Go functions
+	"$function": true,
+
+	// Randomness
+	"$rand": true,
+
+	// Objects
+	"$getField":     true,
+	"$setField":     true,
+	"$unsetField":   true,
+	"$mergeObjects": true,
+
+	// Sets
+	"$setUnion":        true,
+	"$setIntersection": true,
+	"$setDifference":   true,
+	"$setEquals":       true,
+	"$setIsSubset":     true,
+}
+
+// validateExpression checks that every operator used in expr is supported,
+// so that typos are reported when the pipeline is parsed rather than
+// silently evaluating to null.
+func validateExpression(expr interface{}) error {
+	switch val := expr.(type) {
+	case map[string]interface{}:
+		if op, args, isOperator := operatorExpression(val); isOperator {
+			if !expressionOperators[op] {
+				return fmt.Errorf("unsupported expression operator %s", op)
+			}
+			if op == "$literal" {
+				return nil // not an expression
+			}
+			return validateExpression(args)
+		}
+		for key, elem := range val {
+			if strings.HasPrefix(key, "$") {
+				return fmt.Errorf("expression object must have exactly one operator, got %q among %d keys", key, len(val))
+			}
+			if err := validateExpression(elem); err != nil {
+				return err
+			}
+		}
+	case []interface{}:
+		for _, elem := range val {
+			if err := validateExpression(elem); err != nil {
+				return err
+			}
+		}
+	case string:
+		if val == "$" || val == "$$" {
+			return fmt.Errorf("invalid field path %q", val)
+		}
+	}
+	return nil
+}
+
+// expressionArgs returns the arguments of an operator taking an array of
+// between min and max expressions (max < 0 for no limit).
+func (env *exprEnv) expressionArgs(op string, args interface{}, min, max int) ([]interface{}, bool) {
+	arr, ok := args.([]interface{})
+	if !ok {
+		env.fail("%s expects an array of arguments, got %T", op, args)
+		return nil, false
+	}
+	if len(arr) < min || (max >= 0 && len(arr) > max) {
+		if min == max {
+			env.fail("%s expects %d arguments, got %d", op, min, len(arr))
+		} else if max < 0 {
+			env.fail("%s expects at least %d arguments, got %d", op, min, len(arr))
+		} else {
+			env.fail("%s expects between %d and %d arguments, got %d", op, min, max, len(arr))
+		}
+		return nil, false
+	}
+	return arr, true
+}
+
+// unwrapSingleArg accepts both { $op: <expr> } and { $op: [ <expr> ] } for unary operators.
+func unwrapSingleArg(opVal interface{}) interface{} {
+	if args, ok := opVal.([]interface{}); ok && len(args) == 1 {
+		return args[0]
+	}
+	return opVal
+}
+
+// toBool converts an evaluated value to a boolean: false, null, missing, zero
+// and the empty string are false, everything else is true.
+func toBool(val interface{}) bool {
+	switch x := val.(type) {
+	case bool:
+		return x
+	case nil:
+		return false
+	case string:
+		return x != ""
+	default:
+		if n, ok := toFloat64(x); ok {
+			return n != 0
+		}
+		return true
+	}
+}
@@ -0,0 +1,269 @@
+package marco
+
+import "math"
+
+// Arithmetic expression operators. Operands of $add, $subtract, $multiply,
+// $divide and $mod that are not numbers count as 0, and a division or modulo
+// by zero yields null. The math operators ($abs, $sqrt, $round, ...) yield null
+// for null or missing operands and fail on other non-numbers.
+
+func handleAdd(env *exprEnv, opVal interface{}) interface{} {
+	// opVal is typically an array: e.g. [ <expr1>, <expr2>, ... ]
+	arr, ok := env.expressionArgs("$add", opVal, 0, -1)
+	if !ok {
+		return nil
+	}
+	sum := 0.0
+	for _, item := range arr {
+		f, _ := toFloat64(env.eval(item))
+		sum += f
+	}
+	return sum
+}
+
+func handleSubtract(env *exprEnv, opVal interface{}) interface{} {
+	arr, ok := env.expressionArgs("$subtract", opVal, 2, -1)
+	if !ok {
+		return nil
+	}
+	base, _ := toFloat64(env.eval(arr[0]))
+	for i := 1; i < len(arr); i++ {
+		f, _ := toFloat64(env.eval(arr[i]))
+		base -= f
+	}
+	return base
+}
+
+func handleMultiply(env *exprEnv, opVal interface{}) interface{} {
+	arr, ok := env.expressionArgs("$multiply", opVal, 1, -1)
+	if !ok {
+		return nil
+	}
+	product := 1.0
+	for _, item := range arr {
+		f, _ := toFloat64(env.eval(item))
+		product *= f
+	}
+	return product
+}
+
+func handleDivide(env *exprEnv, opVal interface{}) interface{} {
+	arr, ok := env.expressionArgs("$divide", opVal, 2, -1)
+	if !ok {
+		return nil
+	}
+	numf, _ := toFloat64(env.eval(arr[0]))
+	denf, _ := toFloat64(env.eval(arr[1]))
+	if denf == 0 {
+		// Mimic MongoDB’s behavior, which might throw an error or produce NaN
+		return nil
+	}
+	result := numf / denf
+
+	// If there are more items, chain-divide them
+	for i := 2; i < len(arr); i++ {
+		nf, _ := toFloat64(env.eval(arr[i]))
+		if nf == 0 {
+			return nil
+		}
+		result /= nf
+	}
+	return result
+}
+
+func handleMod(env *exprEnv, opVal interface{}) interface{} {
+	arr, ok := env.expressionArgs("$mod", opVal, 2, 2)
+	if !ok {
+		return nil
+	}
+	lv, _ := toFloat64(env.eval(arr[0]))
+	rv, _ := toFloat64(env.eval(arr[1]))
+	if rv == 0 {
+		return nil
+	}
+	return math.Mod(lv, rv)
+}
+
+// numberArg evaluates the operand of a math operator. null is true for a null
+// or missing operand; ok is false, with the error recorded, for a value that
+// is not a number.
+func numberArg(env *exprEnv, op string, expr interface{}) (n float64, null bool, ok bool) {
+	value := env.eval(expr)
+	if value == nil {
+		return 0, true, true
+	}
+	n, ok = numberValue(value)
+	if !ok {
+		env.fail("%s only supports numbers, got %T", op, value)
+	}
+	return n, false, ok
+}
+
+// handleUnaryMath implements the math operators taking one number: $abs,
+// $ceil, $floor, $sqrt, $exp, $ln and $log10.
+func handleUnaryMath(env *exprEnv, op string, opVal interface{}) interface{} {
+	n, null, ok := numberArg(env, op, unwrapSingleArg(opVal))
+	if null || !ok {
+		return nil
+	}
+	switch op {
+	case "$abs":
+		return math.Abs(n)
+	case "$ceil":
+		return math.Ceil(n)
+	case "$floor":
+		return math.Floor(n)
+	case "$sqrt":
+		if n < 0 {
+			return env.fail("$sqrt requires a non-negative number, got %v", n)
+		}
+		return math.Sqrt(n)
+	case "$exp":
+		return math.Exp(n)
+	}
+
+	// $ln and $log10
+	if n <= 0 {
+		return env.fail("%s requires a positive number, got %v", op, n)
+	}
+	if op == "$ln" {
+		return math.Log(n)
+	}
+	return math.Log10(n)
+}
+
+// handlePow implements $pow: [ <base>, <exponent> ].
+func handlePow(env *exprEnv, opVal interface{}) interface{} {
+	args, ok := env.expressionArgs("$pow", opVal, 2, 2)
+	if !ok {
+		return nil
+	}
+	base, baseNull, ok := numberArg(env, "$pow", args[0])
+	if !ok {
+		return nil
+	}
+	exponent, exponentNull, ok := numberArg(env, "$pow", args[1])
+	if !ok || baseNull || exponentNull {
+		return nil
+	}
+	if base == 0 && exponent < 0 {
+		return env.fail("$pow cannot raise 0 to a negative exponent")
+	}
+	return math.Pow(base, exponent)
+}
+
+// handleLog implements $log: [ <number>, <base> ].
+func handleLog(env *exprEnv, opVal interface{}) interface{} {
+	args, ok := env.expressionArgs("$log", opVal, 2, 2)
+	if !ok {
+		return nil
+	}
+	n, nNull, ok := numberArg(env, "$log", args[0])
+	if !ok {
+		return nil
+	}
+	base, baseNull, ok := numberArg(env, "$log", args[1])
+	if !ok || nNull || baseNull {
+		return nil
+	}
+	if n <= 0 {
+		return env.fail("$log requires a positive number, got %v", n)
+	}
+	if base <= 0 || base == 1 {
+		return env.fail("$log requires a positive base other than 1, got %v", base)
+	}
+	return math.Log(n) / math.Log(base)
+}
+
+// handleRound implements $round and $trunc: [ <number>, <place> ]. place,
+// between -20 and 100 and 0 by default, is the number of decimal places
+// kept, or with a negative place the number of integer digits zeroed. $round
+// rounds halves to even, as MongoDB does.
+func handleRound(env *exprEnv, op string, opVal interface{}) interface{} {
+	args, ok := opVal.([]interface{})
+	if !ok {
+		args = []interface{}{opVal}
+	}
+	if len(args) < 1 || len(args) > 2 {
+		return env.fail("%s expects between 1 and 2 arguments, got %d", op, len(args))
+	}
+	n, null, ok := numberArg(env, op, args[0])
+	if !ok {
+		return nil
+	}
+	place := int64(0)
+	if len(args) == 2 {
+		value := env.eval(args[1])
+		if place, ok = toInteger(value); !ok || place < -20 || place > 100 {
+			return env.fail("%s place must be an integer between -20 and 100, got %v", op, value)
+		}
+	}
+	if null {
+		return nil
+	}
+
+	scale := math.Pow(10, float64(place))
+	round := math.RoundToEven
+	if op == "$trunc" {
+		round = math.Trunc
+	}
+	if rounded := round(n*scale) / scale; !math.IsInf(rounded, 0) && !math.IsNaN(rounded) {
+		return rounded
+	}
+	return n // too large to be scaled, and already without decimals
+}
+
+// handleTrig implements the trigonometric operators taking one number, in
+// radians for $sin, $cos and $tan: $sin, $cos, $tan, $asin, $acos, $atan,
+// $degreesToRadians and $radiansToDegrees.
+func handleTrig(env *exprEnv, op string, opVal interface{}) interface{} {
+	n, null, ok := numberArg(env, op, unwrapSingleArg(opVal))
+	if null || !ok {
+		return nil
+	}
+	switch op {
+	case "$sin", "$cos", "$tan":
+		if math.IsInf(n, 0) {
+			return env.fail("%s cannot take an infinite angle", op)
+		}
+		switch op {
+		case "$sin":
+			return math.Sin(n)
+		case "$cos":
+			return math.Cos(n)
+		}
+		return math.Tan(n)
+	case "$asin", "$acos":
+		if n < -1 || n > 1 {
+			return env.fail("%s requires a number between -1 and 1, got %v", op, n)
+		}
+		if op == "$asin" {
+			return math.Asin(n)
+		}
+		return math.Acos(n)
+	case "$atan":
+		return math.Atan(n)
+	case "$degreesToRadians":
+		return n * math.Pi / 180
+	default: // $radiansToDegrees
+		return n * 180 / math.Pi
+	}
+}
+
+// handleAtan2 implements $atan2: [ <y>, <x> ]. It returns the angle, in
+// radians, of the point (x, y).
+func handleAtan2(env *exprEnv, opVal interface{}) interface{} {
+	args, ok := env.expressionArgs("$atan2", opVal, 2, 2)
+	if !ok {
+		return nil
+	}
+	y, yNull, ok := numberArg(env, "$atan2", args[0])
+	if !ok {
+		return nil
+	}
+	x, xNull, ok := numberArg(env, "$atan2", args[1])
+	if !ok || yNull || xNull {
+		return nil
+	}
+	return math.Atan2(y, x)
+}
@@ -0,0 +1,691 @@
+package marco
+
+import "sort"
+
+// Array expression operators.
+
+// $slice (expression form) can have two formats:
+// 1) $slice: [ <array>, <n> ]             first n elements, or last |n| if n is negative
+// 2) $slice: [ <array>, <position>, <n> ] n elements starting at position (negative counts from the end)
+func handleSlice(env *exprEnv, opVal interface{}) interface{} {
+	args, ok := env.expressionArgs("$slice", opVal, 2, 3)
+	if !ok {
+		return nil
+	}
+	arr, ok := toInterfaceSlice(env.eval(args[0]))
+	if !ok {
+		return nil
+	}
+
+	if len(args) == 2 {
+		n, ok := toFloat64(env.eval(args[1]))
+		if !ok {
+			return nil
+		}
+		return sliceArray(arr, 0, int(n), true)
+	}
+
+	position, ok1 := toFloat64(env.eval(args[1]))
+	n, ok2 := toFloat64(env.eval(args[2]))
+	if !ok1 || !ok2 || n <= 0 {
+		return nil
+	}
+	return sliceArray(arr, int(position), int(n), false)
+}
+
+// sliceArray returns a copy of a sub-range of arr.
+// With fromEnd set and a negative n, the last |n| elements are returned.
+// Otherwise n elements are taken starting at position, where a negative
+// position counts from the end of the array.
+func sliceArray(arr []interface{}, position, n int, fromEnd bool) []interface{} {
+	start, end := 0, 0
+	switch {
+	case fromEnd && n < 0:
+		start = len(arr) + n
+		end = len(arr)
+	case position < 0:
+		start = len(arr) + position
+		end = start + n
+	default:
+		start = position
+		end = start + n
+	}
+	if start < 0 {
+		start = 0
+	}
+	if start > len(arr) {
+		start = len(arr)
+	}
+	if end > len(arr) {
+		end = len(arr)
+	}
+	if end < start {
+		end = start
+	}
+	return append([]interface{}{}, arr[start:end]...)
+}
+
+// handleArrayElemAt expects opVal = [ <array>, <index> ]. A negative index counts from the end;
+// an index out of bounds yields nil (a missing field), as does a null array or index.
+func handleArrayElemAt(env *exprEnv, opVal interface{}) interface{} {
+	args, ok := env.expressionArgs("$arrayElemAt", opVal, 2, 2)
+	if !ok {
+		return nil
+	}
+	input, idxVal := env.eval(args[0]), env.eval(args[1])
+	if input == nil || idxVal == nil {
+		return nil
+	}
+	arr, ok := toInterfaceSlice(input)
+	if !ok {
+		return env.fail("$arrayElemAt expects an array, got %T", input)
+	}
+	idx64, ok := toInteger(idxVal)
+	if !ok {
+		return env.fail("$arrayElemAt index must be an integer, got %v", idxVal)
+	}
+	idx := int(idx64)
+	if idx < 0 {
+		idx += len(arr)
+	}
+	if idx < 0 || idx >= len(arr) {
+		return nil
+	}
+	return arr[idx]
+}
+
+// handleFirst returns the first element of an array expression, or nil for an empty or missing array.
+func handleFirst(env *exprEnv, opVal interface{}) interface{} {
+	arr, ok := arrayEndsArg(env, "$first", opVal)
+	if !ok || len(arr) == 0 {
+		return nil
+	}
+	return arr[0]
+}
+
+// handleLast returns the last element of an array expression, or nil for an empty or missing array.
+func handleLast(env *exprEnv, opVal interface{}) interface{} {
+	arr, ok := arrayEndsArg(env, "$last", opVal)
+	if !ok || len(arr) == 0 {
+		return nil
+	}
+	return arr[len(arr)-1]
+}
+
+// arrayEndsArg evaluates the argument of $first or $last. It reports false for
+// a null or missing array, and fails for a value that is not an array.
+func arrayEndsArg(env *exprEnv, op string, opVal interface{}) ([]interface{}, bool) {
+	input := env.eval(unwrapSingleArg(opVal))
+	if input == nil {
+		return nil, false
+	}
+	arr, ok := toInterfaceSlice(input)
+	if !ok {
+		env.fail("%s expects an array, got %T", op, input)
+		return nil, false
+	}
+	return arr, true
+}
+
+// handleFilter implements $filter: { input: <array>, as: <name>, cond: <expr>, limit: <n> }.
+// It returns the elements of input for which cond is true, cond seeing the
+// element as $$<as> ("$$this" by default). With limit, at most limit elements
+// are returned. A null or missing input yields null.
+func handleFilter(env *exprEnv, opVal interface{}) interface{} {
+	spec, ok := opVal.(map[string]interface{})
+	if !ok {
+		return env.fail("$filter expects an object, got %T", opVal)
+	}
+	for name := range spec {
+		if name != "input" && name != "as" && name != "cond" && name != "limit" {
+			return env.fail("$filter: unknown argument %q", name)
+		}
+	}
+	if _, ok := spec["cond"]; !ok {
+		return env.fail("$filter requires cond")
+	}
+	as, ok := variableArg(env, "$filter", spec, "as", "this")
+	if !ok {
+		return nil
+	}
+
+	limit := -1
+	if limitExpr, ok := spec["limit"]; ok {
+		if value := env.eval(limitExpr); value != nil {
+			n, ok := toInteger(value)
+			if !ok || n < 1 {
+				return env.fail("$filter limit must be a positive integer, got %v", value)
+			}
+			limit = int(n)
+		}
+	}
+
+	input := env.eval(spec["input"])
+	if input == nil {
+		return nil
+	}
+	arr, ok := toInterfaceSlice(input)
+	if !ok {
+		return env.fail("$filter input must be an array, got %T", input)
+	}
+
+	result := []interface{}{}
+	for _, elem := range arr {
+		if limit >= 0 && len(result) == limit {
+			break
+		}
+		if toBool(env.withVars(map[string]interface{}{as: elem}).eval(spec["cond"])) {
+			result = append(result, elem)
+		}
+	}
+	return result
+}
+
+// variableArg returns the name of the variable an operator binds, given by
+// its 'field' argument or defaultName when absent.
+func variableArg(env *exprEnv, op string, spec map[string]interface{}, field, defaultName string) (string, bool) {
+	raw, ok := spec[field]
+	if !ok {
+		return defaultName, true
+	}
+	name, ok := raw.(string)
+	if !ok {
+		env.fail("%s %s must be a variable name, got %T", op, field, raw)
+		return "", false
+	}
+	if err := checkVariableName(name); err != nil {
+		env.fail("%s %s: %v", op, field, err)
+		return "", false
+	}
+	return name, true
+}
+
+// handleMap implements $map: { input: <array>, as: <name>, in: <expr> }.
+// It returns the values of in evaluated for each element of input, bound to
+// $$<as> ("$$this" by default). A null or missing input yields null.
+func handleMap(env *exprEnv, opVal interface{}) interface{} {
+	spec, ok := opVal.(map[string]interface{})
+	if !ok {
+		return env.fail("$map expects an object, got %T", opVal)
+	}
+	for name := range spec {
+		if name != "input" && name != "as" && name != "in" {
+			return env.fail("$map: unknown argument %q", name)
+		}
+	}
+	if _, ok := spec["in"]; !ok {
+		return env.fail("$map requires in")
+	}
+	as, ok := variableArg(env, "$map", spec, "as", "this")
+	if !ok {
+		return nil
+	}
+
+	input := env.eval(spec["input"])
+	if input == nil {
+		return nil
+	}
+	arr, ok := toInterfaceSlice(input)
+	if !ok {
+		return env.fail("$map input must be an array, got %T", input)
+	}
+
+	result := make([]interface{}, len(arr))
+	for i, elem := range arr {
+		result[i] = env.withVars(map[string]interface{}{as: elem}).eval(spec["in"])
+	}
+	return result
+}
+
+// handleReduce implements $reduce: { input: <array>, initialValue: <expr>, in: <expr> }.
+// It folds input into a single value: in is evaluated for each element with
+// $$this bound to the element and $$value to the result so far, starting
+// from initialValue. A null or missing input yields null.
+func handleReduce(env *exprEnv, opVal interface{}) interface{} {
+	spec, ok := opVal.(map[string]interface{})
+	if !ok {
+		return env.fail("$reduce expects an object, got %T", opVal)
+	}
+	for name := range spec {
+		if name != "input" && name != "initialValue" && name != "in" {
+			return env.fail("$reduce: unknown argument %q", name)
+		}
+	}
+	for _, name := range []string{"initialValue", "in"} {
+		if _, ok := spec[name]; !ok {
+			return env.fail("$reduce requires %s", name)
+		}
+	}
+
+	input := env.eval(spec["input"])
+	if input == nil {
+		return nil
+	}
+	arr, ok := toInterfaceSlice(input)
+	if !ok {
+		return env.fail("$reduce input must be an array, got %T", input)
+	}
+
+	value := env.eval(spec["initialValue"])
+	for _, elem := range arr {
+		value = env.withVars(map[string]interface{}{"this": elem, "value": value}).eval(spec["in"])
+	}
+	return value
+}
+
+// handleZip implements $zip: { inputs: [ <array>, ... ], useLongestLength: <bool>, defaults: [ ... ] }.
+// It transposes the input arrays: the i-th output element is the array of
+// the i-th elements of the inputs. The output is as long as the shortest
+// input or, with useLongestLength, the longest one, shorter inputs being
+// padded with defaults (null by default). A null or missing input yields null.
+func handleZip(env *exprEnv, opVal interface{}) interface{} {
+	spec, ok := opVal.(map[string]interface{})
+	if !ok {
+		return env.fail("$zip expects an object, got %T", opVal)
+	}
+	for name := range spec {
+		if name != "inputs" && name != "useLongestLength" && name != "defaults" {
+			return env.fail("$zip: unknown argument %q", name)
+		}
+	}
+	inputExprs, ok := spec["inputs"].([]interface{})
+	if !ok || len(inputExprs) == 0 {
+		return env.fail("$zip inputs must be a non-empty array of expressions")
+	}
+	useLongest := false
+	if raw, ok := spec["useLongestLength"]; ok {
+		if useLongest, ok = raw.(bool); !ok {
+			return env.fail("$zip useLongestLength must be a boolean, got %T", raw)
+		}
+	}
+
+	inputs := make([][]interface{}, len(inputExprs))
+	null := false
+	for i, expr := range inputExprs {
+		value := env.eval(expr)
+		if value == nil {
+			null = true
+			continue
+		}
+		arr, ok := toInterfaceSlice(value)
+		if !ok {
+			return env.fail("$zip inputs must be arrays, got %T", value)
+		}
+		inputs[i] = arr
+	}
+
+	defaults := make([]interface{}, len(inputs))
+	if raw, ok := spec["defaults"]; ok {
+		if !useLongest {
+			return env.fail("$zip defaults require useLongestLength")
+		}
+		values, ok := toInterfaceSlice(env.eval(raw))
+		if !ok || len(values) != len(inputs) {
+			return env.fail("$zip defaults must be an array as long as inputs")
+		}
+		defaults = values
+	}
+	if null {
+		return nil
+	}
+
+	length := len(inputs[0])
+	for _, arr := range inputs[1:] {
+		if (useLongest && len(arr) > length) || (!useLongest && len(arr) < length) {
+			length = len(arr)
+		}
+	}
+
+	result := make([]interface{}, length)
+	for i := range result {
+		tuple := make([]interface{}, len(inputs))
+		for j, arr := range inputs {
+			if i < len(arr) {
+				tuple[j] = arr[i]
+			} else {
+				tuple[j] = defaults[j]
+			}
+		}
+		result[i] = tuple
+	}
+	return result
+}
+
+// maxRangeLength bounds the arrays generated by $range.
+const maxRangeLength = 1 << 22
+
+// handleRange implements $range: [ <start>, <end>, <step> ].
+// It returns the integers from start, included, to end, excluded, by step (1
+// by default, possibly negative).
+func handleRange(env *exprEnv, opVal interface{}) interface{} {
+	args, ok := env.expressionArgs("$range", opVal, 2, 3)
+	if !ok {
+		return nil
+	}
+	bounds := [3]int64{0, 0, 1}
+	for i, arg := range args {
+		value := env.eval(arg)
+		n, ok := toInteger(value)
+		if !ok {
+			return env.fail("$range arguments must be integers, got %v", value)
+		}
+		bounds[i] = n
+	}
+	start, end, step := bounds[0], bounds[1], bounds[2]
+	if step == 0 {
+		return env.fail("$range step must not be zero")
+	}
+
+	var count int64
+	if step > 0 && end > start {
+		count = (end - start + step - 1) / step
+	} else if step < 0 && end < start {
+		count = (start - end - step - 1) / -step
+	}
+	if count > maxRangeLength {
+		return env.fail("$range would generate %d values, more than %d", count, maxRangeLength)
+	}
+
+	result := make([]interface{}, count)
+	for i := range result {
+		result[i] = float64(start + int64(i)*step)
+	}
+	return result
+}
+
+// handleConcatArrays implements $concatArrays: [ <array>, ... ].
+// It returns the elements of every array, in order. If any argument is null
+// or missing, the result is null.
+func handleConcatArrays(env *exprEnv, opVal interface{}) interface{} {
+	args, ok := env.expressionArgs("$concatArrays", opVal, 0, -1)
+	if !ok {
+		return nil
+	}
+	result := []interface{}{}
+	null := false
+	for _, arg := range args {
+		value := env.eval(arg)
+		if value == nil {
+			null = true
+			continue
+		}
+		arr, ok := toInterfaceSlice(value)
+		if !ok {
+			return env.fail("$concatArrays only supports arrays, got %T", value)
+		}
+		result = append(result, arr...)
+	}
+	if null {
+		return nil
+	}
+	return result
+}
+
+// handleReverseArray implements $reverseArray: <array>. It returns a reversed
+// copy of the array; a null or missing array yields null.
+func handleReverseArray(env *exprEnv, opVal interface{}) interface{} {
+	value := env.eval(unwrapSingleArg(opVal))
+	if value == nil {
+		return nil
+	}
+	arr, ok := toInterfaceSlice(value)
+	if !ok {
+		return env.fail("$reverseArray expects an array, got %T", value)
+	}
+	result := make([]interface{}, len(arr))
+	for i, elem := range arr {
+		result[len(arr)-1-i] = elem
+	}
+	return result
+}
+
+// handleObjectToArray implements $objectToArray: <object>. It returns the
+// fields of the object as [ { k: <name>, v: <value> }, ... ], sorted by name
+// since decoded documents do not keep their field order. A null or missing
+// object yields null.
+func handleObjectToArray(env *exprEnv, opVal interface{}) interface{} {
+	value := env.eval(unwrapSingleArg(opVal))
+	if value == nil {
+		return nil
+	}
+	doc, ok := value.(map[string]interface{})
+	if !ok {
+		return env.fail("$objectToArray expects an object, got %T", value)
+	}
+	names := make([]string, 0, len(doc))
+	for name := range doc {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	result := make([]interface{}, len(names))
+	for i, name := range names {
+		result[i] = map[string]interface{}{"k": name, "v": doc[name]}
+	}
+	return result
+}
+
+// handleArrayToObject implements $arrayToObject: <array>. The array holds
+// either [ <name>, <value> ] pairs or { k: <name>, v: <value> } documents,
+// all of the same form; a repeated name keeps its last value. A null or
+// missing array yields null.
+func handleArrayToObject(env *exprEnv, opVal interface{}) interface{} {
+	value := env.eval(unwrapSingleArg(opVal))
+	if value == nil {
+		return nil
+	}
+	arr, ok := toInterfaceSlice(value)
+	if !ok {
+		return env.fail("$arrayToObject expects an array, got %T", value)
+	}
+
+	result := make(map[string]interface{}, len(arr))
+	pairs := false
+	for i, elem := range arr {
+		var name, fieldValue interface{}
+		switch e := elem.(type) {
+		case []interface{}:
+			if len(e) != 2 {
+				return env.fail("$arrayToObject pairs must have 2 elements, got %d", len(e))
+			}
+			name, fieldValue = e[0], e[1]
+			if i == 0 {
+				pairs = true
+			} else if !pairs {
+				return env.fail("$arrayToObject elements must all be pairs or all be {k, v} documents")
+			}
+		case map[string]interface{}:
+			_, hasK := e["k"]
+			_, hasV := e["v"]
+			if len(e) != 2 || !hasK || !hasV {
+				return env.fail("$arrayToObject documents must have exactly the fields k and v")
+			}
+			name, fieldValue = e["k"], e["v"]
+			if pairs {
+				return env.fail("$arrayToObject elements must all be pairs or all be {k, v} documents")
+			}
+		default:
+			return env.fail("$arrayToObject elements must be pairs or {k, v} documents, got %T", elem)
+		}
+
+		key, ok := name.(string)
+		if !ok {
+			return env.fail("$arrayToObject field names must be strings, got %T", name)
+		}
+		result[key] = fieldValue
+	}
+	return result
+}
+
+// handleIn implements $in: [ <value>, <array> ]. It reports whether the array
+// holds the value, compared as by $eq.
+func handleIn(env *exprEnv, opVal interface{}) interface{} {
+	args, ok := env.expressionArgs("$in", opVal, 2, 2)
+	if !ok {
+		return nil
+	}
+	value := env.eval(args[0])
+	arr, ok := toInterfaceSlice(env.eval(args[1]))
+	if !ok {
+		return env.fail("$in requires an array as its second argument")
+	}
+	for _, elem := range arr {
+		if valuesEqual(elem, value) {
+			return true
+		}
+	}
+	return false
+}
+
+// handleIndexOfArray implements $indexOfArray:
+// [ <array>, <value>, <start>, <end> ].
+// It returns the index of the first element equal to value within
+// [start, end), or -1. A null or missing array yields null.
+func handleIndexOfArray(env *exprEnv, opVal interface{}) interface{} {
+	args, ok := env.expressionArgs("$indexOfArray", opVal, 2, 4)
+	if !ok {
+		return nil
+	}
+	value := env.eval(args[0])
+	if value == nil {
+		return nil
+	}
+	arr, ok := toInterfaceSlice(value)
+	if !ok {
+		return env.fail("$indexOfArray expects an array, got %T", value)
+	}
+	search := env.eval(args[1])
+
+	start, end := int64(0), int64(len(arr))
+	if len(args) > 2 {
+		n, ok := toInteger(env.eval(args[2]))
+		if !ok || n < 0 {
+			return env.fail("$indexOfArray start must be a non-negative integer")
+		}
+		start = n
+	}
+	if len(args) > 3 {
+		n, ok := toInteger(env.eval(args[3]))
+		if !ok || n < 0 {
+			return env.fail("$indexOfArray end must be a non-negative integer")
+		}
+		if n < end {
+			end = n
+		}
+	}
+	for i := start; i < end; i++ {
+		if valuesEqual(arr[i], search) {
+			return int(i)
+		}
+	}
+	return -1
+}
+
+// handleSize implements $size: <array>. It returns the number of elements of
+// the array, which must not be null or missing.
+func handleSize(env *exprEnv, opVal interface{}) interface{} {
+	value := env.eval(unwrapSingleArg(opVal))
+	arr, ok := toInterfaceSlice(value)
+	if !ok {
+		if value == nil {
+			return env.fail("$size requires an array, got null or a missing field")
+		}
+		return env.fail("$size requires an array, got %T", value)
+	}
+	return len(arr)
+}
+
+// handleIsArray implements $isArray: <expression>. It reports whether the
+// value is an array.
+func handleIsArray(env *exprEnv, opVal interface{}) interface{} {
+	_, ok := toInterfaceSlice(env.eval(unwrapSingleArg(opVal)))
+	return ok
+}
+
+// handleSortArray implements $sortArray: { input: <array>, sortBy: <order> }.
+// sortBy is 1 or -1 to order the elements themselves, or a document such as
+// { "price": -1, "name": 1 } to order documents by their fields; fields are
+// applied in name order since decoded documents do not keep their field
+// order. Values are ordered as by $sort across types, strings by the session
+// collation. A null or missing array yields null.
+func handleSortArray(env *exprEnv, opVal interface{}) interface{} {
+	spec, ok := opVal.(map[string]interface{})
+	if !ok {
+		return env.fail("$sortArray expects an object with input and sortBy, got %T", opVal)
+	}
+	for name := range spec {
+		if name != "input" && name != "sortBy" {
+			return env.fail("$sortArray has unknown field %q", name)
+		}
+	}
+
+	type sortKey struct {
+		field     string // empty to compare the elements themselves
+		direction int
+	}
+	var keys []sortKey
+	switch sortBy := spec["sortBy"].(type) {
+	case map[string]interface{}:
+		if len(sortBy) == 0 {
+			return env.fail("$sortArray sortBy must not be empty")
+		}
+		for _, field := range sortedKeys(sortBy) {
+			direction, ok := sortDirection(sortBy[field])
+			if !ok {
+				return env.fail("$sortArray sortBy directions must be 1 or -1, got %v for %q", sortBy[field], field)
+			}
+			keys = append(keys, sortKey{field: field, direction: direction})
+		}
+	default:
+		direction, ok := sortDirection(sortBy)
+		if !ok {
+			return env.fail("$sortArray sortBy must be 1, -1 or a sort document, got %v", sortBy)
+		}
+		keys = []sortKey{{direction: direction}}
+	}
+
+	value := env.eval(spec["input"])
+	if value == nil {
+		return nil
+	}
+	arr, ok := toInterfaceSlice(value)
+	if !ok {
+		return env.fail("$sortArray input must be an array, got %T", value)
+	}
+
+	collation := sessionCollation(env.ctx)
+	result := make([]interface{}, len(arr))
+	copy(result, arr)
+	sort.SliceStable(result, func(i, j int) bool {
+		for _, key := range keys {
+			left, right := result[i], result[j]
+			if key.field != "" {
+				left, right = sortArrayField(left, key.field), sortArrayField(right, key.field)
+			}
+			if cmp := compareValues(left, right, collation); cmp != 0 {
+				return cmp*key.direction < 0
+			}
+		}
+		return false
+	})
+	return result
+}
+
+// sortDirection converts 1 or -1 into a sort direction.
+func sortDirection(value interface{}) (int, bool) {
+	n, ok := toInteger(value)
+	if !ok || (n != 1 && n != -1) {
+		return 0, false
+	}
+	return int(n), true
+}
+
+// sortArrayField returns the field at a dotted path of an array element, or
+// nil if the element is not a document.
+func sortArrayField(elem interface{}, path string) interface{} {
+	doc, ok := elem.(map[string]interface{})
+	if !ok {
+		return nil
+	}
+	return getNestedField(doc, path)
+}
@@ -0,0 +1,940 @@
+package marco
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Date expression operators. Dates can be time.Time values, RFC3339 strings
+// or epoch milliseconds.
+
+// handleDateToString expects opVal = { "date": <expr>, "format": <formatStr> }
+func handleDateToString(env *exprEnv, opVal interface{}) interface{} {
+	config, ok := opVal.(map[string]interface{})
+	if !ok {
+		return env.fail("$dateToString expects an object, got %T", opVal)
+	}
+
+	dateVal := env.eval(config["date"]) // Might be a $field ref
+	format, _ := env.eval(config["format"]).(string)
+	return formatDate(dateVal, format)
+}
+
+// toTime converts a value to a time: time.Time values, RFC3339 strings and
+// epoch milliseconds are accepted. Times are returned in UTC.
+func toTime(value interface{}) (time.Time, bool) {
+	switch v := value.(type) {
+	case time.Time:
+		return v.UTC(), true
+	case *time.Time:
+		if v == nil {
+			return time.Time{}, false
+		}
+		return v.UTC(), true
+	case string:
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return time.Time{}, false
+		}
+		return t.UTC(), true
+	case bool:
+		return time.Time{}, false
+	default:
+		millis, ok := toFloat64(v)
+		if !ok {
+			return time.Time{}, false
+		}
+		return time.UnixMilli(int64(millis)).UTC(), true
+	}
+}
+
+// loadTimezone resolves an Olson timezone name ("Europe/Paris") or a UTC
+// offset ("+02:00", "-0530", "+03").
+func loadTimezone(name string) (*time.Location, error) {
+	if name == "" || name == "UTC" || name == "GMT" {
+		return time.UTC, nil
+	}
+	if name[0] == '+' || name[0] == '-' {
+		digits := strings.ReplaceAll(name[1:], ":", "")
+		if len(digits) != 2 && len(digits) != 4 {
+			return nil, fmt.Errorf("invalid timezone offset %q", name)
+		}
+		hours, err := strconv.Atoi(digits[:2])
+		if err != nil {
+			return nil, fmt.Errorf("invalid timezone offset %q", name)
+		}
+		minutes := 0
+		if len(digits) == 4 {
+			if minutes, err = strconv.Atoi(digits[2:]); err != nil {
+				return nil, fmt.Errorf("invalid timezone offset %q", name)
+			}
+		}
+		offset := hours*3600 + minutes*60
+		if name[0] == '-' {
+			offset = -offset
+		}
+		return time.FixedZone(name, offset), nil
+	}
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return nil, fmt.Errorf("unknown timezone %q", name)
+	}
+	return loc, nil
+}
+
+// dateOperand evaluates the argument of a date part operator, which is either
+// a date expression, a one-element array, or { date: <expr>, timezone: <tz> }.
+// The second result is false when the date is null or missing, or on error.
+func dateOperand(env *exprEnv, op string, opVal interface{}) (time.Time, bool) {
+	dateExpr, tzExpr := unwrapSingleArg(opVal), interface{}(nil)
+	if spec, ok := opVal.(map[string]interface{}); ok {
+		if date, hasDate := spec["date"]; hasDate {
+			dateExpr, tzExpr = date, spec["timezone"]
+		}
+	}
+
+	value := env.eval(dateExpr)
+	if value == nil {
+		return time.Time{}, false
+	}
+	t, ok := toTime(value)
+	if !ok {
+		env.fail("%s can't convert %T to a date", op, value)
+		return time.Time{}, false
+	}
+
+	loc, ok := dateTimezone(env, op, tzExpr)
+	if !ok {
+		return time.Time{}, false
+	}
+	return t.In(loc), true
+}
+
+// dateTimezone evaluates the optional timezone argument of a date operator.
+// Without one, dates are handled in the session timezone, UTC by default.
+func dateTimezone(env *exprEnv, op string, tzExpr interface{}) (*time.Location, bool) {
+	if tzExpr == nil {
+		return sessionLocation(env.ctx), true
+	}
+	tz, ok := env.eval(tzExpr).(string)
+	if !ok {
+		env.fail("%s timezone must be a string", op)
+		return nil, false
+	}
+	loc, err := loadTimezone(tz)
+	if err != nil {
+		env.fail("%s: %v", op, err)
+		return nil, false
+	}
+	return loc, true
+}
+
+// datePart returns the part of t extracted by a date part operator.
+func datePart(op string, t time.Time) int {
+	switch op {
+	case "$year":
+		return t.Year()
+	case "$month":
+		return int(t.Month())
+	case "$dayOfMonth":
+		return t.Day()
+	case "$dayOfYear":
+		return t.YearDay()
+	case "$hour":
+		return t.Hour()
+	case "$minute":
+		return t.Minute()
+	case "$second":
+		return t.Second()
+	case "$millisecond":
+		return t.Nanosecond() / int(time.Millisecond)
+	case "$dayOfWeek":
+		// 1 (Sunday) to 7 (Saturday)
+		return int(t.Weekday()) + 1
+	case "$week":
+		// 0 to 53; weeks begin on Sundays and week 1 begins with the
+		// first Sunday of the year, as strftime's %U
+		return (t.YearDay() - 1 + 7 - int(t.Weekday())) / 7
+	case "$isoWeek":
+		_, week := t.ISOWeek()
+		return week
+	case "$isoWeekYear":
+		year, _ := t.ISOWeek()
+		return year
+	default: // $isoDayOfWeek
+		// 1 (Monday) to 7 (Sunday)
+		if t.Weekday() == time.Sunday {
+			return 7
+		}
+		return int(t.Weekday())
+	}
+}
+
+// handleDatePart implements $year, $month, $dayOfMonth, $dayOfYear, $hour,
+// $minute, $second, $millisecond, $dayOfWeek, $week, $isoWeek, $isoWeekYear
+// and $isoDayOfWeek. A null or missing date yields null.
+func handleDatePart(env *exprEnv, op string, opVal interface{}) interface{} {
+	t, ok := dateOperand(env, op, opVal)
+	if !ok {
+		return nil
+	}
+	return datePart(op, t)
+}
+
+// dateUnits are the units accepted by $dateAdd, $dateSubtract and $dateDiff.
+var dateUnits = map[string]bool{
+	"year": true, "quarter": true, "month": true, "week": true, "day": true,
+	"hour": true, "minute": true, "second": true, "millisecond": true,
+}
+
+// dateArgument evaluates a named date argument of a date arithmetic operator.
+// The second result is false when the date is null or missing, or on error.
+func dateArgument(env *exprEnv, op, name string, spec map[string]interface{}) (time.Time, bool) {
+	value := env.eval(spec[name])
+	if value == nil {
+		return time.Time{}, false
+	}
+	t, ok := toTime(value)
+	if !ok {
+		env.fail("%s %s can't convert %T to a date", op, name, value)
+		return time.Time{}, false
+	}
+	return t, true
+}
+
+// dateUnit evaluates the unit argument of a date arithmetic operator.
+func dateUnit(env *exprEnv, op string, spec map[string]interface{}) (string, bool) {
+	unit, _ := env.eval(spec["unit"]).(string)
+	if !dateUnits[unit] {
+		env.fail("%s unit must be one of year, quarter, month, week, day, hour, minute, second or millisecond, got %v", op, spec["unit"])
+		return "", false
+	}
+	return unit, true
+}
+
+// handleDateAdd implements $dateAdd and $dateSubtract:
+// { startDate: <date>, unit: <unit>, amount: <number>, timezone: <tz> }.
+// Months, quarters and years that overflow the target month end on its last
+// day, e.g. January 31 plus one month is the last day of February. Calendar
+// units are applied in the timezone, so adding a day across a daylight saving
+// change keeps the local time.
+func handleDateAdd(env *exprEnv, op string, opVal interface{}) interface{} {
+	spec, ok := opVal.(map[string]interface{})
+	if !ok {
+		return env.fail("%s expects an object, got %T", op, opVal)
+	}
+	unit, ok := dateUnit(env, op, spec)
+	if !ok {
+		return nil
+	}
+	loc, ok := dateTimezone(env, op, spec["timezone"])
+	if !ok {
+		return nil
+	}
+	start, ok := dateArgument(env, op, "startDate", spec)
+	if !ok {
+		return nil
+	}
+	amountVal := env.eval(spec["amount"])
+	if amountVal == nil {
+		return nil
+	}
+	amount, ok := toFloat64(amountVal)
+	if _, isStr := amountVal.(string); !ok || isStr || amount != math.Trunc(amount) {
+		return env.fail("%s amount must be an integer, got %v", op, amountVal)
+	}
+	// Amounts spanning more than the range of a date would overflow addDate
+	if !(math.Abs(amount) < float64(math.MaxInt64/dateUnitMillis(unit))) {
+		return env.fail("%s amount %v overflows a date in %ss", op, amountVal, unit)
+	}
+	n := int64(amount)
+	if op == "$dateSubtract" {
+		n = -n
+	}
+	result := addDate(start.In(loc), unit, n)
+	if sec := result.Unix(); sec < math.MinInt64/1000 || sec > math.MaxInt64/1000 {
+		return env.fail("%s result is out of the range of a date", op)
+	}
+	return result.UTC()
+}
+
+// addDate adds n units to t. n*dateUnitMillis(unit) must fit an int64.
+func addDate(t time.Time, unit string, n int64) time.Time {
+	switch unit {
+	case "year":
+		return addMonths(t, 12*int(n))
+	case "quarter":
+		return addMonths(t, 3*int(n))
+	case "month":
+		return addMonths(t, int(n))
+	case "week":
+		return t.AddDate(0, 0, 7*int(n))
+	case "day":
+		return t.AddDate(0, 0, int(n))
+	}
+	// A time.Duration spans only 292 years, so add seconds and milliseconds
+	ms := n * dateUnitMillis(unit)
+	return time.Unix(t.Unix()+ms/1000, int64(t.Nanosecond())+ms%1000*int64(time.Millisecond)).In(t.Location())
+}
+
+// dateUnitMillis returns the length of a $dateAdd unit in milliseconds, the
+// longest length for calendar units.
+func dateUnitMillis(unit string) int64 {
+	const day = 24 * 60 * 60 * 1000
+	switch unit {
+	case "year":
+		return 366 * day
+	case "quarter":
+		return 92 * day
+	case "month":
+		return 31 * day
+	case "week":
+		return 7 * day
+	case "day":
+		return day
+	case "hour":
+		return 60 * 60 * 1000
+	case "minute":
+		return 60 * 1000
+	case "second":
+		return 1000
+	}
+	return 1 // millisecond
+}
+
+// addMonths adds n months to t, clamping the day to the end of the month.
+func addMonths(t time.Time, n int) time.Time {
+	year, month, day := t.Date()
+	first := time.Date(year, month+time.Month(n), 1, t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), t.Location())
+	if last := first.AddDate(0, 1, -1).Day(); day > last {
+		day = last
+	}
+	return first.AddDate(0, 0, day-1)
+}
+
+// handleDateDiff implements $dateDiff:
+// { startDate: <date>, endDate: <date>, unit: <unit>, timezone: <tz>, startOfWeek: <day> }.
+// As in MongoDB, it counts the unit boundaries crossed between the dates, so
+// the difference in years between December 31 and January 1 is 1. Weeks
+// start on startOfWeek, Sunday by default.
+func handleDateDiff(env *exprEnv, opVal interface{}) interface{} {
+	spec, ok := opVal.(map[string]interface{})
+	if !ok {
+		return env.fail("$dateDiff expects an object, got %T", opVal)
+	}
+	unit, ok := dateUnit(env, "$dateDiff", spec)
+	if !ok {
+		return nil
+	}
+	loc, ok := dateTimezone(env, "$dateDiff", spec["timezone"])
+	if !ok {
+		return nil
+	}
+	startOfWeek := time.Sunday
+	if raw, ok := spec["startOfWeek"]; ok && unit == "week" {
+		name, _ := env.eval(raw).(string)
+		day, known := weekdayNames[strings.ToLower(name)]
+		if !known {
+			return env.fail("$dateDiff startOfWeek must be a day of the week, got %v", raw)
+		}
+		startOfWeek = day
+	}
+	start, ok := dateArgument(env, "$dateDiff", "startDate", spec)
+	if !ok {
+		return nil
+	}
+	end, ok := dateArgument(env, "$dateDiff", "endDate", spec)
+	if !ok {
+		return nil
+	}
+	return dateDiff(start.In(loc), end.In(loc), unit, startOfWeek)
+}
+
+// weekdayNames maps the full and abbreviated day names to weekdays.
+var weekdayNames = map[string]time.Weekday{
+	"sunday": time.Sunday, "sun": time.Sunday,
+	"monday": time.Monday, "mon": time.Monday,
+	"tuesday": time.Tuesday, "tue": time.Tuesday,
+	"wednesday": time.Wednesday, "wed": time.Wednesday,
+	"thursday": time.Thursday, "thu": time.Thursday,
+	"friday": time.Friday, "fri": time.Friday,
+	"saturday": time.Saturday, "sat": time.Saturday,
+}
+
+// dateDiff returns the number of unit boundaries between start and end,
+// negative when end is before start.
+func dateDiff(start, end time.Time, unit string, startOfWeek time.Weekday) int64 {
+	switch unit {
+	case "year":
+		return int64(end.Year() - start.Year())
+	case "quarter":
+		return int64((end.Year()-start.Year())*4 + (int(end.Month())-1)/3 - (int(start.Month())-1)/3)
+	case "month":
+		return int64((end.Year()-start.Year())*12 + int(end.Month()) - int(start.Month()))
+	case "week":
+		return civilDays(weekStart(start, startOfWeek), weekStart(end, startOfWeek)) / 7
+	case "day":
+		return civilDays(start, end)
+	case "hour":
+		return int64(end.Truncate(time.Hour).Sub(start.Truncate(time.Hour)) / time.Hour)
+	case "minute":
+		return int64(end.Truncate(time.Minute).Sub(start.Truncate(time.Minute)) / time.Minute)
+	case "second":
+		return int64(end.Truncate(time.Second).Sub(start.Truncate(time.Second)) / time.Second)
+	default: // millisecond
+		return end.Sub(start).Milliseconds()
+	}
+}
+
+// civilDays returns the number of calendar days from the date of start to the
+// date of end, in their own timezones, ignoring daylight saving changes.
+func civilDays(start, end time.Time) int64 {
+	sy, sm, sd := start.Date()
+	ey, em, ed := end.Date()
+	from := time.Date(sy, sm, sd, 0, 0, 0, 0, time.UTC)
+	to := time.Date(ey, em, ed, 0, 0, 0, 0, time.UTC)
+	return int64(to.Sub(from) / (24 * time.Hour))
+}
+
+// weekStart returns the date of the first day of the week containing t.
+func weekStart(t time.Time, startOfWeek time.Weekday) time.Time {
+	back := (int(t.Weekday()) - int(startOfWeek) + 7) % 7
+	return t.AddDate(0, 0, -back)
+}
+
+// handleDateTrunc implements $dateTrunc:
+// { date: <date>, unit: <unit>, binSize: <number>, timezone: <tz>, startOfWeek: <day> }.
+// The date is rounded down to the start of its bin of binSize units (1 by
+// default). As in MongoDB, bins are aligned on 2000-01-01 in the timezone,
+// and weekly bins on the first startOfWeek (Sunday by default) of 2000.
+func handleDateTrunc(env *exprEnv, opVal interface{}) interface{} {
+	spec, ok := opVal.(map[string]interface{})
+	if !ok {
+		return env.fail("$dateTrunc expects an object, got %T", opVal)
+	}
+	unit, ok := dateUnit(env, "$dateTrunc", spec)
+	if !ok {
+		return nil
+	}
+	loc, ok := dateTimezone(env, "$dateTrunc", spec["timezone"])
+	if !ok {
+		return nil
+	}
+	binSize := int64(1)
+	if raw, ok := spec["binSize"]; ok {
+		n, ok := toFloat64(env.eval(raw))
+		if !ok || n < 1 || n != math.Trunc(n) {
+			return env.fail("$dateTrunc binSize must be a positive integer, got %v", raw)
+		}
+		// Bins are counted in months, days or nanoseconds, see truncDate
+		if n >= float64(math.MaxInt64/truncUnitSize(unit)) {
+			return env.fail("$dateTrunc binSize %v is too large for unit %q", raw, unit)
+		}
+		binSize = int64(n)
+	}
+	startOfWeek := time.Sunday
+	if raw, ok := spec["startOfWeek"]; ok && unit == "week" {
+		name, _ := env.eval(raw).(string)
+		day, known := weekdayNames[strings.ToLower(name)]
+		if !known {
+			return env.fail("$dateTrunc startOfWeek must be a day of the week, got %v", raw)
+		}
+		startOfWeek = day
+	}
+	t, ok := dateArgument(env, "$dateTrunc", "date", spec)
+	if !ok {
+		return nil
+	}
+	return truncDate(t.In(loc), unit, binSize, startOfWeek).UTC()
+}
+
+// truncDate rounds t down to the start of its bin of binSize units.
+func truncDate(t time.Time, unit string, binSize int64, startOfWeek time.Weekday) time.Time {
+	loc := t.Location()
+	reference := time.Date(2000, time.January, 1, 0, 0, 0, 0, loc)
+
+	switch unit {
+	case "year", "quarter", "month":
+		bin := truncUnitSize(unit) * binSize
+		months := int64(t.Year()-2000)*12 + int64(t.Month()-1)
+		months = floorDiv(months, bin) * bin
+		return time.Date(2000, time.January+time.Month(months), 1, 0, 0, 0, 0, loc)
+	case "week", "day":
+		if unit == "week" {
+			reference = reference.AddDate(0, 0, (int(startOfWeek)-int(reference.Weekday())+7)%7)
+		}
+		bin := truncUnitSize(unit) * binSize
+		days := floorDiv(civilDays(reference, t), bin) * bin
+		return reference.AddDate(0, 0, int(days))
+	}
+
+	bin := time.Duration(truncUnitSize(unit) * binSize)
+	elapsed := t.Sub(reference)
+	return reference.Add(time.Duration(floorDiv(int64(elapsed), int64(bin))) * bin)
+}
+
+// truncUnitSize returns the size of a $dateTrunc unit in the unit truncDate
+// counts its bins in: months for years, quarters and months, days for weeks
+// and days, nanoseconds for the others.
+func truncUnitSize(unit string) int64 {
+	switch unit {
+	case "year":
+		return 12
+	case "quarter":
+		return 3
+	case "week":
+		return 7
+	case "hour":
+		return int64(time.Hour)
+	case "minute":
+		return int64(time.Minute)
+	case "second":
+		return int64(time.Second)
+	case "millisecond":
+		return int64(time.Millisecond)
+	}
+	return 1 // month, day
+}
+
+// floorDiv divides rounding towards negative infinity.
+func floorDiv(a, b int64) int64 {
+	q := a / b
+	if (a%b != 0) && ((a < 0) != (b < 0)) {
+		q--
+	}
+	return q
+}
+
+// handleDateFromParts implements $dateFromParts, which builds a date from
+// either calendar parts:
+//
+//	{ year, month, day, hour, minute, second, millisecond, timezone }
+//
+// or ISO 8601 week parts:
+//
+//	{ isoWeekYear, isoWeek, isoDayOfWeek, hour, minute, second, millisecond, timezone }
+//
+// Only year or isoWeekYear is required; month, day, isoWeek and isoDayOfWeek
+// default to 1 and the time parts to 0. Parts out of their usual range carry
+// over, so { year: 2024, month: 14 } is February 2025. A null part yields null.
+func handleDateFromParts(env *exprEnv, opVal interface{}) interface{} {
+	spec, ok := opVal.(map[string]interface{})
+	if !ok {
+		return env.fail("$dateFromParts expects an object, got %T", opVal)
+	}
+	_, hasYear := spec["year"]
+	_, hasISOYear := spec["isoWeekYear"]
+	if hasYear == hasISOYear {
+		return env.fail("$dateFromParts requires either year or isoWeekYear")
+	}
+
+	fields := []string{"year", "month", "day", "hour", "minute", "second", "millisecond"}
+	if hasISOYear {
+		fields = []string{"isoWeekYear", "isoWeek", "isoDayOfWeek", "hour", "minute", "second", "millisecond"}
+	}
+	allowed := map[string]bool{"timezone": true}
+	for _, name := range fields {
+		allowed[name] = true
+	}
+	for name := range spec {
+		if !allowed[name] {
+			return env.fail("$dateFromParts: unexpected part %q with %s", name, fields[0])
+		}
+	}
+
+	parts := make(map[string]int)
+	for _, name := range fields {
+		raw, ok := spec[name]
+		if !ok {
+			continue
+		}
+		value := env.eval(raw)
+		if value == nil {
+			return nil
+		}
+		n, ok := toFloat64(value)
+		if _, isStr := value.(string); !ok || isStr || n != math.Trunc(n) {
+			return env.fail("$dateFromParts %s must be an integer, got %v", name, value)
+		}
+		parts[name] = int(n)
+	}
+	if year := parts[fields[0]]; year < 1 || year > 9999 {
+		return env.fail("$dateFromParts %s must be between 1 and 9999, got %d", fields[0], year)
+	}
+
+	loc, ok := dateTimezone(env, "$dateFromParts", spec["timezone"])
+	if !ok {
+		return nil
+	}
+
+	clock := time.Duration(parts["hour"])*time.Hour +
+		time.Duration(parts["minute"])*time.Minute +
+		time.Duration(parts["second"])*time.Second +
+		time.Duration(parts["millisecond"])*time.Millisecond
+
+	if hasISOYear {
+		week, day := 1, 1
+		if n, ok := parts["isoWeek"]; ok {
+			week = n
+		}
+		if n, ok := parts["isoDayOfWeek"]; ok {
+			day = n
+		}
+		return localTime(isoWeekDate(parts["isoWeekYear"], week, day, loc), clock).UTC()
+	}
+
+	month, day := 1, 1
+	if n, ok := parts["month"]; ok {
+		month = n
+	}
+	if n, ok := parts["day"]; ok {
+		day = n
+	}
+	midnight := time.Date(parts["year"], time.Month(month), day, 0, 0, 0, 0, loc)
+	return localTime(midnight, clock).UTC()
+}
+
+// isoWeekDate returns midnight of the given ISO 8601 week date in loc.
+func isoWeekDate(year, week, day int, loc *time.Location) time.Time {
+	// ISO week 1 is the week containing January 4
+	jan4 := time.Date(year, time.January, 4, 0, 0, 0, 0, loc)
+	monday := jan4.AddDate(0, 0, -(datePart("$isoDayOfWeek", jan4) - 1))
+	return monday.AddDate(0, 0, (week-1)*7+day-1)
+}
+
+// localTime returns the time at clock past midnight on the date of midnight,
+// read as a wall clock time in its timezone.
+func localTime(midnight time.Time, clock time.Duration) time.Time {
+	year, month, day := midnight.Date()
+	return time.Date(year, month, day, 0, 0, 0, int(clock), midnight.Location())
+}
+
+// handleDateToParts implements $dateToParts:
+// { date: <date>, timezone: <tz>, iso8601: <bool> }.
+// It returns a document with the year, month, day, hour, minute, second and
+// millisecond of the date, or with iso8601 its isoWeekYear, isoWeek and
+// isoDayOfWeek instead of the year, month and day. A null date yields null.
+func handleDateToParts(env *exprEnv, opVal interface{}) interface{} {
+	spec, ok := opVal.(map[string]interface{})
+	if !ok {
+		return env.fail("$dateToParts expects an object, got %T", opVal)
+	}
+	iso := false
+	if raw, ok := spec["iso8601"]; ok {
+		if iso, ok = env.eval(raw).(bool); !ok {
+			return env.fail("$dateToParts iso8601 must be a boolean, got %v", raw)
+		}
+	}
+	loc, ok := dateTimezone(env, "$dateToParts", spec["timezone"])
+	if !ok {
+		return nil
+	}
+	t, ok := dateArgument(env, "$dateToParts", "date", spec)
+	if !ok {
+		return nil
+	}
+	t = t.In(loc)
+
+	parts := map[string]interface{}{
+		"hour":        t.Hour(),
+		"minute":      t.Minute(),
+		"second":      t.Second(),
+		"millisecond": datePart("$millisecond", t),
+	}
+	if iso {
+		parts["isoWeekYear"] = datePart("$isoWeekYear", t)
+		parts["isoWeek"] = datePart("$isoWeek", t)
+		parts["isoDayOfWeek"] = datePart("$isoDayOfWeek", t)
+	} else {
+		parts["year"] = t.Year()
+		parts["month"] = int(t.Month())
+		parts["day"] = t.Day()
+	}
+	return parts
+}
+
+// handleDateFromString implements $dateFromString:
+// { dateString: <string>, format: <format>, timezone: <tz>, onError: <expr>, onNull: <expr> }.
+// Without a format, ISO 8601 dates such as "2024-03-10", "2024-03-10 15:04"
+// or "2024-03-10T15:04:05.123+02:00" are accepted. Dates without an offset
+// are read in the timezone, UTC by default; a date string with an offset
+// can't be combined with a timezone. A null or missing dateString yields
+// onNull (null by default), and a string that can't be parsed yields onError
+// if it is given.
+func handleDateFromString(env *exprEnv, opVal interface{}) interface{} {
+	spec, ok := opVal.(map[string]interface{})
+	if !ok {
+		return env.fail("$dateFromString expects an object, got %T", opVal)
+	}
+	for name := range spec {
+		switch name {
+		case "dateString", "format", "timezone", "onError", "onNull":
+		default:
+			return env.fail("$dateFromString: unknown argument %q", name)
+		}
+	}
+
+	format := ""
+	if raw, ok := spec["format"]; ok {
+		if format, ok = env.eval(raw).(string); !ok {
+			return env.fail("$dateFromString format must be a string, got %v", raw)
+		}
+	}
+	loc, ok := dateTimezone(env, "$dateFromString", spec["timezone"])
+	if !ok {
+		return nil
+	}
+	_, hasTimezone := spec["timezone"]
+
+	value := env.eval(spec["dateString"])
+	if value == nil {
+		return env.eval(spec["onNull"])
+	}
+
+	var t time.Time
+	var err error
+	if s, isString := value.(string); !isString {
+		err = fmt.Errorf("dateString must be a string, got %T", value)
+	} else if format == "" {
+		t, err = parseISODate(s, loc, hasTimezone)
+	} else {
+		t, err = parseDateFormat(s, format, loc, hasTimezone)
+	}
+	if err != nil {
+		if onError, ok := spec["onError"]; ok {
+			return env.eval(onError)
+		}
+		return env.fail("$dateFromString: %v", err)
+	}
+	return t.UTC()
+}
+
+// isoDateLayouts are the layouts accepted by $dateFromString without a
+// format, with and without a UTC offset.
+var isoDateLayouts = []string{
+	"2006-01-02T15:04:05.999999999",
+	"2006-01-02 15:04:05.999999999",
+	"2006-01-02T15:04",
+	"2006-01-02 15:04",
+	"2006-01-02",
+}
+
+// parseISODate parses an ISO 8601 date, in loc when it has no offset.
+func parseISODate(s string, loc *time.Location, hasTimezone bool) (time.Time, error) {
+	for _, layout := range isoDateLayouts {
+		if t, err := time.ParseInLocation(layout, s, loc); err == nil {
+			return t, nil
+		}
+		for _, zone := range []string{"Z07:00", "Z0700", "Z07"} {
+			if t, err := time.Parse(layout+zone, s); err == nil {
+				if hasTimezone {
+					return time.Time{}, fmt.Errorf("%q has an offset and can't be used with a timezone", s)
+				}
+				return t, nil
+			}
+		}
+	}
+	return time.Time{}, fmt.Errorf("can't parse %q as a date", s)
+}
+
+// parseDateFormat parses s according to a MongoDB date format, in loc unless
+// the format includes an offset (%z or %Z). Supported specifiers:
+//
+//	%Y year          %m month (1-12)   %d day of month   %j day of year
+//	%H hour (0-23)   %M minute         %S second         %L millisecond
+//	%G ISO year      %V ISO week       %u ISO day of week (1-7, Monday first)
+//	%b %B month name (abbreviated or full)
+//	%z offset (+hhmm or +hh:mm)        %Z offset in minutes (+mmm)
+//	%% a literal %
+func parseDateFormat(s, format string, loc *time.Location, hasTimezone bool) (time.Time, error) {
+	parts := map[byte]int{}
+	offset, hasOffset := 0, false
+	pos := 0
+
+	for i := 0; i < len(format); i++ {
+		if format[i] != '%' {
+			if pos >= len(s) || s[pos] != format[i] {
+				return time.Time{}, fmt.Errorf("%q doesn't match format %q", s, format)
+			}
+			pos++
+			continue
+		}
+		if i+1 >= len(format) {
+			return time.Time{}, fmt.Errorf("format %q ends with %%", format)
+		}
+		i++
+		spec := format[i]
+
+		var n, width int
+		var err error
+		switch spec {
+		case '%':
+			if pos >= len(s) || s[pos] != '%' {
+				return time.Time{}, fmt.Errorf("%q doesn't match format %q", s, format)
+			}
+			pos++
+			continue
+		case 'Y', 'G':
+			n, width, err = parseDateDigits(s[pos:], 4, 4)
+		case 'm', 'd', 'H', 'M', 'S', 'V':
+			n, width, err = parseDateDigits(s[pos:], 1, 2)
+		case 'j', 'L':
+			n, width, err = parseDateDigits(s[pos:], 1, 3)
+		case 'u':
+			n, width, err = parseDateDigits(s[pos:], 1, 1)
+		case 'b', 'B':
+			n, width, err = parseMonthName(s[pos:])
+			spec = 'm'
+		case 'z', 'Z':
+			offset, width, err = parseDateOffset(s[pos:], spec)
+			hasOffset = true
+		default:
+			return time.Time{}, fmt.Errorf("unsupported format specifier %%%c", spec)
+		}
+		if err != nil {
+			return time.Time{}, fmt.Errorf("%q doesn't match format %q: %v", s, format, err)
+		}
+		if spec != 'z' && spec != 'Z' {
+			if _, dup := parts[spec]; dup {
+				return time.Time{}, fmt.Errorf("format %q repeats %%%c", format, spec)
+			}
+			parts[spec] = n
+		}
+		pos += width
+	}
+	if pos != len(s) {
+		return time.Time{}, fmt.Errorf("%q has trailing characters after format %q", s, format)
+	}
+
+	if hasOffset {
+		if hasTimezone {
+			return time.Time{}, fmt.Errorf("%q has an offset and can't be used with a timezone", s)
+		}
+		loc = time.FixedZone("", offset)
+	}
+
+	// Range checks; time.Date would silently normalize out-of-range values
+	limits := map[byte][2]int{
+		'm': {1, 12}, 'd': {1, 31}, 'j': {1, 366}, 'H': {0, 23}, 'M': {0, 59},
+		'S': {0, 59}, 'L': {0, 999}, 'V': {1, 53}, 'u': {1, 7},
+	}
+	for spec, n := range parts {
+		if limit, ok := limits[spec]; ok && (n < limit[0] || n > limit[1]) {
+			return time.Time{}, fmt.Errorf("%%%c value %d out of range in %q", spec, n, s)
+		}
+	}
+
+	clock := time.Duration(parts['H'])*time.Hour +
+		time.Duration(parts['M'])*time.Minute +
+		time.Duration(parts['S'])*time.Second +
+		time.Duration(parts['L'])*time.Millisecond
+
+	if isoYear, ok := parts['G']; ok {
+		if _, mixed := parts['Y']; mixed {
+			return time.Time{}, fmt.Errorf("format %q mixes %%G and %%Y", format)
+		}
+		week, day := 1, 1
+		if n, ok := parts['V']; ok {
+			week = n
+		}
+		if n, ok := parts['u']; ok {
+			day = n
+		}
+		return localTime(isoWeekDate(isoYear, week, day, loc), clock), nil
+	}
+
+	year := 1970
+	if n, ok := parts['Y']; ok {
+		year = n
+	}
+	var midnight time.Time
+	if dayOfYear, ok := parts['j']; ok {
+		midnight = time.Date(year, time.January, dayOfYear, 0, 0, 0, 0, loc)
+		if midnight.Year() != year {
+			return time.Time{}, fmt.Errorf("day of year %d out of range in %q", dayOfYear, s)
+		}
+	} else {
+		month, day := 1, 1
+		if n, ok := parts['m']; ok {
+			month = n
+		}
+		if n, ok := parts['d']; ok {
+			day = n
+		}
+		midnight = time.Date(year, time.Month(month), day, 0, 0, 0, 0, loc)
+		if midnight.Day() != day {
+			return time.Time{}, fmt.Errorf("invalid day %d of month %d in %q", day, month, s)
+		}
+	}
+	return localTime(midnight, clock), nil
+}
+
+// parseDateDigits parses between min and max leading digits of s.
+func parseDateDigits(s string, min, max int) (int, int, error) {
+	width := 0
+	for width < max && width < len(s) && s[width] >= '0' && s[width] <= '9' {
+		width++
+	}
+	if width < min {
+		return 0, 0, fmt.Errorf("expected %d digits", min)
+	}
+	n, _ := strconv.Atoi(s[:width])
+	return n, width, nil
+}
+
+// parseMonthName parses a leading full or abbreviated English month name.
+func parseMonthName(s string) (int, int, error) {
+	lower := strings.ToLower(s)
+	for month := time.January; month <= time.December; month++ {
+		name := strings.ToLower(month.String())
+		if strings.HasPrefix(lower, name) {
+			return int(month), len(name), nil
+		}
+	}
+	for month := time.January; month <= time.December; month++ {
+		if strings.HasPrefix(lower, strings.ToLower(month.String()[:3])) {
+			return int(month), 3, nil
+		}
+	}
+	return 0, 0, fmt.Errorf("expected a month name")
+}
+
+// parseDateOffset parses a leading UTC offset: "+hhmm", "+hh:mm" or "Z" for
+// %z, a number of minutes such as "+120" for %Z. It returns seconds.
+func parseDateOffset(s string, spec byte) (int, int, error) {
+	if spec == 'z' && strings.HasPrefix(s, "Z") {
+		return 0, 1, nil
+	}
+	if s == "" || (s[0] != '+' && s[0] != '-') {
+		return 0, 0, fmt.Errorf("expected a UTC offset")
+	}
+	sign := 1
+	if s[0] == '-' {
+		sign = -1
+	}
+
+	if spec == 'Z' {
+		minutes, width, err := parseDateDigits(s[1:], 1, 4)
+		if err != nil {
+			return 0, 0, err
+		}
+		return sign * minutes * 60, 1 + width, nil
+	}
+
+	hours, width, err := parseDateDigits(s[1:], 2, 2)
+	if err != nil {
+		return 0, 0, err
+	}
+	width++
+	if width < len(s) && s[width] == ':' {
+		width++
+	}
+	minutes, minutesWidth, err := parseDateDigits(s[width:], 2, 2)
+	if err != nil {
+		return 0, 0, err
+	}
+	return sign * (hours*3600 + minutes*60), width + minutesWidth, nil
+}
@@ -0,0 +1,79 @@
+package marco
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// dateExpressionResult evaluates the expression 'expr' in a $project on a
+// collection holding one document, and returns its "v" field.
+func dateExpressionResult(t *testing.T, db *DB, expr string) (interface{}, error) {
+	t.Helper()
+	results, err := db.Query("dates", `[{"$project": {"_id": 0, "v": `+expr+`}}]`)
+	if err != nil {
+		return nil, err
+	}
+	if len(results) != 1 {
+		t.Fatalf("got %d results, want 1", len(results))
+	}
+	return results[0]["v"], nil
+}
+
+const testDate = `{"$dateFromString": {"dateString": "2024-05-17T10:42:00Z"}}`
+
+func TestDateTruncBinSize(t *testing.T) {
+	db := openTestDB(t, map[string][]string{"dates": {`{"a": 1}`}})
+
+	v, err := dateExpressionResult(t, db, `{"$dateTrunc": {"date": `+testDate+`, "unit": "hour", "binSize": 6}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := time.Date(2024, time.May, 17, 6, 0, 0, 0, time.UTC); v != want {
+		t.Errorf("got %v, want %v", v, want)
+	}
+
+	// size * binSize would overflow int64
+	for _, c := range []struct{ unit, binSize string }{
+		{"millisecond", "288230376151711744"},
+		{"hour", "1e16"},
+		{"month", "9.3e18"},
+		{"week", "1.4e18"},
+		{"day", "1e300"},
+	} {
+		_, err := dateExpressionResult(t, db, `{"$dateTrunc": {"date": `+testDate+`, "unit": "`+c.unit+`", "binSize": `+c.binSize+`}}`)
+		if err == nil || !strings.Contains(err.Error(), "too large") {
+			t.Errorf("unit %s, binSize %s: got error %v, want binSize too large", c.unit, c.binSize, err)
+		}
+	}
+}
+
+func TestDateAddOverflow(t *testing.T) {
+	db := openTestDB(t, map[string][]string{"dates": {`{"a": 1}`}})
+
+	// More hours than a time.Duration holds
+	v, err := dateExpressionResult(t, db, `{"$dateAdd": {"startDate": `+testDate+`, "unit": "hour", "amount": 3000000}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := time.Date(2024, time.May, 17, 10, 42, 0, 0, time.UTC).AddDate(0, 0, 125000); v != want {
+		t.Errorf("got %v, want %v", v, want)
+	}
+
+	for _, expr := range []string{
+		`{"$dateSubtract": {"startDate": ` + testDate + `, "unit": "year", "amount": 1e18}}`,
+		`{"$dateAdd": {"startDate": ` + testDate + `, "unit": "millisecond", "amount": 9.3e18}}`,
+		`{"$dateAdd": {"startDate": ` + testDate + `, "unit": "hour", "amount": -1e300}}`,
+	} {
+		if _, err := dateExpressionResult(t, db, expr); err == nil || !strings.Contains(err.Error(), "overflows") {
+			t.Errorf("%s: got error %v, want an overflow", expr, err)
+		}
+	}
+
+	// Each amount fits, the sum does not
+	inner := `{"$dateAdd": {"startDate": ` + testDate + `, "unit": "millisecond", "amount": 9.2e18}}`
+	_, err = dateExpressionResult(t, db, `{"$dateAdd": {"startDate": `+inner+`, "unit": "millisecond", "amount": 9.2e18}}`)
+	if err == nil || !strings.Contains(err.Error(), "out of the range") {
+		t.Errorf("got error %v, want a result out of range", err)
+	}
+}
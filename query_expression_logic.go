@@ -0,0 +1,301 @@
+package marco
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Boolean, conditional and comparison expression operators.
+
+func handleAnd(env *exprEnv, opVal interface{}) interface{} {
+	arr, ok := env.expressionArgs("$and", opVal, 0, -1)
+	if !ok {
+		return false
+	}
+	for _, item := range arr {
+		if !toBool(env.eval(item)) {
+			return false
+		}
+	}
+	return true
+}
+
+func handleOr(env *exprEnv, opVal interface{}) interface{} {
+	arr, ok := env.expressionArgs("$or", opVal, 0, -1)
+	if !ok {
+		return false
+	}
+	for _, item := range arr {
+		if toBool(env.eval(item)) {
+			return true
+		}
+	}
+	return false
+}
+
+func handleNot(env *exprEnv, opVal interface{}) interface{} {
+	return !toBool(env.eval(unwrapSingleArg(opVal)))
+}
+
+// $cond can have two formats:
+// 1) $cond: { if: <expr>, then: <expr>, else: <expr> }
+// 2) $cond: [ <if>, <then>, <else> ]
+// Only the selected branch is evaluated.
+func handleCond(env *exprEnv, opVal interface{}) interface{} {
+	var ifExpr, thenExpr, elseExpr interface{}
+	switch condVal := opVal.(type) {
+	case map[string]interface{}:
+		ifExpr, thenExpr, elseExpr = condVal["if"], condVal["then"], condVal["else"]
+	case []interface{}:
+		if len(condVal) != 3 {
+			return env.fail("$cond expects 3 arguments, got %d", len(condVal))
+		}
+		ifExpr, thenExpr, elseExpr = condVal[0], condVal[1], condVal[2]
+	default:
+		return env.fail("$cond expects an object or an array, got %T", opVal)
+	}
+
+	if toBool(env.eval(ifExpr)) {
+		return env.eval(thenExpr)
+	}
+	return env.eval(elseExpr)
+}
+
+// handleSwitch implements $switch:
+// { branches: [ { case: <expr>, then: <expr> }, ... ], default: <expr> }.
+// It returns the then of the first branch whose case is true; later cases
+// and thens are not evaluated. Without a matching branch it returns default,
+// which is then required.
+func handleSwitch(env *exprEnv, opVal interface{}) interface{} {
+	spec, ok := opVal.(map[string]interface{})
+	if !ok {
+		return env.fail("$switch expects an object with branches, got %T", opVal)
+	}
+	for name := range spec {
+		if name != "branches" && name != "default" {
+			return env.fail("$switch has unknown field %q", name)
+		}
+	}
+	branches, ok := spec["branches"].([]interface{})
+	if !ok || len(branches) == 0 {
+		return env.fail("$switch requires a non-empty branches array")
+	}
+
+	for i, raw := range branches {
+		branch, ok := raw.(map[string]interface{})
+		if !ok {
+			return env.fail("$switch branch %d must be an object, got %T", i, raw)
+		}
+		caseExpr, hasCase := branch["case"]
+		thenExpr, hasThen := branch["then"]
+		if !hasCase || !hasThen || len(branch) != 2 {
+			return env.fail("$switch branch %d must have exactly the fields case and then", i)
+		}
+		if toBool(env.eval(caseExpr)) {
+			return env.eval(thenExpr)
+		}
+	}
+
+	defaultExpr, ok := spec["default"]
+	if !ok {
+		return env.fail("$switch found no matching branch and has no default")
+	}
+	return env.eval(defaultExpr)
+}
+
+// $cmp, $eq, $ne, $gt, $gte, $lt and $lte expect opVal = [ <expr1>, <expr2> ]; both sides
+// can be field references, which allows field-vs-field comparisons like [ "$spent", "$budget" ].
+// Values of any types are compared, in the MongoDB order of compareValues: for
+// instance every string is greater than every number. Strings are compared with
+// the session collation.
+func handleComparison(env *exprEnv, op string, opVal interface{}) interface{} {
+	arr, ok := env.expressionArgs(op, opVal, 2, 2)
+	if !ok {
+		return nil
+	}
+	left := env.eval(arr[0])
+	right := env.eval(arr[1])
+
+	cmp := compareValues(left, right, sessionCollation(env.ctx))
+	switch op {
+	case "$cmp":
+		return cmp
+	case "$eq":
+		return cmp == 0
+	case "$ne":
+		return cmp != 0
+	case "$gt":
+		return cmp > 0
+	case "$gte":
+		return cmp >= 0
+	case "$lt":
+		return cmp < 0
+	default: // $lte
+		return cmp <= 0
+	}
+}
+
+// valuesEqual compares two evaluated values; numbers are equal when numerically equal
+// regardless of their Go type, documents and arrays when their contents are.
+func valuesEqual(left, right interface{}) bool {
+	return compareValues(left, right, nil) == 0
+}
+
+// Type ranks of compareValues, in the MongoDB comparison order.
+const (
+	rankNull = iota
+	rankNumber
+	rankString
+	rankObject
+	rankArray
+	rankBinData
+	rankBool
+	rankDate
+	rankOther
+)
+
+// valueTypeRank returns the rank of the type of value in the comparison order.
+func valueTypeRank(value interface{}) int {
+	switch v := value.(type) {
+	case nil:
+		return rankNull
+	case json.Number:
+		return rankNumber
+	case string:
+		return rankString
+	case map[string]interface{}:
+		return rankObject
+	case []byte:
+		return rankBinData
+	case bool:
+		return rankBool
+	case time.Time:
+		return rankDate
+	default:
+		if _, ok := toInterfaceSlice(v); ok {
+			return rankArray
+		}
+		if _, ok := toFloat64(v); ok {
+			return rankNumber
+		}
+		return rankOther
+	}
+}
+
+// compareValues orders any two values as MongoDB does and returns -1, 0 or
+// 1. Values of different types are ordered by type: null, numbers, strings,
+// objects, arrays, binary data, booleans, then dates. Objects are compared
+// field by field, in field name order, and arrays element by element. Strings
+// are compared with collation, byte by byte if nil.
+func compareValues(left, right interface{}, collation *Collation) int {
+	lr, rr := valueTypeRank(left), valueTypeRank(right)
+	if lr != rr {
+		return compareInts(lr, rr)
+	}
+
+	switch lr {
+	case rankNumber:
+		ln, _ := numberValue(left)
+		rn, _ := numberValue(right)
+		switch {
+		case ln < rn:
+			return -1
+		case ln > rn:
+			return 1
+		}
+		return 0
+	case rankString:
+		if collation != nil {
+			return collation.compare(left.(string), right.(string))
+		}
+		return strings.Compare(left.(string), right.(string))
+	case rankObject:
+		return compareObjects(left.(map[string]interface{}), right.(map[string]interface{}), collation)
+	case rankArray:
+		la, _ := toInterfaceSlice(left)
+		ra, _ := toInterfaceSlice(right)
+		for i := 0; i < len(la) && i < len(ra); i++ {
+			if cmp := compareValues(la[i], ra[i], collation); cmp != 0 {
+				return cmp
+			}
+		}
+		return compareInts(len(la), len(ra))
+	case rankBinData:
+		lb, rb := left.([]byte), right.([]byte)
+		if len(lb) != len(rb) {
+			return compareInts(len(lb), len(rb))
+		}
+		return bytes.Compare(lb, rb)
+	case rankBool:
+		lb, rb := left.(bool), right.(bool)
+		if lb == rb {
+			return 0
+		}
+		if rb {
+			return -1
+		}
+		return 1
+	case rankDate:
+		lt, rt := left.(time.Time), right.(time.Time)
+		switch {
+		case lt.Before(rt):
+			return -1
+		case lt.After(rt):
+			return 1
+		}
+		return 0
+	}
+	return strings.Compare(fmt.Sprintf("%v", left), fmt.Sprintf("%v", right))
+}
+
+// compareObjects compares two documents field by field, in field name order:
+// first the names, then the values.
+func compareObjects(left, right map[string]interface{}, collation *Collation) int {
+	lk, rk := sortedKeys(left), sortedKeys(right)
+	for i := 0; i < len(lk) && i < len(rk); i++ {
+		if cmp := strings.Compare(lk[i], rk[i]); cmp != 0 {
+			return cmp
+		}
+		if cmp := compareValues(left[lk[i]], right[rk[i]], collation); cmp != 0 {
+			return cmp
+		}
+	}
+	return compareInts(len(lk), len(rk))
+}
+
+// numberValue converts a number of any Go type, json.Number included, to a
+// float64.
+func numberValue(value interface{}) (float64, bool) {
+	if n, ok := value.(json.Number); ok {
+		f, err := n.Float64()
+		return f, err == nil
+	}
+	if _, isString := value.(string); isString {
+		return 0, false
+	}
+	return toFloat64(value)
+}
+
+func compareInts(a, b int) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+// sortedKeys returns the field names of doc in ascending order.
+func sortedKeys(doc map[string]interface{}) []string {
+	keys := make([]string, 0, len(doc))
+	for key := range doc {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
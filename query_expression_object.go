@@ -0,0 +1,144 @@
+package marco
+
+// Object expression operators.
+
+// fieldOperatorArgs evaluates the arguments of $getField, $setField and
+// $unsetField: { field: <string>, input: <object>, value: <expr> }. allowed
+// lists the accepted argument names. $getField also accepts the field name
+// alone. input defaults to $$CURRENT.
+func fieldOperatorArgs(env *exprEnv, op string, opVal interface{}, allowed ...string) (spec map[string]interface{}, field string, input interface{}, ok bool) {
+	spec, isSpec := opVal.(map[string]interface{})
+	if _, unknown := unknownField(spec, allowed); !isSpec || op == "$getField" && unknown {
+		// $getField: <field name>
+		spec = map[string]interface{}{"field": opVal}
+	}
+	if name, unknown := unknownField(spec, allowed); unknown {
+		env.fail("%s has unknown field %q", op, name)
+		return nil, "", nil, false
+	}
+
+	fieldValue := env.eval(spec["field"])
+	field, isString := fieldValue.(string)
+	if !isString {
+		env.fail("%s field must evaluate to a string, got %T", op, fieldValue)
+		return nil, "", nil, false
+	}
+	if inputExpr, present := spec["input"]; present {
+		input = env.eval(inputExpr)
+	} else {
+		input = env.current
+	}
+	return spec, field, input, true
+}
+
+// unknownField returns a field of spec that is not in names.
+func unknownField(spec map[string]interface{}, names []string) (string, bool) {
+	for field := range spec {
+		known := false
+		for _, name := range names {
+			if field == name {
+				known = true
+				break
+			}
+		}
+		if !known {
+			return field, true
+		}
+	}
+	return "", false
+}
+
+// handleGetField implements $getField: { field: <string>, input: <object> }
+// or $getField: <string>. The field name is taken as is, so names containing
+// dots or starting with "$" can be read. It returns null if the field is
+// missing or input is null or missing.
+func handleGetField(env *exprEnv, opVal interface{}) interface{} {
+	_, field, input, ok := fieldOperatorArgs(env, "$getField", opVal, "field", "input")
+	if !ok || input == nil {
+		return nil
+	}
+	doc, isDoc := input.(map[string]interface{})
+	if !isDoc {
+		return env.fail("$getField input must be an object, got %T", input)
+	}
+	return doc[field]
+}
+
+// handleSetField implements $setField: { field: <string>, input: <object>,
+// value: <expr> }. It returns a copy of input with the field, named as is,
+// set to value, or removed if value is $$REMOVE. A null or missing input
+// yields null.
+func handleSetField(env *exprEnv, opVal interface{}) interface{} {
+	spec, field, input, ok := fieldOperatorArgs(env, "$setField", opVal, "field", "input", "value")
+	if !ok {
+		return nil
+	}
+	valueExpr, present := spec["value"]
+	if !present {
+		return env.fail("$setField requires a value")
+	}
+	if _, present := spec["input"]; !present {
+		return env.fail("$setField requires an input")
+	}
+	value := env.eval(valueExpr)
+	remove := *env.removed
+	return setDocumentField(env, "$setField", input, field, value, remove)
+}
+
+// handleUnsetField implements $unsetField: { field: <string>, input: <object> },
+// a shortcut for $setField with value $$REMOVE.
+func handleUnsetField(env *exprEnv, opVal interface{}) interface{} {
+	spec, field, input, ok := fieldOperatorArgs(env, "$unsetField", opVal, "field", "input")
+	if !ok {
+		return nil
+	}
+	if _, present := spec["input"]; !present {
+		return env.fail("$unsetField requires an input")
+	}
+	return setDocumentField(env, "$unsetField", input, field, nil, true)
+}
+
+// setDocumentField returns a shallow copy of input with field set to value,
+// or removed.
+func setDocumentField(env *exprEnv, op string, input interface{}, field string, value interface{}, remove bool) interface{} {
+	if input == nil {
+		return nil
+	}
+	doc, isDoc := input.(map[string]interface{})
+	if !isDoc {
+		return env.fail("%s input must be an object, got %T", op, input)
+	}
+	result := make(map[string]interface{}, len(doc)+1)
+	for name, fieldValue := range doc {
+		result[name] = fieldValue
+	}
+	if remove {
+		delete(result, field)
+	} else {
+		result[field] = value
+	}
+	return result
+}
+
+// handleMergeObjects implements $mergeObjects: [ <object>, ... ] or
+// $mergeObjects: <object>. It returns a new object with the fields of every
+// object, the last one winning when a field is repeated; fields are merged at
+// the top level only. Null or missing objects are ignored.
+func handleMergeObjects(env *exprEnv, opVal interface{}) interface{} {
+	args, ok := opVal.([]interface{})
+	if !ok {
+		args = []interface{}{opVal}
+	}
+	values := make([]interface{}, 0, len(args))
+	for _, arg := range args {
+		value := env.eval(arg)
+		if value == nil {
+			continue
+		}
+		if _, isDoc := value.(map[string]interface{}); !isDoc {
+			return env.fail("$mergeObjects requires objects, got %T", value)
+		}
+		values = append(values, value)
+	}
+	return mergeObjects(values)
+}
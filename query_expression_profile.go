@@ -0,0 +1,115 @@
+package marco
+
+import (
+	"context"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+// The expression profiler measures the time spent in each operator by the
+// expressions of a query, to find the operators that dominate a pipeline.
+// It samples whole evaluations (one expression against one document): with
+// QueryOptions.ProfileExpressions set to N, each evaluation is timed with a
+// probability of 1/N, so the overhead of reading the clock stays small on
+// large collections. Sampling is random rather than every Nth evaluation,
+// which would always pick the same field of a $project.
+//
+// Operator times are self times: the time spent in the arguments of an
+// operator is charged to the operators of the arguments, so the times of a
+// query add up to the time spent evaluating its sampled expressions.
+
+// ExpressionStats is the time spent in one expression operator.
+type ExpressionStats struct {
+	Operator      string        // e.g. "$regexMatch"
+	Samples       int           // sampled calls of the operator
+	Time          time.Duration // self time measured over the sampled calls
+	EstimatedTime time.Duration // Time scaled to every evaluation of the query
+}
+
+// exprProfile accumulates the operator times of one query.
+type exprProfile struct {
+	every int64
+
+	mu  sync.Mutex
+	ops map[string]*ExpressionStats
+}
+
+// exprSample is the profiling state of one sampled evaluation, shared by the
+// environments derived from its exprEnv.
+type exprSample struct {
+	profile *exprProfile
+	nested  time.Duration // time spent in the arguments of the running operator
+}
+
+// exprProfileKey is the context key of the query's expression profile.
+type exprProfileKey struct{}
+
+// withExprProfile returns a context carrying a profile sampling one
+// evaluation in every.
+func withExprProfile(ctx context.Context, every int) (context.Context, *exprProfile) {
+	profile := &exprProfile{every: int64(every), ops: make(map[string]*ExpressionStats)}
+	return context.WithValue(ctx, exprProfileKey{}, profile), profile
+}
+
+// exprSampleFor returns the profiling state of a new evaluation in ctx, or nil
+// when the query is not profiled or the evaluation is not sampled.
+func exprSampleFor(ctx context.Context) *exprSample {
+	profile, ok := ctx.Value(exprProfileKey{}).(*exprProfile)
+	if !ok {
+		return nil
+	}
+	if profile.every > 1 && rand.Int63n(profile.every) != 0 {
+		return nil
+	}
+	return &exprSample{profile: profile}
+}
+
+// profiledApply is apply, timing the operator.
+func (env *exprEnv) profiledApply(op string, args interface{}) interface{} {
+	sample := env.sample
+	outer := sample.nested
+	sample.nested = 0
+
+	start := time.Now()
+	value := env.apply(op, args)
+	elapsed := time.Since(start)
+
+	sample.profile.record(op, elapsed-sample.nested)
+	sample.nested = outer + elapsed
+	return value
+}
+
+// record adds a sampled call of op.
+func (p *exprProfile) record(op string, self time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	stats, ok := p.ops[op]
+	if !ok {
+		stats = &ExpressionStats{Operator: op}
+		p.ops[op] = stats
+	}
+	stats.Samples++
+	stats.Time += self
+}
+
+// report returns the operator times, the most expensive first.
+func (p *exprProfile) report() []ExpressionStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	report := make([]ExpressionStats, 0, len(p.ops))
+	for _, stats := range p.ops {
+		entry := *stats
+		entry.EstimatedTime = entry.Time * time.Duration(p.every)
+		report = append(report, entry)
+	}
+	sort.Slice(report, func(i, j int) bool {
+		if report[i].Time != report[j].Time {
+			return report[i].Time > report[j].Time
+		}
+		return report[i].Operator < report[j].Operator
+	})
+	return report
+}
@@ -0,0 +1,164 @@
+package marco
+
+// Set operators treat arrays as sets: duplicates are ignored and elements are
+// compared by value, numbers whatever their type and documents and arrays
+// field by field. Arrays returned by these operators hold each element once,
+// in the order it first appears in the arguments.
+
+// valueSet is a set of values keyed by groupKey.
+type valueSet struct {
+	index  map[interface{}]bool
+	values []interface{}
+}
+
+func newValueSet(elems []interface{}) *valueSet {
+	s := &valueSet{index: make(map[interface{}]bool, len(elems))}
+	for _, elem := range elems {
+		s.add(elem)
+	}
+	return s
+}
+
+func (s *valueSet) add(value interface{}) {
+	key := groupKey(value)
+	if !s.index[key] {
+		s.index[key] = true
+		s.values = append(s.values, value)
+	}
+}
+
+func (s *valueSet) has(value interface{}) bool {
+	return s.index[groupKey(value)]
+}
+
+// setArgs evaluates the arguments of a set operator, which must be arrays.
+// With nullable, a null or missing argument makes null true instead of
+// failing.
+func setArgs(env *exprEnv, op string, opVal interface{}, min, max int, nullable bool) (sets [][]interface{}, null bool, ok bool) {
+	args, ok := env.expressionArgs(op, opVal, min, max)
+	if !ok {
+		return nil, false, false
+	}
+	sets = make([][]interface{}, 0, len(args))
+	for _, arg := range args {
+		value := env.eval(arg)
+		if value == nil && nullable {
+			null = true
+			continue
+		}
+		arr, ok := toInterfaceSlice(value)
+		if !ok {
+			env.fail("%s only supports arrays, got %T", op, value)
+			return nil, false, false
+		}
+		sets = append(sets, arr)
+	}
+	return sets, null, true
+}
+
+// handleSetUnion implements $setUnion: [ <array>, ... ]. It returns the
+// elements found in any of the arrays; null if any of them is null or missing.
+func handleSetUnion(env *exprEnv, opVal interface{}) interface{} {
+	sets, null, ok := setArgs(env, "$setUnion", opVal, 0, -1, true)
+	if !ok || null {
+		return nil
+	}
+	union := newValueSet(nil)
+	for _, set := range sets {
+		for _, elem := range set {
+			union.add(elem)
+		}
+	}
+	if union.values == nil {
+		return []interface{}{}
+	}
+	return union.values
+}
+
+// handleSetIntersection implements $setIntersection: [ <array>, ... ]. It
+// returns the elements found in every array; null if any of them is null or
+// missing.
+func handleSetIntersection(env *exprEnv, opVal interface{}) interface{} {
+	sets, null, ok := setArgs(env, "$setIntersection", opVal, 0, -1, true)
+	if !ok || null {
+		return nil
+	}
+	result := []interface{}{}
+	if len(sets) == 0 {
+		return result
+	}
+
+	others := make([]*valueSet, len(sets)-1)
+	for i, set := range sets[1:] {
+		others[i] = newValueSet(set)
+	}
+	for _, elem := range newValueSet(sets[0]).values {
+		inAll := true
+		for _, other := range others {
+			if !other.has(elem) {
+				inAll = false
+				break
+			}
+		}
+		if inAll {
+			result = append(result, elem)
+		}
+	}
+	return result
+}
+
+// handleSetDifference implements $setDifference: [ <array>, <array> ]. It
+// returns the elements of the first array missing from the second; null if
+// either is null or missing.
+func handleSetDifference(env *exprEnv, opVal interface{}) interface{} {
+	sets, null, ok := setArgs(env, "$setDifference", opVal, 2, 2, true)
+	if !ok || null {
+		return nil
+	}
+	excluded := newValueSet(sets[1])
+	result := []interface{}{}
+	for _, elem := range newValueSet(sets[0]).values {
+		if !excluded.has(elem) {
+			result = append(result, elem)
+		}
+	}
+	return result
+}
+
+// handleSetEquals implements $setEquals: [ <array>, <array>, ... ]. It
+// reports whether all the arrays hold the same distinct elements.
+func handleSetEquals(env *exprEnv, opVal interface{}) interface{} {
+	sets, _, ok := setArgs(env, "$setEquals", opVal, 2, -1, false)
+	if !ok {
+		return nil
+	}
+	first := newValueSet(sets[0])
+	for _, set := range sets[1:] {
+		other := newValueSet(set)
+		if len(other.values) != len(first.values) {
+			return false
+		}
+		for _, elem := range other.values {
+			if !first.has(elem) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// handleSetIsSubset implements $setIsSubset: [ <array>, <array> ]. It reports
+// whether every element of the first array is in the second.
+func handleSetIsSubset(env *exprEnv, opVal interface{}) interface{} {
+	sets, _, ok := setArgs(env, "$setIsSubset", opVal, 2, 2, false)
+	if !ok {
+		return nil
+	}
+	superset := newValueSet(sets[1])
+	for _, elem := range sets[0] {
+		if !superset.has(elem) {
+			return false
+		}
+	}
+	return true
+}
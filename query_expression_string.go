@@ -0,0 +1,434 @@
+package marco
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// String expression operators.
+
+// handleConcat expects opVal = []interface{}, each item is an expression.
+// Null or missing values contribute nothing; other non-string values are
+// formatted with their default representation.
+func handleConcat(env *exprEnv, opVal interface{}) interface{} {
+	arr, ok := env.expressionArgs("$concat", opVal, 0, -1)
+	if !ok {
+		return nil
+	}
+
+	var sb strings.Builder
+	for _, item := range arr {
+		switch resolved := env.eval(item).(type) {
+		case nil:
+		case string:
+			sb.WriteString(resolved)
+		default:
+			sb.WriteString(fmt.Sprintf("%v", resolved))
+		}
+	}
+	return sb.String()
+}
+
+// handleSubstrBytes implements $substrBytes and its alias $substr:
+// [ <string>, <byte index>, <byte count> ].
+// A start past the end yields "", a negative count takes the rest of the
+// string. Offsets splitting a multibyte UTF-8 character are an error; use
+// $substrCP to count in characters. Null or missing strings yield "".
+func handleSubstrBytes(env *exprEnv, op string, opVal interface{}) interface{} {
+	arr, ok := env.expressionArgs(op, opVal, 3, 3)
+	if !ok {
+		return nil
+	}
+	s, ok := substringInput(env, op, env.eval(arr[0]))
+	if !ok {
+		return nil
+	}
+	start, ok1 := toInteger(env.eval(arr[1]))
+	count, ok2 := toInteger(env.eval(arr[2]))
+	if !ok1 || !ok2 {
+		return env.fail("%s expects integer index and count", op)
+	}
+
+	if start < 0 || start >= int64(len(s)) {
+		return ""
+	}
+	end := int64(len(s))
+	if count >= 0 && start+count < end {
+		end = start + count
+	}
+	if !utf8.RuneStart(s[start]) || (end < int64(len(s)) && !utf8.RuneStart(s[end])) {
+		return env.fail("%s: byte range [%d, %d) splits a UTF-8 character of %q", op, start, end, s)
+	}
+	return s[start:end]
+}
+
+// handleSubstrCP implements $substrCP: [ <string>, <code point index>, <code point count> ].
+// Indexes count Unicode code points, so multibyte characters are never split.
+func handleSubstrCP(env *exprEnv, opVal interface{}) interface{} {
+	arr, ok := env.expressionArgs("$substrCP", opVal, 3, 3)
+	if !ok {
+		return nil
+	}
+	s, ok := substringInput(env, "$substrCP", env.eval(arr[0]))
+	if !ok {
+		return nil
+	}
+	start, ok1 := toInteger(env.eval(arr[1]))
+	count, ok2 := toInteger(env.eval(arr[2]))
+	if !ok1 || !ok2 || start < 0 || count < 0 {
+		return env.fail("$substrCP expects non-negative integer index and count")
+	}
+
+	runes := []rune(s)
+	if start >= int64(len(runes)) {
+		return ""
+	}
+	end := int64(len(runes))
+	if start+count < end {
+		end = start + count
+	}
+	return string(runes[start:end])
+}
+
+// substringInput converts the string argument of a substring operator:
+// null or missing values are "", numbers are formatted.
+func substringInput(env *exprEnv, op string, value interface{}) (string, bool) {
+	switch v := value.(type) {
+	case nil:
+		return "", true
+	case string:
+		return v, true
+	case int, int8, int16, int32, int64,
+		uint, uint8, uint16, uint32, uint64,
+		float32, float64:
+		return fmt.Sprintf("%v", v), true
+	default:
+		env.fail("%s cannot convert type: %T", op, v)
+		return "", false
+	}
+}
+
+// handleStrLen implements $strLenCP, the number of Unicode code points of a
+// string, and $strLenBytes, its number of UTF-8 bytes.
+func handleStrLen(env *exprEnv, op string, opVal interface{}) interface{} {
+	value := env.eval(unwrapSingleArg(opVal))
+	s, ok := value.(string)
+	if !ok {
+		return env.fail("%s requires a string, got %T", op, value)
+	}
+	if op == "$strLenBytes" {
+		return len(s)
+	}
+	return utf8.RuneCountInString(s)
+}
+
+// handleIndexOf implements $indexOfCP and $indexOfBytes:
+// [ <string>, <substring>, <start>, <end> ].
+// It returns the index of the first occurrence of substring within
+// [start, end), counted in code points or bytes, or -1. A null or missing
+// string yields null.
+func handleIndexOf(env *exprEnv, op string, opVal interface{}) interface{} {
+	arr, ok := env.expressionArgs(op, opVal, 2, 4)
+	if !ok {
+		return nil
+	}
+	value := env.eval(arr[0])
+	if value == nil {
+		return nil
+	}
+	s, ok := value.(string)
+	if !ok {
+		return env.fail("%s requires a string, got %T", op, value)
+	}
+	substring, ok := env.eval(arr[1]).(string)
+	if !ok {
+		return env.fail("%s requires a string to search for", op)
+	}
+
+	// Byte offset of each index; code points map to the byte they start at
+	offsets := make([]int, 0, len(s)+1)
+	if op == "$indexOfCP" {
+		for i := range s {
+			offsets = append(offsets, i)
+		}
+	} else {
+		for i := 0; i < len(s); i++ {
+			offsets = append(offsets, i)
+		}
+	}
+	offsets = append(offsets, len(s))
+
+	start, end := int64(0), int64(len(offsets)-1)
+	if len(arr) > 2 {
+		n, ok := toInteger(env.eval(arr[2]))
+		if !ok || n < 0 {
+			return env.fail("%s start must be a non-negative integer", op)
+		}
+		start = n
+	}
+	if len(arr) > 3 {
+		n, ok := toInteger(env.eval(arr[3]))
+		if !ok || n < 0 {
+			return env.fail("%s end must be a non-negative integer", op)
+		}
+		if n < end {
+			end = n
+		}
+	}
+	if start > end {
+		return -1
+	}
+
+	window := s[offsets[start]:offsets[end]]
+	byteIndex := strings.Index(window, substring)
+	if byteIndex < 0 {
+		return -1
+	}
+	if op == "$indexOfCP" {
+		return int(start) + utf8.RuneCountInString(window[:byteIndex])
+	}
+	return int(start) + byteIndex
+}
+
+// handleSplit implements $split: [ <string>, <delimiter> ]. It returns the
+// parts of string between occurrences of delimiter; a null or missing string
+// yields null.
+func handleSplit(env *exprEnv, opVal interface{}) interface{} {
+	arr, ok := env.expressionArgs("$split", opVal, 2, 2)
+	if !ok {
+		return nil
+	}
+	value := env.eval(arr[0])
+	if value == nil {
+		return nil
+	}
+	s, ok := value.(string)
+	if !ok {
+		return env.fail("$split requires a string, got %T", value)
+	}
+	delimiter, ok := env.eval(arr[1]).(string)
+	if !ok || delimiter == "" {
+		return env.fail("$split requires a non-empty string delimiter")
+	}
+
+	parts := strings.Split(s, delimiter)
+	result := make([]interface{}, len(parts))
+	for i, part := range parts {
+		result[i] = part
+	}
+	return result
+}
+
+// handleToString converts the value of a single expression to a string.
+// Null or missing values convert to the empty string.
+func handleToString(env *exprEnv, opVal interface{}) interface{} {
+	value := env.eval(unwrapSingleArg(opVal))
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case fmt.Stringer:
+		return v.String()
+	case int, int8, int16, int32, int64,
+		uint, uint8, uint16, uint32, uint64,
+		float32, float64, bool:
+		return fmt.Sprintf("%v", v)
+	default:
+		return env.fail("$toString cannot convert type: %T", v)
+	}
+}
+
+// handleCase implements $toUpper and $toLower on a single string expression.
+// Null or missing values convert to the empty string.
+func handleCase(env *exprEnv, op string, opVal interface{}) interface{} {
+	value := env.eval(unwrapSingleArg(opVal))
+	var s string
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		s = v
+	case int, int8, int16, int32, int64,
+		uint, uint8, uint16, uint32, uint64,
+		float32, float64:
+		s = fmt.Sprintf("%v", v)
+	default:
+		return env.fail("%s cannot convert type: %T", op, v)
+	}
+	if op == "$toUpper" {
+		return strings.ToUpper(s)
+	}
+	return strings.ToLower(s)
+}
+
+// handleTrim implements $trim, $ltrim and $rtrim:
+// { input: <string>, chars: <string> }.
+// Without chars, whitespace and the null character are removed; with chars,
+// any of its characters is. A null or missing input yields null.
+func handleTrim(env *exprEnv, op string, opVal interface{}) interface{} {
+	spec, ok := opVal.(map[string]interface{})
+	if !ok {
+		return env.fail("%s expects an object, got %T", op, opVal)
+	}
+	for name := range spec {
+		if name != "input" && name != "chars" {
+			return env.fail("%s: unknown argument %q", op, name)
+		}
+	}
+
+	value := env.eval(spec["input"])
+	if value == nil {
+		return nil
+	}
+	input, ok := value.(string)
+	if !ok {
+		return env.fail("%s input must be a string, got %T", op, value)
+	}
+
+	trimmed := func(r rune) bool { return unicode.IsSpace(r) || r == 0 }
+	if rawChars, ok := spec["chars"]; ok {
+		charsVal := env.eval(rawChars)
+		if charsVal != nil {
+			chars, ok := charsVal.(string)
+			if !ok {
+				return env.fail("%s chars must be a string, got %T", op, charsVal)
+			}
+			trimmed = func(r rune) bool { return strings.ContainsRune(chars, r) }
+		}
+	}
+
+	switch op {
+	case "$ltrim":
+		return strings.TrimLeftFunc(input, trimmed)
+	case "$rtrim":
+		return strings.TrimRightFunc(input, trimmed)
+	default: // $trim
+		return strings.TrimFunc(input, trimmed)
+	}
+}
+
+// handleRegex implements $regexMatch, $regexFind and $regexFindAll:
+// { input: <string>, regex: <pattern>, options: <flags> }.
+// $regexMatch returns whether input matches. $regexFind returns the first
+// match as { match, idx, captures }, or null; $regexFindAll returns an array
+// of them. idx counts code points, and captures holds the captured groups,
+// null for groups that did not participate. A null or missing input does not
+// match. Patterns go through the same cache and limits as $regex.
+func handleRegex(env *exprEnv, op string, opVal interface{}) interface{} {
+	spec, ok := opVal.(map[string]interface{})
+	if !ok {
+		return env.fail("%s expects an object, got %T", op, opVal)
+	}
+	for name := range spec {
+		if name != "input" && name != "regex" && name != "options" {
+			return env.fail("%s: unknown argument %q", op, name)
+		}
+	}
+
+	pattern, ok := env.eval(spec["regex"]).(string)
+	if !ok {
+		return env.fail("%s regex must be a string", op)
+	}
+	options := ""
+	if raw, ok := spec["options"]; ok {
+		if options, ok = env.eval(raw).(string); !ok {
+			return env.fail("%s options must be a string", op)
+		}
+	}
+	re, err := regexCache.get(pattern, options)
+	if err != nil {
+		return env.fail("%s: %v", op, err)
+	}
+
+	value := env.eval(spec["input"])
+	input, isString := value.(string)
+	if value != nil && !isString {
+		return env.fail("%s input must be a string, got %T", op, value)
+	}
+	if value != nil {
+		regexCache.countEvaluation()
+	}
+
+	switch op {
+	case "$regexMatch":
+		return value != nil && re.MatchString(input)
+	case "$regexFind":
+		if value == nil {
+			return nil
+		}
+		loc := re.FindStringSubmatchIndex(input)
+		if loc == nil {
+			return nil
+		}
+		return regexMatchDocument(input, loc)
+	default: // $regexFindAll
+		matches := []interface{}{}
+		if value == nil {
+			return matches
+		}
+		for _, loc := range re.FindAllStringSubmatchIndex(input, -1) {
+			matches = append(matches, regexMatchDocument(input, loc))
+		}
+		return matches
+	}
+}
+
+// regexMatchDocument builds the { match, idx, captures } document of a match
+// located by FindStringSubmatchIndex.
+func regexMatchDocument(input string, loc []int) map[string]interface{} {
+	captures := make([]interface{}, 0, len(loc)/2-1)
+	for i := 2; i+1 < len(loc); i += 2 {
+		if loc[i] < 0 {
+			captures = append(captures, nil)
+			continue
+		}
+		captures = append(captures, input[loc[i]:loc[i+1]])
+	}
+	return map[string]interface{}{
+		"match":    input[loc[0]:loc[1]],
+		"idx":      utf8.RuneCountInString(input[:loc[0]]),
+		"captures": captures,
+	}
+}
+
+// handleReplace implements $replaceOne and $replaceAll:
+// { input: <string>, find: <string>, replacement: <string> }.
+// $replaceOne replaces the first occurrence of find, $replaceAll every one.
+// If any argument is null or missing, the result is null.
+func handleReplace(env *exprEnv, op string, opVal interface{}) interface{} {
+	spec, ok := opVal.(map[string]interface{})
+	if !ok {
+		return env.fail("%s expects an object, got %T", op, opVal)
+	}
+	for name := range spec {
+		if name != "input" && name != "find" && name != "replacement" {
+			return env.fail("%s: unknown argument %q", op, name)
+		}
+	}
+
+	var args [3]string
+	null := false
+	for i, name := range []string{"input", "find", "replacement"} {
+		value := env.eval(spec[name])
+		if value == nil {
+			null = true
+			continue
+		}
+		s, ok := value.(string)
+		if !ok {
+			return env.fail("%s %s must be a string, got %T", op, name, value)
+		}
+		args[i] = s
+	}
+	if null {
+		return nil
+	}
+
+	if op == "$replaceOne" {
+		return strings.Replace(args[0], args[1], args[2], 1)
+	}
+	return strings.ReplaceAll(args[0], args[1], args[2])
+}
@@ -0,0 +1,54 @@
+package marco
+
+import "strings"
+
+// Type expression operators.
+
+// expressionTypeOrder lists the names $type returns, in the order they are
+// tried: dates stored as RFC 3339 strings are dates, and numbers without
+// fractional part are int or long as in $match (see matchesType).
+var expressionTypeOrder = []string{"null", "bool", "date", "string", "int", "long", "double", "decimal", "array", "object", "binData"}
+
+// handleType implements $type: <expression>. It returns the MongoDB name of
+// the type of the value, or "missing" for a field that does not exist.
+func handleType(env *exprEnv, opVal interface{}) interface{} {
+	expr := unwrapSingleArg(opVal)
+	value := env.eval(expr)
+	if value == nil {
+		if path, ok := expr.(string); ok && strings.HasPrefix(path, "$") && !strings.HasPrefix(path, "$$") {
+			if _, exists := getNestedFieldExists(env.current, path[1:]); !exists {
+				return "missing"
+			}
+		}
+	}
+	return expressionTypeName(value)
+}
+
+// expressionTypeName returns the $type name of value.
+func expressionTypeName(value interface{}) string {
+	for _, name := range expressionTypeOrder {
+		if matchesType(value, name) {
+			return name
+		}
+	}
+	return schemaValueType(value)
+}
+
+// handleIsType implements the predicates $isNumber, $isString, $isBool,
+// $isObject and $isDate: <expression>. They report whether the value has the
+// type, matched as by $type in $match.
+func handleIsType(env *exprEnv, op string, opVal interface{}) interface{} {
+	value := env.eval(unwrapSingleArg(opVal))
+	switch op {
+	case "$isNumber":
+		return matchesType(value, "number")
+	case "$isString":
+		return matchesType(value, "string")
+	case "$isBool":
+		return matchesType(value, "bool")
+	case "$isObject":
+		return matchesType(value, "object")
+	default: // $isDate
+		return matchesType(value, "date")
+	}
+}
@@ -0,0 +1,132 @@
+package marco
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// ExpressionFunction is a Go function usable in expressions through the
+// $function operator. It receives the evaluated args of the operator: numbers
+// are float64, documents map[string]interface{} and arrays []interface{}.
+// Its result may be any value encodable as JSON.
+type ExpressionFunction func(args ...interface{}) (interface{}, error)
+
+// ExpressionFunctionContext is an ExpressionFunction that also receives the
+// context of the query (see QueryContext).
+type ExpressionFunctionContext func(ctx context.Context, args ...interface{}) (interface{}, error)
+
+// RegisterFunction makes 'fn' available to expressions under 'name':
+//
+//	db.RegisterFunction("score", func(args ...interface{}) (interface{}, error) {
+//		likes, _ := args[0].(float64)
+//		views, _ := args[1].(float64)
+//		return likes*10 + views, nil
+//	})
+//
+//	db.Query("posts", `[{"$addFields": {"score": {"$function": {"body": "score", "args": ["$likes", "$views"], "lang": "go"}}}}]`)
+//
+// The body of $function names the function, and lang, if present, must be
+// "go". Registering a name again replaces the previous function; a nil
+// function removes it. JavaScript function bodies are not supported.
+func (db *DB) RegisterFunction(name string, fn ExpressionFunction) {
+	if fn == nil {
+		db.RegisterFunctionContext(name, nil)
+		return
+	}
+	db.RegisterFunctionContext(name, func(_ context.Context, args ...interface{}) (interface{}, error) {
+		return fn(args...)
+	})
+}
+
+// RegisterFunctionContext is RegisterFunction for functions that need the
+// context of the query.
+func (db *DB) RegisterFunctionContext(name string, fn ExpressionFunctionContext) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if fn == nil {
+		delete(db.functions, name)
+		return
+	}
+	if db.functions == nil {
+		db.functions = make(map[string]ExpressionFunctionContext)
+	}
+	db.functions[name] = fn
+}
+
+// expressionFunction returns the function registered under 'name', or nil.
+func (db *DB) expressionFunction(name string) ExpressionFunctionContext {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return db.functions[name]
+}
+
+// handleFunction implements $function: { body: <name>, args: [ <expr>, ... ],
+// lang: "go" }, calling the function registered under name with the
+// evaluated args.
+func handleFunction(env *exprEnv, opVal interface{}) interface{} {
+	spec, ok := opVal.(map[string]interface{})
+	if !ok {
+		return env.fail("$function expects an object with body and args, got %T", opVal)
+	}
+	for field := range spec {
+		if field != "body" && field != "args" && field != "lang" {
+			return env.fail("$function has unknown field %q", field)
+		}
+	}
+	if lang, present := spec["lang"]; present && lang != "go" {
+		return env.fail("$function only supports lang \"go\", got %v", lang)
+	}
+	name, ok := spec["body"].(string)
+	if !ok {
+		return env.fail("$function body must be the name of a registered function, got %T", spec["body"])
+	}
+	fn := env.db.expressionFunction(name)
+	if fn == nil {
+		return env.fail("$function %q is not registered", name)
+	}
+
+	var args []interface{}
+	if rawArgs, present := spec["args"]; present {
+		exprs, ok := rawArgs.([]interface{})
+		if !ok {
+			return env.fail("$function args must be an array, got %T", rawArgs)
+		}
+		args = make([]interface{}, len(exprs))
+		for i, expr := range exprs {
+			args[i] = env.eval(expr)
+		}
+	}
+
+	result, err := fn(env.ctx, args...)
+	if err != nil {
+		return env.fail("$function %q: %v", name, err)
+	}
+	result, err = decodedValue(result)
+	if err != nil {
+		return env.fail("$function %q returned a value that can't be encoded: %v", name, err)
+	}
+	return result
+}
+
+// decodedValue converts a Go value into the form documents are decoded to,
+// so that the operators consuming it understand it. Values already in that
+// form are returned as is.
+func decodedValue(value interface{}) (interface{}, error) {
+	switch value.(type) {
+	case nil, bool, string, float64, int, int64, json.Number, time.Time, []byte,
+		map[string]interface{}, []interface{}:
+		return value, nil
+	}
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	var decoded interface{}
+	if err := json.Unmarshal(encoded, &decoded); err != nil {
+		return nil, fmt.Errorf("decoding %s: %w", encoded, err)
+	}
+	return decoded, nil
+}
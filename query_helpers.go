@@ -1,6 +1,7 @@
 package marco
 
 import (
+	"encoding/json"
 	"fmt"
 	"strconv"
 	"strings"
@@ -44,21 +45,6 @@ func formatDate(date interface{}, format string) string {
 	}
 }
 
-// Helper function for substring
-func extractSubstring(str interface{}, start, length int) string {
-	strVal := fmt.Sprintf("%v", str)
-	if start < 0 || start >= len(strVal) {
-		return ""
-	}
-
-	end := start + length
-	if end > len(strVal) {
-		end = len(strVal)
-	}
-
-	return strVal[start:end]
-}
-
 // toFloat64 is a helper to cast an interface{} to float64
 func toFloat64(val interface{}) (float64, bool) {
 	switch v := val.(type) {
@@ -149,3 +135,87 @@ func getNestedFieldExists(doc map[string]interface{}, path string) (interface{},
 	}
 	return nil, false // Should not reach here
 }
+
+// canonicalKey is used as a map key for values that are not hashable
+// (maps and slices). It is a distinct type so it can never collide with
+// a plain string group value.
+type canonicalKey struct {
+	encoded string
+}
+
+// groupKey returns a value usable as a Go map key for grouping 'value'.
+// Hashable scalars are returned as-is, numbers as float64 so that 1 and 1.0
+// are the same key; documents and arrays are keyed by their JSON encoding,
+// which sorts object keys and is therefore stable.
+func groupKey(value interface{}) interface{} {
+	switch value.(type) {
+	case int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64, float32:
+		n, _ := toFloat64(value)
+		return n
+	case map[string]interface{}, []interface{}, []map[string]interface{}:
+		encoded, err := json.Marshal(value)
+		if err != nil {
+			return canonicalKey{encoded: fmt.Sprintf("%v", value)}
+		}
+		return canonicalKey{encoded: string(encoded)}
+	default:
+		return value
+	}
+}
+
+// toInterfaceSlice converts the array types found in documents ([]interface{}
+// from decoded JSON, []map[string]interface{} produced by stages like $lookup)
+// to a []interface{}. It returns false for non-array values.
+func toInterfaceSlice(val interface{}) ([]interface{}, bool) {
+	switch v := val.(type) {
+	case []interface{}:
+		return v, true
+	case []map[string]interface{}:
+		arr := make([]interface{}, len(v))
+		for i, item := range v {
+			arr[i] = item
+		}
+		return arr, true
+	default:
+		return nil, false
+	}
+}
+
+// cloneValue returns a deep copy of a decoded JSON value: documents and
+// arrays are copied recursively, scalars are shared.
+func cloneValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		out := make(map[string]interface{}, len(v))
+		for k, elem := range v {
+			out[k] = cloneValue(elem)
+		}
+		return out
+	case []interface{}:
+		out := make([]interface{}, len(v))
+		for i, elem := range v {
+			out[i] = cloneValue(elem)
+		}
+		return out
+	case []map[string]interface{}:
+		// Arrays of documents built by stages such as $lookup
+		out := make([]map[string]interface{}, len(v))
+		for i, elem := range v {
+			out[i] = cloneValue(elem).(map[string]interface{})
+		}
+		return out
+	case []byte:
+		return append([]byte{}, v...)
+	default:
+		return value
+	}
+}
+
+// cloneDocuments returns a deep copy of a list of documents.
+func cloneDocuments(docs []map[string]interface{}) []map[string]interface{} {
+	out := make([]map[string]interface{}, len(docs))
+	for i, doc := range docs {
+		out[i] = cloneValue(doc).(map[string]interface{})
+	}
+	return out
+}
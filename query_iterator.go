@@ -0,0 +1,532 @@
+package marco
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+)
+
+// docIterator yields the documents flowing between two pipeline stages, one
+// at a time. next returns a nil document once there are no more.
+type docIterator interface {
+	next() (map[string]interface{}, error)
+}
+
+// streamingStages are the stages whose output for a document only depends on
+// that document, or on how many came before it: they pass documents on one at
+// a time. The other stages, such as $sort, need all their input before they
+// can output anything.
+var streamingStages = map[string]bool{
+	"$match":     true,
+	"$project":   true,
+	"$addFields": true,
+	"$unset":     true,
+	"$skip":      true,
+	"$limit":     true,
+	"$unwind":    true,
+}
+
+// streamStages is runStages for the optimized engine. Consecutive streaming
+// stages are chained, so documents flow through them one at a time instead of
+// each stage building its whole output, and a $limit stops reading its input
+// as soon as it has enough documents. Blocking stages read all their input
+// first; $group only keeps the state of its groups, not the documents. With
+// QueryOptions.AllowDiskUse, $sort and $group spill to disk past a threshold.
+func (db *DB) streamStages(ctx context.Context, stages []AggregationStage, input docIterator, stats *QueryStats) ([]map[string]interface{}, error) {
+	stream, err := db.openStages(ctx, stages, input)
+	if err != nil {
+		return nil, err
+	}
+	results, err := drainIterator(stream.out)
+	stream.close()
+	if err != nil {
+		return nil, err
+	}
+	stream.report(stats)
+	return results, nil
+}
+
+// stageStream is a pipeline whose output is read one document at a time from
+// out, built by openStages.
+type stageStream struct {
+	out     docIterator
+	source  *statsIterator
+	runs    []*stageRun
+	workers []*parallelIterator
+}
+
+// stageRun is the execution of one stage of a stageStream.
+type stageRun struct {
+	stats    StageStats
+	out      *statsIterator      // nil inside a parallel run but for its last stage
+	blocking time.Duration       // time spent reading all the input and running the stage
+	parallel *parallelStageStats // set for the stages run by the workers
+}
+
+// openStages chains the stages of a pipeline on input. The blocking stages
+// run before it returns, up to the last one; the streaming stages after it
+// run as the output is read. The stream must be closed before the input is
+// released.
+func (db *DB) openStages(ctx context.Context, stages []AggregationStage, input docIterator) (*stageStream, error) {
+	stream := &stageStream{source: &statsIterator{ctx: ctx, in: input}}
+	var it docIterator = stream.source
+	parallel := db.parallelOptions()
+
+	for i := 0; i < len(stages); i++ {
+		stage := stages[i]
+
+		if err := ctx.Err(); err != nil {
+			stream.close()
+			return nil, err
+		}
+
+		// Consecutive parallel stages are run together by the workers
+		if parallel.Workers > 1 && parallelStages[stage.Stage] {
+			end := i + 1
+			for end < len(stages) && parallelStages[stages[end].Stage] {
+				end++
+			}
+			w := newParallelIterator(ctx, db, stages[i:end], it, parallel)
+			stream.workers = append(stream.workers, w)
+			for j := i; j < end; j++ {
+				stream.runs = append(stream.runs, &stageRun{
+					stats:    StageStats{Index: j, Stage: stages[j].Stage},
+					parallel: &w.stats[j-i],
+				})
+			}
+			last := stream.runs[len(stream.runs)-1]
+			last.out = &statsIterator{ctx: ctx, in: w}
+			it = last.out
+			i = end - 1
+			continue
+		}
+
+		run := &stageRun{stats: StageStats{Index: i, Stage: stage.Stage}}
+		var err error
+		if streamingStages[stage.Stage] {
+			it, err = db.stageIterator(ctx, stage, it)
+		} else {
+			start := time.Now()
+			it, err = db.runBlockingStage(ctx, stages, &i, it, run)
+			run.blocking = time.Since(start)
+		}
+		if err != nil {
+			stream.close()
+			return nil, err
+		}
+
+		run.out = &statsIterator{ctx: ctx, in: it}
+		it = run.out
+		stream.runs = append(stream.runs, run)
+	}
+	stream.out = it
+	return stream, nil
+}
+
+// runBlockingStage runs the blocking stage stages[*i] on all the documents of
+// 'in' and returns an iterator over its output. A $lookup fused with the
+// following $unwind advances *i past the $unwind.
+func (db *DB) runBlockingStage(ctx context.Context, stages []AggregationStage, i *int, in docIterator, run *stageRun) (docIterator, error) {
+	stage := stages[*i]
+
+	if spill := querySpill(ctx); spill != nil && stage.Stage == "$sort" {
+		// Sorted runs are merged as the next stage reads them
+		sorted, err := db.sortDocuments(ctx, in, stage.Params, spill)
+		if err != nil {
+			return nil, fmt.Errorf("error in $sort stage: %w", err)
+		}
+		return sorted, nil
+	}
+
+	if stage.Stage == "$group" {
+		docs, err := db.groupDocuments(ctx, in, stage.Params)
+		if err != nil {
+			return nil, fmt.Errorf("error in $group stage: %w", err)
+		}
+		return &sliceIterator{docs: docs}, nil
+	}
+
+	docs, err := drainIterator(&memoryIterator{in: in, stage: stage.Stage, budget: queryMemory(ctx)})
+	if err != nil {
+		return nil, err
+	}
+	if len(docs) > 0 {
+		// Stages are not run on an empty input, as with the legacy engine
+		if unwind, ok := lookupUnwindFusion(stages, *i); ok {
+			// $lookup + $unwind of its "as" field runs as a single join
+			if docs, err = db.lookupUnwindStage(ctx, docs, stage.Params, unwind); err != nil {
+				return nil, fmt.Errorf("error in $lookup stage: %w", err)
+			}
+			run.stats.Stage = "$lookup+$unwind"
+			*i++
+		} else if docs, err = db.executeStage(ctx, stage, docs); err != nil {
+			return nil, err
+		}
+	}
+	return &sliceIterator{docs: docs}, nil
+}
+
+// close stops the workers, so that the input is no longer read.
+func (s *stageStream) close() {
+	for _, w := range s.workers {
+		w.close()
+	}
+}
+
+// report appends the statistics of the stages to stats, once the output has
+// been read.
+func (s *stageStream) report(stats *QueryStats) {
+	// Each stage pulls its input from the previous one, so the time of a
+	// stage includes the time upstream stages spent producing its input
+	docsIn, upstream := s.source.docs, s.source.elapsed
+	for _, run := range s.runs {
+		run.stats.DocsIn = docsIn
+		if run.parallel != nil {
+			// Parallel stages report the work of every worker
+			run.stats.DocsOut = run.parallel.docs
+			run.stats.Duration = run.parallel.elapsed
+		} else {
+			run.stats.DocsOut = run.out.docs
+			run.stats.Duration = run.blocking + run.out.elapsed - upstream
+		}
+		stats.Stages = append(stats.Stages, run.stats)
+
+		// Stages after an empty result are not reported
+		if run.stats.DocsOut == 0 {
+			break
+		}
+		docsIn = run.stats.DocsOut
+		if run.out != nil {
+			upstream = run.out.elapsed
+		}
+	}
+}
+
+// streamCollection runs a pipeline on a collection read one document at a
+// time from the query's snapshot, rather than loaded in memory first.
+func (db *DB) streamCollection(ctx context.Context, collectionName string, stages []AggregationStage, isolation QueryIsolation, stats *QueryStats) ([]map[string]interface{}, error) {
+	stream, err := db.openCollectionStream(ctx, collectionName, stages, isolation, stats)
+	if err != nil {
+		return nil, err
+	}
+	results, err := drainIterator(stream.out)
+	stream.close(stats)
+	if err != nil {
+		return nil, err
+	}
+	stream.report(stats)
+	return results, nil
+}
+
+// collectionStream is a pipeline reading a collection one document at a time
+// from the query's snapshot, opened by openCollectionStream.
+type collectionStream struct {
+	*stageStream
+	snapshot *querySnapshot
+	it       *Iterator
+	source   *collectionSource
+}
+
+// openCollectionStream opens a pipeline on a collection. The collections
+// joined by the pipeline are still loaded, and its stages are chained by
+// openStages. Documents that can't match the leading $match are skipped
+// before being decoded, and only the fields the pipeline reads are decoded
+// when they are known. The stream holds the snapshot of the query until it
+// is closed; on error, it is closed already, stats filled.
+func (db *DB) openCollectionStream(ctx context.Context, collectionName string, stages []AggregationStage, isolation QueryIsolation, stats *QueryStats) (*collectionStream, error) {
+	ctx, snapshot := db.withQuerySnapshot(ctx, isolation)
+	snapshot.collection = collectionName
+
+	var joined []string
+	for _, c := range pipelineCollections(stages) {
+		if c != collectionName {
+			joined = append(joined, c)
+		}
+	}
+	if len(joined) > 0 {
+		if err := db.preloadCollections(ctx, snapshot, joined); err != nil {
+			stats.SnapshotHeld = snapshot.release()
+			return nil, err
+		}
+	}
+
+	stream := &collectionStream{snapshot: snapshot, it: snapshot.iterate(db, collectionName)}
+	stream.it.screen = pipelineScreen(stages)
+	stream.it.fields = pipelineFields(stages)
+	stream.source = &collectionSource{it: stream.it, budget: snapshot.budget}
+	var err error
+	if stream.stageStream, err = db.openStages(ctx, stages, stream.source); err != nil {
+		stream.close(stats)
+		return nil, err
+	}
+	return stream, nil
+}
+
+// close stops the stages, then releases the collection and the snapshot,
+// recording how they were read in stats.
+func (s *collectionStream) close(stats *QueryStats) {
+	if s.stageStream != nil {
+		s.stageStream.close()
+	}
+	s.it.Close() // before the snapshot is released
+	stats.DocsLoaded = s.source.docs
+	stats.DocsScreened = s.it.screened
+	stats.SnapshotHeld = s.snapshot.release()
+}
+
+// collectionSource feeds a pipeline with the documents of an Iterator,
+// charging them to the read budget of the query.
+type collectionSource struct {
+	it     *Iterator
+	budget *readBudget
+	docs   int
+}
+
+func (s *collectionSource) next() (map[string]interface{}, error) {
+	if !s.it.Next() {
+		return nil, s.it.Err()
+	}
+	if err := s.budget.consume(s.it.size); err != nil {
+		return nil, err
+	}
+	s.docs++
+	return s.it.Doc(), nil
+}
+
+// stageIterator returns an iterator applying the streaming stage 'stage' to
+// the documents of 'in'. It behaves as executeStage does on a slice.
+func (db *DB) stageIterator(ctx context.Context, stage AggregationStage, in docIterator) (docIterator, error) {
+	params := stage.Params
+
+	switch stage.Stage {
+	case "$match":
+		return &matchIterator{db: db, ctx: ctx, in: in, params: params}, nil
+
+	case "$project":
+		mode, err := determineProjectionMode(params)
+		if err != nil {
+			if db.strictMode(ctx) {
+				return nil, fmt.Errorf("error in $project stage: %w", err)
+			}
+			db.logf(LogWarn, "Projection error: %v", err)
+			return in, nil
+		}
+		return &mapIterator{in: in, fn: func(doc map[string]interface{}) (map[string]interface{}, error) {
+			projected, err := db.projectDocument(ctx, doc, params, mode)
+			if err != nil {
+				return nil, fmt.Errorf("error in $project stage: %w", err)
+			}
+			return projected, nil
+		}}, nil
+
+	case "$addFields":
+		if err := db.validateAddFieldsStage(params); err != nil {
+			return nil, fmt.Errorf("error in %s stage: validation error in $addFields stage: %w", stage.Stage, err)
+		}
+		return &mapIterator{in: in, fn: func(doc map[string]interface{}) (map[string]interface{}, error) {
+			newDoc, err := db.addFieldsToDocument(ctx, doc, params)
+			if err != nil {
+				return nil, fmt.Errorf("error in %s stage: %w", stage.Stage, err)
+			}
+			return newDoc, nil
+		}}, nil
+
+	case "$unset":
+		fields, err := db.validateUnsetStage(params)
+		if err != nil {
+			// As with unsetStage, invalid parameters drop every document
+			return &sliceIterator{}, nil
+		}
+		return &mapIterator{in: in, fn: func(doc map[string]interface{}) (map[string]interface{}, error) {
+			return unsetDocument(doc, fields), nil
+		}}, nil
+
+	case "$skip":
+		skip, ok := stageCount(params, "$skip")
+		if !ok {
+			db.logf(LogWarn, "No valid skip value provided")
+			return in, nil
+		}
+		return &skipIterator{in: in, n: documentCount(skip)}, nil
+
+	case "$limit":
+		limit, ok := stageCount(params, "$limit")
+		if !ok {
+			return in, nil
+		}
+		return &limitIterator{in: in, n: documentCount(limit)}, nil
+
+	case "$unwind":
+		pathParam, ok := params["path"].(string)
+		if !ok || pathParam == "" {
+			db.logf(LogWarn, "Invalid or missing path for $unwind")
+			return in, nil
+		}
+		it := &unwindIterator{in: in, path: strings.TrimPrefix(pathParam, "$")}
+		it.preserveNullAndEmptyArrays, _ = params["preserveNullAndEmptyArrays"].(bool)
+		it.includeArrayIndexField, _ = params["includeArrayIndex"].(string)
+		return it, nil
+	}
+
+	return nil, fmt.Errorf("stage %s can't be streamed", stage.Stage)
+}
+
+// stageCount returns the number of documents of $skip or $limit, given as
+// { key: n } or as the stage value.
+func stageCount(params map[string]interface{}, key string) (float64, bool) {
+	if n, ok := toFloat64(params[key]); ok {
+		return n, true
+	}
+	return toFloat64(params["value"])
+}
+
+// documentCount converts the count of a $skip or $limit stage to an int,
+// rounded down. Negative counts are 0, and counts past math.MaxInt, which
+// would overflow the conversion, are math.MaxInt.
+func documentCount(n float64) int {
+	if !(n < float64(math.MaxInt)) {
+		return math.MaxInt
+	}
+	return int(math.Max(0, math.Floor(n)))
+}
+
+// drainIterator reads all the documents of it.
+func drainIterator(it docIterator) ([]map[string]interface{}, error) {
+	var docs []map[string]interface{}
+	for {
+		doc, err := it.next()
+		if err != nil {
+			return nil, err
+		}
+		if doc == nil {
+			return docs, nil
+		}
+		docs = append(docs, doc)
+	}
+}
+
+// sliceIterator iterates over documents already in memory.
+type sliceIterator struct {
+	docs []map[string]interface{}
+	pos  int
+}
+
+func (it *sliceIterator) next() (map[string]interface{}, error) {
+	if it.pos == len(it.docs) {
+		return nil, nil
+	}
+	it.pos++
+	return it.docs[it.pos-1], nil
+}
+
+// statsIterator counts the documents output by a stage and the time spent
+// producing them, upstream stages included. It stops the pipeline once the
+// context is done.
+type statsIterator struct {
+	ctx     context.Context
+	in      docIterator
+	docs    int
+	elapsed time.Duration
+}
+
+func (it *statsIterator) next() (map[string]interface{}, error) {
+	if err := it.ctx.Err(); err != nil {
+		return nil, err
+	}
+	start := time.Now()
+	doc, err := it.in.next()
+	it.elapsed += time.Since(start)
+	if doc != nil {
+		it.docs++
+	}
+	return doc, err
+}
+
+// matchIterator keeps the documents matching a $match filter.
+type matchIterator struct {
+	db     *DB
+	ctx    context.Context
+	in     docIterator
+	params map[string]interface{}
+}
+
+func (it *matchIterator) next() (map[string]interface{}, error) {
+	for {
+		doc, err := it.in.next()
+		if doc == nil || err != nil {
+			return nil, err
+		}
+		if it.db.evaluateMatchExpression(it.ctx, doc, it.params) {
+			return doc, nil
+		}
+	}
+}
+
+// mapIterator replaces each document by fn(document).
+type mapIterator struct {
+	in docIterator
+	fn func(doc map[string]interface{}) (map[string]interface{}, error)
+}
+
+func (it *mapIterator) next() (map[string]interface{}, error) {
+	doc, err := it.in.next()
+	if doc == nil || err != nil {
+		return nil, err
+	}
+	return it.fn(doc)
+}
+
+// skipIterator drops the first n documents.
+type skipIterator struct {
+	in docIterator
+	n  int
+}
+
+func (it *skipIterator) next() (map[string]interface{}, error) {
+	for ; it.n > 0; it.n-- {
+		doc, err := it.in.next()
+		if doc == nil || err != nil {
+			return nil, err
+		}
+	}
+	return it.in.next()
+}
+
+// limitIterator passes the first n documents on, then stops reading.
+type limitIterator struct {
+	in docIterator
+	n  int
+}
+
+func (it *limitIterator) next() (map[string]interface{}, error) {
+	if it.n <= 0 {
+		return nil, nil
+	}
+	it.n--
+	return it.in.next()
+}
+
+// unwindIterator outputs a document per element of an array field, see
+// unwindDocument.
+type unwindIterator struct {
+	in                         docIterator
+	path                       string
+	preserveNullAndEmptyArrays bool
+	includeArrayIndexField     string
+	pending                    []map[string]interface{} // unwound documents not read yet
+}
+
+func (it *unwindIterator) next() (map[string]interface{}, error) {
+	for len(it.pending) == 0 {
+		doc, err := it.in.next()
+		if doc == nil || err != nil {
+			return nil, err
+		}
+		it.pending = unwindDocument(it.pending[:0], doc, it.path, it.preserveNullAndEmptyArrays, it.includeArrayIndexField)
+	}
+	doc := it.pending[0]
+	it.pending = it.pending[1:]
+	return doc, nil
+}
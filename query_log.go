@@ -0,0 +1,183 @@
+package marco
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"math/rand"
+	"strings"
+	"time"
+)
+
+// QueryLogEntry describes one executed Query. Literal values of the pipeline
+// are scrubbed, so entries can be shipped to a log pipeline without leaking
+// the data that was queried.
+type QueryLogEntry struct {
+	Time        time.Time     `json:"time"`
+	Collection  string        `json:"collection"`
+	Pipeline    string        `json:"pipeline"`    // normalized pipeline, literals scrubbed
+	Fingerprint string        `json:"fingerprint"` // equal for queries of the same shape
+	Duration    time.Duration `json:"duration"`
+	Results     int           `json:"results"`
+	Error       string        `json:"error,omitempty"`
+}
+
+// QueryLogger receives the entries of sampled queries. It is called
+// synchronously at the end of Query and should hand the entry off quickly.
+type QueryLogger func(entry QueryLogEntry)
+
+// QueryLogOptions configures the query log.
+type QueryLogOptions struct {
+	// SampleRate is the fraction of queries logged, between 0 and 1.
+	// Zero logs every query.
+	SampleRate float64
+
+	// HashLiterals replaces literals with a salted hash instead of "?", so
+	// that queries using the same value can be correlated without revealing it.
+	HashLiterals bool
+
+	// Salt is mixed into literal hashes.
+	Salt string
+}
+
+// queryLog holds the logger installed with SetQueryLogger.
+type queryLog struct {
+	logger QueryLogger
+	opts   QueryLogOptions
+}
+
+// structuralStages hold no user data; their literals (sort directions,
+// page sizes, field names) are kept in the log.
+var structuralStages = map[string]bool{
+	"$sort":   true,
+	"$limit":  true,
+	"$skip":   true,
+	"$sample": true,
+	"$count":  true,
+	"$unset":  true,
+	"$unwind": true,
+}
+
+// SetQueryLogger enables the structured query log. A nil logger disables it.
+//
+//	db.SetQueryLogger(func(e marco.QueryLogEntry) {
+//		line, _ := json.Marshal(e)
+//		log.Println(string(line))
+//	}, marco.QueryLogOptions{SampleRate: 0.1})
+func (db *DB) SetQueryLogger(logger QueryLogger, opts QueryLogOptions) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if logger == nil {
+		db.queryLog = nil
+		return
+	}
+	db.queryLog = &queryLog{logger: logger, opts: opts}
+}
+
+// sampledQueryLog returns the query log if the current query must be logged.
+func (db *DB) sampledQueryLog() *queryLog {
+	db.mu.RLock()
+	ql := db.queryLog
+	db.mu.RUnlock()
+
+	if ql == nil {
+		return nil
+	}
+	if rate := ql.opts.SampleRate; rate > 0 && rate < 1 && rand.Float64() >= rate {
+		return nil
+	}
+	return ql
+}
+
+// log emits the entry of a finished query.
+func (ql *queryLog) log(collection, pipeline string, start time.Time, results int, err error) {
+	normalized := ql.normalizePipeline(pipeline)
+
+	// The fingerprint ignores literal values, hashed or not
+	shape := normalized
+	if ql.opts.HashLiterals {
+		shape = (&queryLog{}).normalizePipeline(pipeline)
+	}
+	sum := sha256.Sum256([]byte(shape))
+
+	entry := QueryLogEntry{
+		Time:        start,
+		Collection:  collection,
+		Pipeline:    normalized,
+		Fingerprint: hex.EncodeToString(sum[:8]),
+		Duration:    time.Since(start),
+		Results:     results,
+	}
+	if err != nil {
+		entry.Error = err.Error()
+	}
+	ql.logger(entry)
+}
+
+// normalizePipeline re-encodes a pipeline with sorted keys and scrubbed
+// literals. Pipelines that are not valid JSON are replaced entirely.
+func (ql *queryLog) normalizePipeline(pipeline string) string {
+	pipeline = strings.TrimSpace(pipeline)
+	if !strings.HasPrefix(pipeline, "[") {
+		pipeline = "[" + pipeline + "]"
+	}
+
+	var stages []map[string]interface{}
+	if err := json.Unmarshal([]byte(pipeline), &stages); err != nil {
+		return ql.scrubLiteral(pipeline).(string)
+	}
+
+	for _, stage := range stages {
+		for name, params := range stage {
+			if structuralStages[name] {
+				continue
+			}
+			stage[name] = ql.scrub(params)
+		}
+	}
+
+	out, err := json.Marshal(stages)
+	if err != nil {
+		return "?"
+	}
+	return string(out)
+}
+
+// scrub replaces the literals of a stage's parameters. Keys, operators and
+// field references ("$field") describe the shape of the query and are kept.
+func (ql *queryLog) scrub(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		out := make(map[string]interface{}, len(v))
+		for key, elem := range v {
+			out[key] = ql.scrub(elem)
+		}
+		return out
+	case []interface{}:
+		out := make([]interface{}, len(v))
+		for i, elem := range v {
+			out[i] = ql.scrub(elem)
+		}
+		return out
+	case string:
+		if strings.HasPrefix(v, "$") {
+			return v
+		}
+		return ql.scrubLiteral(v)
+	case nil:
+		return nil
+	default:
+		return ql.scrubLiteral(v)
+	}
+}
+
+// scrubLiteral returns "?" or, with HashLiterals, a salted hash of the literal.
+func (ql *queryLog) scrubLiteral(value interface{}) interface{} {
+	if !ql.opts.HashLiterals {
+		return "?"
+	}
+	encoded, _ := json.Marshal(value)
+	sum := sha256.Sum256(append([]byte(ql.opts.Salt), encoded...))
+	return "#" + hex.EncodeToString(sum[:6])
+}
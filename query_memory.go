@@ -0,0 +1,183 @@
+package marco
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+)
+
+// ErrMemoryLimitExceeded is returned by Query when the stages of a pipeline
+// that hold documents in memory ($sort, $group, ...) hold more than the
+// memory limit of the query, see SetQueryMemoryLimit.
+var ErrMemoryLimitExceeded = errors.New("query exceeded its memory limit")
+
+// DefaultQueryMemoryLimit is the memory limit of queries unless changed with
+// SetQueryMemoryLimit or QueryOptions.MemoryLimit.
+const DefaultQueryMemoryLimit = 100 << 20
+
+// SetQueryMemoryLimit sets the number of bytes the buffering stages of a
+// query may hold in memory, summed over its stages, before the query fails
+// with ErrMemoryLimitExceeded: one query can't take down the process. The
+// documents read by the query and those passed on one at a time by streaming
+// stages such as $match are not counted, and neither are the runs of a
+// $sort or the groups of a $group spilled with QueryOptions.AllowDiskUse.
+// Zero restores DefaultQueryMemoryLimit and a negative limit disables it.
+func (db *DB) SetQueryMemoryLimit(limit int64) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.memoryLimit = limit
+}
+
+// queryMemoryLimit returns the memory limit of a query run with opts, or a
+// negative number for no limit.
+func (db *DB) queryMemoryLimit(opts QueryOptions) int64 {
+	if opts.MemoryLimit != 0 {
+		return opts.MemoryLimit
+	}
+	db.mu.RLock()
+	limit := db.memoryLimit
+	db.mu.RUnlock()
+	if limit == 0 {
+		return DefaultQueryMemoryLimit
+	}
+	return limit
+}
+
+// memoryBudget counts the bytes held by the buffering stages of a query. The
+// sizes are estimates of the memory used by decoded documents.
+type memoryBudget struct {
+	limit  int64         // negative for no limit
+	used   int64         // updated atomically
+	parent *memoryBudget // charged with the bytes held, for a stage budget
+}
+
+// memoryBudgetKey is the context key of the query's memoryBudget.
+type memoryBudgetKey struct{}
+
+// withMemoryBudget returns a context whose buffering stages may hold up to
+// 'limit' bytes.
+func withMemoryBudget(ctx context.Context, limit int64) context.Context {
+	return context.WithValue(ctx, memoryBudgetKey{}, &memoryBudget{limit: limit})
+}
+
+// withStageBudget returns a context whose memory budget is a stage budget of
+// the one of ctx, see stageBudget.
+func withStageBudget(ctx context.Context) (context.Context, *memoryBudget) {
+	budget := queryMemory(ctx).stageBudget()
+	return context.WithValue(ctx, memoryBudgetKey{}, budget), budget
+}
+
+// queryMemory returns the memory budget of the query of ctx, or nil.
+func queryMemory(ctx context.Context) *memoryBudget {
+	budget, _ := ctx.Value(memoryBudgetKey{}).(*memoryBudget)
+	return budget
+}
+
+// stageBudget returns a budget charging b, that counts the bytes held through
+// it so that a stage can release them with releaseTo while other stages
+// hold memory too. It must not be charged concurrently.
+func (b *memoryBudget) stageBudget() *memoryBudget {
+	if b == nil {
+		return nil
+	}
+	return &memoryBudget{limit: b.limit, parent: b}
+}
+
+// hold accounts for n more bytes.
+func (b *memoryBudget) hold(n int64) error {
+	if b == nil || b.limit < 0 {
+		return nil
+	}
+	if b.parent != nil {
+		atomic.AddInt64(&b.used, n)
+		return b.parent.hold(n)
+	}
+	if used := atomic.AddInt64(&b.used, n); used > b.limit {
+		return fmt.Errorf("%w: %d bytes held, limit %d", ErrMemoryLimitExceeded, used, b.limit)
+	}
+	return nil
+}
+
+// usage returns the number of bytes held.
+func (b *memoryBudget) usage() int64 {
+	if b == nil {
+		return 0
+	}
+	return atomic.LoadInt64(&b.used)
+}
+
+// releaseTo releases what was held since usage returned 'held'. The bytes
+// are subtracted, so b must be a stage budget for the bytes held by other
+// stages since not to be released too, see stageBudget.
+func (b *memoryBudget) releaseTo(held int64) {
+	if b == nil || b.limit < 0 {
+		return
+	}
+	b.release(atomic.LoadInt64(&b.used) - held)
+}
+
+// release releases n bytes.
+func (b *memoryBudget) release(n int64) {
+	for ; b != nil; b = b.parent {
+		atomic.AddInt64(&b.used, -n)
+	}
+}
+
+// holdValue accounts for a value kept in memory.
+func (b *memoryBudget) holdValue(v interface{}) error {
+	if b == nil || b.limit < 0 {
+		return nil
+	}
+	return b.hold(valueSize(v))
+}
+
+// valueSize estimates the memory used by a decoded value.
+func valueSize(v interface{}) int64 {
+	const header = 16 // interface value
+	switch value := v.(type) {
+	case string:
+		return header + 16 + int64(len(value))
+	case []byte:
+		return header + 24 + int64(len(value))
+	case map[string]interface{}:
+		size := int64(header + 48)
+		for key, item := range value {
+			size += 16 + int64(len(key)) + valueSize(item)
+		}
+		return size
+	case []interface{}:
+		size := int64(header + 24)
+		for _, item := range value {
+			size += valueSize(item)
+		}
+		return size
+	case []map[string]interface{}:
+		size := int64(header + 24)
+		for _, item := range value {
+			size += valueSize(item)
+		}
+		return size
+	default:
+		return header + 8
+	}
+}
+
+// memoryIterator accounts for the documents of 'in' as the buffering stage
+// 'stage' reads them.
+type memoryIterator struct {
+	in     docIterator
+	stage  string
+	budget *memoryBudget
+}
+
+func (it *memoryIterator) next() (map[string]interface{}, error) {
+	doc, err := it.in.next()
+	if doc == nil || err != nil {
+		return doc, err
+	}
+	if err := it.budget.holdValue(doc); err != nil {
+		return nil, fmt.Errorf("error in %s stage: %w", it.stage, err)
+	}
+	return doc, nil
+}
@@ -0,0 +1,73 @@
+package marco
+
+import (
+	"context"
+	"fmt"
+	"testing"
+)
+
+func TestStageBudgetReleasesItsOwnBytes(t *testing.T) {
+	budget := &memoryBudget{limit: 1000}
+	stage := budget.stageBudget()
+	held := stage.usage()
+	if err := stage.hold(300); err != nil {
+		t.Fatal(err)
+	}
+	// Held by another stage in the meantime
+	if err := budget.hold(200); err != nil {
+		t.Fatal(err)
+	}
+	stage.releaseTo(held)
+	if used := budget.usage(); used != 200 {
+		t.Errorf("query holds %d bytes, want the 200 of the other stage", used)
+	}
+	if err := stage.hold(900); err == nil {
+		t.Error("stage budget exceeded the limit of the query")
+	}
+}
+
+func TestLegacyStagesReleaseTheirInput(t *testing.T) {
+	docs := make([]string, 50)
+	for i := range docs {
+		docs[i] = fmt.Sprintf(`{"a": %d, "b": "%060d"}`, i, i)
+	}
+	db := openTestDB(t, map[string][]string{"c": docs})
+	input, err := db.Collection("c")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Each $sort holds the collection, all three together hold it three times
+	limit := valueSize(input) * 3 / 2
+	pipeline := `[{"$sort": {"a": -1}}, {"$sort": {"b": 1}}, {"$sort": {"a": 1}}]`
+	results, _, err := db.QueryWithOptions(context.Background(), "c", pipeline, QueryOptions{Engine: EngineLegacy, MemoryLimit: limit})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != len(docs) {
+		t.Errorf("got %d documents, want %d", len(results), len(docs))
+	}
+}
+
+func TestShadowExecutionHasItsOwnBudget(t *testing.T) {
+	docs := make([]string, 50)
+	for i := range docs {
+		docs[i] = fmt.Sprintf(`{"b": "%060d"}`, i)
+	}
+	db := openTestDB(t, map[string][]string{"c": docs})
+	var divergences []ShadowDivergence
+	db.SetShadowExecution(func(d ShadowDivergence) { divergences = append(divergences, d) }, ShadowOptions{})
+
+	// The values pushed fit the limit once, not twice
+	var pushed int64
+	for i := range docs {
+		pushed += valueSize(fmt.Sprintf("%060d", i))
+	}
+	pipeline := `[{"$group": {"_id": null, "all": {"$push": "$b"}}}]`
+	if _, _, err := db.QueryWithOptions(context.Background(), "c", pipeline, QueryOptions{MemoryLimit: pushed * 3 / 2}); err != nil {
+		t.Fatal(err)
+	}
+	if len(divergences) != 0 {
+		t.Errorf("shadow execution diverged: %+v", divergences)
+	}
+}
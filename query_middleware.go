@@ -0,0 +1,56 @@
+package marco
+
+import "context"
+
+// StageExecutor executes one aggregation stage on the documents produced by
+// the previous stage and returns the documents passed to the next one. ctx is
+// the context given to QueryContext.
+type StageExecutor func(ctx context.Context, stage AggregationStage, docs []map[string]interface{}) ([]map[string]interface{}, error)
+
+// PipelineMiddleware wraps stage execution. It receives the next executor in
+// the chain and returns an executor that may inspect or rewrite the stage,
+// transform the documents, or skip calling next altogether.
+type PipelineMiddleware func(next StageExecutor) StageExecutor
+
+// UsePipelineMiddleware adds a middleware around the execution of every
+// top-level stage of Query. Middleware registered first is the outermost:
+//
+//	db.UsePipelineMiddleware(func(next marco.StageExecutor) marco.StageExecutor {
+//		return func(ctx context.Context, stage marco.AggregationStage, docs []map[string]interface{}) ([]map[string]interface{}, error) {
+//			start := time.Now()
+//			out, err := next(ctx, stage, docs)
+//			metrics.Observe(stage.Stage, time.Since(start))
+//			return out, err
+//		}
+//	})
+//
+// Stages have already been validated when middleware runs, so a rewritten
+// stage must be well formed. Sub-pipelines of $facet are not wrapped.
+func (db *DB) UsePipelineMiddleware(middleware PipelineMiddleware) {
+	if middleware == nil {
+		return
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.pipelineMiddleware = append(db.pipelineMiddleware, middleware)
+}
+
+// hasPipelineMiddleware reports whether any middleware is registered.
+func (db *DB) hasPipelineMiddleware() bool {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return len(db.pipelineMiddleware) > 0
+}
+
+// stageExecutor returns executeStage wrapped by the registered middleware.
+func (db *DB) stageExecutor() StageExecutor {
+	db.mu.RLock()
+	middleware := append([]PipelineMiddleware(nil), db.pipelineMiddleware...)
+	db.mu.RUnlock()
+
+	execute := StageExecutor(db.executeStage)
+	for i := len(middleware) - 1; i >= 0; i-- {
+		execute = middleware[i](execute)
+	}
+	return execute
+}
@@ -0,0 +1,416 @@
+package marco
+
+import (
+	"bytes"
+	"container/heap"
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+
+	"github.com/dgraph-io/badger/v3"
+)
+
+// windowedScanPlan describes a pipeline of the form
+//
+//	$match* [$sort] ($skip | $limit)+
+//
+// with at least one $limit. Such a pipeline only needs the documents inside
+// the final skip/limit window, so the collection can be streamed and, when
+// there is no $sort, reading can stop as soon as the window is full.
+type windowedScanPlan struct {
+	matches []map[string]interface{} // $match filters, applied in order
+	sort    map[string]interface{}   // $sort spec, nil when unsorted
+	skip    int                      // documents to drop from the start
+	limit   int                      // documents to return after skipping
+}
+
+// planWindowedScan recognizes pipelines that can be executed with
+// executeWindowedScan. It returns false for any other pipeline.
+func planWindowedScan(stages []AggregationStage) (*windowedScanPlan, bool) {
+	plan := &windowedScanPlan{limit: math.MaxInt}
+	hasLimit := false
+
+	i := 0
+	for ; i < len(stages) && stages[i].Stage == "$match"; i++ {
+		plan.matches = append(plan.matches, stages[i].Params)
+	}
+	if i < len(stages) && stages[i].Stage == "$sort" {
+		plan.sort = stages[i].Params
+		i++
+	}
+	if i == len(stages) {
+		return nil, false
+	}
+
+	// Fold the trailing $skip/$limit stages into a single window
+	for ; i < len(stages); i++ {
+		n, ok := toFloat64(stages[i].Params["value"])
+		if !ok {
+			return nil, false
+		}
+		count := documentCount(n)
+
+		switch stages[i].Stage {
+		case "$skip":
+			if count > math.MaxInt-plan.skip {
+				plan.skip = math.MaxInt
+			} else {
+				plan.skip += count
+			}
+			if plan.limit != math.MaxInt {
+				plan.limit = int(math.Max(0, float64(plan.limit-count)))
+			}
+		case "$limit":
+			if count < plan.limit {
+				plan.limit = count
+			}
+			hasLimit = true
+		default:
+			return nil, false
+		}
+	}
+
+	return plan, hasLimit
+}
+
+// executeWindowedScan runs a plan produced by planWindowedScan on the
+// collection read with 'isolation', filling stats. Only the documents that
+// can still be part of the window are kept in memory, charged to the memory
+// budget of the query: without a $sort the scan stops once skip+limit
+// documents have matched, with one the best skip+limit documents are kept in
+// a bounded heap.
+func (db *DB) executeWindowedScan(ctx context.Context, collectionName string, stages []AggregationStage, plan *windowedScanPlan, isolation QueryIsolation, stats *QueryStats) ([]map[string]interface{}, error) {
+	if plan.limit == 0 {
+		return nil, nil
+	}
+	ctx, snapshot := db.withQuerySnapshot(ctx, isolation)
+	snapshot.collection = collectionName
+
+	// A $sort on an indexed field reads the window in the order of the index
+	if plan.sort != nil && sessionCollation(ctx) == nil {
+		results, indexed, err := db.executeIndexedWindow(ctx, collectionName, plan, snapshot, stats)
+		if indexed || err != nil {
+			stats.SnapshotHeld = snapshot.release()
+			return results, err
+		}
+	}
+
+	it := snapshot.iterate(db, collectionName)
+	it.screen = pipelineScreen(stages)
+	source := &collectionSource{it: it, budget: snapshot.budget}
+	defer func() {
+		it.Close() // before the snapshot is released
+		stats.DocsLoaded = source.docs
+		stats.DocsScreened = it.screened
+		stats.SnapshotHeld = snapshot.release()
+	}()
+
+	budget := queryMemory(ctx)
+	window := &windowHeap{}
+	if plan.sort != nil {
+		window.less = db.sortLess(ctx, plan.sort)
+	}
+	size := plan.skip + plan.limit // documents kept with a $sort
+	if size < 0 {
+		size = math.MaxInt // overflowed
+	}
+	if plan.sort == nil {
+		size = plan.limit
+	}
+	skipped := 0
+	for seq := 0; ; seq++ {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		doc, err := source.next()
+		if err != nil {
+			return nil, err
+		}
+		if doc == nil {
+			break
+		}
+		if !db.matchesAll(ctx, doc, plan.matches) {
+			continue
+		}
+
+		if plan.sort == nil {
+			// Unsorted output is in collection order: skipped documents
+			// are dropped as they come, and the window is complete once full
+			if skipped < plan.skip {
+				skipped++
+				continue
+			}
+			if err := window.push(windowEntry{doc: doc, seq: seq}, budget); err != nil {
+				return nil, err
+			}
+			if window.Len() == size {
+				break
+			}
+			continue
+		}
+
+		entry := windowEntry{doc: doc, seq: seq}
+		if window.Len() < size {
+			if err := window.push(entry, budget); err != nil {
+				return nil, err
+			}
+		} else if window.after(window.entries[0], entry) {
+			// doc sorts before the last document of the window
+			if err := window.replaceLast(entry, budget); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	matched := window.sorted()
+	if plan.sort != nil {
+		if plan.skip >= len(matched) {
+			return nil, nil
+		}
+		matched = matched[plan.skip:]
+	}
+	return matched, nil
+}
+
+// executeIndexedWindow runs a plan whose $sort an index can serve, see
+// sortIndex, reading the documents in the order of the index until the
+// window is full. It reports false, having read no document, when no index
+// serves the $sort.
+func (db *DB) executeIndexedWindow(ctx context.Context, collectionName string, plan *windowedScanPlan, snapshot *querySnapshot, stats *QueryStats) ([]map[string]interface{}, bool, error) {
+	budget := queryMemory(ctx)
+	window := &windowHeap{} // in the order documents are read
+	indexed := false
+	err := snapshot.view(db, func(txn *badger.Txn) error {
+		field, descending, ok, err := sortIndex(txn, collectionName, plan.sort)
+		if err != nil || !ok {
+			return err
+		}
+		indexed = true
+		stats.Shortcut = "indexScan"
+
+		// visit adds the document of an index entry to the window and
+		// reports whether the window is full
+		skipped := 0
+		visit := func(key []byte) (bool, error) {
+			if err := ctx.Err(); err != nil {
+				return false, err
+			}
+			doc, size, err := db.getDocumentSized(txn, db.keys.primaryKey(collectionName, key[len(key)-16:]))
+			if err == ErrNotFound {
+				return false, nil // deleted by a DropCollection under way
+			}
+			if err != nil {
+				return false, err
+			}
+			if err := snapshot.budget.consume(size); err != nil {
+				return false, err
+			}
+			stats.DocsLoaded++
+			if !db.matchesAll(ctx, doc, plan.matches) {
+				return false, nil
+			}
+			if skipped < plan.skip {
+				skipped++
+				return false, nil
+			}
+			if err := window.push(windowEntry{doc: doc}, budget); err != nil {
+				return false, err
+			}
+			return window.Len() == plan.limit, nil
+		}
+
+		prefix := indexPrefix(collectionName, field)
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		opts.Reverse = descending
+		it := txn.NewIterator(opts)
+		defer it.Close()
+		seek := prefix
+		if descending {
+			seek = append(append([]byte{}, prefix...), 0xff)
+		}
+
+		// Documents sorting equal keep the order of a collection scan, by
+		// UUID, even in a descending sort: runs of equal values are read
+		// backwards, then visited forwards
+		var run [][]byte
+		visitRun := func() (bool, error) {
+			for i := len(run) - 1; i >= 0; i-- {
+				if full, err := visit(run[i]); full || err != nil {
+					return full, err
+				}
+			}
+			run = run[:0]
+			return false, nil
+		}
+		for it.Seek(seek); it.ValidForPrefix(prefix); it.Next() {
+			key := it.Item().KeyCopy(nil)
+			if !descending {
+				if full, err := visit(key); full || err != nil {
+					return err
+				}
+				continue
+			}
+			if len(run) > 0 && !bytes.Equal(indexEntryValue(prefix, run[0]), indexEntryValue(prefix, key)) {
+				if full, err := visitRun(); full || err != nil {
+					return err
+				}
+			}
+			run = append(run, key)
+		}
+		_, err = visitRun()
+		return err
+	})
+	if err != nil {
+		return nil, indexed, err
+	}
+	return window.sorted(), indexed, nil
+}
+
+// matchesAll reports whether doc passes every $match filter of 'matches'.
+func (db *DB) matchesAll(ctx context.Context, doc map[string]interface{}, matches []map[string]interface{}) bool {
+	for _, match := range matches {
+		if !db.evaluateMatchExpression(ctx, doc, match) {
+			return false
+		}
+	}
+	return true
+}
+
+// windowHeap holds the documents of a windowed scan, in the order they were
+// read without a $sort. With one it is a max-heap: the document sorting last, the first to be evicted, is on top.
+// Documents sorting equal keep the order they were read in, as with the
+// stable sort of $sort.
+type windowHeap struct {
+	entries []windowEntry
+	less    func(a, b map[string]interface{}) bool // nil without a $sort
+}
+
+// windowEntry is a document of a windowHeap, with its position in the scan
+// and the memory charged for it.
+type windowEntry struct {
+	doc  map[string]interface{}
+	seq  int
+	size int64
+}
+
+// after reports whether a sorts after b.
+func (h *windowHeap) after(a, b windowEntry) bool {
+	if h.less(b.doc, a.doc) {
+		return true
+	}
+	return !h.less(a.doc, b.doc) && a.seq > b.seq
+}
+
+func (h *windowHeap) Len() int           { return len(h.entries) }
+func (h *windowHeap) Less(i, j int) bool { return h.after(h.entries[i], h.entries[j]) }
+func (h *windowHeap) Swap(i, j int)      { h.entries[i], h.entries[j] = h.entries[j], h.entries[i] }
+func (h *windowHeap) Push(x interface{}) { h.entries = append(h.entries, x.(windowEntry)) }
+func (h *windowHeap) Pop() interface{} {
+	last := h.entries[len(h.entries)-1]
+	h.entries = h.entries[:len(h.entries)-1]
+	return last
+}
+
+// push adds an entry, charging its document to the memory budget.
+func (h *windowHeap) push(entry windowEntry, budget *memoryBudget) error {
+	entry.size = valueSize(entry.doc)
+	if err := budget.hold(entry.size); err != nil {
+		return fmt.Errorf("error in $limit stage: %w", err)
+	}
+	if h.less == nil {
+		h.entries = append(h.entries, entry)
+	} else {
+		heap.Push(h, entry)
+	}
+	return nil
+}
+
+// replaceLast replaces the entry sorting last with 'entry', releasing the
+// memory of the evicted document.
+func (h *windowHeap) replaceLast(entry windowEntry, budget *memoryBudget) error {
+	entry.size = valueSize(entry.doc)
+	if err := budget.hold(entry.size - h.entries[0].size); err != nil {
+		return fmt.Errorf("error in $limit stage: %w", err)
+	}
+	h.entries[0] = entry
+	heap.Fix(h, 0)
+	return nil
+}
+
+// sorted returns the documents of the heap in sort order, or in the order
+// they were read without a $sort.
+func (h *windowHeap) sorted() []map[string]interface{} {
+	if h.less != nil {
+		sort.Slice(h.entries, func(i, j int) bool { return h.after(h.entries[j], h.entries[i]) })
+	}
+	docs := make([]map[string]interface{}, len(h.entries))
+	for i, entry := range h.entries {
+		docs[i] = entry.doc
+	}
+	return docs
+}
+
+// planKeyCount recognizes a pipeline made of a single $count stage and
+// returns the field it outputs the count in. Such a pipeline only needs the
+// number of documents, which countKeys gets from the keys of the collection
+// without reading its values. A $match before the $count needs the values:
+// keys hold the UUID of a document only, and indexes only serve $sort.
+func planKeyCount(stages []AggregationStage) (string, bool) {
+	if len(stages) != 1 || stages[0].Stage != "$count" {
+		return "", false
+	}
+	field, err := countField(stages[0].Params)
+	if err != nil {
+		return "", false
+	}
+	return field, true
+}
+
+// countKeys returns the number of documents of a collection, iterating over
+// its keys only: Badger never reads the values, which for large documents
+// live in the value log. The keys are read in the snapshot of the query.
+func (db *DB) countKeys(ctx context.Context, collectionName string, isolation QueryIsolation, stats *QueryStats) (int, error) {
+	ctx, snapshot := db.withQuerySnapshot(ctx, isolation)
+	defer func() { stats.SnapshotHeld = snapshot.release() }()
+
+	prefix := db.keys.collectionPrefix(collectionName)
+	count := 0
+	err := snapshot.view(db, func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		opts.Prefix = prefix
+		it := txn.NewIterator(opts)
+		defer it.Close()
+
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			// Keys of a collection whose name starts with "collection:" share the prefix
+			if isCollectionKey(db.keys, collectionName, it.Item().Key()) {
+				count++
+			}
+		}
+		return nil
+	})
+	return count, err
+}
+
+// lookupUnwindFusion reports whether stages[i] is a $lookup immediately
+// followed by an $unwind of its "as" field, and returns the $unwind params.
+// Such pairs are executed by lookupUnwindStage, which emits one document per
+// match without building the intermediate arrays.
+func lookupUnwindFusion(stages []AggregationStage, i int) (map[string]interface{}, bool) {
+	if i+1 >= len(stages) || stages[i].Stage != "$lookup" || stages[i+1].Stage != "$unwind" {
+		return nil, false
+	}
+	as, _ := stages[i].Params["as"].(string)
+	path, _ := stages[i+1].Params["path"].(string)
+	if as == "" || strings.TrimPrefix(path, "$") != as {
+		return nil, false
+	}
+	return stages[i+1].Params, true
+}
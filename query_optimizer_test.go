@@ -0,0 +1,34 @@
+package marco
+
+import (
+	"context"
+	"testing"
+)
+
+func TestWindowedScanHugeSkipAndLimit(t *testing.T) {
+	db := openTestDB(t, map[string][]string{"c": {`{"a": 1}`, `{"a": 2}`, `{"a": 3}`}})
+	tests := []struct {
+		pipeline string
+		want     int
+	}{
+		{`[{"$sort": {"a": 1}}, {"$skip": 9223372036854775807}, {"$limit": 5}]`, 0},
+		{`[{"$skip": 1e300}, {"$limit": 1}]`, 0},
+		{`[{"$sort": {"a": 1}}, {"$skip": 1}, {"$skip": 9223372036854775807}, {"$limit": 1}]`, 0},
+		{`[{"$sort": {"a": 1}}, {"$limit": 1e300}]`, 3},
+		{`[{"$skip": 1}, {"$limit": 9223372036854775807}]`, 2},
+	}
+	for _, engine := range []ExecutionEngine{EngineLegacy, EngineOptimized} {
+		for _, test := range tests {
+			results, stats, err := db.QueryWithOptions(context.Background(), "c", test.pipeline, QueryOptions{Engine: engine})
+			if err != nil {
+				t.Fatalf("%s %s: %v", engine, test.pipeline, err)
+			}
+			if len(results) != test.want {
+				t.Errorf("%s %s: got %d documents, want %d", engine, test.pipeline, len(results), test.want)
+			}
+			if engine == EngineOptimized && stats.Shortcut != "windowedScan" {
+				t.Errorf("%s: shortcut %q, want windowedScan", test.pipeline, stats.Shortcut)
+			}
+		}
+	}
+}
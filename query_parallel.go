@@ -0,0 +1,238 @@
+package marco
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// ParallelOptions configures the parallel execution of pipelines.
+type ParallelOptions struct {
+	// Workers is the number of goroutines running the stateless stages of a
+	// query side by side. Zero or one runs them on the goroutine of the
+	// query.
+	Workers int
+
+	// BatchSize is the number of documents handed to a worker at a time.
+	// Zero means 256.
+	BatchSize int
+}
+
+const defaultParallelBatchSize = 256
+
+// parallelStages are the stages run by the workers: they transform or filter
+// each document on its own.
+var parallelStages = map[string]bool{
+	"$match":     true,
+	"$project":   true,
+	"$addFields": true,
+}
+
+// SetParallelOptions configures the parallel execution of the queries run by
+// the optimized engine. Consecutive $match, $project and $addFields stages are
+// run by opts.Workers goroutines, each on its own batch of documents, which
+// pays off on large scans with costly filters or expressions. Documents leave
+// the workers in their original order, so the results are those of a
+// sequential execution.
+//
+//	db.SetParallelOptions(marco.ParallelOptions{Workers: runtime.NumCPU()})
+//
+// The predicates and functions registered with RegisterWhere and
+// RegisterFunction are then called concurrently and must be safe for
+// concurrent use.
+func (db *DB) SetParallelOptions(opts ParallelOptions) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.parallel = opts
+}
+
+// parallelOptions returns the parallel execution settings, defaults applied.
+func (db *DB) parallelOptions() ParallelOptions {
+	db.mu.RLock()
+	opts := db.parallel
+	db.mu.RUnlock()
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = defaultParallelBatchSize
+	}
+	return opts
+}
+
+// parallelStageStats accumulates the work of the workers on one stage.
+type parallelStageStats struct {
+	docs    int           // documents output
+	elapsed time.Duration // time spent in the stage, summed over the workers
+}
+
+// parallelIterator runs a sequence of parallel stages over its input. A
+// reader goroutine cuts the input into batches, the workers run the stages on
+// them, and next returns the documents batch after batch in input order.
+type parallelIterator struct {
+	db        *DB
+	ctx       context.Context
+	stages    []AggregationStage
+	in        docIterator
+	workers   int
+	batchSize int
+
+	mu    sync.Mutex // guards stats
+	stats []parallelStageStats
+
+	started   bool
+	order     chan chan parallelBatch // results of the batches in input order
+	done      chan struct{}
+	closeOnce sync.Once
+	wg        sync.WaitGroup
+
+	current []map[string]interface{}
+	pos     int
+	err     error
+}
+
+// parallelBatch is a batch of documents output by the stages.
+type parallelBatch struct {
+	docs []map[string]interface{}
+	err  error
+}
+
+// parallelJob is a batch of input documents and where to send its result.
+type parallelJob struct {
+	docs   []map[string]interface{}
+	result chan parallelBatch
+}
+
+func newParallelIterator(ctx context.Context, db *DB, stages []AggregationStage, in docIterator, opts ParallelOptions) *parallelIterator {
+	return &parallelIterator{
+		db:        db,
+		ctx:       ctx,
+		stages:    stages,
+		in:        in,
+		workers:   opts.Workers,
+		batchSize: opts.BatchSize,
+		stats:     make([]parallelStageStats, len(stages)),
+		done:      make(chan struct{}),
+	}
+}
+
+func (it *parallelIterator) next() (map[string]interface{}, error) {
+	if !it.started {
+		it.start()
+	}
+	for it.pos == len(it.current) {
+		if it.err != nil {
+			return nil, it.err
+		}
+		result, ok := <-it.order
+		if !ok {
+			return nil, nil
+		}
+		batch := <-result
+		if batch.err != nil {
+			it.err = batch.err
+			return nil, it.err
+		}
+		it.current, it.pos = batch.docs, 0
+	}
+	it.pos++
+	return it.current[it.pos-1], nil
+}
+
+// start launches the reader and the workers. At most 'workers' batches are
+// read ahead of the one being returned.
+func (it *parallelIterator) start() {
+	it.started = true
+	it.order = make(chan chan parallelBatch, it.workers)
+	jobs := make(chan parallelJob)
+
+	for w := 0; w < it.workers; w++ {
+		it.wg.Add(1)
+		go func() {
+			defer it.wg.Done()
+			for job := range jobs {
+				job.result <- it.runBatch(job.docs)
+			}
+		}()
+	}
+
+	it.wg.Add(1)
+	go func() {
+		defer it.wg.Done()
+		defer close(it.order)
+		defer close(jobs)
+
+		for more := true; more; {
+			var docs []map[string]interface{}
+			var err error
+			docs, more, err = it.readBatch()
+			if len(docs) == 0 && err == nil {
+				return
+			}
+
+			result := make(chan parallelBatch, 1)
+			select {
+			case it.order <- result:
+			case <-it.done:
+				return
+			}
+			if err != nil {
+				result <- parallelBatch{err: err}
+				return
+			}
+			select {
+			case jobs <- parallelJob{docs: docs, result: result}:
+			case <-it.done:
+				return
+			}
+		}
+	}()
+}
+
+// readBatch reads the next batch of input documents, and reports whether
+// there may be more.
+func (it *parallelIterator) readBatch() ([]map[string]interface{}, bool, error) {
+	docs := make([]map[string]interface{}, 0, it.batchSize)
+	for len(docs) < it.batchSize {
+		doc, err := it.in.next()
+		if err != nil {
+			return nil, false, err
+		}
+		if doc == nil {
+			return docs, false, nil
+		}
+		docs = append(docs, doc)
+	}
+	return docs, true, nil
+}
+
+// runBatch runs the stages on a batch of documents.
+func (it *parallelIterator) runBatch(docs []map[string]interface{}) parallelBatch {
+	var chain docIterator = &sliceIterator{docs: docs}
+	outs := make([]*statsIterator, len(it.stages))
+	for i, stage := range it.stages {
+		stageIt, err := it.db.stageIterator(it.ctx, stage, chain)
+		if err != nil {
+			return parallelBatch{err: err}
+		}
+		outs[i] = &statsIterator{ctx: it.ctx, in: stageIt}
+		chain = outs[i]
+	}
+	out, err := drainIterator(chain)
+
+	it.mu.Lock()
+	defer it.mu.Unlock()
+	var upstream time.Duration
+	for i, stageOut := range outs {
+		it.stats[i].docs += stageOut.docs
+		it.stats[i].elapsed += stageOut.elapsed - upstream
+		upstream = stageOut.elapsed
+	}
+	return parallelBatch{docs: out, err: err}
+}
+
+// close stops the reader and the workers and waits for them, so that the
+// input is no longer read. It is safe to call several times.
+func (it *parallelIterator) close() {
+	it.closeOnce.Do(func() {
+		close(it.done)
+	})
+	it.wg.Wait()
+}
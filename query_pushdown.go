@@ -0,0 +1,271 @@
+package marco
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+)
+
+// rawScreen is a necessary condition for a document to pass a $match stage,
+// checked on its encoded value before it is decoded. Each term is a top-level
+// field of the filter compared for equality with a string or a boolean: a
+// document can only match if its JSON text contains both the encoded field
+// name and the encoded value.
+type rawScreen []rawScreenTerm
+
+type rawScreenTerm struct {
+	key   []byte // encoded field name, quotes included
+	value []byte // encoded value
+}
+
+// newRawScreen returns the screen of the $match filter 'params', or nil when
+// the filter has no term the screen can check. Only equalities on top-level
+// fields with a string or boolean value are screened: the text of numbers
+// varies with their encoding, and nested fields, arrays and documents are
+// left to the stage.
+func newRawScreen(params map[string]interface{}) rawScreen {
+	var screen rawScreen
+	for field, value := range params {
+		if field == "$and" {
+			clauses, _ := value.([]interface{})
+			for _, clause := range clauses {
+				if clauseParams, ok := clause.(map[string]interface{}); ok {
+					screen = append(screen, newRawScreen(clauseParams)...)
+				}
+			}
+			continue
+		}
+		if strings.HasPrefix(field, "$") || strings.Contains(field, ".") {
+			continue
+		}
+		switch v := value.(type) {
+		case map[string]interface{}:
+			// {field: {"$eq": value}} is the same equality
+			if len(v) != 1 {
+				continue
+			}
+			eq, ok := v["$eq"]
+			if !ok {
+				continue
+			}
+			value = eq
+		}
+		switch value.(type) {
+		case string, bool:
+		default:
+			continue
+		}
+		key, err1 := json.Marshal(field)
+		encoded, err2 := json.Marshal(value)
+		if err1 != nil || err2 != nil {
+			continue
+		}
+		screen = append(screen, rawScreenTerm{key: key, value: encoded})
+	}
+	return screen
+}
+
+// admits reports whether the document encoded as 'val' may pass the filter.
+// Values written with a codec other than plain JSON are always admitted.
+func (s rawScreen) admits(val []byte) bool {
+	if len(val) == 0 || val[0] == codecHeaderMarker {
+		return true
+	}
+	for _, term := range s {
+		if !bytes.Contains(val, term.key) || !bytes.Contains(val, term.value) {
+			return false
+		}
+	}
+	return true
+}
+
+// pipelineScreen returns the screen of the $match stage opening the pipeline,
+// or nil.
+func pipelineScreen(stages []AggregationStage) rawScreen {
+	if len(stages) == 0 || stages[0].Stage != "$match" {
+		return nil
+	}
+	return newRawScreen(stages[0].Params)
+}
+
+// pipelineFields returns the top-level fields of the stored documents that
+// the pipeline reads, or nil when they can't be known before running it. The
+// set is known when the pipeline ends up replacing the documents, e.g. with
+// an inclusion $project or a $group, and the stages before only refer to
+// fields by name: a $where predicate or $$ROOT may read any of them.
+func pipelineFields(stages []AggregationStage) map[string]bool {
+	fields := map[string]bool{"_id": true}
+	for _, stage := range stages {
+		params := stage.Params
+		switch stage.Stage {
+		case "$match":
+			if !addMatchFields(fields, params) {
+				return nil
+			}
+
+		case "$sort":
+			for field := range params {
+				addFieldPath(fields, field)
+			}
+
+		case "$skip", "$limit", "$unset":
+
+		case "$addFields", "$set":
+			if !addExpressionFields(fields, params) {
+				return nil
+			}
+
+		case "$unwind":
+			path, ok := params["path"].(string)
+			if !ok {
+				return nil
+			}
+			addFieldPath(fields, strings.TrimPrefix(path, "$"))
+
+		case "$lookup":
+			localField, ok := params["localField"].(string)
+			if !ok || !addExpressionFields(fields, params["let"]) {
+				return nil
+			}
+			addFieldPath(fields, localField)
+
+		case "$project":
+			if mode, err := determineProjectionMode(params); err != nil || mode != "include" {
+				return nil
+			}
+			for field := range params {
+				addFieldPath(fields, field)
+			}
+			if !addExpressionFields(fields, params) {
+				return nil
+			}
+			return fields
+
+		case "$group", "$sortByCount", "$count":
+			if !addExpressionFields(fields, params) {
+				return nil
+			}
+			return fields
+
+		default:
+			return nil
+		}
+	}
+	// The documents are output with all their fields
+	return nil
+}
+
+// addMatchFields adds the fields read by the $match filter 'params', and
+// reports whether they are known.
+func addMatchFields(fields map[string]bool, params map[string]interface{}) bool {
+	for key, value := range params {
+		switch key {
+		case "$and", "$or", "$nor":
+			clauses, _ := value.([]interface{})
+			for _, clause := range clauses {
+				clauseParams, ok := clause.(map[string]interface{})
+				if !ok || !addMatchFields(fields, clauseParams) {
+					return false
+				}
+			}
+		case "$expr":
+			if !addExpressionFields(fields, value) {
+				return false
+			}
+		case "$sampleRate", "$comment":
+		default:
+			if strings.HasPrefix(key, "$") {
+				return false
+			}
+			addFieldPath(fields, key)
+		}
+	}
+	return true
+}
+
+// addExpressionFields adds the fields referred to by 'expr' as "$field" or
+// "$$ROOT.field", and reports whether they are known. Strings are taken as
+// references wherever they appear, which at worst decodes a field for
+// nothing.
+func addExpressionFields(fields map[string]bool, expr interface{}) bool {
+	switch e := expr.(type) {
+	case string:
+		if strings.HasPrefix(e, "$$") {
+			variable, path := e[2:], ""
+			if i := strings.Index(variable, "."); i >= 0 {
+				variable, path = variable[:i], variable[i+1:]
+			}
+			if variable == "ROOT" || variable == "CURRENT" {
+				if path == "" {
+					return false
+				}
+				addFieldPath(fields, path)
+			}
+		} else if strings.HasPrefix(e, "$") && len(e) > 1 {
+			addFieldPath(fields, e[1:])
+		}
+	case []interface{}:
+		for _, item := range e {
+			if !addExpressionFields(fields, item) {
+				return false
+			}
+		}
+	case map[string]interface{}:
+		for key, value := range e {
+			switch key {
+			case "$getField", "$setField", "$unsetField":
+				// Name fields of the document by their plain name
+				return false
+			case "sortBy":
+				// $top, $bottom and their N variants sort by plain field names
+				if sortBy, ok := value.(map[string]interface{}); ok {
+					for field := range sortBy {
+						addFieldPath(fields, field)
+					}
+				}
+			}
+			if !addExpressionFields(fields, value) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// addFieldPath adds the top-level field of a dotted path.
+func addFieldPath(fields map[string]bool, path string) {
+	if i := strings.Index(path, "."); i >= 0 {
+		path = path[:i]
+	}
+	fields[path] = true
+}
+
+// decodeFields decodes the fields 'fields' of the document encoded as 'val',
+// leaving the others out. Only values stored as plain JSON are decoded
+// partially; the others are decoded whole.
+func (db *DB) decodeFields(val []byte, fields map[string]bool) (map[string]interface{}, error) {
+	if len(val) == 0 || val[0] == codecHeaderMarker {
+		return db.decodeDocument(val)
+	}
+	raw := getRawFields()
+	if err := json.Unmarshal(val, &raw); err != nil {
+		return nil, err
+	}
+	if raw == nil {
+		return nil, nil
+	}
+	defer putRawFields(raw)
+	doc := make(map[string]interface{}, len(fields))
+	for field := range fields {
+		encoded, ok := raw[field]
+		if !ok {
+			continue
+		}
+		var value interface{}
+		if err := json.Unmarshal(encoded, &value); err != nil {
+			return nil, err
+		}
+		doc[field] = value
+	}
+	return doc, nil
+}
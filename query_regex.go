@@ -0,0 +1,264 @@
+package marco
+
+import (
+	"container/list"
+	"errors"
+	"fmt"
+	"regexp"
+	"regexp/syntax"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// regexCacheSize is the number of compiled patterns kept by regexCache.
+const regexCacheSize = 256
+
+// regexCache holds compiled $regex patterns, so that a pattern is compiled
+// once instead of for every document it is matched against.
+var regexCache = newRegexLRU(regexCacheSize)
+
+// ErrRegexTooComplex is returned for patterns exceeding the RegexLimits.
+var ErrRegexTooComplex = errors.New("regular expression exceeds the configured limits")
+
+// RegexLimits bounds the patterns accepted by $regex, $not with a pattern and
+// schema "pattern" keywords, for pipelines built from untrusted input.
+//
+// Patterns are compiled by Go's RE2-based regexp package, which never
+// backtracks: matching time is linear in the input, so catastrophic patterns
+// such as (a+)+$ cannot hang a query. The cost per input byte still grows
+// with the size of the compiled pattern, which these limits cap. Patterns
+// over a limit fail validation like invalid patterns, with ErrRegexTooComplex.
+type RegexLimits struct {
+	MaxPatternLength int // bytes of the pattern; zero for no limit
+	MaxProgramSize   int // instructions of the compiled pattern; zero for no limit
+	MaxRepeatNesting int // depth of nested repetitions, 2 for (a+)*; zero for no limit
+	CacheSize        int // compiled patterns kept; zero for 256
+}
+
+// RegexStats counts the regex work done since the process started.
+type RegexStats struct {
+	Evaluations  uint64 // strings matched against a pattern
+	CacheHits    uint64 // patterns found compiled in the cache
+	Compilations uint64 // patterns compiled
+	Rejected     uint64 // patterns refused by RegexLimits
+}
+
+// SetRegexLimits sets the limits applied to the patterns compiled from now
+// on; the compiled patterns cache is emptied so that every pattern is checked
+// again. The limits and the cache are shared by all DBs of the process.
+func SetRegexLimits(limits RegexLimits) {
+	regexCache.setLimits(limits)
+}
+
+// GetRegexStats returns the regex counters.
+func GetRegexStats() RegexStats {
+	return RegexStats{
+		Evaluations:  atomic.LoadUint64(&regexCache.stats.Evaluations),
+		CacheHits:    atomic.LoadUint64(&regexCache.stats.CacheHits),
+		Compilations: atomic.LoadUint64(&regexCache.stats.Compilations),
+		Rejected:     atomic.LoadUint64(&regexCache.stats.Rejected),
+	}
+}
+
+// regexLRU is a least-recently-used cache of compiled regular expressions,
+// keyed by pattern and options.
+type regexLRU struct {
+	mu       sync.Mutex
+	capacity int
+	limits   RegexLimits
+	order    *list.List // front = most recently used
+	entries  map[string]*list.Element
+	stats    RegexStats // updated atomically
+}
+
+// regexEntry is the value of a regexLRU list element.
+type regexEntry struct {
+	key string
+	re  *regexp.Regexp
+}
+
+func newRegexLRU(capacity int) *regexLRU {
+	return &regexLRU{
+		capacity: capacity,
+		order:    list.New(),
+		entries:  make(map[string]*list.Element),
+	}
+}
+
+// setLimits replaces the limits and the capacity, emptying the cache.
+func (c *regexLRU) setLimits(limits RegexLimits) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.limits = limits
+	c.capacity = regexCacheSize
+	if limits.CacheSize > 0 {
+		c.capacity = limits.CacheSize
+	}
+	c.order.Init()
+	c.entries = make(map[string]*list.Element)
+}
+
+// matchString reports whether s matches pattern with $options applied.
+func (c *regexLRU) matchString(pattern, options, s string) (bool, error) {
+	re, err := c.get(pattern, options)
+	if err != nil {
+		return false, err
+	}
+	c.countEvaluation()
+	return re.MatchString(s), nil
+}
+
+// countEvaluation counts a string matched against a compiled pattern.
+func (c *regexLRU) countEvaluation() {
+	atomic.AddUint64(&c.stats.Evaluations, 1)
+}
+
+// get returns the compiled form of pattern with MongoDB $options applied,
+// compiling and caching it on first use.
+func (c *regexLRU) get(pattern, options string) (*regexp.Regexp, error) {
+	key := options + "\x00" + pattern
+
+	c.mu.Lock()
+	if elem, ok := c.entries[key]; ok {
+		c.order.MoveToFront(elem)
+		c.mu.Unlock()
+		atomic.AddUint64(&c.stats.CacheHits, 1)
+		return elem.Value.(*regexEntry).re, nil
+	}
+	limits := c.limits
+	c.mu.Unlock()
+
+	if err := checkRegexLimits(pattern, options, limits); err != nil {
+		atomic.AddUint64(&c.stats.Rejected, 1)
+		return nil, err
+	}
+	re, err := compileRegex(pattern, options)
+	if err != nil {
+		return nil, err
+	}
+	atomic.AddUint64(&c.stats.Compilations, 1)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.entries[key]; ok {
+		// Compiled concurrently by another query
+		c.order.MoveToFront(elem)
+		return elem.Value.(*regexEntry).re, nil
+	}
+	c.entries[key] = c.order.PushFront(&regexEntry{key: key, re: re})
+	if c.order.Len() > c.capacity {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*regexEntry).key)
+	}
+	return re, nil
+}
+
+// checkRegexLimits checks a pattern against limits.
+func checkRegexLimits(pattern, options string, limits RegexLimits) error {
+	if limits.MaxPatternLength > 0 && len(pattern) > limits.MaxPatternLength {
+		return fmt.Errorf("%w: pattern of %d bytes, the maximum is %d", ErrRegexTooComplex, len(pattern), limits.MaxPatternLength)
+	}
+	if limits.MaxProgramSize <= 0 && limits.MaxRepeatNesting <= 0 {
+		return nil
+	}
+	if strings.ContainsRune(options, 'x') {
+		pattern = stripExtendedRegex(pattern)
+	}
+	parsed, err := syntax.Parse(pattern, syntax.Perl)
+	if err != nil {
+		return nil // reported by compileRegex
+	}
+
+	if limits.MaxRepeatNesting > 0 {
+		if depth := repeatNesting(parsed); depth > limits.MaxRepeatNesting {
+			return fmt.Errorf("%w: repetitions nested %d deep, the maximum is %d", ErrRegexTooComplex, depth, limits.MaxRepeatNesting)
+		}
+	}
+	if limits.MaxProgramSize > 0 {
+		prog, err := syntax.Compile(parsed.Simplify())
+		if err != nil {
+			return nil
+		}
+		if size := len(prog.Inst); size > limits.MaxProgramSize {
+			return fmt.Errorf("%w: compiled to %d instructions, the maximum is %d", ErrRegexTooComplex, size, limits.MaxProgramSize)
+		}
+	}
+	return nil
+}
+
+// repeatNesting returns the maximum depth of nested repetition operators.
+func repeatNesting(re *syntax.Regexp) int {
+	deepest := 0
+	for _, sub := range re.Sub {
+		if depth := repeatNesting(sub); depth > deepest {
+			deepest = depth
+		}
+	}
+	switch re.Op {
+	case syntax.OpStar, syntax.OpPlus, syntax.OpQuest, syntax.OpRepeat:
+		deepest++
+	}
+	return deepest
+}
+
+// compileRegex compiles a pattern with MongoDB $options:
+//
+//   - i: case-insensitive
+//   - m: ^ and $ match at line boundaries
+//   - s: . matches newlines
+//   - x: extended syntax, unescaped whitespace and # comments are ignored
+func compileRegex(pattern, options string) (*regexp.Regexp, error) {
+	var flags string
+	for _, opt := range options {
+		switch opt {
+		case 'i', 'm', 's':
+			if !strings.ContainsRune(flags, opt) {
+				flags += string(opt)
+			}
+		case 'x':
+			pattern = stripExtendedRegex(pattern)
+		default:
+			return nil, fmt.Errorf("unsupported regex option %q", opt)
+		}
+	}
+	if flags != "" {
+		pattern = "(?" + flags + ")" + pattern
+	}
+	return regexp.Compile(pattern)
+}
+
+// stripExtendedRegex removes the whitespace and comments allowed by the x
+// option. Escaped characters and character classes are kept as written.
+func stripExtendedRegex(pattern string) string {
+	var b strings.Builder
+	inClass := false
+	for i := 0; i < len(pattern); i++ {
+		c := pattern[i]
+		switch {
+		case c == '\\' && i+1 < len(pattern):
+			b.WriteByte(c)
+			b.WriteByte(pattern[i+1])
+			i++
+		case inClass:
+			if c == ']' {
+				inClass = false
+			}
+			b.WriteByte(c)
+		case c == '[':
+			inClass = true
+			b.WriteByte(c)
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f' || c == '\v':
+			// ignored
+		case c == '#':
+			// comment until the end of the line
+			for i < len(pattern) && pattern[i] != '\n' {
+				i++
+			}
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
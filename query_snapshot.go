@@ -0,0 +1,343 @@
+package marco
+
+import (
+	"context"
+	"errors"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/dgraph-io/badger/v3"
+)
+
+// ErrQueryBudgetExceeded is returned by Query when loading the collections of
+// a pipeline reads more bytes than LoadOptions.MaxQueryBytes.
+var ErrQueryBudgetExceeded = errors.New("query exceeded its read budget")
+
+// LoadOptions controls how queries load the collections they use.
+type LoadOptions struct {
+	// Workers is the number of collections decoded concurrently, shared by
+	// all queries of the DB. Zero means runtime.NumCPU().
+	Workers int
+
+	// MaxQueryBytes caps the encoded size of the documents a single query
+	// loads, across all its collections. Zero means no limit.
+	MaxQueryBytes int64
+
+	// PrefetchSize is the number of documents Badger reads ahead while a
+	// collection is scanned, by queries and by CollectionIter. Larger values
+	// speed up scans of large collections at the cost of memory. Zero means
+	// Badger's default (100).
+	PrefetchSize int
+}
+
+// SetLoadOptions configures collection loading for queries that use several
+// collections ($lookup, including inside $facet). Such collections are loaded
+// concurrently when the query starts.
+func (db *DB) SetLoadOptions(opts LoadOptions) {
+	workers := opts.Workers
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.loadOptions = opts
+	db.loadSlots = make(chan struct{}, workers)
+}
+
+// scanOptions returns the Badger iterator options of collection scans.
+func (db *DB) scanOptions() badger.IteratorOptions {
+	db.mu.RLock()
+	prefetch := db.loadOptions.PrefetchSize
+	db.mu.RUnlock()
+
+	opts := badger.DefaultIteratorOptions
+	if prefetch > 0 {
+		opts.PrefetchSize = prefetch
+	}
+	return opts
+}
+
+// loadSettings returns the load options and the shared worker slots.
+func (db *DB) loadSettings() (LoadOptions, chan struct{}) {
+	db.mu.RLock()
+	opts, slots := db.loadOptions, db.loadSlots
+	db.mu.RUnlock()
+	if slots != nil {
+		return opts, slots
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.loadSlots == nil {
+		db.loadSlots = make(chan struct{}, runtime.NumCPU())
+	}
+	return db.loadOptions, db.loadSlots
+}
+
+// querySnapshot holds the collections read by one query, so that every stage
+// referring to a collection sees the same documents. In particular a $lookup
+// whose "from" is the queried collection joins against the collection as it
+// was read when the query started, not against the partially processed
+// pipeline input nor against documents written in the meantime.
+//
+// Every collection is read in the snapshot's single Badger read transaction,
+// so the queried collection and the collections it joins are read at the
+// same point in time: a write committed while the query loads its
+// collections is seen by all of them or by none.
+type querySnapshot struct {
+	collection  string // the queried collection
+	mu          sync.Mutex
+	collections map[string][]map[string]interface{}
+	budget      *readBudget
+	txn         *badger.Txn // nil once released, or with ReadCommitted
+	opened      time.Time
+}
+
+// readBudget counts the bytes loaded by a query.
+type readBudget struct {
+	limit int64 // zero for no limit
+	used  int64 // updated atomically
+}
+
+// consume accounts for n more bytes.
+func (b *readBudget) consume(n int) error {
+	if b == nil || b.limit <= 0 {
+		return nil
+	}
+	if atomic.AddInt64(&b.used, int64(n)) > b.limit {
+		return ErrQueryBudgetExceeded
+	}
+	return nil
+}
+
+// querySnapshotKey is the context key of the query's snapshot.
+type querySnapshotKey struct{}
+
+// withQuerySnapshot returns a context carrying a new, empty snapshot. With
+// SnapshotIsolation the snapshot holds a read transaction until it is
+// released; with ReadCommitted each collection is read in its own.
+func (db *DB) withQuerySnapshot(ctx context.Context, isolation QueryIsolation) (context.Context, *querySnapshot) {
+	opts, _ := db.loadSettings()
+	snapshot := &querySnapshot{
+		collections: make(map[string][]map[string]interface{}),
+		budget:      &readBudget{limit: opts.MaxQueryBytes},
+	}
+	if isolation == SnapshotIsolation {
+		snapshot.txn = db.db.NewTransaction(false)
+		snapshot.opened = time.Now()
+	}
+	return context.WithValue(ctx, querySnapshotKey{}, snapshot), snapshot
+}
+
+// view runs fn in the read transaction of the snapshot, or in a new one once
+// the snapshot is released or without one.
+func (s *querySnapshot) view(db *DB, fn func(txn *badger.Txn) error) error {
+	s.mu.Lock()
+	txn := s.txn
+	s.mu.Unlock()
+	if txn == nil {
+		return db.db.View(fn)
+	}
+	return fn(txn)
+}
+
+// iterate returns an Iterator over a collection in the read transaction of
+// the snapshot, or in its own transaction once the snapshot is released or
+// without one. It must be closed before the snapshot is released.
+func (s *querySnapshot) iterate(db *DB, collection string) *Iterator {
+	s.mu.Lock()
+	txn := s.txn
+	s.mu.Unlock()
+	if txn == nil {
+		return db.newIterator(db.db.NewTransaction(false), true, collection)
+	}
+	return db.newIterator(txn, false, collection)
+}
+
+// release discards the read transaction of the snapshot. An open read
+// transaction keeps Badger from discarding the versions it can see, so it must
+// not outlive the query. The documents already recorded stay available.
+// It returns how long the transaction was held.
+func (s *querySnapshot) release() time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.txn == nil {
+		return 0
+	}
+	s.txn.Discard()
+	s.txn = nil
+	return time.Since(s.opened)
+}
+
+// queryCollection returns the collection queried by the query running in ctx,
+// or "" outside of a query.
+func queryCollection(ctx context.Context) string {
+	if snapshot, ok := ctx.Value(querySnapshotKey{}).(*querySnapshot); ok {
+		return snapshot.collection
+	}
+	return ""
+}
+
+// releaseQuerySnapshot releases the snapshot of the query running in ctx, if
+// any, and returns how long its read transaction was held.
+func releaseQuerySnapshot(ctx context.Context) time.Duration {
+	if snapshot, ok := ctx.Value(querySnapshotKey{}).(*querySnapshot); ok {
+		return snapshot.release()
+	}
+	return 0
+}
+
+// record stores the documents of a collection in the snapshot.
+func (s *querySnapshot) record(collection string, docs []map[string]interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.collections[collection] = docs
+}
+
+// get returns the recorded documents of a collection.
+func (s *querySnapshot) get(collection string) ([]map[string]interface{}, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	docs, found := s.collections[collection]
+	return docs, found
+}
+
+// snapshotCollection returns the documents of a collection as seen by the
+// query running in ctx, reading and recording the collection on first use.
+// Outside of a query it reads the collection.
+func (db *DB) snapshotCollection(ctx context.Context, collection string) ([]map[string]interface{}, error) {
+	snapshot, ok := ctx.Value(querySnapshotKey{}).(*querySnapshot)
+	if !ok {
+		return db.Collection(collection)
+	}
+
+	if docs, found := snapshot.get(collection); found {
+		return docs, nil
+	}
+
+	docs, err := db.loadCollection(ctx, snapshot, collection)
+	if err != nil {
+		return nil, err
+	}
+	snapshot.record(collection, docs)
+	return docs, nil
+}
+
+// loadCollection reads a collection in the snapshot's transaction, charging
+// its size to the snapshot's budget.
+func (db *DB) loadCollection(ctx context.Context, snapshot *querySnapshot, collection string) ([]map[string]interface{}, error) {
+	var docs []map[string]interface{}
+	err := snapshot.view(db, func(txn *badger.Txn) error {
+		return db.forEachDocumentInTxn(txn, collection, func(doc map[string]interface{}, size int) (bool, error) {
+			if err := ctx.Err(); err != nil {
+				return false, err
+			}
+			if err := snapshot.budget.consume(size); err != nil {
+				return false, err
+			}
+			docs = append(docs, doc)
+			return true, nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return docs, nil
+}
+
+// preloadCollections loads the given collections into the snapshot, several
+// at a time using the DB's shared worker slots. It returns the first error.
+func (db *DB) preloadCollections(ctx context.Context, snapshot *querySnapshot, collections []string) error {
+	if len(collections) == 1 {
+		_, err := db.snapshotCollection(ctx, collections[0])
+		return err
+	}
+
+	_, slots := db.loadSettings()
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	var once sync.Once
+	var firstErr error
+	for _, collection := range collections {
+		wg.Add(1)
+		go func(collection string) {
+			defer wg.Done()
+
+			select {
+			case slots <- struct{}{}:
+				defer func() { <-slots }()
+			case <-ctx.Done():
+				return
+			}
+
+			docs, err := db.loadCollection(ctx, snapshot, collection)
+			if err != nil {
+				once.Do(func() {
+					firstErr = err
+					cancel()
+				})
+				return
+			}
+			snapshot.record(collection, docs)
+		}(collection)
+	}
+	wg.Wait()
+
+	if firstErr != nil {
+		return firstErr
+	}
+	return ctx.Err()
+}
+
+// pipelineCollections returns the collections the pipeline joins from,
+// including inside the sub-pipelines of $facet, without duplicates.
+func pipelineCollections(stages []AggregationStage) []string {
+	seen := make(map[string]bool)
+	var collections []string
+	for _, stage := range stages {
+		collectStageCollections(stage.Stage, stage.Params, seen, &collections)
+	}
+	return collections
+}
+
+// collectStageCollections is pipelineCollections for a single stage.
+func collectStageCollections(name string, params map[string]interface{}, seen map[string]bool, collections *[]string) {
+	switch name {
+	case "$lookup":
+		from, _ := lookupFromCollections(params["from"])
+		for _, f := range from {
+			if !seen[f] {
+				seen[f] = true
+				*collections = append(*collections, f)
+			}
+		}
+	case "$facet":
+		for _, rawPipeline := range params {
+			pipeline, _ := rawPipeline.([]interface{})
+			for _, rawStage := range pipeline {
+				stage, _ := rawStage.(map[string]interface{})
+				for subName, subParams := range stage {
+					if p, ok := subParams.(map[string]interface{}); ok {
+						collectStageCollections(subName, p, seen, collections)
+					}
+				}
+			}
+		}
+	}
+}
+
+// pipelineLooksUp reports whether a stage of the pipeline, including the
+// sub-pipelines of $facet, joins from 'collection'.
+func pipelineLooksUp(stages []AggregationStage, collection string) bool {
+	for _, c := range pipelineCollections(stages) {
+		if c == collection {
+			return true
+		}
+	}
+	return false
+}
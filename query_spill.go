@@ -0,0 +1,609 @@
+package marco
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/google/uuid"
+)
+
+// defaultSpillThreshold is the number of documents or groups a $sort or a
+// $group holds in memory before spilling, see QueryOptions.SpillThreshold.
+const defaultSpillThreshold = 100000
+
+// diskSpill is where the blocking stages of a query run with
+// QueryOptions.AllowDiskUse move what outgrows the spill threshold: temporary
+// keys of the database, under a prefix of their own, deleted when the query
+// completes.
+type diskSpill struct {
+	db        *DB
+	threshold int
+	prefix    []byte
+	docs      int64 // documents written, updated atomically
+
+	mu      sync.Mutex
+	areas   int            // areas handed out so far
+	readers []*spillReader // closed by release
+}
+
+// diskSpillKey is the context key of the query's diskSpill.
+type diskSpillKey struct{}
+
+// withDiskSpill returns a context letting the stages of a query spill to
+// disk once they hold more than 'threshold' documents or groups.
+func (db *DB) withDiskSpill(ctx context.Context, threshold int) (context.Context, *diskSpill) {
+	if threshold <= 0 {
+		threshold = defaultSpillThreshold
+	}
+	spill := &diskSpill{
+		db:        db,
+		threshold: threshold,
+		prefix:    append(systemKey("spill", uuid.New().String()), ':'),
+	}
+	return context.WithValue(ctx, diskSpillKey{}, spill), spill
+}
+
+// querySpill returns the diskSpill of the query of ctx, or nil if the query
+// may not use the disk.
+func querySpill(ctx context.Context) *diskSpill {
+	spill, _ := ctx.Value(diskSpillKey{}).(*diskSpill)
+	return spill
+}
+
+// area returns a new prefix under which a stage writes one sorted run or one
+// set of groups.
+func (s *diskSpill) area() []byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.areas++
+	return append(append([]byte{}, s.prefix...), fmt.Sprintf("%08d:", s.areas)...)
+}
+
+// writer returns a writer of documents under the prefix 'area'.
+func (s *diskSpill) writer(area []byte) *spillWriter {
+	return &spillWriter{spill: s, area: area, wb: s.db.db.NewWriteBatch()}
+}
+
+// reader returns a reader of the documents written under 'area', in key
+// order.
+func (s *diskSpill) reader(area []byte) *spillReader {
+	txn := s.db.db.NewTransaction(false)
+	opts := badger.DefaultIteratorOptions
+	opts.Prefix = area
+	r := &spillReader{area: area, txn: txn, it: txn.NewIterator(opts)}
+	r.it.Seek(area)
+
+	s.mu.Lock()
+	s.readers = append(s.readers, r)
+	s.mu.Unlock()
+	return r
+}
+
+// spilled returns the number of documents written to disk.
+func (s *diskSpill) spilled() int {
+	return int(atomic.LoadInt64(&s.docs))
+}
+
+// release closes the readers and deletes every key the query spilled.
+func (s *diskSpill) release() error {
+	s.mu.Lock()
+	readers := s.readers
+	s.readers = nil
+	s.mu.Unlock()
+	for _, r := range readers {
+		r.close()
+	}
+	return s.db.deleteKeysWithPrefix(s.prefix)
+}
+
+// deleteKeysWithPrefix deletes every key starting with prefix.
+func (db *DB) deleteKeysWithPrefix(prefix []byte) error {
+	wb := db.db.NewWriteBatch()
+	defer wb.Cancel()
+	err := db.db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		opts.Prefix = prefix
+		it := txn.NewIterator(opts)
+		defer it.Close()
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			if err := wb.Delete(it.Item().KeyCopy(nil)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return wb.Flush()
+}
+
+// dropSpills deletes the keys spilled by queries interrupted by a crash.
+func (db *DB) dropSpills() error {
+	return db.deleteKeysWithPrefix(systemKey("spill"))
+}
+
+// Spilled documents are encoded with the types of their values, which a
+// JSON round trip would lose: dates would come back as strings, binary data
+// as base64 and integers as float64, so a query would return other results
+// once it spills. Values of other types are spilled as JSON.
+const (
+	spillNil byte = iota
+	spillFalse
+	spillTrue
+	spillFloat64
+	spillFloat32
+	spillInt
+	spillInt8
+	spillInt16
+	spillInt32
+	spillInt64
+	spillUint
+	spillUint8
+	spillUint16
+	spillUint32
+	spillUint64
+	spillString
+	spillBytes
+	spillTime
+	spillDocument
+	spillArray
+	spillDocuments // []map[string]interface{}
+	spillJSON
+)
+
+// encodeSpillDocument encodes doc for the disk.
+func encodeSpillDocument(doc map[string]interface{}) ([]byte, error) {
+	return appendSpillValue(nil, doc)
+}
+
+func appendSpillValue(buf []byte, value interface{}) ([]byte, error) {
+	var err error
+	switch v := value.(type) {
+	case nil:
+		return append(buf, spillNil), nil
+	case bool:
+		if v {
+			return append(buf, spillTrue), nil
+		}
+		return append(buf, spillFalse), nil
+	case float64:
+		return appendUint64(append(buf, spillFloat64), math.Float64bits(v)), nil
+	case float32:
+		return appendUint64(append(buf, spillFloat32), uint64(math.Float32bits(v))), nil
+	case int:
+		return appendVarint(append(buf, spillInt), int64(v)), nil
+	case int8:
+		return appendVarint(append(buf, spillInt8), int64(v)), nil
+	case int16:
+		return appendVarint(append(buf, spillInt16), int64(v)), nil
+	case int32:
+		return appendVarint(append(buf, spillInt32), int64(v)), nil
+	case int64:
+		return appendVarint(append(buf, spillInt64), v), nil
+	case uint:
+		return appendUvarint(append(buf, spillUint), uint64(v)), nil
+	case uint8:
+		return appendUvarint(append(buf, spillUint8), uint64(v)), nil
+	case uint16:
+		return appendUvarint(append(buf, spillUint16), uint64(v)), nil
+	case uint32:
+		return appendUvarint(append(buf, spillUint32), uint64(v)), nil
+	case uint64:
+		return appendUvarint(append(buf, spillUint64), v), nil
+	case string:
+		return appendSpillBytes(append(buf, spillString), []byte(v)), nil
+	case []byte:
+		return appendSpillBytes(append(buf, spillBytes), v), nil
+	case time.Time:
+		data, err := v.MarshalBinary()
+		if err != nil {
+			return nil, err
+		}
+		return appendSpillBytes(append(buf, spillTime), data), nil
+	case map[string]interface{}:
+		buf = appendUvarint(append(buf, spillDocument), uint64(len(v)))
+		for key, item := range v {
+			buf = appendSpillBytes(buf, []byte(key))
+			if buf, err = appendSpillValue(buf, item); err != nil {
+				return nil, err
+			}
+		}
+		return buf, nil
+	case []interface{}:
+		buf = appendUvarint(append(buf, spillArray), uint64(len(v)))
+		for _, item := range v {
+			if buf, err = appendSpillValue(buf, item); err != nil {
+				return nil, err
+			}
+		}
+		return buf, nil
+	case []map[string]interface{}:
+		buf = appendUvarint(append(buf, spillDocuments), uint64(len(v)))
+		for _, item := range v {
+			if buf, err = appendSpillValue(buf, item); err != nil {
+				return nil, err
+			}
+		}
+		return buf, nil
+	default:
+		data, err := json.Marshal(v)
+		if err != nil {
+			return nil, err
+		}
+		return appendSpillBytes(append(buf, spillJSON), data), nil
+	}
+}
+
+func appendUint64(buf []byte, v uint64) []byte {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], v)
+	return append(buf, b[:]...)
+}
+
+func appendVarint(buf []byte, v int64) []byte {
+	var b [binary.MaxVarintLen64]byte
+	return append(buf, b[:binary.PutVarint(b[:], v)]...)
+}
+
+func appendUvarint(buf []byte, v uint64) []byte {
+	var b [binary.MaxVarintLen64]byte
+	return append(buf, b[:binary.PutUvarint(b[:], v)]...)
+}
+
+func appendSpillBytes(buf, data []byte) []byte {
+	return append(appendUvarint(buf, uint64(len(data))), data...)
+}
+
+// errSpillCorrupt is returned when a spilled document can't be decoded.
+var errSpillCorrupt = errors.New("corrupt document spilled to disk")
+
+// decodeSpillDocument decodes a document encoded by encodeSpillDocument.
+func decodeSpillDocument(data []byte) (map[string]interface{}, error) {
+	d := spillDecoder{data: data}
+	doc, ok := d.value().(map[string]interface{})
+	if d.err != nil {
+		return nil, d.err
+	}
+	if !ok || len(d.data) != 0 {
+		return nil, errSpillCorrupt
+	}
+	return doc, nil
+}
+
+// spillDecoder decodes the values of a spilled document. The first error
+// stops the decoding.
+type spillDecoder struct {
+	data []byte
+	err  error
+}
+
+func (d *spillDecoder) fail(err error) interface{} {
+	if d.err == nil {
+		d.err = err
+	}
+	d.data = nil
+	return nil
+}
+
+func (d *spillDecoder) uvarint() uint64 {
+	v, n := binary.Uvarint(d.data)
+	if n <= 0 {
+		d.fail(errSpillCorrupt)
+		return 0
+	}
+	d.data = d.data[n:]
+	return v
+}
+
+func (d *spillDecoder) varint() int64 {
+	v, n := binary.Varint(d.data)
+	if n <= 0 {
+		d.fail(errSpillCorrupt)
+		return 0
+	}
+	d.data = d.data[n:]
+	return v
+}
+
+func (d *spillDecoder) uint64() uint64 {
+	if len(d.data) < 8 {
+		d.fail(errSpillCorrupt)
+		return 0
+	}
+	v := binary.BigEndian.Uint64(d.data)
+	d.data = d.data[8:]
+	return v
+}
+
+// bytes returns length-prefixed bytes, which alias the decoded data.
+func (d *spillDecoder) bytes() []byte {
+	n := d.uvarint()
+	if n > uint64(len(d.data)) {
+		d.fail(errSpillCorrupt)
+		return nil
+	}
+	b := d.data[:n]
+	d.data = d.data[n:]
+	return b
+}
+
+// length returns the number of items of a document or array, each taking at
+// least one byte.
+func (d *spillDecoder) length() int {
+	n := d.uvarint()
+	if n > uint64(len(d.data)) {
+		d.fail(errSpillCorrupt)
+		return 0
+	}
+	return int(n)
+}
+
+func (d *spillDecoder) value() interface{} {
+	if d.err != nil {
+		return nil
+	}
+	if len(d.data) == 0 {
+		return d.fail(errSpillCorrupt)
+	}
+	tag := d.data[0]
+	d.data = d.data[1:]
+	switch tag {
+	case spillNil:
+		return nil
+	case spillFalse:
+		return false
+	case spillTrue:
+		return true
+	case spillFloat64:
+		return math.Float64frombits(d.uint64())
+	case spillFloat32:
+		return math.Float32frombits(uint32(d.uint64()))
+	case spillInt:
+		return int(d.varint())
+	case spillInt8:
+		return int8(d.varint())
+	case spillInt16:
+		return int16(d.varint())
+	case spillInt32:
+		return int32(d.varint())
+	case spillInt64:
+		return d.varint()
+	case spillUint:
+		return uint(d.uvarint())
+	case spillUint8:
+		return uint8(d.uvarint())
+	case spillUint16:
+		return uint16(d.uvarint())
+	case spillUint32:
+		return uint32(d.uvarint())
+	case spillUint64:
+		return d.uvarint()
+	case spillString:
+		return string(d.bytes())
+	case spillBytes:
+		return append([]byte{}, d.bytes()...)
+	case spillTime:
+		var t time.Time
+		if err := t.UnmarshalBinary(d.bytes()); err != nil {
+			return d.fail(err)
+		}
+		return t
+	case spillDocument:
+		n := d.length()
+		doc := make(map[string]interface{}, n)
+		for i := 0; i < n && d.err == nil; i++ {
+			key := string(d.bytes())
+			doc[key] = d.value()
+		}
+		return doc
+	case spillArray:
+		n := d.length()
+		arr := make([]interface{}, n)
+		for i := 0; i < n && d.err == nil; i++ {
+			arr[i] = d.value()
+		}
+		return arr
+	case spillDocuments:
+		n := d.length()
+		docs := make([]map[string]interface{}, n)
+		for i := 0; i < n && d.err == nil; i++ {
+			docs[i], _ = d.value().(map[string]interface{})
+		}
+		return docs
+	case spillJSON:
+		var v interface{}
+		if err := json.Unmarshal(d.bytes(), &v); err != nil {
+			return d.fail(err)
+		}
+		return v
+	}
+	return d.fail(errSpillCorrupt)
+}
+
+// spillWriter writes documents under an area, see encodeSpillDocument.
+type spillWriter struct {
+	spill *diskSpill
+	area  []byte
+	wb    *badger.WriteBatch
+	seq   uint64
+}
+
+// put writes doc under the area, after 'sortKey' and a sequence number
+// keeping documents with the same sortKey in the order they were written.
+func (w *spillWriter) put(sortKey []byte, doc map[string]interface{}) error {
+	val, err := encodeSpillDocument(doc)
+	if err != nil {
+		return fmt.Errorf("spilling a document to disk: %w", err)
+	}
+	key := make([]byte, 0, len(w.area)+len(sortKey)+8)
+	key = append(append(key, w.area...), sortKey...)
+	var seq [8]byte
+	binary.BigEndian.PutUint64(seq[:], w.seq)
+	key = append(key, seq[:]...)
+	w.seq++
+	atomic.AddInt64(&w.spill.docs, 1)
+	return w.wb.Set(key, val)
+}
+
+// flush makes the written documents readable.
+func (w *spillWriter) flush() error {
+	return w.wb.Flush()
+}
+
+// spillReader reads back the documents of an area in key order.
+type spillReader struct {
+	area []byte
+	txn  *badger.Txn
+	it   *badger.Iterator
+	key  []byte // sort key of the last document read
+}
+
+func (r *spillReader) next() (map[string]interface{}, error) {
+	if r.it == nil || !r.it.ValidForPrefix(r.area) {
+		return nil, nil
+	}
+	item := r.it.Item()
+	key := item.Key()
+	r.key = append(r.key[:0], key[len(r.area):len(key)-8]...)
+	var doc map[string]interface{}
+	if err := item.Value(func(val []byte) error {
+		var err error
+		doc, err = decodeSpillDocument(val)
+		return err
+	}); err != nil {
+		return nil, err
+	}
+	r.it.Next()
+	return doc, nil
+}
+
+func (r *spillReader) close() {
+	if r.it != nil {
+		r.it.Close()
+		r.txn.Discard()
+		r.it = nil
+	}
+}
+
+// sortDocuments is the $sort stage of a query allowed to use the disk. Runs
+// of up to the spill threshold documents are sorted in memory and written to
+// disk, then merged as the output is read.
+func (db *DB) sortDocuments(ctx context.Context, input docIterator, params map[string]interface{}, spill *diskSpill) (docIterator, error) {
+	var runs []docIterator
+	var buffer []map[string]interface{}
+	for {
+		doc, err := input.next()
+		if err != nil {
+			return nil, err
+		}
+		if doc != nil {
+			buffer = append(buffer, doc)
+			if len(buffer) < spill.threshold {
+				continue
+			}
+		}
+		if doc == nil && len(runs) == 0 {
+			// Everything fit in memory
+			return &sliceIterator{docs: db.sortStage(ctx, buffer, params)}, nil
+		}
+		if len(buffer) > 0 {
+			run, err := db.spillRun(db.sortStage(ctx, buffer, params), spill)
+			if err != nil {
+				return nil, err
+			}
+			runs = append(runs, run)
+			buffer = nil
+		}
+		if doc == nil {
+			return &mergeIterator{runs: runs, less: db.sortLess(ctx, params)}, nil
+		}
+	}
+}
+
+// spillRun writes sorted documents to disk and returns a reader of them.
+func (db *DB) spillRun(docs []map[string]interface{}, spill *diskSpill) (docIterator, error) {
+	area := spill.area()
+	w := spill.writer(area)
+	defer w.wb.Cancel()
+	for _, doc := range docs {
+		if err := w.put(nil, doc); err != nil {
+			return nil, err
+		}
+	}
+	if err := w.flush(); err != nil {
+		return nil, err
+	}
+	return spill.reader(area), nil
+}
+
+// mergeIterator merges sorted runs. Documents that sort equal come out in the
+// order of their runs, so the merge of stable sorts is stable.
+type mergeIterator struct {
+	runs    []docIterator
+	heads   []map[string]interface{}
+	less    func(a, b map[string]interface{}) bool
+	started bool
+}
+
+func (it *mergeIterator) next() (map[string]interface{}, error) {
+	if !it.started {
+		it.started = true
+		it.heads = make([]map[string]interface{}, len(it.runs))
+		for i, run := range it.runs {
+			var err error
+			if it.heads[i], err = run.next(); err != nil {
+				return nil, err
+			}
+		}
+	}
+	best := -1
+	for i, head := range it.heads {
+		if head != nil && (best < 0 || it.less(head, it.heads[best])) {
+			best = i
+		}
+	}
+	if best < 0 {
+		return nil, nil
+	}
+	doc := it.heads[best]
+	var err error
+	if it.heads[best], err = it.runs[best].next(); err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
+
+// spillGroupKey encodes the key of a group (see groupKey) as bytes, so that
+// the documents of a group spilled by $group are contiguous on disk.
+func spillGroupKey(value interface{}) []byte {
+	var encoded string
+	switch k := groupKey(value).(type) {
+	case nil:
+		encoded = "z"
+	case canonicalKey:
+		encoded = "d" + k.encoded
+	case float64:
+		encoded = "n" + strconv.FormatFloat(k, 'g', -1, 64)
+	case string:
+		encoded = "s" + k
+	case bool:
+		encoded = "b" + strconv.FormatBool(k)
+	default:
+		encoded = fmt.Sprintf("%T:%v", k, k)
+	}
+	// The length keeps a key from being the prefix of another
+	key := make([]byte, 4, 4+len(encoded))
+	binary.BigEndian.PutUint32(key, uint32(len(encoded)))
+	return append(key, encoded...)
+}
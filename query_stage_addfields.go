@@ -1,6 +1,7 @@
 package marco
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"strings"
@@ -19,9 +20,10 @@ import (
 //
 // Behavior:
 // - For each document, adds or updates fields as specified in params.
-// - Supports simple field assignments and expressions.
+// - Supports simple field assignments and expressions, evaluated by the shared expression engine.
 // - If an expression is used, it should be a valid expression starting with "$".
 func (db *DB) addFieldsStage(
+	ctx context.Context,
 	input []map[string]interface{},
 	params map[string]interface{},
 ) ([]map[string]interface{}, error) {
@@ -31,21 +33,39 @@ func (db *DB) addFieldsStage(
 	}
 
 	// Iterate over each document and add/set fields
+	results := make([]map[string]interface{}, len(input))
 	for i, doc := range input {
-		for field, expr := range params {
-			// Evaluate the expression
-			value, err := db.evaluateExpression(doc, expr)
-			if err != nil {
-				return nil, fmt.Errorf("error evaluating expression for field '%s': %w", field, err)
-			}
-
-			// Set the field to the evaluated value
-			doc[field] = value
+		newDoc, err := db.addFieldsToDocument(ctx, doc, params)
+		if err != nil {
+			return nil, err
 		}
-		input[i] = doc
+		results[i] = newDoc
 	}
 
-	return input, nil
+	return results, nil
+}
+
+// addFieldsToDocument returns a copy of doc with the fields of 'params' set.
+// doc itself is left unchanged: it may be shared, e.g. by the sub-pipelines
+// of a $facet or with the document a $replaceRoot took it from.
+func (db *DB) addFieldsToDocument(ctx context.Context, doc map[string]interface{}, params map[string]interface{}) (map[string]interface{}, error) {
+	newDoc := cloneDocument(doc)
+	for field, expr := range params {
+		// Evaluate the expression against the original document, as the
+		// fields of the stage are set at once
+		value, removed, err := db.evaluateField(ctx, doc, expr)
+		if err != nil {
+			return nil, fmt.Errorf("error evaluating expression for field '%s': %w", field, err)
+		}
+
+		// Set the field to the evaluated value; $$REMOVE removes it
+		if removed {
+			delete(newDoc, field)
+		} else {
+			newDoc[field] = value
+		}
+	}
+	return newDoc, nil
 }
 
 // validateAddFieldsStage validates the parameters for the $addFields and $set stages.
@@ -81,8 +101,10 @@ func (db *DB) validateAddFieldsStage(params map[string]interface{}) error {
 		case float64, float32, int, int8, int16, int32, int64,
 			uint, uint8, uint16, uint32, uint64,
 			bool, map[string]interface{}, []interface{}:
-			// These types are acceptable
-			// You can add more types or further validation as needed
+			// These types are acceptable; operators are checked by the expression engine
+			if err := validateExpression(exprTyped); err != nil {
+				return fmt.Errorf("$addFields/$set field '%s': %w", fieldName, err)
+			}
 		default:
 			return fmt.Errorf("$addFields/$set stage has unsupported expression type for field '%s': %T", fieldName, expr)
 		}
@@ -90,139 +112,3 @@ func (db *DB) validateAddFieldsStage(params map[string]interface{}) error {
 
 	return nil
 }
-
-// evaluateExpression evaluates the given expression based on the document.
-//
-// Parameters:
-// - doc: The current document being processed.
-// - expr: The expression to evaluate.
-//
-// Returns:
-// - The evaluated value.
-// - An error if the expression cannot be evaluated.
-func (db *DB) evaluateExpression(doc map[string]interface{}, expr interface{}) (interface{}, error) {
-	switch v := expr.(type) {
-	case string:
-		// Handle simple field reference (e.g., "$existingField")
-		if strings.HasPrefix(v, "$") {
-			fieldName := v[1:]
-			value, exists := doc[fieldName]
-			if !exists {
-				// Field does not exist; return nil or handle as needed
-				return nil, nil
-			}
-			return value, nil
-		}
-		// Direct string value
-		return v, nil
-	case map[string]interface{}:
-		// Handle expression objects
-		if len(v) != 1 {
-			return nil, fmt.Errorf("invalid expression object: %v", v)
-		}
-		for op, params := range v {
-			if !isValidExpressionOperator(op) {
-				return nil, fmt.Errorf("unsupported expression operator: %s", op)
-			}
-			switch op {
-			case "$concat":
-				return db.exprConcat(doc, params)
-			case "$toString":
-				return db.exprToString(doc, params)
-			// Implement other expression operators as needed
-			default:
-				return nil, fmt.Errorf("unsupported expression operator: %s", op)
-			}
-		}
-	case float64, float32, int, int32, int64, bool, nil:
-		// Direct scalar value
-		return v, nil
-	default:
-		return nil, fmt.Errorf("unsupported expression type: %T", v)
-	}
-	return nil, nil
-}
-
-// exprConcat handles the $concat expression operator.
-//
-// Parameters:
-// - doc: The current document being processed.
-// - params: The parameters for the $concat operator (expected to be a slice).
-//
-// Returns:
-// - The concatenated string.
-// - An error if the parameters are invalid.
-func (db *DB) exprConcat(doc map[string]interface{}, params interface{}) (interface{}, error) {
-	parts, ok := params.([]interface{})
-	if !ok {
-		return nil, fmt.Errorf("$concat expects an array of expressions, got: %T", params)
-	}
-
-	var result strings.Builder
-	for _, part := range parts {
-		str, err := db.evaluateExpression(doc, part)
-		if err != nil {
-			return nil, err
-		}
-		if str == nil {
-			str = ""
-		}
-		result.WriteString(fmt.Sprintf("%v", str))
-	}
-
-	return result.String(), nil
-}
-
-// exprToString handles the $toString expression operator.
-//
-// Parameters:
-// - doc: The current document being processed.
-// - params: The parameter for the $toString operator (expected to be a single expression).
-//
-// Returns:
-// - The string representation of the evaluated expression.
-// - An error if the parameters are invalid.
-func (db *DB) exprToString(doc map[string]interface{}, params interface{}) (interface{}, error) {
-	// $toString expects a single expression
-	expr := params
-
-	// Evaluate the expression with the current document context
-	value, err := db.evaluateExpression(doc, expr)
-	if err != nil {
-		return nil, err
-	}
-
-	if value == nil {
-		return "", nil
-	}
-
-	// Convert the value to string
-	switch v := value.(type) {
-	case string:
-		return v, nil
-	case fmt.Stringer:
-		return v.String(), nil
-	case int, int8, int16, int32, int64,
-		uint, uint8, uint16, uint32, uint64,
-		float32, float64, bool:
-		return fmt.Sprintf("%v", v), nil
-	default:
-		return nil, fmt.Errorf("$toString cannot convert type: %T", v)
-	}
-}
-
-// isValidExpressionOperator checks if the given operator is supported for expressions.
-//
-// Parameters:
-// - op: The operator string to check.
-//
-// Returns:
-// - True if the operator is supported; otherwise, false.
-func isValidExpressionOperator(op string) bool {
-	allowed := map[string]bool{
-		"$concat":   true,
-		"$toString": true, // Added $toString
-		// Add more supported operators as needed
-	}
-	return allowed[op]
-}
@@ -1,20 +1,23 @@
 package marco
 
 import (
+	"context"
 	"fmt"
 	"sort"
+	"strings"
 )
 
 // bucketStage implements the $bucket aggregation stage.
-// It categorizes documents into specified buckets based on the groupBy field.
+// It categorizes documents into specified buckets based on the groupBy expression.
 func (db *DB) bucketStage(
+	ctx context.Context,
 	input []map[string]interface{},
 	params map[string]interface{},
 ) ([]map[string]interface{}, error) {
 	// Extract required parameters
-	groupBy, ok := params["groupBy"].(string)
-	if !ok {
-		return nil, fmt.Errorf("$bucket stage requires a string 'groupBy' field")
+	groupBy, err := groupByExpression("$bucket", params["groupBy"])
+	if err != nil {
+		return nil, err
 	}
 
 	// Extract boundaries
@@ -73,8 +76,11 @@ func (db *DB) bucketStage(
 
 	// Assign documents to buckets
 	for _, doc := range input {
-		value, exists := doc[groupBy]
-		if !exists {
+		value, err := db.evaluate(ctx, doc, groupBy)
+		if err != nil {
+			return nil, err
+		}
+		if value == nil {
 			if hasDefault {
 				buckets[len(buckets)-1].Docs = append(buckets[len(buckets)-1].Docs, doc)
 			}
@@ -117,32 +123,20 @@ func (db *DB) bucketStage(
 		result := make(map[string]interface{})
 		result["_id"] = bucket.Label
 
-		// Process output aggregations
+		// Process output aggregations with the $group accumulators
 		if hasOutput {
 			for key, expr := range output {
-				switch e := expr.(type) {
-				case map[string]interface{}:
-					for op, field := range e {
-						switch op {
-						case "$sum":
-							// Use toFloat64 to handle various types for the $sum field
-							sumValue, success := toFloat64(field)
-							if !success {
-								return nil, fmt.Errorf("$sum field must be numeric or string representing a number")
-							}
-							if sumValue == 1 {
-								result[key] = len(bucket.Docs)
-							} else {
-								return nil, fmt.Errorf("$sum currently supports only counting documents (field value must be 1)")
-							}
-						// Implement other aggregation operations as needed
-						default:
-							return nil, fmt.Errorf("unsupported aggregation operator in $bucket output: %s", op)
-						}
-					}
-				default:
+				e, ok := expr.(map[string]interface{})
+				if !ok {
 					return nil, fmt.Errorf("$bucket stage 'output' must be an object")
 				}
+				for op, arg := range e {
+					value, err := db.accumulate(ctx, op, arg, bucket.Docs)
+					if err != nil {
+						return nil, fmt.Errorf("$bucket output %q: %w", key, err)
+					}
+					result[key] = value
+				}
 			}
 		}
 
@@ -163,9 +157,8 @@ func (db *DB) validateBucketStage(params map[string]interface{}) error {
 	}
 
 	// Validate 'groupBy'
-	groupBy, ok := params["groupBy"].(string)
-	if !ok || groupBy == "" {
-		return fmt.Errorf("$bucket stage 'groupBy' must be a non-empty string")
+	if _, err := groupByExpression("$bucket", params["groupBy"]); err != nil {
+		return err
 	}
 
 	// Validate 'boundaries'
@@ -191,11 +184,43 @@ func (db *DB) validateBucketStage(params map[string]interface{}) error {
 
 	// Validate 'output' if present
 	if output, ok := params["output"]; ok {
-		if _, ok := output.(map[string]interface{}); !ok {
+		outputMap, ok := output.(map[string]interface{})
+		if !ok {
 			return fmt.Errorf("$bucket stage 'output' must be an object")
 		}
-		// Further validation of 'output' can be added here
+		for key, expr := range outputMap {
+			exprMap, ok := expr.(map[string]interface{})
+			if !ok {
+				return fmt.Errorf("$bucket stage 'output' expressions must be objects")
+			}
+			if err := validateAccumulators(exprMap); err != nil {
+				return fmt.Errorf("$bucket output %q: %w", key, err)
+			}
+		}
 	}
 
 	return nil
 }
+
+// groupByExpression returns the groupBy expression of $bucket and $bucketAuto.
+// It is either a field path ("$price"), a bare field name ("price", kept for
+// backwards compatibility) or an operator expression.
+func groupByExpression(stage string, raw interface{}) (interface{}, error) {
+	switch v := raw.(type) {
+	case string:
+		if strings.TrimPrefix(v, "$") == "" {
+			return nil, fmt.Errorf("%s stage 'groupBy' must be a non-empty field path or expression", stage)
+		}
+		if !strings.HasPrefix(v, "$") {
+			return "$" + v, nil
+		}
+		return v, nil
+	case map[string]interface{}:
+		if err := validateExpression(v); err != nil {
+			return nil, fmt.Errorf("%s stage 'groupBy': %w", stage, err)
+		}
+		return v, nil
+	default:
+		return nil, fmt.Errorf("%s stage requires a 'groupBy' field path or expression", stage)
+	}
+}
@@ -1,20 +1,13 @@
 package marco
 
 import (
+	"context"
 	"fmt"
-	"log"
 	"math"
 	"sort"
+	"strings"
 )
 
-// cleanGroupByField removes the '$' prefix if present.
-func cleanGroupByField(field string) string {
-	if len(field) > 0 && field[0] == '$' {
-		return field[1:]
-	}
-	return field
-}
-
 // Bucket represents a single bucket with its label, documents, and aggregations.
 type Bucket struct {
 	Label        string
@@ -25,6 +18,7 @@ type Bucket struct {
 // bucketAutoStage implements the $bucketAuto aggregation stage.
 // It automatically determines the bucket boundaries to group documents into a specified number of buckets.
 func (db *DB) bucketAutoStage(
+	ctx context.Context,
 	input []map[string]interface{},
 	params map[string]interface{},
 ) ([]map[string]interface{}, error) {
@@ -33,45 +27,43 @@ func (db *DB) bucketAutoStage(
 		return nil, err
 	}
 
-	// Extract and clean 'groupBy' parameter
-	groupByRaw, _ := params["groupBy"].(string)
-	groupBy := cleanGroupByField(groupByRaw)
-	log.Println("Using groupBy field:", groupBy)
+	// Extract the 'groupBy' expression
+	groupBy, err := groupByExpression("$bucketAuto", params["groupBy"])
+	if err != nil {
+		return nil, err
+	}
 
 	// Extract number of buckets
 	bucketsParam := params["buckets"]
 	numBuckets, _ := toFloat64(bucketsParam)
 	numBucketsInt := int(numBuckets)
-	log.Printf("Number of buckets: %d\n", numBucketsInt)
 
 	// Extract output definitions
 	output, hasOutput := params["output"].(map[string]interface{})
 
-	// Collect all groupBy values
+	// Collect all groupBy values, evaluated once per document
+	groupValues, err := db.evaluateEach(ctx, input, groupBy)
+	if err != nil {
+		return nil, err
+	}
 	values := []float64{}
-	for _, doc := range input {
-		value, exists := doc[groupBy]
-		if !exists {
-			log.Printf("Document %v does not have the 'groupBy' field '%v'. Skipping.\n", doc["_id"], groupBy)
-			continue
-		}
-		numericValue, ok := toFloat64(value)
-		if !ok {
-			log.Printf("Document %v has unsupported 'groupBy' type: %T. Skipping.\n", doc["_id"], value)
-			continue
+	for _, value := range groupValues {
+		// Documents without a numeric groupBy value are skipped
+		if numericValue, ok := toFloat64(value); ok {
+			values = append(values, numericValue)
 		}
-		values = append(values, numericValue)
 	}
 
 	if len(values) == 0 {
 		return nil, fmt.Errorf("$bucketAuto stage found no valid 'groupBy' values")
 	}
 
-	log.Printf("Collected %d valid 'groupBy' values.\n", len(values))
+	if skipped := len(input) - len(values); skipped > 0 {
+		db.logf(LogDebug, "$bucketAuto skipped %d documents without a numeric groupBy value", skipped)
+	}
 
 	// Sort the values
 	sort.Float64s(values)
-	log.Println("Sorted groupBy values.")
 
 	// Determine bucket boundaries using quantiles
 	boundaries := []float64{values[0]}
@@ -98,7 +90,7 @@ func (db *DB) bucketAutoStage(
 	}
 	boundaries = uniqueBoundaries
 
-	log.Printf("Determined bucket boundaries: %v\n", boundaries)
+	db.logf(LogDebug, "$bucketAuto bucket boundaries: %v", boundaries)
 
 	// Prepare buckets
 	buckets := []Bucket{}
@@ -112,9 +104,9 @@ func (db *DB) bucketAutoStage(
 	}
 
 	// Assign documents to buckets
-	for _, doc := range input {
-		value, exists := doc[groupBy]
-		if !exists {
+	for i, doc := range input {
+		value := groupValues[i]
+		if value == nil {
 			continue
 		}
 
@@ -132,13 +124,11 @@ func (db *DB) bucketAutoStage(
 				// Include the upper boundary in the last bucket
 				if numericValue >= lower && numericValue <= upper {
 					buckets[i].Docs = append(buckets[i].Docs, doc)
-					log.Printf("Assigned document %v to bucket %d: %v\n", doc["_id"], i, buckets[i].Label)
 					break
 				}
 			} else {
 				if numericValue >= lower && numericValue < upper {
 					buckets[i].Docs = append(buckets[i].Docs, doc)
-					log.Printf("Assigned document %v to bucket %d: %v\n", doc["_id"], i, buckets[i].Label)
 					break
 				}
 			}
@@ -151,123 +141,20 @@ func (db *DB) bucketAutoStage(
 		result := make(map[string]interface{})
 		result["_id"] = bucket.Label
 
-		// Process output aggregations
+		// Process output aggregations with the $group accumulators
 		if hasOutput {
 			for key, expr := range output {
-				switch e := expr.(type) {
-				case map[string]interface{}:
-					for op, field := range e {
-						switch op {
-						case "$sum":
-							if fieldStr, ok := field.(string); ok && fieldStr == "1" {
-								// Count documents
-								result[key] = len(bucket.Docs)
-							} else {
-								// Sum specific field
-								fieldName, ok := field.(string)
-								if !ok {
-									return nil, fmt.Errorf("$sum operator requires a string field name or '1'")
-								}
-								sum := 0.0
-								for _, doc := range bucket.Docs {
-									val, exists := doc[fieldName]
-									if !exists {
-										continue
-									}
-									num, ok := toFloat64(val)
-									if !ok {
-										continue
-									}
-									sum += num
-								}
-								result[key] = sum
-							}
-						case "$avg":
-							// Calculate average of a specific field
-							fieldName, ok := field.(string)
-							if !ok {
-								return nil, fmt.Errorf("$avg operator requires a string field name")
-							}
-							sum := 0.0
-							count := 0
-							for _, doc := range bucket.Docs {
-								val, exists := doc[fieldName]
-								if !exists {
-									continue
-								}
-								num, ok := toFloat64(val)
-								if !ok {
-									continue
-								}
-								sum += num
-								count++
-							}
-							if count > 0 {
-								result[key] = sum / float64(count)
-							} else {
-								result[key] = nil
-							}
-						case "$max":
-							// Find maximum value of a specific field
-							fieldName, ok := field.(string)
-							if !ok {
-								return nil, fmt.Errorf("$max operator requires a string field name")
-							}
-							var maxVal float64
-							first := true
-							for _, doc := range bucket.Docs {
-								val, exists := doc[fieldName]
-								if !exists {
-									continue
-								}
-								num, ok := toFloat64(val)
-								if !ok {
-									continue
-								}
-								if first || num > maxVal {
-									maxVal = num
-									first = false
-								}
-							}
-							if !first {
-								result[key] = maxVal
-							} else {
-								result[key] = nil
-							}
-						case "$min":
-							// Find minimum value of a specific field
-							fieldName, ok := field.(string)
-							if !ok {
-								return nil, fmt.Errorf("$min operator requires a string field name")
-							}
-							var minVal float64
-							first := true
-							for _, doc := range bucket.Docs {
-								val, exists := doc[fieldName]
-								if !exists {
-									continue
-								}
-								num, ok := toFloat64(val)
-								if !ok {
-									continue
-								}
-								if first || num < minVal {
-									minVal = num
-									first = false
-								}
-							}
-							if !first {
-								result[key] = minVal
-							} else {
-								result[key] = nil
-							}
-						default:
-							return nil, fmt.Errorf("unsupported aggregation operator in $bucketAuto output: %s", op)
-						}
-					}
-				default:
+				e, ok := expr.(map[string]interface{})
+				if !ok {
 					return nil, fmt.Errorf("$bucketAuto stage 'output' must be an object")
 				}
+				for op, field := range e {
+					value, err := db.accumulate(ctx, op, bucketAutoAccumulatorArg(field), bucket.Docs)
+					if err != nil {
+						return nil, fmt.Errorf("$bucketAuto output %q: %w", key, err)
+					}
+					result[key] = value
+				}
 			}
 		}
 
@@ -280,13 +167,8 @@ func (db *DB) bucketAutoStage(
 // validateBucketAutoStage validates the parameters for the $bucketAuto stage.
 func (db *DB) validateBucketAutoStage(params map[string]interface{}) error {
 	// Check 'groupBy'
-	groupByRaw, ok := params["groupBy"].(string)
-	if !ok || groupByRaw == "" {
-		return fmt.Errorf("$bucketAuto stage requires a non-empty string 'groupBy' field")
-	}
-	groupBy := cleanGroupByField(groupByRaw)
-	if groupBy == "" {
-		return fmt.Errorf("$bucketAuto stage 'groupBy' cannot be empty after cleaning")
+	if _, err := groupByExpression("$bucketAuto", params["groupBy"]); err != nil {
+		return err
 	}
 
 	// Check 'buckets'
@@ -309,34 +191,34 @@ func (db *DB) validateBucketAutoStage(params map[string]interface{}) error {
 		if !ok {
 			return fmt.Errorf("$bucketAuto stage 'output' must be an object")
 		}
-		for _, expr := range outputMap {
+		for key, expr := range outputMap {
 			exprMap, ok := expr.(map[string]interface{})
 			if !ok {
 				return fmt.Errorf("$bucketAuto stage 'output' expressions must be objects")
 			}
+			accumulators := make(map[string]interface{}, len(exprMap))
 			for op, field := range exprMap {
-				switch op {
-				case "$sum", "$avg", "$max", "$min":
-					if op == "$sum" {
-						// $sum can be "1" or a field name
-						if fieldStr, ok := field.(string); !ok || (fieldStr != "1" && fieldStr == "") {
-							// Must be a field name if not "1"
-							if _, ok := field.(string); !ok {
-								return fmt.Errorf("$sum operator requires a string field name or '1'")
-							}
-						}
-					} else {
-						// Other operators require a field name
-						if _, ok := field.(string); !ok {
-							return fmt.Errorf("%s operator requires a string field name", op)
-						}
-					}
-				default:
-					return fmt.Errorf("unsupported aggregation operator in $bucketAuto output: %s", op)
-				}
+				accumulators[op] = bucketAutoAccumulatorArg(field)
+			}
+			if err := validateAccumulators(accumulators); err != nil {
+				return fmt.Errorf("$bucketAuto output %q: %w", key, err)
 			}
 		}
 	}
 
 	return nil
 }
+
+// bucketAutoAccumulatorArg converts the legacy $bucketAuto output arguments to
+// expressions: a bare field name ("price") is a field path and "1" counts the
+// documents. Field paths and operator expressions are kept as-is.
+func bucketAutoAccumulatorArg(field interface{}) interface{} {
+	name, ok := field.(string)
+	if !ok || strings.HasPrefix(name, "$") {
+		return field
+	}
+	if name == "1" {
+		return 1.0
+	}
+	return "$" + name
+}
@@ -20,6 +20,25 @@ func (db *DB) countStage(
 	input []map[string]interface{},
 	params interface{},
 ) ([]map[string]interface{}, error) {
+	fieldName, err := countField(params)
+	if err != nil {
+		return nil, err
+	}
+
+	// Count the number of documents
+	count := len(input)
+
+	// Create the result document
+	result := map[string]interface{}{
+		fieldName: count,
+	}
+
+	return []map[string]interface{}{result}, nil
+}
+
+// countField returns the name of the field the $count stage 'params' outputs
+// the count in.
+func countField(params interface{}) (string, error) {
 	var fieldName string
 
 	// Determine the field name based on the input params
@@ -27,7 +46,7 @@ func (db *DB) countStage(
 	case string:
 		// Directly use the string as the field name
 		if strings.TrimSpace(v) == "" {
-			return nil, errors.New("$count stage requires a non-empty string as the field name")
+			return "", errors.New("$count stage requires a non-empty string as the field name")
 		}
 		fieldName = v
 	case map[string]interface{}:
@@ -36,39 +55,29 @@ func (db *DB) countStage(
 			if fieldStr, ok := fieldVal.(string); ok && strings.TrimSpace(fieldStr) != "" {
 				fieldName = fieldStr
 			} else {
-				return nil, errors.New("$count 'field' parameter must be a non-empty string")
+				return "", errors.New("$count 'field' parameter must be a non-empty string")
 			}
 			// Use 'field' key if provided
 		} else if fieldVal, ok := v["$count"]; ok {
 			if fieldStr, ok := fieldVal.(string); ok && strings.TrimSpace(fieldStr) != "" {
 				fieldName = fieldStr
 			} else {
-				return nil, errors.New("$count 'field' parameter must be a non-empty string")
+				return "", errors.New("$count 'field' parameter must be a non-empty string")
 			}
 		} else if fieldVal, ok := v["path"]; ok {
 			if fieldStr, ok := fieldVal.(string); ok && strings.TrimSpace(fieldStr) != "" {
 				fieldName = fieldStr
 			} else {
-				return nil, errors.New("$count 'field' parameter must be a non-empty string")
+				return "", errors.New("$count 'field' parameter must be a non-empty string")
 			}
 		} else {
 
-			return nil, errors.New("$count stage requires a 'field' key in the map")
+			return "", errors.New("$count stage requires a 'field' key in the map")
 		}
 	default:
-		fmt.Println("type = ", v)
-		return nil, errors.New("$count stage requires a string or a map with a 'field' key")
+		return "", errors.New("$count stage requires a string or a map with a 'field' key")
 	}
-
-	// Count the number of documents
-	count := len(input)
-
-	// Create the result document
-	result := map[string]interface{}{
-		fieldName: count,
-	}
-
-	return []map[string]interface{}{result}, nil
+	return fieldName, nil
 }
 
 // validateCountStage validates the parameters for the $count stage.
@@ -1,13 +1,14 @@
 package marco
 
 import (
+	"context"
 	"fmt"
-	"log"
 )
 
 // facetStage applies multiple pipelines (facets) to the input dataset and returns the results.
 //
 // Parameters:
+// - ctx: Context of the query, passed down to the sub-pipelines.
 // - input: Slice of input documents to be processed by each pipeline.
 // - params: A map where keys are facet names and values are corresponding pipelines (slices of stages).
 // - docs: A map representing all collections, used for operations like $lookup.
@@ -24,6 +25,7 @@ import (
 // - facet1: Filters input based on a match condition.
 // - facet2: Sorts input by the specified field.
 func (db *DB) facetStage(
+	ctx context.Context,
 	input []map[string]interface{},
 	params map[string]interface{},
 ) []map[string]interface{} {
@@ -37,12 +39,12 @@ func (db *DB) facetStage(
 		// Assert that rawPipeline is a slice of pipeline stages.
 		pipeline, ok := rawPipeline.([]interface{})
 		if !ok {
-			fmt.Printf("Invalid pipeline for facet %s\n", facetName)
+			db.logf(LogWarn, "Invalid pipeline for facet %s", facetName)
 			continue
 		}
 
 		// Apply the pipeline to the input data.
-		facetResult := db.applyPipeline(input, pipeline)
+		facetResult := db.applyPipeline(ctx, input, pipeline)
 
 		// Store the result of the facet in the output map.
 		result[0][facetName] = facetResult
@@ -54,6 +56,7 @@ func (db *DB) facetStage(
 // applyPipeline applies a sequence of aggregation stages to an input dataset.
 //
 // Parameters:
+// - ctx: Context of the query, passed down to the stages.
 // - input: Slice of input documents to process.
 // - pipeline: A slice of stages (maps) to apply sequentially.
 // - docs: A map representing all collections, used for operations like $lookup.
@@ -72,6 +75,7 @@ func (db *DB) facetStage(
 // - $lookup: Performs a join-like operation with another collection.
 // - $unwind: Deconstructs arrays in documents into individual documents.
 func (db *DB) applyPipeline(
+	ctx context.Context,
 	input []map[string]interface{},
 	pipeline []interface{},
 ) []map[string]interface{} {
@@ -86,19 +90,29 @@ func (db *DB) applyPipeline(
 				switch key {
 				case "$match":
 					// Apply $match stage to filter documents.
-					data = db.matchStage(data, value.(map[string]interface{}))
+					data = db.matchStage(ctx, data, value.(map[string]interface{}))
 				case "$project":
 					// Apply $project stage to transform documents.
-					data = db.projectStage(data, value.(map[string]interface{}))
+					projected, err := db.projectStage(ctx, data, value.(map[string]interface{}))
+					if err != nil {
+						db.logf(LogWarn, "Error in $project stage: %v", err)
+						return nil
+					}
+					data = projected
 				case "$group":
 					// Apply $group stage to group documents by a specified key.
-					data = db.groupStage(data, value.(map[string]interface{}))
+					grouped, err := db.groupStage(ctx, data, value.(map[string]interface{}))
+					if err != nil {
+						db.logf(LogWarn, "Error in $group stage: %v", err)
+						return nil
+					}
+					data = grouped
 				case "$facet":
 					// Apply $facet stage to process multiple pipelines.
-					data = db.facetStage(data, value.(map[string]interface{}))
+					data = db.facetStage(ctx, data, value.(map[string]interface{}))
 				case "$sort":
 					// Apply $sort stage to sort documents.
-					data = db.sortStage(data, value.(map[string]interface{}))
+					data = db.sortStage(ctx, data, value.(map[string]interface{}))
 				case "$limit":
 					// Apply $limit stage to restrict the number of documents.
 					data = db.limitStage(data, value.(map[string]interface{}))
@@ -107,24 +121,29 @@ func (db *DB) applyPipeline(
 					data = db.skipStage(data, value.(map[string]interface{}))
 				case "$lookup":
 					// Apply $lookup stage to perform a join-like operation with another collection.
-					data = db.lookupStage(data, value.(map[string]interface{}))
+					looked, err := db.lookupStage(ctx, data, value.(map[string]interface{}))
+					if err != nil {
+						db.logf(LogWarn, "Error in $lookup stage: %v", err)
+						return nil
+					}
+					data = looked
 				case "$unwind":
 					// Apply $unwind stage to deconstruct arrays into individual documents.
 					data = db.unwindStage(data, value.(map[string]interface{}))
 				default:
 					// Log unsupported aggregation stages.
-					log.Printf("Unsupported aggregation stage: %s", value.(map[string]interface{}))
+					db.logf(LogWarn, "Unsupported aggregation stage: %s", value.(map[string]interface{}))
 				}
 			}
 		default:
 			// Handle invalid stage formats.
-			log.Println("Invalid stage format")
+			db.logf(LogWarn, "Invalid stage format")
 		}
 	}
 	return data
 }
 
-func (db *DB) validateFacetStage(params map[string]interface{}) error {
+func (db *DB) validateFacetStage(ctx context.Context, params map[string]interface{}) error {
 
 	// By MongoDB spec, $facet is an object where each key is a pipeline array
 	// e.g. { "$facet": { "categorizedByTags": [ { "$unwind": "$tags" }, ... ], ... } }
@@ -145,8 +164,8 @@ func (db *DB) validateFacetStage(params map[string]interface{}) error {
 			}
 			// Recursively validate
 			for op, opParams := range stageMap {
-				if err := db.validateStage(op, asMap(opParams)); err != nil {
-					return fmt.Errorf("$facet: sub-stage %q invalid: %v", op, err)
+				if err := db.validateStage(ctx, op, asMap(opParams)); err != nil {
+					return fmt.Errorf("$facet: sub-stage %q invalid: %w", op, err)
 				}
 			}
 		}
@@ -1,17 +1,12 @@
 package marco
 
 import (
+	"context"
 	"fmt"
-	"log"
 	"math"
-	"sort"
 	"strings"
 )
 
-// getNestedField(doc, fieldName) -> interface{}
-// toFloat64(val) -> (float64, bool)
-// Both are assumed to be defined elsewhere, just like in your original code.
-
 // groupStage implements a MongoDB-like group aggregation operation for in-memory document processing.
 // It allows grouping documents by a specified key and applying various aggregation operations.
 //
@@ -20,456 +15,763 @@ import (
 // - $stdDevPop      (population standard deviation)
 // - $stdDevSamp     (sample standard deviation)
 // - $mergeObjects   (merge multiple objects into a single object)
-// - $accumulator    (placeholder for custom JS-based accumulators)
+// - $accumulator    (custom accumulators written in Go, see RegisterAccumulator)
 // - $count          (count the number of documents, alternative to { $sum: 1 })
-// - $arrayToObject  (convert an array of [k,v] pairs into an object; placeholder usage)
-// - $maxN           (top N values)
-// - $minN           (bottom N values)
+// - $maxN           (N highest values)
+// - $minN           (N lowest values)
 // - $firstN         (first N values in the original order)
 // - $lastN          (last N values in the original order)
+// - $top, $topN     (output of the first 1 or N documents in sortBy order)
+// - $bottom, $bottomN (output of the last 1 or N documents in sortBy order)
 //
 // Existing operators were:
 // - $sum, $avg, $max, $min, $push, $first, $last
 //
-// Adjust or refine as needed for your use case.
+// Documents are read in a single pass: each group keeps the running state of
+// its accumulators (a sum, the N best values so far, ...) rather than its
+// documents, so memory grows with the number of groups, not of documents.
+// Groups are returned in the order their first document was read. With
+// QueryOptions.AllowDiskUse, the groups beyond the spill threshold follow, in
+// no particular order.
 
 func (db *DB) groupStage(
+	ctx context.Context,
 	input []map[string]interface{},
 	params map[string]interface{},
-) []map[string]interface{} {
-	groups := make(map[interface{}][]map[string]interface{})
-	aggExpressions := make(map[string]map[string]interface{})
-	var groupIDField string
+) ([]map[string]interface{}, error) {
+	return db.groupDocuments(ctx, &sliceIterator{docs: input}, params)
+}
+
+// groupDocuments is groupStage reading its input from an iterator, so that
+// the documents don't have to be in memory together.
+func (db *DB) groupDocuments(ctx context.Context, input docIterator, params map[string]interface{}) ([]map[string]interface{}, error) {
+	var groupID interface{} // expression evaluated to group documents
+
+	// The groups are charged to a budget of the stage, so that a spilled
+	// group can release what it held once emitted
+	ctx, memory := withStageBudget(ctx)
+
+	// groupField is an accumulator of an output field, e.g. "total" for
+	// { "total": { "$sum": "$price" } }
+	type groupField struct {
+		name string
+		new  func() groupAccumulator
+	}
+	var fields []groupField
 
 	// Process grouping and aggregation parameters
 	for k, v := range params {
 		switch k {
 		case "_id":
-			if idStr, ok := v.(string); ok && strings.HasPrefix(idStr, "$") {
-				groupIDField = strings.TrimPrefix(idStr, "$")
-			}
+			// A field path ("$city"), an operator expression, e.g.
+			// { "$dateTrunc": { "date": "$ts", "unit": "hour" } }, a compound
+			// key such as { "year": { "$year": "$ts" }, "city": "$city" }, or
+			// a constant (null) putting every document in a single group
+			groupID = v
 		default:
-			// Store aggregation expressions for later processing
-			if expr, ok := v.(map[string]interface{}); ok {
-				aggExpressions[k] = expr
+			expr, ok := v.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			for op, arg := range expr {
+				newAccumulator, err := db.compileAccumulator(ctx, op, arg)
+				if err != nil {
+					return nil, fmt.Errorf("$group field %q: %w", k, err)
+				}
+				fields = append(fields, groupField{name: k, new: newAccumulator})
 			}
 		}
 	}
 
-	// Group documents by the specified field
-	for _, doc := range input {
-		groupValue := doc[groupIDField]
-		groups[groupValue] = append(groups[groupValue], doc)
-	}
-
-	// Process and aggregate grouped documents
-	var results []map[string]interface{}
-	for groupValue, groupDocs := range groups {
-		groupResult := map[string]interface{}{"_id": groupValue}
-
-		for fieldName, expr := range aggExpressions {
-			for op, val := range expr {
-				switch op {
-				// Existing operators
-				case "$sum":
-					groupResult[fieldName] = calculateSum(groupDocs, val)
-				case "$avg":
-					groupResult[fieldName] = calculateAverage(groupDocs, val)
-				case "$max":
-					groupResult[fieldName] = calculateMax(groupDocs, val)
-				case "$min":
-					groupResult[fieldName] = calculateMin(groupDocs, val)
-				case "$push":
-					groupResult[fieldName] = collectValues(groupDocs, val)
-				case "$first":
-					groupResult[fieldName] = selectFirst(groupDocs, val)
-				case "$last":
-					groupResult[fieldName] = selectLast(groupDocs, val)
-
-				// New operators
-				case "$addToSet":
-					groupResult[fieldName] = addToSet(groupDocs, val)
-				case "$stdDevPop":
-					groupResult[fieldName] = calculateStdDev(groupDocs, val, true)
-				case "$stdDevSamp":
-					groupResult[fieldName] = calculateStdDev(groupDocs, val, false)
-				case "$mergeObjects":
-					groupResult[fieldName] = mergeObjects(groupDocs, val)
-				case "$accumulator":
-					groupResult[fieldName] = runAccumulator( /*not implemented yet: groupDocs, val*/ )
-				case "$count":
-					groupResult[fieldName] = float64(len(groupDocs))
-				case "$arrayToObject":
-					groupResult[fieldName] = arrayToObject(groupDocs, val)
-				case "$maxN":
-					groupResult[fieldName] = maxN(groupDocs, val)
-				case "$minN":
-					groupResult[fieldName] = minN(groupDocs, val)
-				case "$firstN":
-					groupResult[fieldName] = firstN(groupDocs, val)
-				case "$lastN":
-					groupResult[fieldName] = lastN(groupDocs, val)
-
-				default:
-					log.Printf("Aggregator %s not implemented", op)
-				}
+	// Group documents by the value of the _id expression. Groups are keyed by
+	// the canonical form of the value (see groupKey), so compound keys that
+	// only differ by field order or number type fall in the same group, and
+	// the emitted _id keeps the structured value of the group's first
+	// document: downstream stages can address "_id.city".
+	type group struct {
+		id           interface{}
+		accumulators []groupAccumulator
+	}
+	groups := make(map[interface{}]*group)
+	var order []*group
+	newGroup := func(id interface{}) *group {
+		g := &group{id: id, accumulators: make([]groupAccumulator, len(fields))}
+		for i, field := range fields {
+			g.accumulators[i] = field.new()
+		}
+		return g
+	}
+	addDocument := func(g *group, doc map[string]interface{}) error {
+		for i, acc := range g.accumulators {
+			if err := acc.add(doc); err != nil {
+				return fmt.Errorf("$group field %q: %w", fields[i].name, err)
 			}
 		}
-
-		results = append(results, groupResult)
+		return nil
 	}
 
-	return results
-}
-
-//------------------------------------------------------------------------------
-// Existing aggregator helpers
-//------------------------------------------------------------------------------
-
-func calculateSum(docs []map[string]interface{}, val interface{}) float64 {
-	var sum float64
-	if valStr, ok := val.(string); ok && strings.HasPrefix(valStr, "$") {
-		// Sum values of a specific field
-		fieldToSum := strings.TrimPrefix(valStr, "$")
-		for _, doc := range docs {
-			if number, ok := toFloat64(getNestedField(doc, fieldToSum)); ok {
-				sum += number
+	// With AllowDiskUse, the documents of the groups beyond the spill
+	// threshold are written to disk, next to those of the same group, and
+	// accumulated one group at a time once the input is read
+	spill := querySpill(ctx)
+	var spillArea []byte
+	var spilled *spillWriter
+	for {
+		doc, err := input.next()
+		if err != nil {
+			return nil, err
+		}
+		if doc == nil {
+			break
+		}
+		groupValue, err := db.evaluate(ctx, doc, groupID)
+		if err != nil {
+			return nil, fmt.Errorf("$group _id: %w", err)
+		}
+		key := groupKey(groupValue)
+		g, exists := groups[key]
+		if !exists {
+			if spill != nil && len(order) >= spill.threshold {
+				if spilled == nil {
+					spillArea = spill.area()
+					spilled = spill.writer(spillArea)
+					defer spilled.wb.Cancel()
+				}
+				if err := spilled.put(spillGroupKey(groupValue), doc); err != nil {
+					return nil, err
+				}
+				continue
+			}
+			if err := memory.holdValue(groupValue); err != nil {
+				return nil, err
 			}
+			g = newGroup(groupValue)
+			groups[key] = g
+			order = append(order, g)
+		}
+		if err := addDocument(g, doc); err != nil {
+			return nil, err
 		}
-	} else if floatVal, ok := toFloat64(val); ok {
-		// e.g. { $sum: 1 } for count of docs
-		sum = float64(len(docs)) * floatVal
 	}
-	return sum
-}
 
-func calculateMax(docs []map[string]interface{}, val interface{}) float64 {
-	if valStr, ok := val.(string); ok && strings.HasPrefix(valStr, "$") {
-		fieldToMax := strings.TrimPrefix(valStr, "$")
-		var maxVal float64
-		first := true
-		for _, doc := range docs {
-			if number, ok := toFloat64(getNestedField(doc, fieldToMax)); ok {
-				if first || number > maxVal {
-					maxVal = number
-					first = false
-				}
+	// Emit a document per group with the final value of its accumulators
+	results := make([]map[string]interface{}, 0, len(order))
+	emit := func(g *group) error {
+		groupResult := map[string]interface{}{"_id": g.id}
+		for i, acc := range g.accumulators {
+			value, err := acc.result()
+			if err != nil {
+				return fmt.Errorf("$group field %q: %w", fields[i].name, err)
 			}
+			groupResult[fields[i].name] = value
 		}
-		if !first {
-			return maxVal
+		results = append(results, groupResult)
+		return nil
+	}
+	for _, g := range order {
+		if err := emit(g); err != nil {
+			return nil, err
 		}
 	}
-	return 0
-}
+	if spilled == nil {
+		return results, nil
+	}
 
-func calculateMin(docs []map[string]interface{}, val interface{}) float64 {
-	if valStr, ok := val.(string); ok && strings.HasPrefix(valStr, "$") {
-		fieldToMin := strings.TrimPrefix(valStr, "$")
-		var minVal float64
-		first := true
-		for _, doc := range docs {
-			if number, ok := toFloat64(getNestedField(doc, fieldToMin)); ok {
-				if first || number < minVal {
-					minVal = number
-					first = false
+	// The spilled groups follow, in the order of their keys on disk. They are
+	// accumulated one at a time, so the memory held by one is released once
+	// it is emitted
+	if err := spilled.flush(); err != nil {
+		return nil, err
+	}
+	reader := spill.reader(spillArea)
+	defer reader.close()
+	held := memory.usage()
+	var g *group
+	var current []byte
+	for {
+		doc, err := reader.next()
+		if err != nil {
+			return nil, err
+		}
+		if doc == nil {
+			break
+		}
+		if g == nil || string(reader.key) != string(current) {
+			if g != nil {
+				if err := emit(g); err != nil {
+					return nil, err
 				}
+				memory.releaseTo(held)
+			}
+			groupValue, err := db.evaluate(ctx, doc, groupID)
+			if err != nil {
+				return nil, fmt.Errorf("$group _id: %w", err)
 			}
+			g = newGroup(groupValue)
+			current = append(current[:0], reader.key...)
 		}
-		if !first {
-			return minVal
+		if err := addDocument(g, doc); err != nil {
+			return nil, err
 		}
 	}
-	return 0
+	if g != nil {
+		if err := emit(g); err != nil {
+			return nil, err
+		}
+	}
+	return results, nil
 }
 
-func calculateAverage(docs []map[string]interface{}, val interface{}) float64 {
-	if valStr, ok := val.(string); ok && strings.HasPrefix(valStr, "$") {
-		fieldToAvg := strings.TrimPrefix(valStr, "$")
-		var sum float64
-		count := 0
-		for _, doc := range docs {
-			nestedValue := getNestedField(doc, fieldToAvg)
-			if number, ok := toFloat64(nestedValue); ok {
-				sum += number
-				count++
-			}
-		}
-		if count > 0 {
-			return sum / float64(count)
+// accumulate applies the accumulator 'op' to a group of documents. Its
+// argument is an expression evaluated against every document of the group by
+// the shared expression engine, e.g. {"$sum": "$price"},
+// {"$sum": {"$multiply": ["$price", "$qty"]}} or {"$sum": 1}.
+// $maxN, $minN, $firstN and $lastN take { n: <int>, input: <expression> }.
+// $top and $bottom take { sortBy: <sort document>, output: <expression> },
+// $topN and $bottomN also take n.
+// The same accumulators are used by the output of $bucket and $bucketAuto.
+func (db *DB) accumulate(ctx context.Context, op string, arg interface{}, docs []map[string]interface{}) (interface{}, error) {
+	newAccumulator, err := db.compileAccumulator(ctx, op, arg)
+	if err != nil {
+		return nil, err
+	}
+	acc := newAccumulator()
+	for _, doc := range docs {
+		if err := acc.add(doc); err != nil {
+			return nil, err
 		}
 	}
-	return 0
+	return acc.result()
+}
+
+// groupAccumulator holds the state of an accumulator for one group, updated
+// as the documents of the group are read.
+type groupAccumulator interface {
+	add(doc map[string]interface{}) error
+	result() (interface{}, error)
 }
 
-func collectValues(docs []map[string]interface{}, val interface{}) []interface{} {
-	if valStr, ok := val.(string); ok && strings.HasPrefix(valStr, "$") {
-		fieldToPush := strings.TrimPrefix(valStr, "$")
-		var pushArray []interface{}
-		for _, doc := range docs {
-			v := getNestedField(doc, fieldToPush)
-			if v != nil {
-				pushArray = append(pushArray, v)
+// compileAccumulator parses the argument of the accumulator 'op' once and
+// returns a function creating its state for a new group.
+func (db *DB) compileAccumulator(ctx context.Context, op string, arg interface{}) (func() groupAccumulator, error) {
+	input := accumulatorInput{db: db, ctx: ctx, expr: arg, memory: queryMemory(ctx)}
+	collation := sessionCollation(ctx)
+
+	switch op {
+	case "$sum":
+		return func() groupAccumulator { return &sumAccumulator{input: input} }, nil
+	case "$avg":
+		return func() groupAccumulator { return &sumAccumulator{input: input, average: true} }, nil
+	case "$max", "$min":
+		sign := 1
+		if op == "$min" {
+			sign = -1
+		}
+		return func() groupAccumulator {
+			return &bestNAccumulator{input: input, n: 1, sign: sign, collation: collation, single: true}
+		}, nil
+	case "$push":
+		return func() groupAccumulator { return &pushAccumulator{input: input} }, nil
+	case "$addToSet":
+		return func() groupAccumulator { return &addToSetAccumulator{input: input, seen: make(map[interface{}]bool)} }, nil
+	case "$stdDevPop", "$stdDevSamp":
+		return func() groupAccumulator { return &stdDevAccumulator{input: input, population: op == "$stdDevPop"} }, nil
+	case "$mergeObjects":
+		return func() groupAccumulator { return &mergeObjectsAccumulator{input: input} }, nil
+	case "$first", "$last":
+		return func() groupAccumulator { return &firstLastAccumulator{input: input, last: op == "$last"} }, nil
+	case "$count":
+		return func() groupAccumulator { return new(countAccumulator) }, nil
+	case "$accumulator":
+		return db.compileCustomAccumulator(ctx, arg)
+	case "$top", "$topN", "$bottom", "$bottomN":
+		spec, err := parseTopBottomSpec(op, arg)
+		if err != nil {
+			return nil, err
+		}
+		bottom := op == "$bottom" || op == "$bottomN"
+		return func() groupAccumulator {
+			return &topBottomAccumulator{db: db, ctx: ctx, spec: spec, bottom: bottom, collation: collation}
+		}, nil
+	case "$maxN", "$minN", "$firstN", "$lastN":
+		params, _ := arg.(map[string]interface{})
+		nVal, _ := toFloat64(params["n"])
+		n := int(nVal)
+		if n < 1 {
+			return func() groupAccumulator { return nullAccumulator{} }, nil
+		}
+		input.expr = params["input"]
+		switch op {
+		case "$maxN", "$minN":
+			sign := 1
+			if op == "$minN" {
+				sign = -1
 			}
+			return func() groupAccumulator {
+				return &bestNAccumulator{input: input, n: n, sign: sign, collation: collation}
+			}, nil
+		default:
+			return func() groupAccumulator {
+				return &firstLastNAccumulator{input: input, n: n, last: op == "$lastN"}
+			}, nil
+		}
+	default:
+		if db.strictMode(ctx) {
+			return nil, fmt.Errorf("%w: accumulator %s", ErrUnsupportedOperator, op)
 		}
-		return pushArray
+		db.logf(LogWarn, "Aggregator %s not implemented", op)
+		return func() groupAccumulator { return nullAccumulator{} }, nil
 	}
-	return nil
 }
 
-func selectFirst(docs []map[string]interface{}, val interface{}) interface{} {
-	if valStr, ok := val.(string); ok && strings.HasPrefix(valStr, "$") {
-		fieldToFirst := strings.TrimPrefix(valStr, "$")
-		if len(docs) > 0 {
-			return getNestedField(docs[0], fieldToFirst)
-		}
+//------------------------------------------------------------------------------
+// Accumulator states
+//------------------------------------------------------------------------------
+
+// accumulatorInput is the expression an accumulator is applied to.
+type accumulatorInput struct {
+	db     *DB
+	ctx    context.Context
+	expr   interface{}
+	memory *memoryBudget // accounts for the values the accumulator keeps
+}
+
+func (in accumulatorInput) eval(doc map[string]interface{}) (interface{}, error) {
+	return in.db.evaluate(in.ctx, doc, in.expr)
+}
+
+// numericValue returns the value as a number if it is one. Numeric strings
+// are not numbers here.
+func numericValue(v interface{}) (float64, bool) {
+	if _, isStr := v.(string); isStr {
+		return 0, false
 	}
+	return toFloat64(v)
+}
+
+// nullAccumulator returns null, for accumulators that can't produce a value.
+type nullAccumulator struct{}
+
+func (nullAccumulator) add(map[string]interface{}) error { return nil }
+func (nullAccumulator) result() (interface{}, error)     { return nil, nil }
+
+// $count: Count the documents of the group.
+type countAccumulator struct {
+	n int
+}
+
+func (a *countAccumulator) add(map[string]interface{}) error {
+	a.n++
 	return nil
 }
 
-func selectLast(docs []map[string]interface{}, val interface{}) interface{} {
-	if valStr, ok := val.(string); ok && strings.HasPrefix(valStr, "$") {
-		fieldToLast := strings.TrimPrefix(valStr, "$")
-		if len(docs) > 0 {
-			return getNestedField(docs[len(docs)-1], fieldToLast)
-		}
+func (a *countAccumulator) result() (interface{}, error) {
+	return float64(a.n), nil
+}
+
+// $sum / $avg: Sum or average of the numeric values; 0 if there are none.
+type sumAccumulator struct {
+	input   accumulatorInput
+	average bool
+	sum     float64
+	count   int
+}
+
+func (a *sumAccumulator) add(doc map[string]interface{}) error {
+	v, err := a.input.eval(doc)
+	if err != nil {
+		return err
+	}
+	if number, ok := numericValue(v); ok {
+		a.sum += number
+		a.count++
 	}
 	return nil
 }
 
-//------------------------------------------------------------------------------
-// New aggregator helpers
-//------------------------------------------------------------------------------
+func (a *sumAccumulator) result() (interface{}, error) {
+	if !a.average {
+		return a.sum, nil
+	}
+	if a.count == 0 {
+		return float64(0), nil
+	}
+	return a.sum / float64(a.count), nil
+}
 
-// $addToSet: Collects unique values of a field into an array.
-func addToSet(docs []map[string]interface{}, val interface{}) []interface{} {
-	if valStr, ok := val.(string); ok && strings.HasPrefix(valStr, "$") {
-		field := strings.TrimPrefix(valStr, "$")
-		uniqueMap := make(map[interface{}]struct{})
-		for _, doc := range docs {
-			v := getNestedField(doc, field)
-			if v != nil {
-				uniqueMap[v] = struct{}{}
-			}
-		}
-		result := make([]interface{}, 0, len(uniqueMap))
-		for k := range uniqueMap {
-			result = append(result, k)
-		}
-		return result
+// $max / $min / $maxN / $minN: Keep the N highest (sign 1) or lowest (sign
+// -1) values, compared across types as by $sort (numbers < strings <
+// documents < arrays < booleans < dates) and strings by the collation. Null
+// and missing values are ignored. $max and $min (single) return the value
+// itself, null if there are none; $maxN and $minN return the values best
+// first, equal values in input order.
+type bestNAccumulator struct {
+	input     accumulatorInput
+	n         int
+	sign      int
+	collation *Collation
+	single    bool
+	values    []interface{}
+}
+
+func (a *bestNAccumulator) add(doc map[string]interface{}) error {
+	v, err := a.input.eval(doc)
+	if err != nil || v == nil {
+		return err
+	}
+	// Insert after the values ranking as well as v, unless all n rank better
+	i := len(a.values)
+	for i > 0 && compareValues(v, a.values[i-1], a.collation)*a.sign > 0 {
+		i--
+	}
+	if i == a.n {
+		return nil
+	}
+	a.values = append(a.values, nil)
+	copy(a.values[i+1:], a.values[i:])
+	a.values[i] = v
+	if len(a.values) > a.n {
+		a.values = a.values[:a.n]
 	}
 	return nil
 }
 
-// $stdDevPop / $stdDevSamp: Standard deviation (population vs sample).
-func calculateStdDev(docs []map[string]interface{}, val interface{}, population bool) float64 {
-	if valStr, ok := val.(string); ok && strings.HasPrefix(valStr, "$") {
-		field := strings.TrimPrefix(valStr, "$")
-		var values []float64
-		for _, doc := range docs {
-			if number, ok := toFloat64(getNestedField(doc, field)); ok {
-				values = append(values, number)
-			}
-		}
-		n := float64(len(values))
-		if n == 0 {
-			return 0
+func (a *bestNAccumulator) result() (interface{}, error) {
+	if a.single {
+		if len(a.values) == 0 {
+			return nil, nil
 		}
-		// Calculate mean
-		var sum float64
-		for _, v := range values {
-			sum += v
-		}
-		mean := sum / n
+		return a.values[0], nil
+	}
+	return a.values, nil
+}
 
-		// Calculate variance
-		var variance float64
-		for _, v := range values {
-			diff := v - mean
-			variance += diff * diff
-		}
-		if population {
-			variance = variance / n
-		} else if n > 1 {
-			variance = variance / (n - 1)
-		}
-		return math.Sqrt(variance)
+// $push: Collect the values into an array. Null and missing values are
+// skipped.
+type pushAccumulator struct {
+	input  accumulatorInput
+	values []interface{}
+}
+
+func (a *pushAccumulator) add(doc map[string]interface{}) error {
+	v, err := a.input.eval(doc)
+	if err != nil || v == nil {
+		return err
 	}
-	return 0
+	if err := a.input.memory.holdValue(v); err != nil {
+		return err
+	}
+	a.values = append(a.values, v)
+	return nil
 }
 
-// $mergeObjects: Merge multiple object fields. Simplified top-level merge only.
-func mergeObjects(docs []map[string]interface{}, val interface{}) map[string]interface{} {
-	merged := make(map[string]interface{})
-	if valStr, ok := val.(string); ok && strings.HasPrefix(valStr, "$") {
-		field := strings.TrimPrefix(valStr, "$")
-		for _, doc := range docs {
-			obj, _ := getNestedField(doc, field).(map[string]interface{})
-			for k, v := range obj {
-				merged[k] = v
-			}
+func (a *pushAccumulator) result() (interface{}, error) {
+	return a.values, nil
+}
+
+// $addToSet: Collects unique values into an array, in order of first appearance.
+// Documents and arrays are compared by content.
+type addToSetAccumulator struct {
+	input  accumulatorInput
+	seen   map[interface{}]bool
+	values []interface{}
+}
+
+func (a *addToSetAccumulator) add(doc map[string]interface{}) error {
+	v, err := a.input.eval(doc)
+	if err != nil || v == nil {
+		return err
+	}
+	key := groupKey(v)
+	if !a.seen[key] {
+		if err := a.input.memory.holdValue(v); err != nil {
+			return err
 		}
+		a.seen[key] = true
+		a.values = append(a.values, v)
 	}
-	return merged
+	return nil
+}
+
+func (a *addToSetAccumulator) result() (interface{}, error) {
+	if a.values == nil {
+		return []interface{}{}, nil
+	}
+	return a.values, nil
 }
 
-// $accumulator: Placeholder for user-defined logic in MongoDB (JavaScript).
-func runAccumulator( /*docs []map[string]interface{}, val interface{}*/ ) interface{} {
-	// Real MongoDB uses JavaScript to define init, accumulate, merge, finalize, etc.
-	// Placeholder: just return a message or a simple sum.
-	// If `val` is a map with "accumulateArgs", "init", etc., you could manually interpret them.
-	log.Println("Warning: $accumulator aggregator is not fully implemented.")
+// $stdDevPop / $stdDevSamp: Standard deviation (population vs sample) of the
+// numeric values, computed in one pass with Welford's algorithm.
+type stdDevAccumulator struct {
+	input      accumulatorInput
+	population bool
+	n          float64
+	mean       float64
+	m2         float64 // sum of squared differences from the mean
+}
+
+func (a *stdDevAccumulator) add(doc map[string]interface{}) error {
+	v, err := a.input.eval(doc)
+	if err != nil {
+		return err
+	}
+	if number, ok := numericValue(v); ok {
+		a.n++
+		delta := number - a.mean
+		a.mean += delta / a.n
+		a.m2 += delta * (number - a.mean)
+	}
 	return nil
 }
 
-// $count: (already handled by default: groupResult[fieldName] = float64(len(groupDocs)) )
-
-// $arrayToObject: Convert an array of [key, value] pairs into a single object. (Placeholder example)
-func arrayToObject(docs []map[string]interface{}, val interface{}) interface{} {
-	// In real Mongo usage, $arrayToObject often is used inside $push or other pipelines.
-	// We'll assume { $arrayToObject: "$someField" } refers to an array in each doc.
-	if valStr, ok := val.(string); ok && strings.HasPrefix(valStr, "$") {
-		field := strings.TrimPrefix(valStr, "$")
-		// We'll only convert the first doc's array as an example.
-		if len(docs) > 0 {
-			arr, _ := getNestedField(docs[0], field).([]interface{})
-			obj := make(map[string]interface{})
-			// Expect array in form: [ [k1, v1], [k2, v2], ... ]
-			for _, pair := range arr {
-				if kv, ok := pair.([]interface{}); ok && len(kv) == 2 {
-					keyStr, _ := kv[0].(string)
-					obj[keyStr] = kv[1]
-				}
-			}
-			return obj
-		}
+func (a *stdDevAccumulator) result() (interface{}, error) {
+	if a.n == 0 {
+		return float64(0), nil
+	}
+	variance := a.m2
+	if a.population {
+		variance = variance / a.n
+	} else if a.n > 1 {
+		variance = variance / (a.n - 1)
+	}
+	return math.Sqrt(variance), nil
+}
+
+// $mergeObjects: Merge multiple object fields. Simplified top-level merge only.
+type mergeObjectsAccumulator struct {
+	input  accumulatorInput
+	merged map[string]interface{}
+}
+
+func (a *mergeObjectsAccumulator) add(doc map[string]interface{}) error {
+	v, err := a.input.eval(doc)
+	if err != nil {
+		return err
 	}
+	a.merged = mergeObjectInto(a.merged, v)
 	return nil
 }
 
-// $maxN: Return top N numeric values from the group.
-func maxN(docs []map[string]interface{}, val interface{}) []float64 {
-	// val should be an object: { n: <int>, input: "$field" }
-	params, _ := val.(map[string]interface{})
-	nVal, _ := toFloat64(params["n"])
-	inputStr, _ := params["input"].(string)
-	n := int(nVal)
+func (a *mergeObjectsAccumulator) result() (interface{}, error) {
+	return mergeObjectInto(a.merged, nil), nil
+}
 
-	if !strings.HasPrefix(inputStr, "$") || n < 1 {
-		return nil
+// mergeObjects merges the objects among values, later fields replacing
+// earlier ones.
+func mergeObjects(values []interface{}) map[string]interface{} {
+	var merged map[string]interface{}
+	for _, v := range values {
+		merged = mergeObjectInto(merged, v)
 	}
-	field := strings.TrimPrefix(inputStr, "$")
+	return mergeObjectInto(merged, nil)
+}
 
-	// Collect all numeric values
-	var allVals []float64
-	for _, doc := range docs {
-		if number, ok := toFloat64(getNestedField(doc, field)); ok {
-			allVals = append(allVals, number)
-		}
+// mergeObjectInto copies the fields of v, if it is an object, into merged,
+// allocated if nil.
+func mergeObjectInto(merged map[string]interface{}, v interface{}) map[string]interface{} {
+	if merged == nil {
+		merged = make(map[string]interface{})
 	}
-	// Sort descending
-	sort.Slice(allVals, func(i, j int) bool {
-		return allVals[i] > allVals[j]
-	})
-	if len(allVals) > n {
-		return allVals[:n]
+	obj, _ := v.(map[string]interface{})
+	for k, v := range obj {
+		merged[k] = v
 	}
-	return allVals
+	return merged
 }
 
-// $minN: Return bottom N numeric values from the group.
-func minN(docs []map[string]interface{}, val interface{}) []float64 {
-	// val should be an object: { n: <int>, input: "$field" }
-	params, _ := val.(map[string]interface{})
-	nVal, _ := toFloat64(params["n"])
-	inputStr, _ := params["input"].(string)
-	n := int(nVal)
+// $first / $last: The value of the first or last document of the group. Only
+// that document is evaluated.
+type firstLastAccumulator struct {
+	input accumulatorInput
+	last  bool
+	doc   map[string]interface{}
+	seen  bool
+}
 
-	if !strings.HasPrefix(inputStr, "$") || n < 1 {
-		return nil
+func (a *firstLastAccumulator) add(doc map[string]interface{}) error {
+	if !a.seen || a.last {
+		a.doc, a.seen = doc, true
 	}
-	field := strings.TrimPrefix(inputStr, "$")
+	return nil
+}
 
-	// Collect all numeric values
-	var allVals []float64
-	for _, doc := range docs {
-		if number, ok := toFloat64(getNestedField(doc, field)); ok {
-			allVals = append(allVals, number)
-		}
-	}
-	// Sort ascending
-	sort.Slice(allVals, func(i, j int) bool {
-		return allVals[i] < allVals[j]
-	})
-	if len(allVals) > n {
-		return allVals[:n]
+func (a *firstLastAccumulator) result() (interface{}, error) {
+	if !a.seen {
+		return nil, nil
 	}
-	return allVals
+	return a.input.eval(a.doc)
 }
 
-// $firstN: Return the first N values (in input order).
-func firstN(docs []map[string]interface{}, val interface{}) []interface{} {
-	// val should be an object: { n: <int>, input: "$field" }
-	params, _ := val.(map[string]interface{})
-	nVal, _ := toFloat64(params["n"])
-	inputStr, _ := params["input"].(string)
-	n := int(nVal)
+// $firstN / $lastN: The first or last N values, in input order. Null and
+// missing values are skipped.
+type firstLastNAccumulator struct {
+	input  accumulatorInput
+	n      int
+	last   bool
+	values []interface{}
+}
 
-	if !strings.HasPrefix(inputStr, "$") || n < 1 {
+func (a *firstLastNAccumulator) add(doc map[string]interface{}) error {
+	if !a.last && len(a.values) == a.n {
 		return nil
 	}
-	field := strings.TrimPrefix(inputStr, "$")
+	v, err := a.input.eval(doc)
+	if err != nil || v == nil {
+		return err
+	}
+	a.values = append(a.values, v)
+	if len(a.values) > a.n {
+		a.values = a.values[1:]
+	}
+	return nil
+}
 
-	var result []interface{}
-	count := 0
-	for _, doc := range docs {
-		if count >= n {
-			break
+func (a *firstLastNAccumulator) result() (interface{}, error) {
+	return a.values, nil
+}
+
+// topBottomSpec is the parsed argument of $top, $topN, $bottom and $bottomN.
+type topBottomSpec struct {
+	n      int // 0 for $top and $bottom, which return a single value
+	sortBy []groupSortKey
+	output interface{}
+}
+
+// groupSortKey is a field of a sortBy document.
+type groupSortKey struct {
+	field     string
+	direction int
+}
+
+// parseTopBottomSpec checks the argument of $top, $topN, $bottom and
+// $bottomN. The fields of sortBy are applied in name order, as by $sortArray.
+// It returns nil, nil for the other accumulators.
+func parseTopBottomSpec(op string, arg interface{}) (*topBottomSpec, error) {
+	var withN bool
+	switch op {
+	case "$top", "$bottom":
+	case "$topN", "$bottomN":
+		withN = true
+	default:
+		return nil, nil
+	}
+
+	params, ok := arg.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%s expects an object with sortBy and output, got %T", op, arg)
+	}
+	for field := range params {
+		if field != "sortBy" && field != "output" && (field != "n" || !withN) {
+			return nil, fmt.Errorf("%s has unknown field %q", op, field)
+		}
+	}
+
+	spec := &topBottomSpec{output: params["output"]}
+	if _, present := params["output"]; !present {
+		return nil, fmt.Errorf("%s is missing required field: output", op)
+	}
+	if err := validateExpression(spec.output); err != nil {
+		return nil, fmt.Errorf("%s output: %w", op, err)
+	}
+	if withN {
+		n, ok := toInteger(params["n"])
+		if !ok || n < 1 {
+			return nil, fmt.Errorf("%s n must be a positive integer, got %v", op, params["n"])
 		}
-		v := getNestedField(doc, field)
-		if v != nil {
-			result = append(result, v)
-			count++
+		spec.n = int(n)
+	}
+
+	sortBy, ok := params["sortBy"].(map[string]interface{})
+	if !ok || len(sortBy) == 0 {
+		return nil, fmt.Errorf("%s sortBy must be a non-empty sort document, got %v", op, params["sortBy"])
+	}
+	for _, field := range sortedKeys(sortBy) {
+		direction, ok := sortDirection(sortBy[field])
+		if !ok {
+			return nil, fmt.Errorf("%s sortBy directions must be 1 or -1, got %v for %q", op, sortBy[field], field)
 		}
+		spec.sortBy = append(spec.sortBy, groupSortKey{field: field, direction: direction})
 	}
-	return result
+	return spec, nil
 }
 
-// $lastN: Return the last N values (in input order).
-func lastN(docs []map[string]interface{}, val interface{}) []interface{} {
-	// val should be an object: { n: <int>, input: "$field" }
-	params, _ := val.(map[string]interface{})
-	nVal, _ := toFloat64(params["n"])
-	inputStr, _ := params["input"].(string)
-	n := int(nVal)
+// $top / $topN / $bottom / $bottomN: The documents of the group are ordered
+// by sortBy, across types as by $sort and strings by the session collation,
+// and the output expression is evaluated against the first (top) or last
+// (bottom) of them. Only those documents are kept and evaluated. $top and
+// $bottom return that single value, $topN and $bottomN an array of up to n
+// values in sortBy order.
+type topBottomAccumulator struct {
+	db        *DB
+	ctx       context.Context
+	spec      *topBottomSpec
+	bottom    bool
+	collation *Collation
+	docs      []map[string]interface{} // kept documents in sortBy order
+}
 
-	if !strings.HasPrefix(inputStr, "$") || n < 1 {
+func (a *topBottomAccumulator) add(doc map[string]interface{}) error {
+	n := a.spec.n
+	if n == 0 {
+		n = 1
+	}
+	// Insert after the documents sorting before or with doc, so that equal
+	// documents stay in input order
+	i := len(a.docs)
+	for i > 0 && a.compare(doc, a.docs[i-1]) < 0 {
+		i--
+	}
+	if !a.bottom && i == n {
 		return nil
 	}
-	field := strings.TrimPrefix(inputStr, "$")
+	a.docs = append(a.docs, nil)
+	copy(a.docs[i+1:], a.docs[i:])
+	a.docs[i] = doc
+	if len(a.docs) > n {
+		if a.bottom {
+			a.docs = a.docs[1:]
+		} else {
+			a.docs = a.docs[:n]
+		}
+	}
+	return nil
+}
 
-	var allVals []interface{}
-	for _, doc := range docs {
-		v := getNestedField(doc, field)
-		if v != nil {
-			allVals = append(allVals, v)
+func (a *topBottomAccumulator) compare(left, right map[string]interface{}) int {
+	for _, key := range a.spec.sortBy {
+		cmp := compareValues(getNestedField(left, key.field), getNestedField(right, key.field), a.collation)
+		if cmp != 0 {
+			return cmp * key.direction
 		}
 	}
-	// Return the last N elements
-	size := len(allVals)
-	if size > n {
-		return allVals[size-n:]
+	return 0
+}
+
+func (a *topBottomAccumulator) result() (interface{}, error) {
+	values, err := a.db.evaluateEach(a.ctx, a.docs, a.spec.output)
+	if err != nil {
+		return nil, err
+	}
+	if a.spec.n == 0 {
+		if len(values) == 0 {
+			return nil, nil
+		}
+		return values[0], nil
 	}
-	return allVals
+	return values, nil
 }
 
 func (db *DB) validateGroupStage(params map[string]interface{}) error {
 
 	// By MongoDB spec, $group must have an _id and then aggregations
 	// like sum, avg, push, etc. stored in other keys.
-	if _, ok := params["_id"]; !ok {
+	id, ok := params["_id"]
+	if !ok {
 		return fmt.Errorf("$group is missing required field: _id")
 	}
+	if err := validateExpression(id); err != nil {
+		return fmt.Errorf("$group _id: %w", err)
+	}
 	// Optionally validate each aggregator function
 	for field, aggValue := range params {
 		if field == "_id" {
@@ -478,10 +780,8 @@ func (db *DB) validateGroupStage(params map[string]interface{}) error {
 		switch v := aggValue.(type) {
 		case map[string]interface{}:
 			// e.g. { "$sum": "$someField" }, { "$avg": ... }, etc.
-			for op := range v {
-				if !isValidGroupOperator(op) {
-					return fmt.Errorf("$group aggregator %q is not supported", op)
-				}
+			if err := validateAccumulators(v); err != nil {
+				return fmt.Errorf("$group field %q: %w", field, err)
 			}
 		default:
 			return fmt.Errorf("$group field %q must be an aggregator object, got %T", field, v)
@@ -490,3 +790,31 @@ func (db *DB) validateGroupStage(params map[string]interface{}) error {
 	return nil
 
 }
+
+// validateAccumulators checks an accumulator object such as { "$sum": "$price" }
+// and the expressions it is applied to.
+func validateAccumulators(spec map[string]interface{}) error {
+	for op, arg := range spec {
+		if !isValidGroupOperator(op) {
+			return fmt.Errorf("aggregator %q is not supported", op)
+		}
+		if op == "$accumulator" {
+			if _, err := parseAccumulatorSpec(arg); err != nil {
+				return err
+			}
+			continue
+		}
+		if spec, err := parseTopBottomSpec(op, arg); err != nil {
+			return err
+		} else if spec != nil {
+			continue
+		}
+		if params, ok := arg.(map[string]interface{}); ok && strings.HasSuffix(op, "N") {
+			arg = params["input"]
+		}
+		if err := validateExpression(arg); err != nil {
+			return fmt.Errorf("%s: %w", op, err)
+		}
+	}
+	return nil
+}
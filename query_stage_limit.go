@@ -31,7 +31,7 @@ func (db *DB) limitStage(
 		}
 	}
 
-	limit := int(limitFloat)
+	limit := documentCount(limitFloat)
 
 	// Handle edge cases
 	switch {
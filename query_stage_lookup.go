@@ -1,80 +1,226 @@
 package marco
 
 import (
+	"context"
 	"fmt"
-	"log"
 )
 
 // lookupStage implements a lookup operation similar to MongoDB's $lookup aggregation stage
 // It performs a left outer join between two collections based on specified fields
 //
 // Parameters:
+// - ctx: Context of the query, holding the collections it has read
 // - input: Primary collection of documents to be augmented
 // - params: Configuration for the lookup operation
 // - data: Map of available collections for lookup
 //
 // Lookup Parameters:
-// - from: Name of the collection to join from
+// - from: Name of the collection to join from, or an array of names to resolve
+//   polymorphic references in one stage (e.g. ["posts", "photos", "videos"])
 // - localField: Field in the input collection to match
 // - foreignField: Field in the foreign collection to match against
 // - as: Name of the field to store matched documents
+// - sourceField: With several collections in "from", the field added to each
+//   matched document holding the collection it came from (default "_from")
+// - maxDepth: Number of additional levels joined recursively: each matched
+//   document gets its own matches under "as", down to maxDepth levels (default
+//   0, at most maxLookupDepth). Used for parent/child rows stored in one
+//   collection. A document is not matched again below itself.
+// - project: A $project specification applied to the matched documents, to
+//   keep only the needed fields of wide reference documents
+// - dedupe: When true, matches equal to an earlier match (after projection)
+//   are dropped
+//
+// Foreign collections are read once per query. When "from" is the queried
+// collection, the join is made against the collection as it was read at the
+// start of the query, not against the documents produced by earlier stages.
 //
 // Returns:
 // - Augmented documents with matched foreign collection documents
+// - An error in strict mode when the parameters are invalid or a foreign
+//   collection cannot be read; otherwise it is logged and the input is
+//   returned unchanged
 
 func (db *DB) lookupStage(
+	ctx context.Context,
 	input []map[string]interface{},
 	params map[string]interface{},
-) []map[string]interface{} {
-	// Validate and extract lookup parameters
-	lookupParams, err := validateLookupParams(params)
-	if err != nil {
-		log.Printf("Lookup parameter validation error: %v", err)
-		return input
-	}
-
-	// Retrieve the foreign collection
-	foreignCollection, err := db.Collection(lookupParams.from)
+) ([]map[string]interface{}, error) {
+	// Validate and extract lookup parameters, and retrieve the foreign collections
+	lookupParams, foreignCollections, err := db.lookupForeignCollections(ctx, params)
 	if err != nil {
-		log.Printf("Foreign collection '%s' not found", lookupParams.from)
-		return input
+		if db.strictMode(ctx) {
+			return nil, err
+		}
+		db.logf(LogWarn, "%v", err)
+		return input, nil
 	}
 
 	// Perform the lookup operation
 	var results []map[string]interface{}
 	for _, doc := range input {
-		// Create a deep copy of the original document
-		newDoc := deepCopyDocument(doc)
-
-		// Find matching documents in the foreign collection
-		matchedDocs := findMatchingDocuments(
-			doc,
-			foreignCollection,
-			lookupParams.localField,
-			lookupParams.foreignField,
-		)
+		// Copy the original document, which only gets the "as" field
+		newDoc := cloneDocument(doc)
 
 		// Add matched documents to the specified field
+		matchedDocs, err := db.lookupMatches(ctx, doc, foreignCollections, lookupParams, lookupParams.maxDepth, nil)
+		if err != nil {
+			return nil, err
+		}
 		newDoc[lookupParams.as] = matchedDocs
 
 		results = append(results, newDoc)
 	}
 
-	return results
+	return results, nil
+}
+
+// lookupForeignCollections validates the $lookup parameters 'params' and
+// returns the documents of each of its foreign collections.
+func (db *DB) lookupForeignCollections(ctx context.Context, params map[string]interface{}) (*lookupParameters, [][]map[string]interface{}, error) {
+	lookupParams, err := validateLookupParams(params)
+	if err != nil {
+		return nil, nil, fmt.Errorf("lookup parameter validation error: %w", err)
+	}
+	foreignCollections := make([][]map[string]interface{}, len(lookupParams.from))
+	for i, from := range lookupParams.from {
+		foreignCollections[i], err = db.snapshotCollection(ctx, from)
+		if err != nil {
+			return nil, nil, fmt.Errorf("cannot read foreign collection '%s': %w", from, err)
+		}
+	}
+	return lookupParams, foreignCollections, nil
+}
+
+// lookupDocument identifies a document of the foreign collections of a
+// $lookup: the index of its collection in "from" and its index in it.
+type lookupDocument struct {
+	collection, index int
+}
+
+// lookupMatches returns the documents of the foreign collections matching doc,
+// merged in the order of "from". While depth is positive, every match gets its
+// own matches under "as", one level less deep. Matches are then projected and
+// deduplicated as requested by the "project" and "dedupe" options.
+//
+// 'path' holds the matches doc was reached through, which are not matched
+// again: documents joined on a shared field would otherwise match each other
+// at every level. Matches are charged to the memory budget of the query.
+func (db *DB) lookupMatches(
+	ctx context.Context,
+	doc map[string]interface{},
+	foreignCollections [][]map[string]interface{},
+	lookupParams *lookupParameters,
+	depth int,
+	path map[lookupDocument]bool,
+) ([]map[string]interface{}, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	budget := queryMemory(ctx)
+
+	var matchedDocs []map[string]interface{}
+	var matchedFrom []lookupDocument
+	for i, foreignCollection := range foreignCollections {
+		for _, j := range findMatchingDocuments(doc, foreignCollection, lookupParams.localField, lookupParams.foreignField) {
+			ref := lookupDocument{collection: i, index: j}
+			if path[ref] {
+				continue
+			}
+			// Add a deep copy of the matched document to avoid mutation
+			// issues: the documents it is matched by must not share it
+			matchedDoc := deepCopyDocument(foreignCollection[j])
+			if err := budget.holdValue(matchedDoc); err != nil {
+				return nil, err
+			}
+
+			// Tag each match with its source when several collections are joined
+			if len(lookupParams.from) > 1 {
+				matchedDoc[lookupParams.sourceField] = lookupParams.from[i]
+			}
+			matchedDocs = append(matchedDocs, matchedDoc)
+			matchedFrom = append(matchedFrom, ref)
+		}
+	}
+
+	if depth > 0 {
+		if path == nil {
+			path = make(map[lookupDocument]bool)
+		}
+		for k, matchedDoc := range matchedDocs {
+			path[matchedFrom[k]] = true
+			nested, err := db.lookupMatches(ctx, matchedDoc, foreignCollections, lookupParams, depth-1, path)
+			delete(path, matchedFrom[k])
+			if err != nil {
+				return nil, err
+			}
+			matchedDoc[lookupParams.as] = nested
+		}
+	}
+
+	if lookupParams.project != nil && len(matchedDocs) > 0 {
+		projected, err := db.projectStage(ctx, matchedDocs, lookupParams.project)
+		if err != nil {
+			db.logf(LogWarn, "Lookup projection error: %v", err)
+			return matchedDocs, nil
+		}
+
+		// Keep the nested matches of recursive lookups and the source tag
+		for i, matchedDoc := range matchedDocs {
+			if depth > 0 {
+				projected[i][lookupParams.as] = matchedDoc[lookupParams.as]
+			}
+			if source, ok := matchedDoc[lookupParams.sourceField]; ok && len(lookupParams.from) > 1 {
+				projected[i][lookupParams.sourceField] = source
+			}
+		}
+		matchedDocs = projected
+	}
+
+	if lookupParams.dedupe {
+		matchedDocs = dedupeDocuments(matchedDocs)
+	}
+	return matchedDocs, nil
+}
+
+// dedupeDocuments removes documents equal to an earlier one, keeping the order.
+func dedupeDocuments(docs []map[string]interface{}) []map[string]interface{} {
+	seen := make(map[interface{}]bool, len(docs))
+	unique := docs[:0]
+	for _, doc := range docs {
+		key := groupKey(doc)
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		unique = append(unique, doc)
+	}
+	return unique
 }
 
 // lookupParameters encapsulates the configuration for a lookup operation
 type lookupParameters struct {
-	from         string
+	from         []string
 	localField   string
 	foreignField string
 	as           string
+	sourceField  string
+	maxDepth     int
+	project      map[string]interface{} // $project spec for matches, nil for none
+	dedupe       bool
 }
 
+// defaultLookupSourceField tags documents joined from several collections.
+const defaultLookupSourceField = "_from"
+
+// maxLookupDepth is the largest maxDepth of a $lookup. Every level multiplies
+// the matches of the previous one.
+const maxLookupDepth = 16
+
 // validateLookupParams checks and extracts lookup parameters
 func validateLookupParams(params map[string]interface{}) (*lookupParameters, error) {
 	// Extract parameters with type checking
-	from, ok1 := params["from"].(string)
+	from, ok1 := lookupFromCollections(params["from"])
 	localField, ok2 := params["localField"].(string)
 	foreignField, ok3 := params["foreignField"].(string)
 	as, ok4 := params["as"].(string)
@@ -85,47 +231,109 @@ func validateLookupParams(params map[string]interface{}) (*lookupParameters, err
 	}
 
 	// Ensure no empty strings
-	if from == "" || localField == "" || foreignField == "" || as == "" {
+	if localField == "" || foreignField == "" || as == "" {
 		return nil, fmt.Errorf("lookup parameters cannot be empty strings")
 	}
 
+	sourceField := defaultLookupSourceField
+	if raw, exists := params["sourceField"]; exists {
+		s, ok := raw.(string)
+		if !ok || s == "" {
+			return nil, fmt.Errorf("lookup sourceField must be a non-empty string")
+		}
+		sourceField = s
+	}
+
+	maxDepth := 0
+	if raw, exists := params["maxDepth"]; exists {
+		n, ok := toInteger(raw)
+		if !ok || n < 0 || n > maxLookupDepth {
+			return nil, fmt.Errorf("lookup maxDepth must be an integer between 0 and %d", maxLookupDepth)
+		}
+		maxDepth = int(n)
+	}
+
+	var project map[string]interface{}
+	if raw, exists := params["project"]; exists {
+		spec, ok := raw.(map[string]interface{})
+		if !ok || len(spec) == 0 {
+			return nil, fmt.Errorf("lookup project must be a non-empty $project specification")
+		}
+		project = spec
+	}
+
+	dedupe := false
+	if raw, exists := params["dedupe"]; exists {
+		b, ok := raw.(bool)
+		if !ok {
+			return nil, fmt.Errorf("lookup dedupe must be a boolean")
+		}
+		dedupe = b
+	}
+
 	return &lookupParameters{
 		from:         from,
 		localField:   localField,
 		foreignField: foreignField,
 		as:           as,
+		sourceField:  sourceField,
+		maxDepth:     maxDepth,
+		project:      project,
+		dedupe:       dedupe,
 	}, nil
 }
 
-// deepCopyDocument creates a complete copy of a document to prevent unintended mutations
-func deepCopyDocument(doc map[string]interface{}) map[string]interface{} {
-	newDoc := make(map[string]interface{})
-	for k, v := range doc {
-		newDoc[k] = v
+// lookupFromCollections returns the collections named by "from": a single
+// name or a non-empty array of names, none of them empty.
+func lookupFromCollections(raw interface{}) ([]string, bool) {
+	switch v := raw.(type) {
+	case string:
+		return []string{v}, v != ""
+	case []interface{}:
+		if len(v) == 0 {
+			return nil, false
+		}
+		names := make([]string, len(v))
+		for i, elem := range v {
+			name, ok := elem.(string)
+			if !ok || name == "" {
+				return nil, false
+			}
+			names[i] = name
+		}
+		return names, true
+	default:
+		return nil, false
 	}
-	return newDoc
 }
 
+// deepCopyDocument creates a complete copy of a document, embedded documents
+// and arrays included, to prevent unintended mutations
+func deepCopyDocument(doc map[string]interface{}) map[string]interface{} {
+	return cloneValue(doc).(map[string]interface{})
+}
+
+// findMatchingDocuments returns the indexes of the documents of
+// foreignCollection whose foreignField equals the localField of doc.
 func findMatchingDocuments(
 	doc map[string]interface{},
 	foreignCollection []map[string]interface{},
 	localField,
 	foreignField string,
-) []map[string]interface{} {
-	var matchedDocs []map[string]interface{}
+) []int {
+	var matches []int
 	localValue, ok := doc[localField]
 	if !ok {
-		return matchedDocs // Return empty if localField does not exist
+		return matches // Return empty if localField does not exist
 	}
 
-	for _, foreignDoc := range foreignCollection {
+	for i, foreignDoc := range foreignCollection {
 		if foreignDoc[foreignField] == localValue {
-			// Add a deep copy of matched document to avoid mutation issues
-			matchedDocs = append(matchedDocs, deepCopyDocument(foreignDoc))
+			matches = append(matches, i)
 		}
 	}
 
-	return matchedDocs
+	return matches
 }
 
 func (db *DB) validateLookupStage(params map[string]interface{}) error {
@@ -135,11 +343,93 @@ func (db *DB) validateLookupStage(params map[string]interface{}) error {
 		if _, ok := params[field]; !ok {
 			return fmt.Errorf("$lookup is missing required field: %q", field)
 		}
+		// "from" may also list several collections
+		if field == "from" {
+			if _, ok := lookupFromCollections(params[field]); !ok {
+				return fmt.Errorf("$lookup field \"from\" must be a collection name or a non-empty array of names")
+			}
+			continue
+		}
 		// Optionally check they are strings:
 		if _, isString := params[field].(string); !isString {
 			return fmt.Errorf("$lookup field %q must be a string", field)
 		}
 	}
+	if sourceField, exists := params["sourceField"]; exists {
+		if s, ok := sourceField.(string); !ok || s == "" {
+			return fmt.Errorf("$lookup field \"sourceField\" must be a non-empty string")
+		}
+	}
+	if maxDepth, exists := params["maxDepth"]; exists {
+		if n, ok := toInteger(maxDepth); !ok || n < 0 || n > maxLookupDepth {
+			return fmt.Errorf("$lookup field \"maxDepth\" must be an integer between 0 and %d", maxLookupDepth)
+		}
+	}
+	if project, exists := params["project"]; exists {
+		spec, ok := project.(map[string]interface{})
+		if !ok || len(spec) == 0 {
+			return fmt.Errorf("$lookup field \"project\" must be a non-empty $project specification")
+		}
+		if err := db.validateProjectStage(spec); err != nil {
+			return fmt.Errorf("$lookup field \"project\": %w", err)
+		}
+	}
+	if dedupe, exists := params["dedupe"]; exists {
+		if _, ok := dedupe.(bool); !ok {
+			return fmt.Errorf("$lookup field \"dedupe\" must be a boolean")
+		}
+	}
 	return nil
 
 }
+
+// lookupUnwindStage executes a $lookup followed by an $unwind of its "as"
+// field. The output is the same as running both stages, but each match is
+// emitted directly instead of first being collected in an array.
+func (db *DB) lookupUnwindStage(
+	ctx context.Context,
+	input []map[string]interface{},
+	params map[string]interface{},
+	unwindParams map[string]interface{},
+) ([]map[string]interface{}, error) {
+	lookupParams, foreignCollections, err := db.lookupForeignCollections(ctx, params)
+	if err != nil {
+		if db.strictMode(ctx) {
+			return nil, err
+		}
+		db.logf(LogWarn, "%v", err)
+		return input, nil
+	}
+	preserveNullAndEmptyArrays, _ := unwindParams["preserveNullAndEmptyArrays"].(bool)
+	includeArrayIndexField, _ := unwindParams["includeArrayIndex"].(string)
+
+	var results []map[string]interface{}
+	for _, doc := range input {
+		matchedDocs, err := db.lookupMatches(ctx, doc, foreignCollections, lookupParams, lookupParams.maxDepth, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		// Without matches the document is dropped, or kept with an empty
+		// "as" field when preserveNullAndEmptyArrays is set
+		if len(matchedDocs) == 0 {
+			if preserveNullAndEmptyArrays {
+				newDoc := cloneDocument(doc)
+				newDoc[lookupParams.as] = matchedDocs
+				results = append(results, newDoc)
+			}
+			continue
+		}
+
+		for idx, matchedDoc := range matchedDocs {
+			newDoc := cloneDocument(doc)
+			newDoc[lookupParams.as] = matchedDoc
+			if includeArrayIndexField != "" {
+				newDoc[includeArrayIndexField] = idx
+			}
+			results = append(results, newDoc)
+		}
+	}
+
+	return results, nil
+}
@@ -0,0 +1,72 @@
+package marco
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+// lookupDepth returns the number of levels of nested matches under "as".
+func lookupDepth(doc map[string]interface{}, as string) int {
+	depth := 0
+	for _, match := range asDocuments(doc[as]) {
+		if d := 1 + lookupDepth(match, as); d > depth {
+			depth = d
+		}
+	}
+	return depth
+}
+
+// asDocuments returns the documents of a $lookup "as" field.
+func asDocuments(v interface{}) []map[string]interface{} {
+	switch docs := v.(type) {
+	case []map[string]interface{}:
+		return docs
+	case []interface{}:
+		out := make([]map[string]interface{}, 0, len(docs))
+		for _, doc := range docs {
+			if m, ok := doc.(map[string]interface{}); ok {
+				out = append(out, m)
+			}
+		}
+		return out
+	}
+	return nil
+}
+
+func TestLookupMaxDepthSkipsCycles(t *testing.T) {
+	db := openTestDB(t, map[string][]string{
+		"nodes": {`{"n": 1, "g": "a"}`, `{"n": 2, "g": "a"}`, `{"n": 3, "g": "a"}`},
+	})
+	// Every node matches every node, itself included: only the nodes not
+	// already on the path are matched again
+	results, err := db.Query("nodes", `[{"$match": {"n": 1}}, {"$lookup": {"from": "nodes", "localField": "g", "foreignField": "g", "as": "m", "maxDepth": 16}}]`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 {
+		t.Fatalf("got %d results, want 1", len(results))
+	}
+	if depth := lookupDepth(results[0], "m"); depth != 3 {
+		t.Errorf("got %d levels of matches, want 3", depth)
+	}
+}
+
+func TestLookupMaxDepthLimits(t *testing.T) {
+	db := openTestDB(t, map[string][]string{"nodes": {`{"g": "a"}`}})
+	_, err := db.Query("nodes", `[{"$lookup": {"from": "nodes", "localField": "g", "foreignField": "g", "as": "m", "maxDepth": 1000}}]`)
+	if !errors.Is(err, ErrInvalidPipeline) {
+		t.Errorf("maxDepth 1000: got %v, want ErrInvalidPipeline", err)
+	}
+
+	// Matches are charged to the memory budget
+	var docs []string
+	for i := 0; i < 8; i++ {
+		docs = append(docs, `{"g": "a", "pad": "................................................................"}`)
+	}
+	db = openTestDB(t, map[string][]string{"nodes": docs})
+	_, _, err = db.QueryWithOptions(context.Background(), "nodes", `[{"$lookup": {"from": "nodes", "localField": "g", "foreignField": "g", "as": "m", "maxDepth": 8}}]`, QueryOptions{MemoryLimit: 1 << 20})
+	if !errors.Is(err, ErrMemoryLimitExceeded) {
+		t.Errorf("got %v, want ErrMemoryLimitExceeded", err)
+	}
+}
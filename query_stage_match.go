@@ -1,22 +1,26 @@
 package marco
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
-	"log"
 	"math"
+	"math/rand"
 	"reflect"
-	"regexp"
-	"strings"
+	"time"
+
+	"github.com/google/uuid"
 )
 
 // matchStage filters documents based on specified criteria.
 func (db *DB) matchStage(
+	ctx context.Context,
 	input []map[string]interface{},
 	params map[string]interface{},
 ) []map[string]interface{} {
 	var results []map[string]interface{}
 	for _, doc := range input {
-		if evaluateMatchExpression(doc, params) {
+		if db.evaluateMatchExpression(ctx, doc, params) {
 			results = append(results, doc)
 		}
 	}
@@ -26,7 +30,7 @@ func (db *DB) matchStage(
 // evaluateMatchExpression is the central expression-evaluation function for $match queries.
 // It recursively processes logical operators ($and, $or, $nor) and field-based conditions
 // (like {"field": {"$gt": 10}}).
-func evaluateMatchExpression(doc map[string]interface{}, expr interface{}) bool {
+func (db *DB) evaluateMatchExpression(ctx context.Context, doc map[string]interface{}, expr interface{}) bool {
 	switch condition := expr.(type) {
 	case map[string]interface{}:
 		// Could be a top-level object like {field: condition} or {$and: [...]} or similar.
@@ -39,7 +43,7 @@ func evaluateMatchExpression(doc map[string]interface{}, expr interface{}) bool
 				}
 				// All must match
 				for _, clause := range andClauses {
-					if !evaluateMatchExpression(doc, clause) {
+					if !db.evaluateMatchExpression(ctx, doc, clause) {
 						return false
 					}
 				}
@@ -52,7 +56,7 @@ func evaluateMatchExpression(doc map[string]interface{}, expr interface{}) bool
 				}
 				// Any must match
 				for _, clause := range orClauses {
-					if evaluateMatchExpression(doc, clause) {
+					if db.evaluateMatchExpression(ctx, doc, clause) {
 						return true
 					}
 				}
@@ -65,26 +69,53 @@ func evaluateMatchExpression(doc map[string]interface{}, expr interface{}) bool
 				}
 				// All must fail
 				for _, clause := range norClauses {
-					if evaluateMatchExpression(doc, clause) {
+					if db.evaluateMatchExpression(ctx, doc, clause) {
 						// If any clause matches, $nor fails
 						return false
 					}
 				}
 				return true
 
+			case "$where":
+				// Named Go predicate registered with RegisterWhere
+				if !db.evaluateWhere(ctx, doc, val) {
+					return false
+				}
+
+			case "$sampleRate":
+				// Keeps each document with the given probability, e.g.
+				// {"$sampleRate": 0.1} keeps about one document in ten
+				rate, _ := toFloat64(val)
+				if rand.Float64() >= rate {
+					return false
+				}
+
+			case "$expr":
+				// Aggregation expression evaluated against the whole document,
+				// e.g. {"$expr": {"$gt": ["$spent", "$budget"]}}. The document
+				// matches when the expression result is truthy.
+				matched, err := db.evaluate(ctx, doc, val)
+				if err != nil {
+					db.logf(LogWarn, "Error evaluating $expr: %v", err)
+					return false
+				}
+				if !toBool(matched) {
+					return false
+				}
+
 			default:
-				// Treat 'key' as a field name or nested path
+				// Treat 'key' as a field name or nested path; a missing field is nil
 				docVal, fieldExists := getNestedFieldExists(doc, key)
 
 				// If val is a map, might contain operators like $gt, $lt, etc.
 				opMap, isMap := val.(map[string]interface{})
 				if isMap {
-					if !evaluateOperators(docVal, fieldExists, opMap) {
+					if !db.evaluateOperators(ctx, docVal, fieldExists, opMap) {
 						return false
 					}
 				} else {
-					// Direct equality
-					if !reflect.DeepEqual(docVal, val) {
+					// Direct equality; an array field matches if any element is equal
+					if !eqOperator(docVal, val) {
 						return false
 					}
 				}
@@ -97,7 +128,7 @@ func evaluateMatchExpression(doc map[string]interface{}, expr interface{}) bool
 		// Usually $match expressions at top-level aren't arrays except for $and/$or.
 		// If needed, treat them as a $and? This is not standard, but you could interpret it if you wish.
 		for _, clause := range condition {
-			if !evaluateMatchExpression(doc, clause) {
+			if !db.evaluateMatchExpression(ctx, doc, clause) {
 				return false
 			}
 		}
@@ -111,7 +142,7 @@ func evaluateMatchExpression(doc map[string]interface{}, expr interface{}) bool
 
 // evaluateOperators checks individual field-level operators like $gt, $lt, $eq, $regex, etc.
 // If multiple operators exist on the same field, they all must pass.
-func evaluateOperators(value interface{}, valueExists bool, operators map[string]interface{}) bool {
+func (db *DB) evaluateOperators(ctx context.Context, value interface{}, valueExists bool, operators map[string]interface{}) bool {
 	for opKey, opVal := range operators {
 		switch opKey {
 
@@ -122,13 +153,13 @@ func evaluateOperators(value interface{}, valueExists bool, operators map[string
 			nestedMap, ok := opVal.(map[string]interface{})
 			if ok {
 				// If evaluateOperators is true for nested, we invert it
-				if evaluateOperators(value, valueExists, nestedMap) {
+				if db.evaluateOperators(ctx, value, valueExists, nestedMap) {
 					return false
 				}
 			} else {
 				// If it's a direct value (like a regex), we interpret in a simplified way.
 				// For instance: { field: { $not: /pattern/ } }
-				if !handleRegexNot(value, opVal) {
+				if matchesAnyElement(value, func(v interface{}) bool { return handleRegexNot(v, opVal) }) {
 					// handleRegexNot returns 'true' if it matched => $not fails
 					return false
 				}
@@ -149,7 +180,7 @@ func evaluateOperators(value interface{}, valueExists bool, operators map[string
 				if !isMap {
 					continue
 				}
-				if evaluateMatchExpression(elemMap, elemCriteria) {
+				if db.evaluateMatchExpression(ctx, elemMap, elemCriteria) {
 					matchFound = true
 					break
 				}
@@ -181,8 +212,18 @@ func evaluateOperators(value interface{}, valueExists bool, operators map[string
 		case "$size":
 			// Check array length
 			arr, ok := value.([]interface{})
+			if !ok {
+				return false
+			}
+			// Extension: comparison operators on the length, e.g. {"$size": {"$gte": 3}}
+			if sizeOps, isMap := opVal.(map[string]interface{}); isMap {
+				if db.strictMode(ctx) || !db.evaluateOperators(ctx, float64(len(arr)), true, sizeOps) {
+					return false
+				}
+				continue
+			}
 			size, sizeOk := opVal.(float64)
-			if !ok || !sizeOk {
+			if !sizeOk {
 				return false
 			}
 			if float64(len(arr)) != size {
@@ -193,7 +234,7 @@ func evaluateOperators(value interface{}, valueExists bool, operators map[string
 	
 		case "$regex":
 			// Process $regex along with its associated $options
-			if !regexMatch(value, opVal, operators) {
+			if !matchesAnyElement(value, func(v interface{}) bool { return regexMatch(v, opVal, operators) }) {
 				return false
 			}
 			// Continue to skip processing $options separately
@@ -217,30 +258,35 @@ func evaluateOperators(value interface{}, valueExists bool, operators map[string
 			}
 
 		case "$gt":
-			valNum, okVal := toFloat64(value)
-			opNum, okOp := toFloat64(opVal)
-			if !okVal || !okOp || !(valNum > opNum) {
+			if !compareOperator(value, opVal, func(a, b float64) bool { return a > b }) {
 				return false
 			}
 
 		case "$gte":
-			valNum, okVal := toFloat64(value)
-			opNum, okOp := toFloat64(opVal)
-			if !okVal || !okOp || !(valNum >= opNum) {
+			// {$gte: null} and {$lte: null} match null and missing fields, like {$eq: null}
+			if opVal == nil {
+				if !eqOperator(value, nil) {
+					return false
+				}
+				continue
+			}
+			if !compareOperator(value, opVal, func(a, b float64) bool { return a >= b }) {
 				return false
 			}
 
 		case "$lt":
-			valNum, okVal := toFloat64(value)
-			opNum, okOp := toFloat64(opVal)
-			if !okVal || !okOp || !(valNum < opNum) {
+			if !compareOperator(value, opVal, func(a, b float64) bool { return a < b }) {
 				return false
 			}
 
 		case "$lte":
-			valNum, okVal := toFloat64(value)
-			opNum, okOp := toFloat64(opVal)
-			if !okVal || !okOp || !(valNum <= opNum) {
+			if opVal == nil {
+				if !eqOperator(value, nil) {
+					return false
+				}
+				continue
+			}
+			if !compareOperator(value, opVal, func(a, b float64) bool { return a <= b }) {
 				return false
 			}
 
@@ -251,7 +297,7 @@ func evaluateOperators(value interface{}, valueExists bool, operators map[string
 			}
 			found := false
 			for _, item := range arr {
-				if reflect.DeepEqual(value, item) {
+				if eqOperator(value, item) {
 					found = true
 					break
 				}
@@ -266,7 +312,7 @@ func evaluateOperators(value interface{}, valueExists bool, operators map[string
 				return false
 			}
 			for _, item := range arr {
-				if reflect.DeepEqual(value, item) {
+				if eqOperator(value, item) {
 					return false
 				}
 			}
@@ -284,11 +330,13 @@ func evaluateOperators(value interface{}, valueExists bool, operators map[string
 			}
 
 		case "$type":
-			typeStr, ok := opVal.(string)
-			if !ok {
+			// A type name, a BSON type code, or an array of them (any may match)
+			typeNames, err := typeSpecNames(opVal)
+			if err != nil {
 				return false
 			}
-			if !matchesType(value, typeStr) {
+			// A missing field has no type, not even "null"
+			if !valueExists || !matchesAnyElement(value, func(v interface{}) bool { return matchesAnyType(v, typeNames) }) {
 				return false
 			}
 
@@ -303,22 +351,30 @@ func evaluateOperators(value interface{}, valueExists bool, operators map[string
 			if !ok1 || !ok2 {
 				return false
 			}
-			valNum, okVal := toFloat64(value)
-			if !okVal {
+			if !matchesAnyElement(value, func(v interface{}) bool {
+				valNum, okVal := toFloat64(v)
+				return okVal && math.Mod(valNum, divisor) == remainder
+			}) {
+				return false
+			}
+
+		case "$bitsAllSet", "$bitsAnySet", "$bitsAllClear", "$bitsAnyClear":
+			// Bitwise tests on integer fields; the argument is a bitmask or an array of bit positions
+			positions, err := bitPositions(opVal)
+			if err != nil {
 				return false
 			}
-			if math.Mod(valNum, divisor) != remainder {
+			if !matchesAnyElement(value, func(v interface{}) bool { return matchBits(opKey, v, positions) }) {
 				return false
 			}
 
 		case "$expr":
-			// Full $expr support requires an expression parser (like in $project).
-			// For now, we do a simple placeholder log message:
-			log.Println("Warning: $expr is not fully implemented in $match.")
+			// $expr needs the whole document and is handled by evaluateMatchExpression
+			db.logf(LogWarn, "$expr is only supported at the top level of $match")
 			return false
 
 		default:
-			log.Printf("Operator %s not recognized", opKey)
+			db.logf(LogWarn, "Operator %s not recognized", opKey)
 			return false
 		}
 	}
@@ -326,9 +382,46 @@ func evaluateOperators(value interface{}, valueExists bool, operators map[string
 }
 
 // eqOperator handles equality with a little extra logic for strings, etc.
+// Missing fields are passed as nil, so that, as in MongoDB, a null condition
+// ({field: null}, {$eq: null}, {$in: [null]}) matches both null and missing
+// fields and {$ne: null} excludes both. Use $exists to tell them apart.
 func eqOperator(value interface{}, opVal interface{}) bool {
 	// Trim strings if desired, or do exact match. Here we'll do a direct DeepEqual match, same as Mongo's basic ==.
-	return reflect.DeepEqual(value, opVal)
+	// As in MongoDB, an array field also matches when one of its elements is equal.
+	return matchesAnyElement(value, func(v interface{}) bool { return reflect.DeepEqual(v, opVal) })
+}
+
+// compareOperator applies a numeric comparison ($gt, $gte, $lt, $lte) to value,
+// or to any element of value if it is an array.
+func compareOperator(value interface{}, opVal interface{}, cmp func(a, b float64) bool) bool {
+	opNum, okOp := toFloat64(opVal)
+	if !okOp {
+		return false
+	}
+	return matchesAnyElement(value, func(v interface{}) bool {
+		valNum, okVal := toFloat64(v)
+		return okVal && cmp(valNum, opNum)
+	})
+}
+
+// matchesAnyElement applies a condition the way MongoDB does for array fields:
+// it holds if it holds for the value itself or, when the value is an array,
+// for at least one of its elements. Negated operators ($ne, $nin, $not) invert
+// the result, so they require that no element matches.
+func matchesAnyElement(value interface{}, cond func(interface{}) bool) bool {
+	if cond(value) {
+		return true
+	}
+	arr, ok := value.([]interface{})
+	if !ok {
+		return false
+	}
+	for _, elem := range arr {
+		if cond(elem) {
+			return true
+		}
+	}
+	return false
 }
 
 // handleRegexNot is a helper for $not with direct regex usage.
@@ -339,11 +432,8 @@ func handleRegexNot(value interface{}, pattern interface{}) bool {
 	if !okVal || !okPat {
 		return false // can't match
 	}
-	matched, err := regexp.MatchString(patStr, strVal)
-	if err != nil {
-		return false
-	}
-	return matched
+	matched, err := regexCache.matchString(patStr, "", strVal)
+	return err == nil && matched
 }
 
 // regexMatch applies $regex and optional $options on 'value'.
@@ -357,19 +447,92 @@ func regexMatch(value interface{}, opVal interface{}, operators map[string]inter
 		return false
 	}
 
-	// Optional case-insensitive flag
-	if caseInsensitive, exists := operators["$options"].(string); exists && strings.Contains(caseInsensitive, "i") {
-		pattern = "(?i)" + pattern
+	// Optional flags (i, m, s, x), folded into the cached compiled pattern
+	options, _ := operators["$options"].(string)
+
+	matched, err := regexCache.matchString(pattern, options, str)
+	return err == nil && matched
+}
+
+// bsonTypeCodes maps the numeric BSON type codes accepted by $type to type names.
+var bsonTypeCodes = map[int]string{
+	1:  "double",
+	2:  "string",
+	3:  "object",
+	4:  "array",
+	5:  "binData",
+	7:  "objectId",
+	8:  "bool",
+	9:  "date",
+	10: "null",
+	16: "int",
+	18: "long",
+	19: "decimal",
+}
+
+// knownTypeNames lists the type names accepted by $type.
+var knownTypeNames = map[string]bool{
+	"number": true, "double": true, "int": true, "long": true, "decimal": true,
+	"string": true, "bool": true, "array": true, "object": true, "null": true,
+	"date": true, "binData": true, "objectId": true,
+}
+
+// typeSpecNames converts the argument of $type (a type name, a numeric BSON
+// type code, or an array of either) into type names.
+func typeSpecNames(spec interface{}) ([]string, error) {
+	switch v := spec.(type) {
+	case string:
+		if !knownTypeNames[v] {
+			return nil, fmt.Errorf("unknown type name %q", v)
+		}
+		return []string{v}, nil
+	case []interface{}:
+		if len(v) == 0 {
+			return nil, fmt.Errorf("type array must not be empty")
+		}
+		var names []string
+		for _, elem := range v {
+			if _, isArray := elem.([]interface{}); isArray {
+				return nil, fmt.Errorf("type arrays cannot be nested")
+			}
+			elemNames, err := typeSpecNames(elem)
+			if err != nil {
+				return nil, err
+			}
+			names = append(names, elemNames...)
+		}
+		return names, nil
+	default:
+		code, ok := toInteger(spec)
+		if !ok {
+			return nil, fmt.Errorf("type must be a name, a numeric code or an array, got %T", spec)
+		}
+		name, ok := bsonTypeCodes[int(code)]
+		if !ok {
+			return nil, fmt.Errorf("unknown type code %d", code)
+		}
+		return []string{name}, nil
 	}
+}
 
-	match, err := regexp.MatchString(pattern, str)
-	if err != nil {
-		return false
+// matchesAnyType checks if 'value' has one of the given type names.
+func matchesAnyType(value interface{}, typeNames []string) bool {
+	for _, typeName := range typeNames {
+		if matchesType(value, typeName) {
+			return true
+		}
 	}
-	return match
+	return false
 }
 
 // matchesType checks if 'value' has the specified MongoDB type string (e.g., "string", "number", "bool").
+//
+// Documents are stored as JSON, so every number is a float64 after a round
+// trip: "double" matches any floating-point number, while "int" and "long"
+// match numbers without fractional part that fit in 32 and 64 bits (a value
+// that fits in an int is not a long). "decimal" matches json.Number values,
+// "date" time.Time values and RFC 3339 strings, "binData" byte slices and
+// "objectId" UUID strings, which marco uses as document identifiers.
 func matchesType(value interface{}, typeStr string) bool {
 	// reflect.TypeOf(value).Kind().String() => e.g. "float64", "string", "bool", "slice", "map"
 	if value == nil {
@@ -380,23 +543,169 @@ func matchesType(value interface{}, typeStr string) bool {
 	switch typeStr {
 	case "number":
 		// Treat float64 or any numeric as 'number'
-		return actualKind == reflect.Float64 || isIntegerKind(actualKind)
+		return actualKind == reflect.Float64 || actualKind == reflect.Float32 || isIntegerKind(actualKind) || isDecimal(value)
+	case "double":
+		return actualKind == reflect.Float64 || actualKind == reflect.Float32
+	case "int", "long":
+		if !isIntegerKind(actualKind) && actualKind != reflect.Float64 && actualKind != reflect.Float32 {
+			return false
+		}
+		n, ok := toInteger(value)
+		if !ok {
+			return false
+		}
+		fitsInt := n >= math.MinInt32 && n <= math.MaxInt32
+		return fitsInt == (typeStr == "int")
+	case "decimal":
+		return isDecimal(value)
 	case "string":
-		return actualKind == reflect.String
+		return actualKind == reflect.String && !isDecimal(value)
 	case "bool":
 		return actualKind == reflect.Bool
 	case "array":
-		return actualKind == reflect.Slice
+		return actualKind == reflect.Slice && !isBinData(value)
 	case "object":
 		return actualKind == reflect.Map
 	case "null":
 		return value == nil
-	// Add more as needed, e.g., "date"
+	case "date":
+		switch v := value.(type) {
+		case time.Time:
+			return true
+		case string:
+			_, err := time.Parse(time.RFC3339, v)
+			return err == nil
+		}
+		return false
+	case "binData":
+		return isBinData(value)
+	case "objectId":
+		s, ok := value.(string)
+		if !ok || len(s) != 36 {
+			return false
+		}
+		_, err := uuid.Parse(s)
+		return err == nil
 	default:
 		return false
 	}
 }
 
+// isDecimal reports whether value is an arbitrary-precision decimal number.
+func isDecimal(value interface{}) bool {
+	_, ok := value.(json.Number)
+	return ok
+}
+
+// isBinData reports whether value is binary data.
+func isBinData(value interface{}) bool {
+	_, ok := value.([]byte)
+	return ok
+}
+
+// sizeComparisonOperators are the operators accepted inside $size.
+var sizeComparisonOperators = map[string]bool{
+	"$eq": true, "$ne": true, "$gt": true, "$gte": true, "$lt": true, "$lte": true, "$in": true, "$nin": true,
+}
+
+// validateSizeOperator checks the argument of $size: an array length or, as
+// a marco extension unavailable in strict mode, comparison operators on it.
+func (db *DB) validateSizeOperator(ctx context.Context, arg interface{}) error {
+	sizeOps, isMap := arg.(map[string]interface{})
+	if !isMap {
+		if n, ok := toInteger(arg); !ok || n < 0 {
+			return fmt.Errorf("expects a non-negative integer, got %v", arg)
+		}
+		return nil
+	}
+	if db.strictMode(ctx) {
+		return fmt.Errorf("comparison operators inside $size are a marco extension, not allowed in strict mode")
+	}
+	if len(sizeOps) == 0 {
+		return fmt.Errorf("expects at least one comparison operator")
+	}
+	for op := range sizeOps {
+		if !sizeComparisonOperators[op] {
+			return fmt.Errorf("unsupported operator %q inside $size", op)
+		}
+	}
+	return nil
+}
+
+// bitPositions converts the argument of a bitwise operator into bit positions.
+// The argument is either a non-negative integer bitmask or an array of
+// non-negative bit positions.
+func bitPositions(arg interface{}) ([]int, error) {
+	if arr, ok := arg.([]interface{}); ok {
+		positions := make([]int, 0, len(arr))
+		for _, elem := range arr {
+			pos, ok := toInteger(elem)
+			if !ok || pos < 0 {
+				return nil, fmt.Errorf("bit positions must be non-negative integers, got %v", elem)
+			}
+			positions = append(positions, int(pos))
+		}
+		return positions, nil
+	}
+
+	mask, ok := toInteger(arg)
+	if !ok || mask < 0 {
+		return nil, fmt.Errorf("bitmask must be a non-negative integer, got %v", arg)
+	}
+	var positions []int
+	for pos := 0; mask != 0; pos++ {
+		if mask&1 == 1 {
+			positions = append(positions, pos)
+		}
+		mask >>= 1
+	}
+	return positions, nil
+}
+
+// matchBits applies a bitwise operator to an integer value. Non-integer values
+// never match. Negative values are sign-extended, as in two's complement.
+func matchBits(op string, value interface{}, positions []int) bool {
+	v, ok := toInteger(value)
+	if !ok {
+		return false
+	}
+	bitSet := func(pos int) bool {
+		if pos >= 64 {
+			return v < 0
+		}
+		return v&(int64(1)<<uint(pos)) != 0
+	}
+
+	switch op {
+	case "$bitsAllSet", "$bitsAllClear":
+		want := op == "$bitsAllSet"
+		for _, pos := range positions {
+			if bitSet(pos) != want {
+				return false
+			}
+		}
+		return true
+	case "$bitsAnySet", "$bitsAnyClear":
+		want := op == "$bitsAnySet"
+		for _, pos := range positions {
+			if bitSet(pos) == want {
+				return true
+			}
+		}
+		return false
+	}
+	return false
+}
+
+// toInteger converts a number without fractional part to int64.
+func toInteger(val interface{}) (int64, bool) {
+	f, ok := toFloat64(val)
+	if !ok || f != math.Trunc(f) || f < math.MinInt64 || f >= math.MaxInt64 {
+		return 0, false
+	}
+	return int64(f), true
+}
+
 // isIntegerKind checks if kind is an integer type (int, int32, int64, etc.).
 func isIntegerKind(k reflect.Kind) bool {
 	switch k {
@@ -407,7 +716,7 @@ func isIntegerKind(k reflect.Kind) bool {
 	return false
 }
 
-func (db *DB) validateMatchStage(params map[string]interface{}) error {
+func (db *DB) validateMatchStage(ctx context.Context, params map[string]interface{}) error {
 
 	// If the user wrote `$match: {}`, that might be valid as a no-op, or you might want to forbid it:
 	if len(params) == 0 {
@@ -436,6 +745,34 @@ func (db *DB) validateMatchStage(params map[string]interface{}) error {
 				// For example, you could call a helper function `validateMatchSubCondition(condMap)`.
 			}
 
+		} else if field == "$where" {
+			// $where references a predicate registered with RegisterWhere
+			name, ok := val.(string)
+			if !ok {
+				return fmt.Errorf("$match operator $where expects the name of a registered predicate, got %T", val)
+			}
+			if db.wherePredicate(name) == nil {
+				return fmt.Errorf("$match operator $where references unknown predicate %q", name)
+			}
+
+		} else if field == "$sampleRate" {
+			// $sampleRate is the probability a document is kept
+			rate, ok := val.(float64)
+			if !ok || rate < 0 || rate > 1 {
+				return fmt.Errorf("$match operator $sampleRate expects a number between 0 and 1, got %v", val)
+			}
+
+		} else if field == "$expr" {
+			// $expr holds an aggregation expression, not field operators
+			switch val.(type) {
+			case map[string]interface{}, string, bool:
+			default:
+				return fmt.Errorf("$match operator $expr expects an expression, got %T", val)
+			}
+			if err := validateExpression(val); err != nil {
+				return fmt.Errorf("$match operator $expr: %w", err)
+			}
+
 		} else {
 			// Not a top-level logical operator like $or / $and / $nor
 			// => interpret `field` as the actual field name, and `val` as either
@@ -447,9 +784,34 @@ func (db *DB) validateMatchStage(params map[string]interface{}) error {
 					if !isValidMatchOperator(op) {
 						return fmt.Errorf("$match has invalid operator %q for field %q", op, field)
 					}
+					switch op {
+					case "$bitsAllSet", "$bitsAnySet", "$bitsAllClear", "$bitsAnyClear":
+						if _, err := bitPositions(valTyped[op]); err != nil {
+							return fmt.Errorf("$match operator %s on field %q: %w", op, field, err)
+						}
+					case "$type":
+						if _, err := typeSpecNames(valTyped[op]); err != nil {
+							return fmt.Errorf("$match operator $type on field %q: %w", field, err)
+						}
+					case "$size":
+						if err := db.validateSizeOperator(ctx, valTyped[op]); err != nil {
+							return fmt.Errorf("$match operator $size on field %q: %w", field, err)
+						}
+					case "$regex":
+						pattern, ok := valTyped[op].(string)
+						if !ok {
+							return fmt.Errorf("$match operator $regex on field %q expects a string pattern, got %T", field, valTyped[op])
+						}
+						options, _ := valTyped["$options"].(string)
+						if _, err := regexCache.get(pattern, options); err != nil {
+							return fmt.Errorf("$match operator $regex on field %q: %w", field, err)
+						}
+					}
 				}
 			case string, float64, int, bool:
 				// scalar is okay, e.g. "status": "active"
+			case []interface{}, nil:
+				// whole-array equality, e.g. "tags": ["red", "blue"], or "field": null
 			default:
 				// The error that triggered your message:
 				// "Error parsing aggregation stages: $match field "$or" has unexpected type []interface {}"
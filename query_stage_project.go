@@ -1,9 +1,8 @@
 package marco
 
 import (
+	"context"
 	"fmt"
-	"log"
-	"math"
 	"strings"
 )
 
@@ -15,76 +14,106 @@ import (
 // 3. Process more operators in a generic, recursive expression evaluator.
 // 4. Respect _id default inclusion/exclusion rules.
 //
-// If the user mixes 1 and 0 in the same projection (and it's not just `_id`), we log a warning or error
-// to mimic MongoDB's general restriction.
-func (db *DB) projectStage(input []map[string]interface{}, params map[string]interface{}) []map[string]interface{} {
+// If the user mixes 1 and 0 in the same projection (and it's not just `_id`), we log a warning and
+// return the input unchanged, or fail in strict mode, to mimic MongoDB's general restriction.
+func (db *DB) projectStage(ctx context.Context, input []map[string]interface{}, params map[string]interface{}) ([]map[string]interface{}, error) {
 	// 1. Determine inclusion or exclusion mode.
 	//    In MongoDB, if ANY field is "1" (true), we treat the projection as "include mode" except _id might be explicit.
 	//    If ALL numeric fields are "0", it's "exclude mode".
 	//    Mixing 1 and 0 in the same doc is invalid except for _id.
 	mode, err := determineProjectionMode(params)
 	if err != nil {
-		log.Printf("Projection error: %v", err)
+		if db.strictMode(ctx) {
+			return nil, err
+		}
+		db.logf(LogWarn, "Projection error: %v", err)
 		// Return original docs or handle error as you wish.
-		return input
+		return input, nil
 	}
 
 	var results []map[string]interface{}
 	for _, doc := range input {
-		// Start by copying the document or building from scratch depending on mode
-		var projectedDoc map[string]interface{}
-
-		if mode == "include" {
-			// In "include" mode, we start with an empty doc
-			projectedDoc = make(map[string]interface{})
-		} else {
-			// In "exclude" mode, we start with a shallow copy of the entire doc
-			// Then we'll remove fields that are explicitly excluded
-			projectedDoc = cloneDocument(doc)
+		projectedDoc, err := db.projectDocument(ctx, doc, params, mode)
+		if err != nil {
+			return nil, err
 		}
+		results = append(results, projectedDoc)
+	}
+
+	return results, nil
+}
 
-		for field, rawSpec := range params {
-			// `_id` has special default handling, but we'll treat it just like any other field
-			// except we allow mixing 1 or 0 with `_id`.
-			switch spec := rawSpec.(type) {
-			case float64:
-				// Projection spec is numeric, i.e. 1 or 0
-				if spec == 1 && mode == "include" {
-					// Evaluate expression as a direct field reference or handle deeper logic:
-					//   In a "pure" numeric projection, the *field name* itself is used to fetch the doc field.
-					//   But let's allow for expression references in the future if needed.
-					if val, exists := doc[field]; exists {
-						projectedDoc[field] = val
-					}
-				} else if spec == 0 && mode == "exclude" {
-					// Exclude this field from projected doc (only if it exists)
-					delete(projectedDoc, field)
-				}
-				// If spec=1 but we're in exclude mode, or spec=0 in include mode, that was flagged earlier as invalid
-				// (except for _id). So no action needed here, we effectively ignore or skip it.
-			default:
-				// For anything that's not a numeric spec (1/0), treat it as an expression
-				// Evaluate the expression and place it into the projected doc.
-				value := evaluateExpression(doc, rawSpec)
+// projectDocument applies the projection 'params', in mode "include" or
+// "exclude" (see determineProjectionMode), to a single document.
+func (db *DB) projectDocument(ctx context.Context, doc map[string]interface{}, params map[string]interface{}, mode string) (map[string]interface{}, error) {
+	// Start by copying the document or building from scratch depending on mode
+	var projectedDoc map[string]interface{}
+
+	if mode == "include" {
+		// In "include" mode, we start with an empty doc
+		projectedDoc = make(map[string]interface{})
+	} else {
+		// In "exclude" mode, we start with a shallow copy of the entire doc
+		// Then we'll remove fields that are explicitly excluded
+		projectedDoc = cloneDocument(doc)
+	}
+
+	for field, rawSpec := range params {
+		// `_id` has special default handling, but we'll treat it just like any other field
+		// except we allow mixing 1 or 0 with `_id`.
+		switch spec := rawSpec.(type) {
+		case float64:
+			// Projection spec is numeric, i.e. 1 or 0
+			if spec == 1 && mode == "include" {
+				// In a "pure" numeric projection, the *field name* itself is used to fetch the doc field.
+				// Dot-notation paths ("address.city") rebuild the nested structure in the output.
+				includePath(projectedDoc, doc, strings.Split(field, "."))
+			} else if spec == 0 && mode == "exclude" {
+				// Exclude this field from projected doc (only if it exists)
+				excludePath(projectedDoc, strings.Split(field, "."))
+			}
+			// If spec=1 but we're in exclude mode, or spec=0 in include mode, that was flagged earlier as invalid
+			// (except for _id). So no action needed here, we effectively ignore or skip it.
+		case map[string]interface{}:
+			// Projection form of $slice trims the array stored under the field itself:
+			// { "comments": { "$slice": 5 } } or { "comments": { "$slice": [ 10, 5 ] } }
+			if sliceSpec, ok := sliceProjectionSpec(spec); ok {
+				applySliceProjection(projectedDoc, doc, field, sliceSpec)
+				continue
+			}
+			value, removed, err := db.evaluateField(ctx, doc, rawSpec)
+			if err != nil {
+				return nil, fmt.Errorf("$project field %q: %w", field, err)
+			}
+			if !removed {
 				projectedDoc[field] = value
 			}
-		}
-
-		// If _id is not mentioned in the params at all, but we're in "include" mode,
-		// we default to including _id. If we're in "exclude" mode and `_id` wasn't explicitly set to 1,
-		// then `_id` remains part of the doc (since exclude mode started with a full copy).
-		// That logic effectively matches MongoDB.
-		if _, exists := params["_id"]; !exists && mode == "include" {
-			// In "include" mode, we didn't explicitly mention _id, so let's add it if present
-			if val, ok := doc["_id"]; ok {
-				projectedDoc["_id"] = val
+		default:
+			// For anything that's not a numeric spec (1/0), treat it as an expression
+			// Evaluate the expression and place it into the projected doc,
+			// unless it evaluates to $$REMOVE.
+			value, removed, err := db.evaluateField(ctx, doc, rawSpec)
+			if err != nil {
+				return nil, fmt.Errorf("$project field %q: %w", field, err)
+			}
+			if !removed {
+				projectedDoc[field] = value
 			}
 		}
+	}
 
-		results = append(results, projectedDoc)
+	// If _id is not mentioned in the params at all, but we're in "include" mode,
+	// we default to including _id. If we're in "exclude" mode and `_id` wasn't explicitly set to 1,
+	// then `_id` remains part of the doc (since exclude mode started with a full copy).
+	// That logic effectively matches MongoDB.
+	if _, exists := params["_id"]; !exists && mode == "include" {
+		// In "include" mode, we didn't explicitly mention _id, so let's add it if present
+		if val, ok := doc["_id"]; ok {
+			projectedDoc["_id"] = val
+		}
 	}
 
-	return results
+	return projectedDoc, nil
 }
 
 // determineProjectionMode scans the params for numeric (1/0) fields
@@ -122,287 +151,169 @@ func determineProjectionMode(params map[string]interface{}) (string, error) {
 	return "exclude", nil
 }
 
-// evaluateExpression tries to parse and evaluate the given 'expr' as either:
-// 1) A literal value (string/number/bool).
-// 2) A field reference (string starting with '$').
-// 3) An operator expression (map with keys like $concat, $add, $cond, etc.).
-// 4) A numeric projection is handled outside this function, so we won't see float64==1 or float64==0 here.
-func evaluateExpression(doc map[string]interface{}, expr interface{}) interface{} {
-	switch val := expr.(type) {
-	case string:
-		// Check if it's a $field reference
-		if strings.HasPrefix(val, "$") {
-			return resolveField(doc, strings.TrimPrefix(val, "$"))
-		}
-		// Otherwise it's just a literal string
-		return val
-
-	case float64, bool, int, nil:
-		// Basic literal
-		return val
-
-	case map[string]interface{}:
-		// Potentially an operator expression like { $concat: [...] } or { $add: [...] }
-		// We'll parse the first key to see what operator it is.
-		// If multiple keys exist, the first one is the primary operator (like Mongo does).
-		for op, opVal := range val {
-			switch op {
-			case "$concat":
-				return handleConcat(doc, opVal)
-			case "$substr":
-				return handleSubstring(doc, opVal)
-			case "$dateToString":
-				return handleDateToString(doc, opVal)
-			case "$add":
-				return handleAdd(doc, opVal)
-			case "$subtract":
-				return handleSubtract(doc, opVal)
-			case "$multiply":
-				return handleMultiply(doc, opVal)
-			case "$divide":
-				return handleDivide(doc, opVal)
-			case "$mod":
-				return handleMod(doc, opVal)
-			case "$and":
-				return handleAnd(doc, opVal)
-			case "$or":
-				return handleOr(doc, opVal)
-			case "$not":
-				return handleNot(doc, opVal)
-			case "$cond":
-				return handleCond(doc, opVal)
-			// Add additional operators here as needed
-			default:
-				log.Printf("Unhandled operator: %s", op)
-				return nil
-			}
-		}
-		return nil
-
-	case []interface{}:
-		// Could be an array literal, or an expression array
-		// For a direct array, we evaluate each element
-		resultArr := make([]interface{}, 0, len(val))
-		for _, item := range val {
-			resultArr = append(resultArr, evaluateExpression(doc, item))
-		}
-		return resultArr
-
-	default:
-		// Unhandled type
-		log.Printf("Unhandled expression type: %T", expr)
-		return nil
+// sliceProjectionSpec recognizes the projection form of $slice, { "$slice": <n> } or
+// { "$slice": [ <skip>, <limit> ] } with literal numbers, and returns its argument.
+// Anything else (e.g. { "$slice": [ "$arr", 2 ] }) is the expression form.
+func sliceProjectionSpec(spec map[string]interface{}) (interface{}, bool) {
+	if len(spec) != 1 {
+		return nil, false
 	}
-}
-
-// ---------- Basic Operator Implementations ----------
-
-// handleConcat expects opVal = []interface{}, each item is either a literal or a $field reference
-func handleConcat(doc map[string]interface{}, opVal interface{}) string {
-	arr, ok := opVal.([]interface{})
+	arg, ok := spec["$slice"]
 	if !ok {
-		return ""
+		return nil, false
 	}
-
-	var sb strings.Builder
-	for _, item := range arr {
-		resolved := evaluateExpression(doc, item)
-		if resolvedStr, isString := resolved.(string); isString {
-			sb.WriteString(resolvedStr)
+	switch v := arg.(type) {
+	case float64:
+		return v, true
+	case []interface{}:
+		if len(v) != 2 {
+			return nil, false
 		}
+		_, ok1 := v[0].(float64)
+		_, ok2 := v[1].(float64)
+		return v, ok1 && ok2
 	}
-	return sb.String()
-}
-
-// handleSubstring expects opVal = [ <string expression>, <start>, <length> ]
-func handleSubstring(doc map[string]interface{}, opVal interface{}) string {
-	arr, ok := opVal.([]interface{})
-	if !ok || len(arr) != 3 {
-		return ""
-	}
-
-	strVal := evaluateExpression(doc, arr[0])
-	startVal := evaluateExpression(doc, arr[1])
-	lengthVal := evaluateExpression(doc, arr[2])
-
-	s, _ := strVal.(string)
-	start, _ := toFloat64(startVal)
-	length, _ := toFloat64(lengthVal)
-
-	return extractSubstring(s, int(start), int(length))
-}
-
-// handleDateToString expects opVal = { "date": <expr>, "format": <formatStr> }
-func handleDateToString(doc map[string]interface{}, opVal interface{}) string {
-	config, ok := opVal.(map[string]interface{})
-	if !ok {
-		return ""
-	}
-	dateRaw := config["date"]
-	formatRaw := config["format"]
-
-	dateVal := evaluateExpression(doc, dateRaw) // Might be a $field ref
-	formatStr := evaluateExpression(doc, formatRaw)
-
-	format, _ := formatStr.(string)
-	return formatDate(dateVal, format)
+	return nil, false
 }
 
-// Arithmetic
-func handleAdd(doc map[string]interface{}, opVal interface{}) interface{} {
-	// opVal is typically an array: e.g. [ <expr1>, <expr2>, ... ]
-	arr, ok := opVal.([]interface{})
-	if !ok {
-		return nil
-	}
-	sum := 0.0
-	for _, item := range arr {
-		val := evaluateExpression(doc, item)
-		f, _ := toFloat64(val)
-		sum += f
+// applySliceProjection trims the array found at 'field' (dot notation allowed) in doc and
+// stores the result under the same path of projectedDoc. Non-array values are kept as-is.
+func applySliceProjection(projectedDoc, doc map[string]interface{}, field string, sliceSpec interface{}) {
+	value := resolveField(doc, field)
+	arr, ok := toInterfaceSlice(value)
+	if ok {
+		switch v := sliceSpec.(type) {
+		case float64:
+			value = sliceArray(arr, 0, int(v), true)
+		case []interface{}:
+			skip, _ := v[0].(float64)
+			limit, _ := v[1].(float64)
+			if limit <= 0 {
+				value = []interface{}{}
+			} else {
+				value = sliceArray(arr, int(skip), int(limit), false)
+			}
+		}
+	} else if value == nil {
+		return
 	}
-	return sum
+	setPath(projectedDoc, strings.Split(field, "."), value)
 }
 
-func handleSubtract(doc map[string]interface{}, opVal interface{}) interface{} {
-	arr, ok := opVal.([]interface{})
-	if !ok || len(arr) < 2 {
-		return nil
-	}
-	firstVal := evaluateExpression(doc, arr[0])
-	base, _ := toFloat64(firstVal)
-	for i := 1; i < len(arr); i++ {
-		val := evaluateExpression(doc, arr[i])
-		f, _ := toFloat64(val)
-		base -= f
-	}
-	return base
-}
+// ---------- Path Projection ----------
 
-func handleMultiply(doc map[string]interface{}, opVal interface{}) interface{} {
-	arr, ok := opVal.([]interface{})
-	if !ok || len(arr) == 0 {
-		return nil
+// setPath stores value at 'parts' in doc, copying the embedded documents along the
+// path so that documents shared with the input are not modified.
+func setPath(doc map[string]interface{}, parts []string, value interface{}) {
+	if len(parts) == 1 {
+		doc[parts[0]] = value
+		return
 	}
-	product := 1.0
-	for _, item := range arr {
-		val := evaluateExpression(doc, item)
-		f, _ := toFloat64(val)
-		product *= f
+	sub, ok := doc[parts[0]].(map[string]interface{})
+	if ok {
+		sub = cloneDocument(sub)
+	} else {
+		sub = make(map[string]interface{})
 	}
-	return product
+	setPath(sub, parts[1:], value)
+	doc[parts[0]] = sub
 }
 
-func handleDivide(doc map[string]interface{}, opVal interface{}) interface{} {
-	arr, ok := opVal.([]interface{})
-	if !ok || len(arr) < 2 {
-		return nil
+// includePath copies the value found at 'parts' in src into dst, creating the
+// intermediate embedded documents as needed. Several paths sharing a prefix
+// ("address.city", "address.zip") are merged into the same output document.
+//
+// Arrays are traversed like MongoDB does: for {"items.name": 1} every embedded
+// document of "items" keeps only its "name" field, while scalar elements are
+// dropped because they cannot contain the requested sub-field.
+func includePath(dst, src map[string]interface{}, parts []string) {
+	val, exists := src[parts[0]]
+	if !exists {
+		return
 	}
-	numerator := evaluateExpression(doc, arr[0])
-	denom := evaluateExpression(doc, arr[1])
-
-	numf, _ := toFloat64(numerator)
-	denf, _ := toFloat64(denom)
-	if denf == 0 {
-		// Mimic MongoDB’s behavior, which might throw an error or produce NaN
-		return nil
+	if len(parts) == 1 {
+		dst[parts[0]] = val
+		return
 	}
-	result := numf / denf
 
-	// If there are more items, chain-divide them
-	for i := 2; i < len(arr); i++ {
-		nextVal := evaluateExpression(doc, arr[i])
-		nf, _ := toFloat64(nextVal)
-		if nf == 0 {
-			return nil
+	switch v := val.(type) {
+	case map[string]interface{}:
+		sub, ok := dst[parts[0]].(map[string]interface{})
+		if !ok {
+			sub = make(map[string]interface{})
 		}
-		result /= nf
-	}
-	return result
-}
+		includePath(sub, v, parts[1:])
+		dst[parts[0]] = sub
 
-func handleMod(doc map[string]interface{}, opVal interface{}) interface{} {
-	arr, ok := opVal.([]interface{})
-	if !ok || len(arr) != 2 {
-		return nil
-	}
-	leftVal := evaluateExpression(doc, arr[0])
-	rightVal := evaluateExpression(doc, arr[1])
-
-	lv, _ := toFloat64(leftVal)
-	rv, _ := toFloat64(rightVal)
-	if rv == 0 {
-		return nil
+	case []interface{}:
+		existing, _ := dst[parts[0]].([]interface{})
+		dst[parts[0]] = includeArrayPath(existing, v, parts[1:])
 	}
-	return math.Mod(lv, rv)
 }
 
-// Logical
-func handleAnd(doc map[string]interface{}, opVal interface{}) interface{} {
-	arr, ok := opVal.([]interface{})
-	if !ok {
-		return false
-	}
-	for _, item := range arr {
-		val := evaluateExpression(doc, item)
-		boolVal := toBool(val)
-		if !boolVal {
-			return false
+// includeArrayPath applies includePath to every element of 'arr'. 'existing'
+// holds the output of a previous path projected from the same array, so that
+// the results of several paths are merged element by element.
+func includeArrayPath(existing, arr []interface{}, parts []string) []interface{} {
+	out := make([]interface{}, 0, len(arr))
+	for _, elem := range arr {
+		var prev interface{}
+		if len(out) < len(existing) {
+			prev = existing[len(out)]
 		}
-	}
-	return true
-}
 
-func handleOr(doc map[string]interface{}, opVal interface{}) interface{} {
-	arr, ok := opVal.([]interface{})
-	if !ok {
-		return false
-	}
-	for _, item := range arr {
-		val := evaluateExpression(doc, item)
-		boolVal := toBool(val)
-		if boolVal {
-			return true
+		switch e := elem.(type) {
+		case map[string]interface{}:
+			sub, ok := prev.(map[string]interface{})
+			if !ok {
+				sub = make(map[string]interface{})
+			}
+			includePath(sub, e, parts)
+			out = append(out, sub)
+		case []interface{}:
+			prevArr, _ := prev.([]interface{})
+			out = append(out, includeArrayPath(prevArr, e, parts))
 		}
 	}
-	return false
+	return out
 }
 
-func handleNot(doc map[string]interface{}, opVal interface{}) interface{} {
-	val := evaluateExpression(doc, opVal)
-	boolVal := toBool(val)
-	return !boolVal
-}
+// excludePath removes the field at 'parts' from doc. Embedded documents and
+// arrays along the path are copied before being modified so that the source
+// document, which doc was shallow-cloned from, is left untouched.
+func excludePath(doc map[string]interface{}, parts []string) {
+	if len(parts) == 1 {
+		delete(doc, parts[0])
+		return
+	}
 
-// Conditional
-// $cond can have two formats:
-// 1) $cond: { if: <expr>, then: <expr>, else: <expr> }
-// 2) $cond: [ <if>, <then>, <else> ]
-func handleCond(doc map[string]interface{}, opVal interface{}) interface{} {
-	switch condVal := opVal.(type) {
+	switch v := doc[parts[0]].(type) {
 	case map[string]interface{}:
-		ifExpr := evaluateExpression(doc, condVal["if"])
-		thenExpr := condVal["then"]
-		elseExpr := condVal["else"]
-		if toBool(ifExpr) {
-			return evaluateExpression(doc, thenExpr)
-		}
-		return evaluateExpression(doc, elseExpr)
+		sub := cloneDocument(v)
+		excludePath(sub, parts[1:])
+		doc[parts[0]] = sub
 
 	case []interface{}:
-		// Format: [ <if>, <then>, <else> ]
-		if len(condVal) != 3 {
-			return nil
-		}
-		ifExpr := evaluateExpression(doc, condVal[0])
-		thenExpr := condVal[1]
-		elseExpr := condVal[2]
-		if toBool(ifExpr) {
-			return evaluateExpression(doc, thenExpr)
+		doc[parts[0]] = excludeArrayPath(v, parts[1:])
+	}
+}
+
+// excludeArrayPath applies excludePath to every embedded document of 'arr'.
+func excludeArrayPath(arr []interface{}, parts []string) []interface{} {
+	out := make([]interface{}, len(arr))
+	for i, elem := range arr {
+		switch e := elem.(type) {
+		case map[string]interface{}:
+			sub := cloneDocument(e)
+			excludePath(sub, parts)
+			out[i] = sub
+		case []interface{}:
+			out[i] = excludeArrayPath(e, parts)
+		default:
+			out[i] = elem
 		}
-		return evaluateExpression(doc, elseExpr)
 	}
-	return nil
+	return out
 }
 
 // ---------- Utility Functions ----------
@@ -427,21 +338,6 @@ func resolveField(doc map[string]interface{}, path string) interface{} {
 	return nil
 }
 
-func toBool(val interface{}) bool {
-	switch x := val.(type) {
-	case bool:
-		return x
-	case float64:
-		return x != 0
-	case nil:
-		return false
-	case string:
-		return x != ""
-	default:
-		return false
-	}
-}
-
 func (db *DB) validateProjectStage(params map[string]interface{}) error {
 
 	// For $project, each entry typically is 1, 0, or an expression. Minimal validation:
@@ -462,7 +358,13 @@ func (db *DB) validateProjectStage(params map[string]interface{}) error {
 		case bool:
 			// Sometimes boolean is used in projections as well, that’s fine
 		case map[string]interface{}:
-			// Expression-based projection, e.g. { "$concat": [...] }, you'd parse more deeply
+			// Expression-based projection, e.g. { "$concat": [...] }
+			if _, ok := sliceProjectionSpec(v); ok {
+				continue
+			}
+			if err := validateExpression(v); err != nil {
+				return fmt.Errorf("$project field %q: %w", field, err)
+			}
 		default:
 			return fmt.Errorf("$project field %q has unexpected type %T", field, v)
 		}
@@ -0,0 +1,56 @@
+package marco
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// replaceRootStage implements the $replaceRoot aggregation stage.
+// Each document is replaced by the value of the newRoot expression, which
+// must evaluate to an object:
+//
+//	{ "$replaceRoot": { "newRoot": "$address" } }
+//	{ "$replaceRoot": { "newRoot": { "$mergeObjects": [ { "qty": 0 }, "$$ROOT" ] } } }
+//
+// Returns:
+// - The replacement documents, in input order
+// - An error if newRoot does not evaluate to an object for some document
+func (db *DB) replaceRootStage(
+	ctx context.Context,
+	input []map[string]interface{},
+	params map[string]interface{},
+) ([]map[string]interface{}, error) {
+	newRoot := params["newRoot"]
+
+	results := make([]map[string]interface{}, 0, len(input))
+	for _, doc := range input {
+		value, err := db.evaluate(ctx, doc, newRoot)
+		if err != nil {
+			return nil, err
+		}
+		root, ok := value.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("newRoot must evaluate to an object, got %T", value)
+		}
+		results = append(results, root)
+	}
+	return results, nil
+}
+
+// validateReplaceRootStage checks that $replaceRoot has a valid newRoot expression.
+func (db *DB) validateReplaceRootStage(params map[string]interface{}) error {
+	newRoot, ok := params["newRoot"]
+	if !ok {
+		return errors.New("$replaceRoot requires a newRoot expression")
+	}
+	for field := range params {
+		if field != "newRoot" {
+			return fmt.Errorf("$replaceRoot has unknown field %q", field)
+		}
+	}
+	if err := validateExpression(newRoot); err != nil {
+		return fmt.Errorf("$replaceRoot newRoot: %w", err)
+	}
+	return nil
+}
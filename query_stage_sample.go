@@ -2,7 +2,6 @@ package marco
 
 import (
 	"errors"
-	"log"
 	"math"
 	"math/rand"
 	"time"
@@ -46,7 +45,7 @@ func (db *DB) sampleStage(
 	n := int(math.Max(0, math.Floor(size)))
 
 	if n == 0 {
-		log.Println("Warning: $sample size is 0, returning empty result")
+		db.logf(LogDebug, "$sample size is 0, returning empty result")
 		return []map[string]interface{}{}, nil
 	}
 
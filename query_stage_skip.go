@@ -2,8 +2,6 @@ package marco
 
 import (
 	"fmt"
-	"log"
-	"math"
 )
 
 // skipStage implements a document skipping operation similar to MongoDB's $skip stage
@@ -32,13 +30,13 @@ func (db *DB) skipStage(
 		skip, ok = toFloat64(params["value"])
 		if !ok {
 			// If no valid skip value is found, return original input
-			log.Println("Warning: No valid skip value provided")
+			db.logf(LogWarn, "No valid skip value provided")
 			return input
 		}
 	}
 
 	// Convert skip to integer, handling potential float values
-	n := int(math.Max(0, math.Floor(skip)))
+	n := documentCount(skip)
 
 	// If skip is greater than input length, return empty slice
 	if n > len(input) {
@@ -1,8 +1,10 @@
 package marco
 
 import (
+	"context"
 	"fmt"
 	"sort"
+	"strings"
 )
 
 // sortStage implements a document sorting operation similar to MongoDB's $sort stage
@@ -22,6 +24,7 @@ import (
 // - Handles both numeric and string comparisons
 // - Numeric values are prioritized over string comparisons
 // - Uses stable sorting to maintain relative order of equal elements
+// - Strings are ordered by the session collation, if any
 // - Sort direction: 1 for ascending, -1 for descending
 //
 // Examples:
@@ -29,6 +32,7 @@ import (
 // - First sort by amount in ascending order
 // - Then sort by name in descending order for items with equal amount
 func (db *DB) sortStage(
+	ctx context.Context,
 	input []map[string]interface{},
 	params map[string]interface{},
 ) []map[string]interface{} {
@@ -37,7 +41,20 @@ func (db *DB) sortStage(
 	copy(results, input)
 
 	// Use stable sort to maintain relative order of equal elements
+	less := db.sortLess(ctx, params)
 	sort.SliceStable(results, func(i, j int) bool {
+		return less(results[i], results[j])
+	})
+
+	return results
+}
+
+// sortLess returns the order of $sort 'params': whether document a sorts
+// before document b.
+func (db *DB) sortLess(ctx context.Context, params map[string]interface{}) func(a, b map[string]interface{}) bool {
+	collation := sessionCollation(ctx)
+
+	return func(a, b map[string]interface{}) bool {
 		// Iterate through sort fields in order
 		for field, direction := range params {
 			// Ensure sort direction is a valid numeric value
@@ -47,9 +64,10 @@ func (db *DB) sortStage(
 				continue
 			}
 
-			// Extract values for current field
-			iVal := results[i][field]
-			jVal := results[j][field]
+			// Extract values for current field; dotted paths such as
+			// "_id.city" address embedded documents
+			iVal := getNestedField(a, field)
+			jVal := getNestedField(b, field)
 
 			// Attempt to convert values to numeric for comparison
 			iNum, iOk := toFloat64(iVal)
@@ -71,22 +89,24 @@ func (db *DB) sortStage(
 			// Fallback to string comparison for non-numeric values
 			iStr := fmt.Sprintf("%v", iVal)
 			jStr := fmt.Sprintf("%v", jVal)
-			if iStr == jStr {
+			cmp := strings.Compare(iStr, jStr)
+			if collation != nil {
+				cmp = collation.compare(iStr, jStr)
+			}
+			if cmp == 0 {
 				// If string values are equal, continue to next sort field
 				continue
 			}
 			// Sort based on direction: 1 (ascending), -1 (descending)
 			if dirFloat == 1 {
-				return iStr < jStr
+				return cmp < 0
 			}
-			return iStr > jStr
+			return cmp > 0
 		}
 
 		// If no conclusive sorting is found, maintain stable ordering
 		return false
-	})
-
-	return results
+	}
 }
 
 func (db *DB) validateSortStage(params map[string]interface{}) error {
@@ -1,6 +1,7 @@
 package marco
 
 import (
+	"context"
 	"fmt"
 	"sort"
 	"strings"
@@ -10,6 +11,9 @@ import (
 // It groups documents by the specified expression, counts the number of documents in each group,
 // and sorts the results in descending order of the count.
 //
+// The expression can be a field path ("$tag", "$address.city") or any operator
+// expression understood by the shared expression engine, e.g. {"$toLower": "$tag"}.
+//
 // Parameters:
 // - input: Slice of documents to be processed
 // - params: A map containing the $sortByCount parameter
@@ -18,56 +22,90 @@ import (
 // - A slice of documents with '_id' as the group key and 'count' as the number of documents in each group
 // - An error if the stage parameters are invalid
 func (db *DB) sortByCountStage(
+	ctx context.Context,
 	input []map[string]interface{},
 	params map[string]interface{},
 ) ([]map[string]interface{}, error) {
 	// Extract the expression to group by
-	expr, ok := params["path"].(string)
-	if !ok || expr == "" {
-		return nil, fmt.Errorf("$sortByCount requires a non-empty 'path' parameter")
+	expr, err := sortByCountExpression(params)
+	if err != nil {
+		return nil, err
 	}
 
-	// Remove the leading '$' if present
-	expr = strings.TrimPrefix(expr, "$")
-
-	// Map to hold the count for each group
-	countMap := make(map[interface{}]int)
+	// Groups are kept in order of first appearance so that ties in the
+	// final sort are deterministic.
+	type countGroup struct {
+		value interface{}
+		count int
+	}
+	groups := make(map[interface{}]*countGroup)
+	var order []*countGroup
 
 	for _, doc := range input {
-		// Retrieve the value based on the expression
-		value, exists := doc[expr]
+		// Evaluate the expression; missing fields evaluate to nil
+		value, err := db.evaluate(ctx, doc, expr)
+		if err != nil {
+			return nil, err
+		}
+
+		// Maps and slices are not hashable, so group on a canonical key
+		key := groupKey(value)
+		group, exists := groups[key]
 		if !exists {
-			value = nil // Treat missing fields as nil
+			group = &countGroup{value: value}
+			groups[key] = group
+			order = append(order, group)
 		}
 
 		// Increment the count for this group
-		countMap[value]++
+		group.count++
 	}
 
+	// Sort the groups by count in descending order
+	sort.SliceStable(order, func(i, j int) bool {
+		return order[i].count > order[j].count
+	})
+
 	// Construct the result slice
-	result := make([]map[string]interface{}, 0, len(countMap))
-	for key, count := range countMap {
+	result := make([]map[string]interface{}, 0, len(order))
+	for _, group := range order {
 		result = append(result, map[string]interface{}{
-			"_id":   key,
-			"count": count,
+			"_id":   group.value,
+			"count": group.count,
 		})
 	}
 
-	// Sort the result by 'count' in descending order
-	sort.Slice(result, func(i, j int) bool {
-		// Ensure that 'count' is of type float64 for consistent comparison
-		countI, okI := toFloat64(result[i]["count"])
-		countJ, okJ := toFloat64(result[j]["count"])
-		if !okI || !okJ {
-			// Fallback to integer comparison if float conversion fails
-			intCountI, _ := result[i]["count"].(int)
-			intCountJ, _ := result[j]["count"].(int)
-			return intCountI > intCountJ
+	return result, nil
+}
+
+// sortByCountExpression extracts the grouping expression from the stage params.
+// A string argument is stored by the parser under "path"; an expression object
+// is stored as the params map itself.
+func sortByCountExpression(params map[string]interface{}) (interface{}, error) {
+	if path, ok := params["path"]; ok {
+		pathStr, ok := path.(string)
+		if !ok || strings.TrimSpace(pathStr) == "" {
+			return nil, fmt.Errorf("$sortByCount 'path' parameter must be a non-empty string")
 		}
-		return countI > countJ
-	})
+		// Bare field names are accepted for backwards compatibility
+		if !strings.HasPrefix(pathStr, "$") {
+			pathStr = "$" + pathStr
+		}
+		return pathStr, nil
+	}
 
-	return result, nil
+	if len(params) != 1 {
+		return nil, fmt.Errorf("$sortByCount expression object must have exactly one operator, got %d keys", len(params))
+	}
+	for op := range params {
+		if !strings.HasPrefix(op, "$") {
+			return nil, fmt.Errorf("$sortByCount expression object must be an operator expression, got key %q", op)
+		}
+	}
+	if err := validateExpression(params); err != nil {
+		return nil, fmt.Errorf("$sortByCount: %w", err)
+	}
+	return params, nil
 }
 
 // validateSortByCountStage validates the parameters for the $sortByCount stage.
@@ -78,19 +116,7 @@ func (db *DB) sortByCountStage(
 // Returns:
 // - An error if validation fails
 func (db *DB) validateSortByCountStage(params map[string]interface{}) error {
-	// Check if 'path' parameter exists
-	path, ok := params["path"]
-	if !ok {
-		return fmt.Errorf("$sortByCount stage requires a 'path' parameter")
-	}
-
-	// Ensure that 'path' is a non-empty string
-	pathStr, ok := path.(string)
-	if !ok || strings.TrimSpace(pathStr) == "" {
-		return fmt.Errorf("$sortByCount 'path' parameter must be a non-empty string")
-	}
-
-	// Optionally, further validation can be performed here (e.g., checking for valid field paths)
-
-	return nil
+	// Accept either a field path or a single operator expression
+	_, err := sortByCountExpression(params)
+	return err
 }
@@ -1,7 +1,6 @@
 package marco
 
 import (
-	"encoding/json"
 	"fmt"
 )
 
@@ -25,28 +24,27 @@ func (db *DB) unsetStage(
 		return nil, err
 	}
 
-	// Debug statement (optional)
-	b, _ := json.Marshal(fields)
-	fmt.Println("unset fields=", string(b))
-
 	// Create a copy of the input to avoid modifying the original slice
 	results := make([]map[string]interface{}, len(input))
 	for i, doc := range input {
-		// Create a shallow copy of the document
-		newDoc := make(map[string]interface{})
-		for k, v := range doc {
-			newDoc[k] = v
-		}
+		results[i] = unsetDocument(doc, fields)
+	}
 
-		// Remove the fields specified
-		for _, field := range fields {
-			delete(newDoc, field)
-		}
+	return results, nil
+}
 
-		results[i] = newDoc
+// unsetDocument returns a shallow copy of doc without 'fields'.
+func unsetDocument(doc map[string]interface{}, fields []string) map[string]interface{} {
+	newDoc := make(map[string]interface{})
+	for k, v := range doc {
+		newDoc[k] = v
 	}
 
-	return results, nil
+	// Remove the fields specified
+	for _, field := range fields {
+		delete(newDoc, field)
+	}
+	return newDoc
 }
 
 // validateUnsetStage ensures params is valid for the $unset operation.
@@ -63,8 +61,6 @@ func (db *DB) unsetStage(
 func (db *DB) validateUnsetStage(params interface{}) ([]string, error) {
 	var fields []string
 
-	fmt.Printf("DEBUG: validateUnsetStage called with params type: %T, value: %v\n", params, params)
-
 	switch v := params.(type) {
 	case string:
 		// Single field name
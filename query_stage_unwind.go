@@ -2,7 +2,6 @@ package marco
 
 import (
 	"fmt"
-	"log"
 	"strings"
 )
 
@@ -14,7 +13,7 @@ func (db *DB) unwindStage(
 	// Extract and normalize the path to unwind
 	pathParam, ok := params["path"].(string)
 	if !ok || pathParam == "" {
-		log.Println("Error: Invalid or missing path for $unwind")
+		db.logf(LogWarn, "Invalid or missing path for $unwind")
 		return input
 	}
 	path := strings.TrimPrefix(pathParam, "$")
@@ -27,87 +26,96 @@ func (db *DB) unwindStage(
 
 	// Iterate through each input document
 	for _, doc := range input {
-		arrayToUnwind, exists := doc[path]
+		results = unwindDocument(results, doc, path, preserveNullAndEmptyArrays, includeArrayIndexField)
+	}
+
+	return results
+}
+
+// unwindDocument appends to results the documents $unwind outputs for doc.
+func unwindDocument(results []map[string]interface{}, doc map[string]interface{}, path string, preserveNullAndEmptyArrays bool, includeArrayIndexField string) []map[string]interface{} {
+	arrayToUnwind, exists := doc[path]
+
+	// If the field doesn't exist or is nil:
+	// - If preserveNullAndEmptyArrays is true, keep the original doc as-is.
+	// - Otherwise, skip the doc (same as original code).
+	if !exists || arrayToUnwind == nil {
+		if preserveNullAndEmptyArrays {
+			// Pass the original document through unchanged
+			results = append(results, doc)
+		}
+		return results
+	}
+
+	// Handle array types. If arrayToUnwind is not an array, treat it as a single item.
+	switch arr := arrayToUnwind.(type) {
 
-		// If the field doesn't exist or is nil:
-		// - If preserveNullAndEmptyArrays is true, keep the original doc as-is.
-		// - Otherwise, skip the doc (same as original code).
-		if !exists || arrayToUnwind == nil {
+	// 1) If it's a []map[string]interface{}
+	case []map[string]interface{}:
+		// If empty array, decide based on preserveNullAndEmptyArrays
+		if len(arr) == 0 {
 			if preserveNullAndEmptyArrays {
-				// Pass the original document through unchanged
+				// Pass the original doc as-is
 				results = append(results, doc)
 			}
-			continue
+			return results
 		}
 
-		// Handle array types. If arrayToUnwind is not an array, treat it as a single item.
-		switch arr := arrayToUnwind.(type) {
-
-		// 1) If it's a []map[string]interface{}
-		case []map[string]interface{}:
-			// If empty array, decide based on preserveNullAndEmptyArrays
-			if len(arr) == 0 {
-				if preserveNullAndEmptyArrays {
-					// Pass the original doc as-is
-					results = append(results, doc)
-				}
-				continue
-			}
-
-			// Process each element
-			for idx, itemMap := range arr {
-				newDoc := cloneDocument(doc)
-				newDoc[path] = itemMap
+		// Process each element
+		for idx, itemMap := range arr {
+			newDoc := cloneDocument(doc)
+			newDoc[path] = itemMap
 
-				// If includeArrayIndexField is specified, add the index
-				if includeArrayIndexField != "" {
-					newDoc[includeArrayIndexField] = idx
-				}
-				results = append(results, newDoc)
+			// If includeArrayIndexField is specified, add the index
+			if includeArrayIndexField != "" {
+				newDoc[includeArrayIndexField] = idx
 			}
+			results = append(results, newDoc)
+		}
 
-		// 2) If it's a []interface{}
-		case []interface{}:
-			// If empty array, handle preserveNullAndEmptyArrays
-			if len(arr) == 0 {
-				if preserveNullAndEmptyArrays {
-					results = append(results, doc)
-				}
-				continue
+	// 2) If it's a []interface{}
+	case []interface{}:
+		// If empty array, handle preserveNullAndEmptyArrays
+		if len(arr) == 0 {
+			if preserveNullAndEmptyArrays {
+				results = append(results, doc)
 			}
+			return results
+		}
 
-			for idx, item := range arr {
-				itemMap, ok := item.(map[string]interface{})
-				if !ok {
-					// If item can’t be converted to map, wrap it under "value" key
-					itemMap = map[string]interface{}{"value": item}
-				}
-
-				newDoc := cloneDocument(doc)
-				newDoc[path] = itemMap
-
-				// Optionally include the array index
-				if includeArrayIndexField != "" {
-					newDoc[includeArrayIndexField] = idx
-				}
-				results = append(results, newDoc)
+		for idx, item := range arr {
+			itemMap, ok := item.(map[string]interface{})
+			if !ok {
+				// If item can’t be converted to map, wrap it under "value" key
+				itemMap = map[string]interface{}{"value": item}
 			}
 
-		// 3) If it's not a slice at all, treat it like a single item (like MongoDB does).
-		default:
-			// For a single value, if preserveNullAndEmptyArrays is on, that doc remains with a single unwound item.
 			newDoc := cloneDocument(doc)
-			newDoc[path] = arr
-			// No index is relevant because it's not actually an array
+			newDoc[path] = itemMap
+
+			// Optionally include the array index
+			if includeArrayIndexField != "" {
+				newDoc[includeArrayIndexField] = idx
+			}
 			results = append(results, newDoc)
 		}
-	}
 
+	// 3) If it's not a slice at all, treat it like a single item (like MongoDB does).
+	default:
+		// For a single value, if preserveNullAndEmptyArrays is on, that doc remains with a single unwound item.
+		newDoc := cloneDocument(doc)
+		newDoc[path] = arr
+		// No index is relevant because it's not actually an array
+		results = append(results, newDoc)
+	}
 	return results
 }
 
-// cloneDocument is a helper that copies the original map to avoid mutation issues.
-// (Alternative: you could do a deep copy if there are nested maps, but shallow clone may suffice.)
+// cloneDocument returns a shallow copy of a document, whose fields can be set
+// or deleted without changing the original. Stages are copy-on-write: the
+// embedded documents and arrays are shared with the original and are copied
+// before being modified (see setPath), never changed in place. Use
+// deepCopyDocument for a copy sharing nothing.
 func cloneDocument(original map[string]interface{}) map[string]interface{} {
 	newDoc := make(map[string]interface{}, len(original))
 	for k, v := range original {
@@ -0,0 +1,139 @@
+package marco
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/dgraph-io/badger/v3"
+)
+
+// schemaValidationStage implements the $validate aggregation stage. It checks
+// each input document against a schema and outputs one document per violation
+// instead of the data, so data-quality reports run as regular pipelines:
+//
+//	[{"$validate": {"include": ["_id", "email"]}},
+//	 {"$group": {"_id": "$rule", "count": {"$sum": 1}}}]
+//
+// The schema is the inline "schema" parameter or, without one, the schema of
+// the queried collection (see SetCollectionSchema). Each violation document
+// has the fields:
+//
+//   - document: the fields listed in "include" of the invalid document
+//     (its "_id" by default)
+//   - path: dotted path of the invalid value, "" for the document itself
+//   - rule: the schema keyword that failed, e.g. "required" or "bsonType"
+//   - message: a readable description
+//
+// Parameters:
+// - input: Slice of documents to be checked
+// - params: A map with the optional "schema" and "include" parameters
+//
+// Returns:
+// - The violation documents, in input order
+// - An error if there is no schema to check against
+func (db *DB) schemaValidationStage(
+	ctx context.Context,
+	input []map[string]interface{},
+	params map[string]interface{},
+) ([]map[string]interface{}, error) {
+	schema, _ := params["schema"].(map[string]interface{})
+	if schema == nil {
+		var err error
+		if schema, err = db.querySchema(ctx); err != nil {
+			return nil, err
+		}
+	}
+
+	include := []string{"_id"}
+	if raw, ok := params["include"].([]interface{}); ok {
+		include = include[:0]
+		for _, field := range raw {
+			include = append(include, field.(string))
+		}
+	}
+
+	var output []map[string]interface{}
+	for _, doc := range input {
+		var violations []SchemaViolation
+		checkSchema(schema, doc, "", &violations)
+		if len(violations) == 0 {
+			continue
+		}
+
+		identity := make(map[string]interface{})
+		for _, field := range include {
+			if value, exists := getNestedFieldExists(doc, field); exists {
+				setPath(identity, strings.Split(field, "."), value)
+			}
+		}
+		for _, violation := range violations {
+			output = append(output, map[string]interface{}{
+				"document": cloneDocument(identity),
+				"path":     violation.Path,
+				"rule":     violation.Rule,
+				"message":  violation.Message,
+			})
+		}
+	}
+	return output, nil
+}
+
+// querySchema returns the schema of the collection queried in ctx, read in
+// the query's transaction.
+func (db *DB) querySchema(ctx context.Context) (map[string]interface{}, error) {
+	collection := queryCollection(ctx)
+	if collection == "" {
+		return nil, fmt.Errorf("$validate without a schema can only run in a query")
+	}
+
+	var schema map[string]interface{}
+	var found bool
+	read := func(txn *badger.Txn) error {
+		var err error
+		found, err = collectionMetaField(txn, collection, "schema", &schema)
+		return err
+	}
+	var err error
+	if snapshot, ok := ctx.Value(querySnapshotKey{}).(*querySnapshot); ok {
+		err = snapshot.view(db, read)
+	} else {
+		err = db.db.View(read)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, fmt.Errorf("collection %s has no schema; set one with SetCollectionSchema or pass \"schema\"", collection)
+	}
+	return schema, nil
+}
+
+// validateSchemaValidationStage checks the parameters of a $validate stage.
+func (db *DB) validateSchemaValidationStage(params map[string]interface{}) error {
+	for key, value := range params {
+		switch key {
+		case "schema":
+			schema, ok := value.(map[string]interface{})
+			if !ok {
+				return fmt.Errorf("$validate schema must be an object")
+			}
+			if err := validateSchemaDefinition(schema, ""); err != nil {
+				return fmt.Errorf("$validate schema: %w", err)
+			}
+		case "include":
+			fields, ok := value.([]interface{})
+			if !ok {
+				return fmt.Errorf("$validate include must be an array of field paths")
+			}
+			for _, field := range fields {
+				if name, ok := field.(string); !ok || name == "" {
+					return fmt.Errorf("$validate include must be an array of field paths")
+				}
+			}
+		default:
+			return fmt.Errorf("$validate: unknown parameter %q", key)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,126 @@
+package marco
+
+import "time"
+
+// QueryOptions tunes a single QueryWithOptions call.
+type QueryOptions struct {
+	// TraceDocs records up to TraceDocs documents entering and leaving each
+	// stage in the returned QueryStats, to see where a pipeline loses
+	// documents. Tracing runs every stage as written: shortcuts such as the
+	// streamed $match/$sort/$limit scan and the $lookup+$unwind join are
+	// disabled.
+	TraceDocs int
+
+	// IncludeArchived also runs the pipeline over the documents moved to the
+	// archive tier of the queried collection (see ArchiveCollection). This
+	// decompresses every archive segment and disables the streamed scan.
+	// Collections joined by $lookup are read without their archive.
+	IncludeArchived bool
+
+	// Isolation selects how the query reads its collections: in a single
+	// read transaction by default, or one transaction per collection.
+	Isolation QueryIsolation
+
+	// ProfileExpressions times the operators of one expression evaluation in
+	// ProfileExpressions, on average, and reports them in
+	// QueryStats.Expressions; 1 times every evaluation. Zero disables
+	// profiling.
+	ProfileExpressions int
+
+	// Engine selects the execution engine of the query; EngineDefault uses
+	// the engine of the database.
+	Engine ExecutionEngine
+
+	// AllowDiskUse lets $sort and $group move what they hold to temporary
+	// keys of the database once it exceeds SpillThreshold documents or
+	// groups, so that aggregations larger than memory complete. $sort writes
+	// sorted runs merged as its output is read, with the optimized engine;
+	// $group writes the documents of the groups beyond the threshold, which
+	// are output after the others. The keys are deleted when the query
+	// completes.
+	AllowDiskUse bool
+
+	// SpillThreshold is the number of documents a $sort, or of groups a
+	// $group, holds in memory with AllowDiskUse. Zero means 100000.
+	SpillThreshold int
+
+	// MemoryLimit is the number of bytes the buffering stages of the query
+	// may hold, see SetQueryMemoryLimit. Zero uses the limit of the
+	// database; a negative limit disables it.
+	MemoryLimit int64
+}
+
+// QueryIsolation selects how a query reads the collections it uses.
+type QueryIsolation int
+
+const (
+	// SnapshotIsolation reads every collection of the query in one read
+	// transaction, held until the query completes, so the results reflect a
+	// single point in time. An open read transaction keeps Badger from
+	// discarding the versions it can see, which grows the LSM tree while
+	// long pipelines run.
+	SnapshotIsolation QueryIsolation = iota
+
+	// ReadCommitted reads each collection in its own short read transaction.
+	// Every collection is consistent on its own, but a collection joined by
+	// $lookup may reflect writes committed after the queried collection was
+	// read. Meant for long pipelines where holding a snapshot is undesirable.
+	ReadCommitted
+)
+
+// String returns "snapshot" or "readCommitted".
+func (i QueryIsolation) String() string {
+	if i == ReadCommitted {
+		return "readCommitted"
+	}
+	return "snapshot"
+}
+
+// QueryStats describes how a query was executed.
+type QueryStats struct {
+	Collection   string
+	DocsLoaded   int             // documents read from the queried collection
+	DocsScreened int             // documents skipped undecoded, as they can't match the leading $match
+	DocsSpilled  int             // documents written to disk with QueryOptions.AllowDiskUse
+	Duration     time.Duration   // total execution time, parsing included
+	Shortcut     string          // "windowedScan", "indexScan" or "keyCount" when a scan ran instead of the stages
+	Stages       []StageStats    // stages in execution order; stages after an empty result are not run
+	Engine       ExecutionEngine // engine that ran the query, see QueryOptions.Engine
+
+	// Isolation is the isolation the collections were read with, and
+	// SnapshotHeld how long the query held its read transaction (zero with
+	// ReadCommitted).
+	Isolation    QueryIsolation
+	SnapshotHeld time.Duration
+
+	// With QueryOptions.ProfileExpressions, the time spent in each
+	// expression operator, the most expensive first.
+	Expressions []ExpressionStats
+}
+
+// StageStats describes the execution of one stage. The optimized engine
+// streams documents through consecutive stages: a stage only reads the
+// documents the following stages ask for, e.g. up to a $limit.
+type StageStats struct {
+	Index    int    // position of the stage in the pipeline
+	Stage    string // stage name, "$lookup+$unwind" for the fused join
+	DocsIn   int
+	DocsOut  int
+	Duration time.Duration
+
+	// With QueryOptions.TraceDocs, copies of the first documents entering
+	// and leaving the stage.
+	Input  []map[string]interface{}
+	Output []map[string]interface{}
+}
+
+// traceDocuments returns copies of the first n documents.
+func traceDocuments(docs []map[string]interface{}, n int) []map[string]interface{} {
+	if n <= 0 {
+		return nil
+	}
+	if len(docs) < n {
+		n = len(docs)
+	}
+	return cloneDocuments(docs[:n])
+}
@@ -0,0 +1,75 @@
+package marco
+
+import (
+	"context"
+)
+
+// WherePredicate is a Go function usable from $match through the $where
+// operator. It receives the document being matched and reports whether it
+// passes the filter. The document must not be modified.
+type WherePredicate func(doc map[string]interface{}) bool
+
+// WherePredicateContext is a WherePredicate that also receives the context of
+// the query (see QueryContext), e.g. to read the tenant of the caller.
+type WherePredicateContext func(ctx context.Context, doc map[string]interface{}) bool
+
+// RegisterWhere makes 'predicate' available to queries under 'name':
+//
+//	db.RegisterWhere("isVip", func(doc map[string]interface{}) bool {
+//		spent, _ := doc["spent"].(float64)
+//		return spent > 10000
+//	})
+//
+//	db.Query("customers", `[{"$match": {"$where": "isVip"}}]`)
+//
+// Registering a name again replaces the previous predicate; a nil predicate
+// removes it. JavaScript function bodies are not supported.
+func (db *DB) RegisterWhere(name string, predicate WherePredicate) {
+	if predicate == nil {
+		db.RegisterWhereContext(name, nil)
+		return
+	}
+	db.RegisterWhereContext(name, func(_ context.Context, doc map[string]interface{}) bool {
+		return predicate(doc)
+	})
+}
+
+// RegisterWhereContext is RegisterWhere for predicates that need the context
+// of the query.
+func (db *DB) RegisterWhereContext(name string, predicate WherePredicateContext) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if predicate == nil {
+		delete(db.wherePredicates, name)
+		return
+	}
+	if db.wherePredicates == nil {
+		db.wherePredicates = make(map[string]WherePredicateContext)
+	}
+	db.wherePredicates[name] = predicate
+}
+
+// wherePredicate returns the predicate registered under 'name', or nil.
+func (db *DB) wherePredicate(name string) WherePredicateContext {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return db.wherePredicates[name]
+}
+
+// evaluateWhere runs the $where predicate named by 'val' against doc.
+// Unknown predicates never match; strict mode rejects them when the pipeline
+// is parsed, see checkStrictMatch.
+func (db *DB) evaluateWhere(ctx context.Context, doc map[string]interface{}, val interface{}) bool {
+	name, ok := val.(string)
+	if !ok {
+		db.logf(LogWarn, "$where expects a predicate name, got %T", val)
+		return false
+	}
+	predicate := db.wherePredicate(name)
+	if predicate == nil {
+		db.logf(LogWarn, "$where predicate %q is not registered", name)
+		return false
+	}
+	return predicate(ctx, doc)
+}
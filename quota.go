@@ -0,0 +1,218 @@
+package marco
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/dgraph-io/badger/v3"
+)
+
+// A collection quota caps the number of documents of a collection and the
+// bytes they take, so one tenant cannot fill the disk of a shared database.
+//
+// While a collection has a quota, its usage is kept in a counter updated by
+// every write, under a collection-scoped system key:
+//
+//	systemKeyPrefix + "usage:" + collection + "\x00"
+//
+// Put fails with a *QuotaExceededError when the write would take the usage
+// past the quota. Quotas are soft: writes that do not grow the usage (deletes,
+// overwrites with smaller documents) always succeed, so a collection already
+// over its quota, e.g. after the quota was lowered, can be brought back under.
+
+func init() {
+	registerCollectionKeyKind("usage")
+}
+
+// ErrQuotaExceeded is matched by errors.Is for every *QuotaExceededError.
+var ErrQuotaExceeded = errors.New("quota exceeded")
+
+// CollectionQuota limits the size of a collection. Zero fields are unlimited.
+type CollectionQuota struct {
+	MaxDocuments int64 `json:"maxDocuments,omitempty"`
+	MaxBytes     int64 `json:"maxBytes,omitempty"` // encoded size of the documents
+}
+
+// CollectionUsage is the current size of a collection.
+type CollectionUsage struct {
+	Documents int64 `json:"documents"`
+	Bytes     int64 `json:"bytes"`
+
+	// Quota is the quota of the collection, zero if it has none.
+	Quota CollectionQuota `json:"-"`
+}
+
+// QuotaExceededError is returned by writes rejected by a collection quota.
+type QuotaExceededError struct {
+	Collection string
+	Limit      string // "documents" or "bytes"
+	Max        int64  // the quota
+	Usage      int64  // the usage the write would have reached
+}
+
+func (e *QuotaExceededError) Error() string {
+	return fmt.Sprintf("quota exceeded: collection %s would hold %d %s, more than its quota of %d",
+		e.Collection, e.Usage, e.Limit, e.Max)
+}
+
+// Unwrap makes errors.Is(err, ErrQuotaExceeded) true.
+func (e *QuotaExceededError) Unwrap() error {
+	return ErrQuotaExceeded
+}
+
+// SetCollectionQuota sets the quota of a collection, stored in its metadata,
+// and counts its current usage. Documents already over the quota are kept.
+func (db *DB) SetCollectionQuota(collection string, quota CollectionQuota) error {
+	if err := validateCollectionName(collection); err != nil {
+		return err
+	}
+	if quota.MaxDocuments < 0 || quota.MaxBytes < 0 {
+		return fmt.Errorf("quota of collection %s must not be negative", collection)
+	}
+	if quota == (CollectionQuota{}) {
+		return db.RemoveCollectionQuota(collection)
+	}
+
+	// Count the usage in the transaction enabling the quota, so that no
+	// write is missed by the counter
+	return db.update(func(txn *badger.Txn) error {
+		var usage CollectionUsage
+		if err := db.forEachDocumentInTxn(txn, collection, func(_ map[string]interface{}, size int) (bool, error) {
+			usage.Documents++
+			usage.Bytes += int64(size)
+			return true, nil
+		}); err != nil {
+			return err
+		}
+		if err := writeCollectionUsage(txn, collection, usage); err != nil {
+			return err
+		}
+
+		meta, err := readCollectionMeta(txn, collection)
+		if err != nil {
+			return err
+		}
+		meta["quota"] = quota
+		return writeCollectionMeta(txn, collection, meta)
+	})
+}
+
+// RemoveCollectionQuota removes the quota of a collection and stops counting
+// its usage.
+func (db *DB) RemoveCollectionQuota(collection string) error {
+	if err := validateCollectionName(collection); err != nil {
+		return err
+	}
+	return db.update(func(txn *badger.Txn) error {
+		meta, err := readCollectionMeta(txn, collection)
+		if err != nil {
+			return err
+		}
+		delete(meta, "quota")
+		if err := writeCollectionMeta(txn, collection, meta); err != nil {
+			return err
+		}
+		return txn.Delete(collectionSystemPrefix("usage", collection))
+	})
+}
+
+// CollectionUsage returns the current usage of a collection with its quota.
+// The usage of a collection with a quota is read from its counter; the
+// others are scanned.
+func (db *DB) CollectionUsage(collection string) (CollectionUsage, error) {
+	var usage CollectionUsage
+	err := db.db.View(func(txn *badger.Txn) error {
+		var quota CollectionQuota
+		found, err := collectionMetaField(txn, collection, "quota", &quota)
+		if err != nil {
+			return err
+		}
+		if found {
+			usage, err = readCollectionUsage(txn, collection)
+			usage.Quota = quota
+			return err
+		}
+		return db.forEachDocumentInTxn(txn, collection, func(_ map[string]interface{}, size int) (bool, error) {
+			usage.Documents++
+			usage.Bytes += int64(size)
+			return true, nil
+		})
+	})
+	return usage, err
+}
+
+// chargeQuota adds the write of a value of newSize bytes at primaryKey, or its
+// deletion when newSize is negative, to the usage of a collection with a
+// quota. It must run in the transaction of the write, before it. It fails with
+// a *QuotaExceededError if the write grows the usage past the quota.
+// Collections without a quota are not tracked.
+func chargeQuota(txn *badger.Txn, collection string, primaryKey []byte, newSize int) error {
+	var quota CollectionQuota
+	found, err := collectionMetaField(txn, collection, "quota", &quota)
+	if err != nil || !found {
+		return err
+	}
+
+	var documents, bytes int64
+	item, err := txn.Get(primaryKey)
+	switch {
+	case err == nil:
+		// ValueSize is only an estimate for large values; the counter must
+		// not drift, so read the value
+		if err := item.Value(func(val []byte) error {
+			bytes -= int64(storedSize(val))
+			return nil
+		}); err != nil {
+			return err
+		}
+		documents--
+	case err != badger.ErrKeyNotFound:
+		return err
+	}
+	if newSize >= 0 {
+		documents++
+		bytes += int64(newSize)
+	}
+	if documents == 0 && bytes == 0 {
+		return nil
+	}
+
+	usage, err := readCollectionUsage(txn, collection)
+	if err != nil {
+		return err
+	}
+	usage.Documents += documents
+	usage.Bytes += bytes
+
+	if documents > 0 && quota.MaxDocuments > 0 && usage.Documents > quota.MaxDocuments {
+		return &QuotaExceededError{Collection: collection, Limit: "documents", Max: quota.MaxDocuments, Usage: usage.Documents}
+	}
+	if bytes > 0 && quota.MaxBytes > 0 && usage.Bytes > quota.MaxBytes {
+		return &QuotaExceededError{Collection: collection, Limit: "bytes", Max: quota.MaxBytes, Usage: usage.Bytes}
+	}
+	return writeCollectionUsage(txn, collection, usage)
+}
+
+func readCollectionUsage(txn *badger.Txn, collection string) (CollectionUsage, error) {
+	var usage CollectionUsage
+	item, err := txn.Get(collectionSystemPrefix("usage", collection))
+	if err == badger.ErrKeyNotFound {
+		return usage, nil
+	}
+	if err != nil {
+		return usage, err
+	}
+	err = item.Value(func(val []byte) error {
+		return json.Unmarshal(val, &usage)
+	})
+	return usage, err
+}
+
+func writeCollectionUsage(txn *badger.Txn, collection string, usage CollectionUsage) error {
+	val, err := json.Marshal(usage)
+	if err != nil {
+		return err
+	}
+	return txn.Set(collectionSystemPrefix("usage", collection), val)
+}
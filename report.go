@@ -0,0 +1,72 @@
+package marco
+
+import (
+	"context"
+	htmltemplate "html/template"
+	"io"
+	"text/template"
+	"time"
+)
+
+// ReportOptions configures RunReportWithOptions.
+type ReportOptions struct {
+	// HTML renders with html/template, escaping the results for HTML
+	// output such as emailed reports. Otherwise text/template is used.
+	HTML bool
+
+	// Funcs are added to the functions available in the template.
+	Funcs map[string]interface{}
+
+	// Query tunes the query run for the report.
+	Query QueryOptions
+}
+
+// ReportData is the value a report template is executed with:
+//
+//	{{len .Results}} orders on {{.Generated.Format "2006-01-02"}}
+//	{{range .Results}}{{._id}}: {{.total}}
+//	{{end}}
+type ReportData struct {
+	Collection string
+	Results    []map[string]interface{}
+	Generated  time.Time
+	Stats      *QueryStats
+}
+
+// reportTemplate is what text/template and html/template templates share.
+type reportTemplate interface {
+	Execute(w io.Writer, data interface{}) error
+}
+
+// RunReport runs an aggregation pipeline on a collection and renders its
+// results with a text/template template into w. The template is parsed before
+// the query runs, so a broken template fails without querying.
+func (db *DB) RunReport(collectionName, mongoAggregationPipeline, templateText string, w io.Writer) error {
+	return db.RunReportWithOptions(context.Background(), collectionName, mongoAggregationPipeline, templateText, w, ReportOptions{})
+}
+
+// RunReportWithOptions is RunReport with a context and options, e.g. to render
+// HTML or to add template functions.
+func (db *DB) RunReportWithOptions(ctx context.Context, collectionName, mongoAggregationPipeline, templateText string, w io.Writer, opts ReportOptions) error {
+	var tmpl reportTemplate
+	var err error
+	if opts.HTML {
+		tmpl, err = htmltemplate.New(collectionName).Funcs(opts.Funcs).Parse(templateText)
+	} else {
+		tmpl, err = template.New(collectionName).Funcs(opts.Funcs).Parse(templateText)
+	}
+	if err != nil {
+		return err
+	}
+
+	results, stats, err := db.QueryWithOptions(ctx, collectionName, mongoAggregationPipeline, opts.Query)
+	if err != nil {
+		return err
+	}
+	return tmpl.Execute(w, ReportData{
+		Collection: collectionName,
+		Results:    results,
+		Generated:  time.Now(),
+		Stats:      stats,
+	})
+}
@@ -0,0 +1,112 @@
+package marco
+
+import (
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/dgraph-io/badger/v3"
+)
+
+// RetryPolicy controls how write transactions are retried when Badger
+// reports a conflict with a concurrent transaction (badger.ErrConflict).
+type RetryPolicy struct {
+	// MaxAttempts is the total number of attempts, including the first one.
+	// A value of 1 or less disables retries.
+	MaxAttempts int
+
+	// InitialBackoff is the delay before the second attempt.
+	InitialBackoff time.Duration
+
+	// MaxBackoff caps the delay between two attempts.
+	MaxBackoff time.Duration
+
+	// Multiplier is applied to the delay after every failed attempt.
+	// Values below 1 are treated as 1 (constant backoff).
+	Multiplier float64
+}
+
+// DefaultRetryPolicy is used by Open: up to 5 attempts with exponential
+// backoff starting at 2ms and capped at 100ms.
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts:    5,
+	InitialBackoff: 2 * time.Millisecond,
+	MaxBackoff:     100 * time.Millisecond,
+	Multiplier:     2,
+}
+
+// RetryError is returned when a write transaction still conflicts after all
+// attempts allowed by the RetryPolicy. It wraps the last error, so
+// errors.Is(err, badger.ErrConflict) keeps working.
+type RetryError struct {
+	Attempts int           // number of attempts made
+	Elapsed  time.Duration // total time spent, including backoff
+	Err      error         // error returned by the last attempt
+}
+
+func (e *RetryError) Error() string {
+	return fmt.Sprintf("transaction failed after %d attempts in %s: %v", e.Attempts, e.Elapsed, e.Err)
+}
+
+// Unwrap returns the error of the last attempt.
+func (e *RetryError) Unwrap() error {
+	return e.Err
+}
+
+// SetRetryPolicy replaces the retry policy used by every write path
+// (Put, Delete, DropCollection, ...).
+func (db *DB) SetRetryPolicy(policy RetryPolicy) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.retryPolicy = policy
+}
+
+// RetryPolicy returns the retry policy currently in use.
+func (db *DB) RetryPolicy() RetryPolicy {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return db.retryPolicy
+}
+
+// update runs fn in a read-write transaction, retrying it according to the
+// retry policy when the commit fails with badger.ErrConflict. fn may run
+// several times and must therefore not keep state between invocations.
+// In read-only mode it fails with ErrReadOnly.
+func (db *DB) update(fn func(txn *badger.Txn) error) error {
+	if db.ReadOnly() {
+		return ErrReadOnly
+	}
+	policy := db.RetryPolicy()
+	start := time.Now()
+	backoff := policy.InitialBackoff
+
+	for attempt := 1; ; attempt++ {
+		err := db.db.Update(fn)
+		if err != badger.ErrConflict {
+			return err
+		}
+		if attempt >= policy.MaxAttempts {
+			return &RetryError{Attempts: attempt, Elapsed: time.Since(start), Err: err}
+		}
+
+		// Sleep between half and the full backoff so that conflicting writers
+		// do not retry in lockstep.
+		if backoff > 0 {
+			time.Sleep(backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1)))
+		}
+		backoff = nextBackoff(backoff, policy)
+	}
+}
+
+// nextBackoff computes the delay before the next attempt.
+func nextBackoff(current time.Duration, policy RetryPolicy) time.Duration {
+	multiplier := policy.Multiplier
+	if multiplier < 1 {
+		multiplier = 1
+	}
+	next := time.Duration(float64(current) * multiplier)
+	if policy.MaxBackoff > 0 && next > policy.MaxBackoff {
+		next = policy.MaxBackoff
+	}
+	return next
+}
@@ -0,0 +1,350 @@
+package marco
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/dgraph-io/badger/v3"
+)
+
+// A collection schema describes the documents a collection is expected to
+// hold, in the $jsonSchema dialect of MongoDB:
+//
+//	{
+//		"bsonType": "object",
+//		"required": ["name", "email"],
+//		"properties": {
+//			"name":  {"bsonType": "string", "minLength": 1},
+//			"email": {"bsonType": "string", "pattern": "^[^@]+@[^@]+$"},
+//			"age":   {"bsonType": "int", "minimum": 0, "maximum": 150},
+//			"tags":  {"bsonType": "array", "items": {"bsonType": "string"}}
+//		},
+//		"additionalProperties": true
+//	}
+//
+// Supported keywords: bsonType, type, enum, required, properties,
+// additionalProperties, minProperties, maxProperties, minimum, maximum,
+// minLength, maxLength, pattern, items, minItems, maxItems, description and
+// title. The schema is stored in the collection metadata and checked by the
+// $validate stage; writes are not rejected.
+
+// SchemaViolation describes a value that does not satisfy a schema.
+type SchemaViolation struct {
+	Path    string // dotted path of the value, "" for the document itself
+	Rule    string // schema keyword that failed, e.g. "required" or "bsonType"
+	Message string
+}
+
+// schemaKeywords are the keywords accepted in schemas.
+var schemaKeywords = map[string]bool{
+	"bsonType": true, "type": true, "enum": true,
+	"required": true, "properties": true, "additionalProperties": true,
+	"minProperties": true, "maxProperties": true,
+	"minimum": true, "maximum": true,
+	"minLength": true, "maxLength": true, "pattern": true,
+	"items": true, "minItems": true, "maxItems": true,
+	"description": true, "title": true,
+}
+
+// jsonSchemaTypes maps the JSON Schema "type" names to type names of $type.
+var jsonSchemaTypes = map[string][]string{
+	"object":  {"object"},
+	"array":   {"array"},
+	"string":  {"string"},
+	"number":  {"number"},
+	"integer": {"int", "long"},
+	"boolean": {"bool"},
+	"null":    {"null"},
+}
+
+// SetCollectionSchema stores the schema of a collection in its metadata, after
+// checking that it is well formed. A nil schema removes it.
+func (db *DB) SetCollectionSchema(collection string, schema map[string]interface{}) error {
+	if schema == nil {
+		return db.setCollectionMetaField(collection, "schema", nil)
+	}
+	if err := validateSchemaDefinition(schema, ""); err != nil {
+		return fmt.Errorf("invalid schema for collection %s: %w", collection, err)
+	}
+	return db.setCollectionMetaField(collection, "schema", schema)
+}
+
+// CollectionSchema returns the schema of a collection; the second result is
+// false if the collection has none.
+func (db *DB) CollectionSchema(collection string) (map[string]interface{}, bool, error) {
+	var schema map[string]interface{}
+	var found bool
+	err := db.db.View(func(txn *badger.Txn) error {
+		var err error
+		found, err = collectionMetaField(txn, collection, "schema", &schema)
+		return err
+	})
+	return schema, found, err
+}
+
+// validateSchemaDefinition checks the keywords of a schema and of its
+// sub-schemas; path locates the schema in error messages.
+func validateSchemaDefinition(schema map[string]interface{}, path string) error {
+	at := ""
+	if path != "" {
+		at = " at " + path
+	}
+
+	for keyword, value := range schema {
+		if !schemaKeywords[keyword] {
+			return fmt.Errorf("unknown schema keyword %q%s", keyword, at)
+		}
+
+		switch keyword {
+		case "bsonType":
+			if _, err := typeSpecNames(value); err != nil {
+				return fmt.Errorf("bsonType%s: %w", at, err)
+			}
+		case "type":
+			if _, err := jsonSchemaTypeNames(value); err != nil {
+				return fmt.Errorf("type%s: %w", at, err)
+			}
+		case "enum":
+			if values, ok := value.([]interface{}); !ok || len(values) == 0 {
+				return fmt.Errorf("enum%s must be a non-empty array", at)
+			}
+		case "required":
+			names, ok := value.([]interface{})
+			if !ok {
+				return fmt.Errorf("required%s must be an array of field names", at)
+			}
+			for _, name := range names {
+				if _, ok := name.(string); !ok {
+					return fmt.Errorf("required%s must be an array of field names", at)
+				}
+			}
+		case "properties":
+			properties, ok := value.(map[string]interface{})
+			if !ok {
+				return fmt.Errorf("properties%s must be an object", at)
+			}
+			for name, sub := range properties {
+				subSchema, ok := sub.(map[string]interface{})
+				if !ok {
+					return fmt.Errorf("property %q%s must be a schema", name, at)
+				}
+				if err := validateSchemaDefinition(subSchema, joinSchemaPath(path, name)); err != nil {
+					return err
+				}
+			}
+		case "additionalProperties":
+			switch v := value.(type) {
+			case bool:
+			case map[string]interface{}:
+				if err := validateSchemaDefinition(v, joinSchemaPath(path, "*")); err != nil {
+					return err
+				}
+			default:
+				return fmt.Errorf("additionalProperties%s must be a boolean or a schema", at)
+			}
+		case "items":
+			items, ok := value.(map[string]interface{})
+			if !ok {
+				return fmt.Errorf("items%s must be a schema", at)
+			}
+			if err := validateSchemaDefinition(items, path+"[]"); err != nil {
+				return err
+			}
+		case "minimum", "maximum":
+			if _, ok := toFloat64(value); !ok {
+				return fmt.Errorf("%s%s must be a number", keyword, at)
+			}
+		case "minLength", "maxLength", "minItems", "maxItems", "minProperties", "maxProperties":
+			if n, ok := toInteger(value); !ok || n < 0 {
+				return fmt.Errorf("%s%s must be a non-negative integer", keyword, at)
+			}
+		case "pattern":
+			pattern, ok := value.(string)
+			if !ok {
+				return fmt.Errorf("pattern%s must be a string", at)
+			}
+			if _, err := regexCache.get(pattern, ""); err != nil {
+				return fmt.Errorf("pattern%s: %w", at, err)
+			}
+		case "description", "title":
+			if _, ok := value.(string); !ok {
+				return fmt.Errorf("%s%s must be a string", keyword, at)
+			}
+		}
+	}
+	return nil
+}
+
+// jsonSchemaTypeNames converts the "type" keyword, a name or an array of
+// names, into type names of $type.
+func jsonSchemaTypeNames(spec interface{}) ([]string, error) {
+	var names []string
+	switch v := spec.(type) {
+	case string:
+		types, ok := jsonSchemaTypes[v]
+		if !ok {
+			return nil, fmt.Errorf("unknown type %q", v)
+		}
+		return types, nil
+	case []interface{}:
+		for _, elem := range v {
+			name, ok := elem.(string)
+			if !ok {
+				return nil, fmt.Errorf("type must be a name or an array of names")
+			}
+			types, ok := jsonSchemaTypes[name]
+			if !ok {
+				return nil, fmt.Errorf("unknown type %q", name)
+			}
+			names = append(names, types...)
+		}
+		if len(names) == 0 {
+			return nil, fmt.Errorf("type array must not be empty")
+		}
+		return names, nil
+	default:
+		return nil, fmt.Errorf("type must be a name or an array of names, got %T", spec)
+	}
+}
+
+// checkSchema appends to violations the ways value, found at path, does not
+// satisfy schema. The schema must have been checked by validateSchemaDefinition.
+func checkSchema(schema map[string]interface{}, value interface{}, path string, violations *[]SchemaViolation) {
+	fail := func(rule, format string, args ...interface{}) {
+		*violations = append(*violations, SchemaViolation{Path: path, Rule: rule, Message: fmt.Sprintf(format, args...)})
+	}
+
+	if spec, ok := schema["bsonType"]; ok {
+		names, _ := typeSpecNames(spec)
+		if !matchesAnyType(value, names) {
+			fail("bsonType", "expected %s, got %s", strings.Join(names, " or "), schemaValueType(value))
+			return // the other keywords would only repeat the type mismatch
+		}
+	}
+	if spec, ok := schema["type"]; ok {
+		names, _ := jsonSchemaTypeNames(spec)
+		if !matchesAnyType(value, names) {
+			fail("type", "expected %s, got %s", strings.Join(names, " or "), schemaValueType(value))
+			return
+		}
+	}
+	if values, ok := schema["enum"].([]interface{}); ok {
+		found := false
+		for _, allowed := range values {
+			if valuesEqual(value, allowed) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			fail("enum", "value %v is not one of %v", value, values)
+		}
+	}
+
+	switch v := value.(type) {
+	case map[string]interface{}:
+		checkObjectSchema(schema, v, path, violations, fail)
+	case []interface{}:
+		if n, ok := toInteger(schema["minItems"]); ok && int64(len(v)) < n {
+			fail("minItems", "array has %d items, fewer than %d", len(v), n)
+		}
+		if n, ok := toInteger(schema["maxItems"]); ok && int64(len(v)) > n {
+			fail("maxItems", "array has %d items, more than %d", len(v), n)
+		}
+		if items, ok := schema["items"].(map[string]interface{}); ok {
+			for i, item := range v {
+				checkSchema(items, item, fmt.Sprintf("%s.%d", path, i), violations)
+			}
+		}
+	case string:
+		length := int64(len([]rune(v)))
+		if n, ok := toInteger(schema["minLength"]); ok && length < n {
+			fail("minLength", "string has %d characters, fewer than %d", length, n)
+		}
+		if n, ok := toInteger(schema["maxLength"]); ok && length > n {
+			fail("maxLength", "string has %d characters, more than %d", length, n)
+		}
+		if pattern, ok := schema["pattern"].(string); ok {
+			if matched, err := regexCache.matchString(pattern, "", v); err == nil && !matched {
+				fail("pattern", "string does not match %q", pattern)
+			}
+		}
+	default:
+		if n, isNumber := toFloat64(value); isNumber && value != nil {
+			if min, ok := toFloat64(schema["minimum"]); ok && n < min {
+				fail("minimum", "%v is less than %v", value, min)
+			}
+			if max, ok := toFloat64(schema["maximum"]); ok && n > max {
+				fail("maximum", "%v is greater than %v", value, max)
+			}
+		}
+	}
+}
+
+// checkObjectSchema checks the object keywords of schema against doc.
+func checkObjectSchema(schema map[string]interface{}, doc map[string]interface{}, path string, violations *[]SchemaViolation, fail func(rule, format string, args ...interface{})) {
+	if required, ok := schema["required"].([]interface{}); ok {
+		for _, raw := range required {
+			name, _ := raw.(string)
+			if _, present := doc[name]; !present {
+				*violations = append(*violations, SchemaViolation{
+					Path:    joinSchemaPath(path, name),
+					Rule:    "required",
+					Message: fmt.Sprintf("required field %q is missing", name),
+				})
+			}
+		}
+	}
+	if n, ok := toInteger(schema["minProperties"]); ok && int64(len(doc)) < n {
+		fail("minProperties", "object has %d fields, fewer than %d", len(doc), n)
+	}
+	if n, ok := toInteger(schema["maxProperties"]); ok && int64(len(doc)) > n {
+		fail("maxProperties", "object has %d fields, more than %d", len(doc), n)
+	}
+
+	properties, _ := schema["properties"].(map[string]interface{})
+	names := make([]string, 0, len(doc))
+	for name := range doc {
+		names = append(names, name)
+	}
+	sort.Strings(names) // report violations in a stable order
+
+	for _, name := range names {
+		fieldPath := joinSchemaPath(path, name)
+		if sub, ok := properties[name].(map[string]interface{}); ok {
+			checkSchema(sub, doc[name], fieldPath, violations)
+			continue
+		}
+		switch additional := schema["additionalProperties"].(type) {
+		case bool:
+			if !additional {
+				*violations = append(*violations, SchemaViolation{
+					Path:    fieldPath,
+					Rule:    "additionalProperties",
+					Message: fmt.Sprintf("field %q is not allowed", name),
+				})
+			}
+		case map[string]interface{}:
+			checkSchema(additional, doc[name], fieldPath, violations)
+		}
+	}
+}
+
+// schemaValueType names the type of a value in violation messages.
+func schemaValueType(value interface{}) string {
+	for _, name := range []string{"null", "bool", "string", "int", "long", "double", "decimal", "array", "object", "binData"} {
+		if matchesType(value, name) {
+			return name
+		}
+	}
+	return fmt.Sprintf("%T", value)
+}
+
+// joinSchemaPath appends a field name to a dotted path.
+func joinSchemaPath(path, name string) string {
+	if path == "" {
+		return name
+	}
+	return path + "." + name
+}
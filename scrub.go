@@ -0,0 +1,245 @@
+package marco
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/google/uuid"
+)
+
+// ScrubOptions configures Scrub.
+type ScrubOptions struct {
+	// Repair deletes dangling secondary keys and recreates missing ones.
+	// Without it Scrub only reports problems.
+	Repair bool
+
+	// BatchSize is the maximum number of keys fixed per transaction when
+	// repairing. Zero means DefaultBatchSize.
+	BatchSize int
+}
+
+// ScrubEntry identifies a document involved in a consistency problem.
+type ScrubEntry struct {
+	Collection string // collection of the document, empty if unknown
+	ID         string // document UUID
+}
+
+// ScrubReport summarizes a Scrub run.
+type ScrubReport struct {
+	Documents     int // primary keys scanned
+	SecondaryKeys int // secondary keys scanned
+
+	// Dangling lists secondary keys pointing at a document that does not exist.
+	Dangling []ScrubEntry
+
+	// Missing lists documents that have no secondary key, so GetID and graph
+	// traversal cannot find them.
+	Missing []ScrubEntry
+
+	// Conflicting lists documents whose UUID is also used in another collection;
+	// the secondary key points at the other document. These are never repaired.
+	Conflicting []ScrubEntry
+
+	// Repaired is the number of keys deleted or written when Repair is set.
+	// Keys made consistent by other writers since the scan are not repaired.
+	Repaired int
+}
+
+// Scrub verifies that every document has a secondary key pointing back at it
+// and that every secondary key points at an existing document. Put always
+// keeps both in sync, but writers going through db.Badger() may not.
+//
+// With ScrubOptions.Repair set, dangling secondary keys are deleted and missing
+// ones are recreated.
+func (db *DB) Scrub(opts ScrubOptions) (*ScrubReport, error) {
+	report := &ScrubReport{}
+
+	var danglingKeys [][]byte // secondary keys to delete
+	var missingKeys [][]byte  // primary keys needing a secondary key
+
+	err := db.db.View(func(txn *badger.Txn) error {
+		iterOpts := badger.DefaultIteratorOptions
+		iterOpts.PrefetchValues = false
+
+		it := txn.NewIterator(iterOpts)
+		defer it.Close()
+
+		for it.Rewind(); it.Valid(); it.Next() {
+			item := it.Item()
+			key := item.KeyCopy(nil)
+
+			switch {
+			case bytes.HasPrefix(key, []byte(systemKeyPrefix)):
+				continue
+
+			case db.keys.isSecondaryKey(key):
+				// Secondary key: UUID -> primary key
+				report.SecondaryKeys++
+				primaryKey, err := item.ValueCopy(nil)
+				if err != nil {
+					return err
+				}
+				if _, err := txn.Get(primaryKey); err == badger.ErrKeyNotFound {
+					collection, _ := db.keys.splitPrimaryKey(primaryKey)
+					report.Dangling = append(report.Dangling, ScrubEntry{Collection: collection, ID: uuidString(key)})
+					danglingKeys = append(danglingKeys, key)
+				} else if err != nil {
+					return err
+				}
+
+			default:
+				collection, uBytes := db.keys.splitPrimaryKey(key)
+				if uBytes == nil {
+					continue
+				}
+				report.Documents++
+
+				secondary, err := txn.Get(db.keys.secondaryKey(uBytes))
+				if err == badger.ErrKeyNotFound {
+					report.Missing = append(report.Missing, ScrubEntry{Collection: collection, ID: uuidString(uBytes)})
+					missingKeys = append(missingKeys, key)
+					continue
+				}
+				if err != nil {
+					return err
+				}
+				if err := secondary.Value(func(val []byte) error {
+					if !bytes.Equal(val, key) {
+						report.Conflicting = append(report.Conflicting, ScrubEntry{Collection: collection, ID: uuidString(uBytes)})
+					}
+					return nil
+				}); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if !opts.Repair {
+		return report, nil
+	}
+
+	batchSize := opts.BatchSize
+	if batchSize <= 0 {
+		batchSize = DefaultBatchSize
+	}
+
+	// Keys may have changed since the scan: each one is checked again in the
+	// transaction repairing it, and left alone if it is now consistent
+	for _, batch := range splitBatches(danglingKeys, batchSize) {
+		var repaired int
+		if err := db.update(func(txn *badger.Txn) error {
+			repaired = 0
+			for _, key := range batch {
+				dangling, err := secondaryKeyDangles(txn, key)
+				if err != nil {
+					return err
+				}
+				if !dangling {
+					continue
+				}
+				if err := txn.Delete(key); err != nil {
+					return err
+				}
+				repaired++
+			}
+			return nil
+		}); err != nil {
+			return report, fmt.Errorf("failed to delete dangling secondary keys: %w", err)
+		}
+		report.Repaired += repaired
+	}
+
+	for _, batch := range splitBatches(missingKeys, batchSize) {
+		var repaired int
+		if err := db.update(func(txn *badger.Txn) error {
+			repaired = 0
+			for _, primaryKey := range batch {
+				_, uBytes := db.keys.splitPrimaryKey(primaryKey)
+				secondaryKey := db.keys.secondaryKey(uBytes)
+				missing, err := secondaryKeyMissing(txn, primaryKey, secondaryKey)
+				if err != nil {
+					return err
+				}
+				if !missing {
+					continue
+				}
+				if err := txn.Set(secondaryKey, primaryKey); err != nil {
+					return err
+				}
+				repaired++
+			}
+			return nil
+		}); err != nil {
+			return report, fmt.Errorf("failed to recreate missing secondary keys: %w", err)
+		}
+		report.Repaired += repaired
+	}
+
+	return report, nil
+}
+
+// secondaryKeyDangles reports whether the secondary key 'key' exists in txn
+// and points at a document that does not.
+func secondaryKeyDangles(txn *badger.Txn, key []byte) (bool, error) {
+	item, err := txn.Get(key)
+	if err == badger.ErrKeyNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	primaryKey, err := item.ValueCopy(nil)
+	if err != nil {
+		return false, err
+	}
+	if _, err := txn.Get(primaryKey); err == badger.ErrKeyNotFound {
+		return true, nil
+	} else if err != nil {
+		return false, err
+	}
+	return false, nil
+}
+
+// secondaryKeyMissing reports whether the document at primaryKey exists in
+// txn without its secondary key.
+func secondaryKeyMissing(txn *badger.Txn, primaryKey, secondaryKey []byte) (bool, error) {
+	if _, err := txn.Get(primaryKey); err == badger.ErrKeyNotFound {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	if _, err := txn.Get(secondaryKey); err == badger.ErrKeyNotFound {
+		return true, nil
+	} else if err != nil {
+		return false, err
+	}
+	return false, nil
+}
+
+// splitBatches cuts keys into consecutive chunks of at most batchSize keys.
+func splitBatches(keys [][]byte, batchSize int) [][][]byte {
+	var batches [][][]byte
+	for len(keys) > batchSize {
+		batches = append(batches, keys[:batchSize])
+		keys = keys[batchSize:]
+	}
+	if len(keys) > 0 {
+		batches = append(batches, keys)
+	}
+	return batches
+}
+
+// uuidString formats a 16-byte binary UUID.
+func uuidString(b []byte) string {
+	u, err := uuid.FromBytes(b)
+	if err != nil {
+		return fmt.Sprintf("%x", b)
+	}
+	return u.String()
+}
@@ -0,0 +1,75 @@
+package marco
+
+import (
+	"testing"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/google/uuid"
+)
+
+// TestScrubRepairRechecksKeys checks the conditions the repair transactions
+// test before fixing a key, which a Put or Delete may have fixed since the
+// scan.
+func TestScrubRepairRechecksKeys(t *testing.T) {
+	db := openTestDB(t, nil)
+	id, err := db.Put("c", "", testDocument(t, `{"a": 1}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	u := uuid.MustParse(id)
+	primaryKey := db.keys.primaryKey("c", u[:])
+	secondaryKey := db.keys.secondaryKey(u[:])
+
+	check := func(wantDangling, wantMissing bool) {
+		t.Helper()
+		if err := db.db.View(func(txn *badger.Txn) error {
+			dangling, err := secondaryKeyDangles(txn, secondaryKey)
+			if err != nil {
+				return err
+			}
+			missing, err := secondaryKeyMissing(txn, primaryKey, secondaryKey)
+			if err != nil {
+				return err
+			}
+			if dangling != wantDangling || missing != wantMissing {
+				t.Errorf("dangling %v, missing %v, want %v, %v", dangling, missing, wantDangling, wantMissing)
+			}
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	check(false, false)
+
+	// A missing secondary key is recreated only while the document exists
+	deleteKey(t, db, secondaryKey)
+	check(false, true)
+	deleteKey(t, db, primaryKey)
+	check(false, false)
+
+	// A dangling secondary key is deleted only while the document is missing
+	if err := db.db.Update(func(txn *badger.Txn) error { return txn.Set(secondaryKey, primaryKey) }); err != nil {
+		t.Fatal(err)
+	}
+	check(true, false)
+	if _, err := db.Put("c", id, testDocument(t, `{"a": 2}`)); err != nil {
+		t.Fatal(err)
+	}
+	check(false, false)
+
+	report, err := db.Scrub(ScrubOptions{Repair: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Repaired != 0 {
+		t.Errorf("repaired %d keys of a consistent database", report.Repaired)
+	}
+}
+
+// deleteKey deletes a key behind the back of marco.
+func deleteKey(t *testing.T, db *DB, key []byte) {
+	t.Helper()
+	if err := db.db.Update(func(txn *badger.Txn) error { return txn.Delete(key) }); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,193 @@
+package marco
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// SessionOptions are defaults shared by the queries of a session, typically
+// the settings of one request or user.
+type SessionOptions struct {
+	// Timezone is the timezone of date operators without a "timezone"
+	// argument: an Olson name such as "Europe/Paris" or a UTC offset such
+	// as "+02:00". Empty means UTC.
+	Timezone string
+
+	// Collation orders strings in $sort. Nil compares them byte by byte.
+	Collation *Collation
+
+	// Strict overrides the strict mode of the database (see SetStrict) for
+	// the session's queries. Nil inherits it.
+	Strict *bool
+
+	// Principal identifies who runs the queries, for pipeline middleware and
+	// $where predicates enforcing authorization; see SessionPrincipal.
+	Principal interface{}
+}
+
+// Collation selects how strings are ordered.
+type Collation struct {
+	// CaseInsensitive orders strings ignoring case: "apple" < "Banana".
+	CaseInsensitive bool
+
+	// NumericOrdering orders runs of digits by their numeric value:
+	// "item2" < "item10".
+	NumericOrdering bool
+}
+
+// Session runs queries with the defaults of its SessionOptions. A session is
+// cheap to create and safe for concurrent use.
+type Session struct {
+	db       *DB
+	opts     SessionOptions
+	location *time.Location
+}
+
+// sessionKey is the context key of the session running a query.
+type sessionKey struct{}
+
+// Session returns a handle whose queries inherit opts, so request-scoped
+// settings don't have to be passed to every call:
+//
+//	strict := true
+//	s, err := db.Session(marco.SessionOptions{Timezone: user.Timezone, Strict: &strict, Principal: user})
+//	results, err := s.Query("orders", pipeline)
+func (db *DB) Session(opts SessionOptions) (*Session, error) {
+	location := time.UTC
+	if opts.Timezone != "" {
+		var err error
+		if location, err = loadTimezone(opts.Timezone); err != nil {
+			return nil, fmt.Errorf("invalid session timezone: %w", err)
+		}
+	}
+	return &Session{db: db, opts: opts, location: location}, nil
+}
+
+// Options returns the options the session was created with.
+func (s *Session) Options() SessionOptions {
+	return s.opts
+}
+
+// Query runs an aggregation pipeline on a collection with the session defaults.
+func (s *Session) Query(collectionName string, mongoAggregationPipeline string) ([]map[string]interface{}, error) {
+	return s.QueryContext(context.Background(), collectionName, mongoAggregationPipeline)
+}
+
+// QueryContext is DB.QueryContext with the session defaults.
+func (s *Session) QueryContext(ctx context.Context, collectionName string, mongoAggregationPipeline string) ([]map[string]interface{}, error) {
+	return s.db.QueryContext(s.context(ctx), collectionName, mongoAggregationPipeline)
+}
+
+// QueryWithOptions is DB.QueryWithOptions with the session defaults.
+func (s *Session) QueryWithOptions(ctx context.Context, collectionName string, mongoAggregationPipeline string, opts QueryOptions) ([]map[string]interface{}, *QueryStats, error) {
+	return s.db.QueryWithOptions(s.context(ctx), collectionName, mongoAggregationPipeline, opts)
+}
+
+// DebugQuery is DB.DebugQuery with the session defaults.
+func (s *Session) DebugQuery(ctx context.Context, collectionName string, mongoAggregationPipeline string) (*QueryDebugger, error) {
+	return s.db.DebugQuery(s.context(ctx), collectionName, mongoAggregationPipeline)
+}
+
+// context attaches the session to ctx.
+func (s *Session) context(ctx context.Context) context.Context {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	return context.WithValue(ctx, sessionKey{}, s)
+}
+
+// sessionFrom returns the session running the query of ctx, or nil.
+func sessionFrom(ctx context.Context) *Session {
+	if ctx == nil {
+		return nil
+	}
+	s, _ := ctx.Value(sessionKey{}).(*Session)
+	return s
+}
+
+// SessionPrincipal returns the principal of the session running the query of
+// ctx, as seen by pipeline middleware and $where predicates. The second
+// result is false outside a session or if the session has no principal.
+func SessionPrincipal(ctx context.Context) (interface{}, bool) {
+	s := sessionFrom(ctx)
+	if s == nil || s.opts.Principal == nil {
+		return nil, false
+	}
+	return s.opts.Principal, true
+}
+
+// strictMode reports whether the query of ctx runs in strict mode.
+func (db *DB) strictMode(ctx context.Context) bool {
+	if s := sessionFrom(ctx); s != nil && s.opts.Strict != nil {
+		return *s.opts.Strict
+	}
+	return db.Strict()
+}
+
+// sessionLocation returns the default timezone of date operators in the
+// query of ctx.
+func sessionLocation(ctx context.Context) *time.Location {
+	if s := sessionFrom(ctx); s != nil {
+		return s.location
+	}
+	return time.UTC
+}
+
+// sessionCollation returns the collation of the query of ctx, or nil.
+func sessionCollation(ctx context.Context) *Collation {
+	if s := sessionFrom(ctx); s != nil {
+		return s.opts.Collation
+	}
+	return nil
+}
+
+// compare returns -1, 0 or 1 as a sorts before, with or after b.
+func (c *Collation) compare(a, b string) int {
+	if c.CaseInsensitive {
+		a, b = strings.ToLower(a), strings.ToLower(b)
+	}
+	if !c.NumericOrdering {
+		return strings.Compare(a, b)
+	}
+
+	for a != "" && b != "" {
+		aDigits, bDigits := leadingDigits(a), leadingDigits(b)
+		if aDigits == 0 || bDigits == 0 {
+			if a[0] != b[0] {
+				if a[0] < b[0] {
+					return -1
+				}
+				return 1
+			}
+			a, b = a[1:], b[1:]
+			continue
+		}
+
+		// Compare the numbers without their leading zeros: the longer is
+		// the larger, equal lengths compare digit by digit
+		aNum := strings.TrimLeft(a[:aDigits], "0")
+		bNum := strings.TrimLeft(b[:bDigits], "0")
+		if len(aNum) != len(bNum) {
+			if len(aNum) < len(bNum) {
+				return -1
+			}
+			return 1
+		}
+		if cmp := strings.Compare(aNum, bNum); cmp != 0 {
+			return cmp
+		}
+		a, b = a[aDigits:], b[bDigits:]
+	}
+	return strings.Compare(a, b)
+}
+
+// leadingDigits returns the number of ASCII digits s starts with.
+func leadingDigits(s string) int {
+	n := 0
+	for n < len(s) && s[n] >= '0' && s[n] <= '9' {
+		n++
+	}
+	return n
+}
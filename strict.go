@@ -0,0 +1,192 @@
+package marco
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// SetStrict enables or disables strict mode. In strict mode pipelines only
+// accept MongoDB syntax: marco extensions, such as comparison operators inside
+// $size, are rejected when the pipeline is parsed. So are the stages and
+// operators marco does not implement, such as the $near or $text query
+// operators and the $median accumulator, which are otherwise ignored with a
+// warning; the *InvalidPipelineError names the stage and its index in the
+// pipeline, and the operator. Strict mode is off by default, which the next
+// major version will change; a Session can override it for its queries.
+func (db *DB) SetStrict(strict bool) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.strict = strict
+}
+
+// Strict reports whether strict mode is enabled.
+func (db *DB) Strict() bool {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return db.strict
+}
+
+// In strict mode pipelines also fail when they use a stage or operator marco
+// accepts but does not implement, which would otherwise be logged and
+// ignored, silently giving wrong results. checkStrictStage finds them when
+// the pipeline is parsed, and the stages that still meet one at run time
+// fail with ErrUnsupportedStage or ErrUnsupportedOperator.
+
+// facetStages are the stages applyPipeline runs in the sub-pipelines of
+// $facet; the other stages are skipped.
+var facetStages = map[string]bool{
+	"$match": true, "$project": true, "$group": true, "$facet": true, "$sort": true,
+	"$limit": true, "$skip": true, "$lookup": true, "$unwind": true,
+}
+
+// matchQueryOperators are the top-level operators of $match implemented by
+// evaluateMatchExpression.
+var matchQueryOperators = map[string]bool{
+	"$and": true, "$or": true, "$nor": true, "$where": true, "$sampleRate": true, "$expr": true,
+}
+
+// matchFieldOperators are the field operators of $match implemented by
+// evaluateOperators. isValidMatchOperator accepts many more.
+var matchFieldOperators = map[string]bool{
+	"$eq": true, "$ne": true, "$gt": true, "$gte": true, "$lt": true, "$lte": true, "$in": true, "$nin": true,
+	"$not": true, "$exists": true, "$type": true, "$mod": true, "$regex": true, "$options": true,
+	"$elemMatch": true, "$all": true, "$size": true,
+	"$bitsAllSet": true, "$bitsAnySet": true, "$bitsAllClear": true, "$bitsAnyClear": true,
+}
+
+// checkStrictStage returns the operator, or the stage of a $facet, that
+// 'stage' uses but marco does not implement, with the error describing it.
+// The stage has been validated by validateStage.
+func (db *DB) checkStrictStage(ctx context.Context, stage AggregationStage) (string, error) {
+	switch stage.Stage {
+	case "$set":
+		// validateStage accepts the $addFields alias, which is not run
+		return "", fmt.Errorf("%w: %s", ErrUnsupportedStage, stage.Stage)
+
+	case "$match":
+		return db.checkStrictMatch(stage.Params)
+
+	case "$project":
+		// A projection mixing inclusions and exclusions is ignored
+		if _, err := determineProjectionMode(stage.Params); err != nil {
+			return "", err
+		}
+
+	case "$lookup":
+		if project, ok := stage.Params["project"].(map[string]interface{}); ok {
+			if _, err := determineProjectionMode(project); err != nil {
+				return "", fmt.Errorf("project: %w", err)
+			}
+		}
+
+	case "$group":
+		for field, spec := range stage.Params {
+			if field == "_id" {
+				continue
+			}
+			if op, err := db.checkStrictAccumulators(ctx, spec); err != nil {
+				return op, fmt.Errorf("field %q: %w", field, err)
+			}
+		}
+
+	case "$bucket", "$bucketAuto":
+		output, _ := stage.Params["output"].(map[string]interface{})
+		for field, spec := range output {
+			if op, err := db.checkStrictAccumulators(ctx, spec); err != nil {
+				return op, fmt.Errorf("output field %q: %w", field, err)
+			}
+		}
+
+	case "$facet":
+		for facet, pipeline := range stage.Params {
+			stages, _ := pipeline.([]interface{})
+			for i, sub := range stages {
+				for name, params := range asMap(sub) {
+					if !facetStages[name] {
+						return name, fmt.Errorf("%w: %s is not supported in $facet %q (stage %d)", ErrUnsupportedStage, name, facet, i)
+					}
+					op, err := db.checkStrictStage(ctx, AggregationStage{Stage: name, Params: asMap(params)})
+					if err != nil {
+						return op, fmt.Errorf("$facet %q stage %d (%s): %w", facet, i, name, err)
+					}
+				}
+			}
+		}
+	}
+	return "", nil
+}
+
+// checkStrictAccumulators checks the accumulators of a $group field or a
+// $bucket output field, e.g. {"$sum": "$qty"}.
+func (db *DB) checkStrictAccumulators(ctx context.Context, spec interface{}) (string, error) {
+	for op, arg := range asMap(spec) {
+		// compileAccumulator fails in strict mode for accumulators it does
+		// not implement
+		if _, err := db.compileAccumulator(ctx, op, arg); err != nil {
+			return op, err
+		}
+	}
+	return "", nil
+}
+
+// checkStrictMatch checks the operators of the $match filter 'filter', and
+// that the predicates it names with $where are registered.
+func (db *DB) checkStrictMatch(filter map[string]interface{}) (string, error) {
+	for key, val := range filter {
+		if strings.HasPrefix(key, "$") {
+			if !matchQueryOperators[key] {
+				return key, fmt.Errorf("%w: %s", ErrUnsupportedOperator, key)
+			}
+			switch key {
+			case "$and", "$or", "$nor":
+				clauses, _ := val.([]interface{})
+				for _, clause := range clauses {
+					if op, err := db.checkStrictMatch(asMap(clause)); err != nil {
+						return op, err
+					}
+				}
+			case "$where":
+				// An unknown predicate never matches
+				if name, _ := val.(string); db.wherePredicate(name) == nil {
+					return key, fmt.Errorf("$where predicate %q is not registered", name)
+				}
+			}
+			continue
+		}
+		if ops, ok := val.(map[string]interface{}); ok {
+			if op, err := db.checkStrictFieldOperators(key, ops); err != nil {
+				return op, err
+			}
+		}
+	}
+	return "", nil
+}
+
+// checkStrictFieldOperators checks the operators applied to 'field' in a
+// $match filter.
+func (db *DB) checkStrictFieldOperators(field string, ops map[string]interface{}) (string, error) {
+	for op, arg := range ops {
+		if !matchFieldOperators[op] {
+			// Embedded documents are compared as operators, e.g.
+			// {"address": {"city": "Paris"}} never matches
+			return op, fmt.Errorf("%w: %s on field %q", ErrUnsupportedOperator, op, field)
+		}
+		nested, ok := arg.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		switch op {
+		case "$not":
+			if op, err := db.checkStrictFieldOperators(field, nested); err != nil {
+				return op, err
+			}
+		case "$elemMatch":
+			// The criteria are a filter on the elements
+			if op, err := db.checkStrictMatch(nested); err != nil {
+				return op, err
+			}
+		}
+	}
+	return "", nil
+}